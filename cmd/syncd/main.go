@@ -3,7 +3,10 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/rand"
+	"errors"
 	"log"
+	"math/big"
 	"net/http"
 	"os"
 	"os/signal"
@@ -15,22 +18,45 @@ import (
 	"grafana-ad-syncher/internal/config"
 	"grafana-ad-syncher/internal/entra"
 	"grafana-ad-syncher/internal/grafana"
+	"grafana-ad-syncher/internal/oidc"
+	"grafana-ad-syncher/internal/proxy"
+	"grafana-ad-syncher/internal/ratelimit"
 	"grafana-ad-syncher/internal/store"
 	syncer "grafana-ad-syncher/internal/sync"
 	"grafana-ad-syncher/internal/web"
+	"grafana-ad-syncher/internal/yamlconv"
 )
 
 func main() {
 	cfg := config.Load()
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("config: %v", err)
+	}
 	if err := os.MkdirAll(cfg.DataDir, 0o755); err != nil {
 		log.Fatalf("data dir: %v", err)
 	}
 
-	st, err := store.Open(cfg.DataDir)
+	st, err := store.Open(cfg.DataDir, cfg.DBPageSize, cfg.DBCacheSizeKB)
 	if err != nil {
 		log.Fatalf("store: %v", err)
 	}
 	defer st.Close()
+	st.SetMaintenanceTimeout(cfg.DBMaintenanceTimeout)
+	st.SetEncryptionKey(cfg.DataEncryptionKey)
+	if n, err := st.EncryptTenantSecrets(); errors.Is(err, store.ErrNoEncryptionKey) {
+		log.Printf("WARNING: tenant client secrets are stored unencrypted; set DATA_ENCRYPTION_KEY to encrypt them")
+	} else if err != nil {
+		log.Fatalf("encrypt tenant secrets: %v", err)
+	} else if n > 0 {
+		log.Printf("encrypted the client secrets of %d tenant(s)", n)
+	}
+	if n, err := st.EncryptServiceAccountTokenKeys(); errors.Is(err, store.ErrNoEncryptionKey) {
+		log.Printf("WARNING: service account token keys are stored unencrypted; set DATA_ENCRYPTION_KEY to encrypt them")
+	} else if err != nil {
+		log.Fatalf("encrypt service account token keys: %v", err)
+	} else if n > 0 {
+		log.Printf("encrypted %d service account token key(s)", n)
+	}
 
 	if cfg.AutoSyncOnStartSet {
 		if err := st.SetAutoSyncEnabled(cfg.AutoSyncOnStart); err != nil {
@@ -40,49 +66,373 @@ func main() {
 		}
 	}
 
-	grafanaClient := grafana.New(cfg.GrafanaURL, cfg.GrafanaAdminUser, cfg.GrafanaAdminPassword, cfg.GrafanaAdminToken, cfg.GrafanaInsecureTLS, cfg.GrafanaDebug)
-	entraClient := entra.New(cfg.EntraTenantID, cfg.EntraClientID, cfg.EntraClientSecret, cfg.EntraAuthorityBaseURL, cfg.GraphAPIBaseURL)
+	grafanaTransport := grafana.TransportOptions{
+		MaxIdleConns:    cfg.GrafanaMaxIdleConns,
+		MaxConnsPerHost: cfg.GrafanaMaxConnsPerHost,
+		ReadTimeout:     cfg.GrafanaReadTimeout,
+		WriteTimeout:    cfg.GrafanaWriteTimeout,
+		SkipVerifyHosts: cfg.GrafanaTLSSkipVerifyHosts,
+	}
+	if err := grafanaTransport.LoadTLSFiles(cfg.GrafanaTLSCertFile, cfg.GrafanaTLSKeyFile, cfg.GrafanaTLSCAFile); err != nil {
+		log.Fatalf("grafana tls: %v", err)
+	}
+	grafanaProxy, err := proxy.Func(cfg.GrafanaHTTPProxy, "", cfg.NoProxy)
+	if err != nil {
+		log.Fatalf("grafana proxy: %v", err)
+	}
+	grafanaTransport.Proxy = grafanaProxy
+	entraProxy, err := proxy.Func(cfg.EntraHTTPProxy, cfg.EntraHTTPProxyAuth, cfg.NoProxy)
+	if err != nil {
+		log.Fatalf("entra proxy: %v", err)
+	}
+	if cfg.GrafanaHTTPProxy != "" {
+		log.Printf("grafana requests use proxy %s", proxy.Redact(cfg.GrafanaHTTPProxy))
+	}
+	if cfg.EntraHTTPProxy != "" {
+		log.Printf("entra requests use proxy %s", proxy.Redact(cfg.EntraHTTPProxy))
+	}
+	grafanaClient := grafana.New(cfg.GrafanaURL, cfg.GrafanaAPIPathPrefix, cfg.GrafanaAdminUser, cfg.GrafanaAdminPassword, cfg.GrafanaAdminToken, cfg.GrafanaOrgTokens, cfg.GrafanaInsecureTLS, cfg.GrafanaDebug, grafanaTransport)
+	grafanaClient.SetUserPageSize(cfg.GrafanaOrgUserPageSize)
+	grafanaClient.SetTokenProvider(st)
+	grafanaHeaders, err := config.ParseExtraHeaders(cfg.GrafanaExtraHeaders)
+	if err != nil {
+		log.Fatalf("GRAFANA_EXTRA_HEADERS: %v", err)
+	}
+	grafanaClient.SetExtraHeaders(grafanaHeaders)
+	grafanaClient.SetDisableProvenance(cfg.GrafanaDisableProvenance)
+	if cfg.GrafanaDisableProvenance {
+		log.Printf("grafana: WARNING provenance checks disabled (GRAFANA_DISABLE_PROVENANCE=true); provisioned resources can be overwritten")
+	}
+	entraHeaders, err := config.ParseExtraHeaders(cfg.EntraExtraHeaders)
+	if err != nil {
+		log.Fatalf("ENTRA_EXTRA_HEADERS: %v", err)
+	}
+	entraScopes, entraExtraParams, err := entra.ParseTokenParams(cfg.EntraOAuthScopes, cfg.EntraOAuthExtraParams)
+	if err != nil {
+		log.Fatalf("ENTRA_OAUTH_SCOPES/ENTRA_OAUTH_EXTRA_PARAMS: %v", err)
+	}
+	if err := entra.ValidateGroupFilter(cfg.EntraGroupFilter); err != nil {
+		log.Fatalf("ENTRA_GROUP_FILTER: %v", err)
+	}
+	allowedGroupTypes, err := entra.ParseGroupTypes(cfg.EntraAllowedGroupTypes)
+	if err != nil {
+		log.Fatalf("ENTRA_ALLOWED_GROUP_TYPES: %v", err)
+	}
+	entraCAs, err := entra.LoadCAFile(cfg.EntraCACertFile)
+	if err != nil {
+		log.Fatalf("ENTRA_CA_CERT_FILE: %v", err)
+	}
+	if cfg.EntraInsecureTLS {
+		log.Printf("entra: TLS certificate verification is disabled (ENTRA_INSECURE_TLS)")
+	}
+	entraClient := entra.New(cfg.EntraTenantID, cfg.EntraClientID, cfg.EntraClientSecret, cfg.EntraAuthorityBaseURL, cfg.GraphAPIBaseURL, cfg.GraphAPIVersion, entraProxy)
+	entraClient.SetTLS(cfg.EntraInsecureTLS, entraCAs)
+	entraClient.SetTokenParams(entraScopes, entraExtraParams)
+	entraClient.SetGroupFilter(cfg.EntraGroupFilter, cfg.EntraGroupFilterCount)
+	entraClient.SetExtraHeaders(entraHeaders)
+	if history, err := st.GetConnectivityHistory(); err != nil {
+		log.Printf("store: load connectivity history failed: %v", err)
+	} else {
+		grafanaClient.RestoreStatus(parseStoredTime(history.Grafana.LastOK), history.Grafana.LastError, parseStoredTime(history.Grafana.LastErrorAt))
+		entraClient.RestoreStatus(parseStoredTime(history.Entra.LastOK), history.Entra.LastError, parseStoredTime(history.Entra.LastErrorAt))
+	}
+	newTenantClient := func(t store.Tenant) *entra.Client {
+		authBase := t.AuthorityBaseURL
+		if authBase == "" {
+			authBase = cfg.EntraAuthorityBaseURL
+		}
+		graphBase := t.GraphBaseURL
+		if graphBase == "" {
+			graphBase = cfg.GraphAPIBaseURL
+		}
+		if version := entra.GraphBaseVersion(graphBase); version != "" && version != strings.Trim(cfg.GraphAPIVersion, "/") {
+			log.Printf("WARNING: tenant %s graph base URL ends with %s, GRAPH_API_VERSION %s is ignored for it", t.Name, version, cfg.GraphAPIVersion)
+		}
+		client := entra.New(t.TenantID, t.ClientID, t.ClientSecret, authBase, graphBase, cfg.GraphAPIVersion, entraProxy)
+		client.SetTLS(cfg.EntraInsecureTLS, entraCAs)
+		client.SetTokenParams(entraScopes, entraExtraParams)
+		client.SetGroupFilter(cfg.EntraGroupFilter, cfg.EntraGroupFilterCount)
+		client.SetExtraHeaders(entraHeaders)
+		return client
+	}
+
+	startupHealth := checkStartupHealth(grafanaClient, entraClient)
+	if !startupHealth.OK() && cfg.RequireHealthyOnStart {
+		log.Fatalf("startup check failed and REQUIRE_HEALTHY_ON_START is set")
+	}
 
 	if cfg.GrafanaDebug {
 		log.Printf("grafana debug logging enabled (GRAFANA_DEBUG=true)")
-		log.Printf("grafana config: url=%s insecureTLS=%t admin_user_set=%t admin_token_set=%t",
-			cfg.GrafanaURL, cfg.GrafanaInsecureTLS, cfg.GrafanaAdminUser != "", cfg.GrafanaAdminToken != "")
+		log.Printf("grafana config: url=%s insecureTLS=%t mtls=%t private_ca=%t admin_user_set=%t admin_token_set=%t org_tokens=%d extra_headers=%d",
+			cfg.GrafanaURL, cfg.GrafanaInsecureTLS, cfg.GrafanaTLSCertFile != "", cfg.GrafanaTLSCAFile != "", cfg.GrafanaAdminUser != "", cfg.GrafanaAdminToken != "", len(cfg.GrafanaOrgTokens), grafanaClient.ExtraHeaderCount())
 		logEtcHosts()
 		probeCtx, probeCancel := context.WithTimeout(context.Background(), 30*time.Second)
 		grafanaClient.LogProbe(grafanaClient.Probe(probeCtx))
 		probeCancel()
 	}
-	clientSyncer := syncer.New(st, grafanaClient, entraClient, cfg.DefaultUserRole, cfg.AllowCreateUsers, cfg.AllowRemoveMembers)
+	displayNameTmpl, err := syncer.ParseDisplayNameTemplate(cfg.UserDisplayNameTemplate)
+	if err != nil {
+		log.Fatalf("USER_DISPLAY_NAME_TEMPLATE: %v", err)
+	}
+	folderTmpl, err := syncer.ParseTeamFolderTemplate(cfg.TeamFolderTitleTemplate)
+	if err != nil {
+		log.Fatalf("TEAM_FOLDER_TITLE_TEMPLATE: %v", err)
+	}
+	folderPerm, err := grafana.ParseFolderPermission(cfg.TeamFolderPermission)
+	if err != nil {
+		log.Fatalf("SYNC_TEAM_FOLDER_PERMISSION_LEVEL: %v", err)
+	}
+	noteTmpl, err := syncer.ParseNoteTemplate(cfg.NoteTemplate)
+	if err != nil {
+		log.Fatalf("NOTE_TEMPLATE: %v", err)
+	}
+	managedKey, managedValue, err := syncer.ParseTeamLabel(cfg.TeamManagedLabel)
+	if err != nil {
+		log.Fatalf("TEAM_MANAGED_LABEL: %v", err)
+	}
+	var teamLabels map[string]string
+	if managedKey != "" {
+		teamLabels = map[string]string{managedKey: managedValue}
+	}
+	avatarTmpl, err := syncer.ParseTeamAvatarTemplate(cfg.TeamAvatarURLTemplate)
+	if err != nil {
+		log.Fatalf("TEAM_AVATAR_URL_TEMPLATE: %v", err)
+	}
+	roleRules, err := syncer.ParseRoleRules(cfg.RoleFromGroupNamePattern)
+	if err != nil {
+		log.Fatalf("ROLE_FROM_GROUP_NAME_PATTERN: %v", err)
+	}
+	allowedActions, err := syncer.ParseActionAllowlist(cfg.AllowedActionTypes)
+	if err != nil {
+		log.Fatalf("ALLOWED_ACTION_TYPES: %v", err)
+	}
+	actionOrder, err := syncer.ParseActionOrder(cfg.ActionOrder)
+	if err != nil {
+		log.Fatalf("ACTION_ORDER: %v", err)
+	}
+	clientSyncer := syncer.New(st, grafanaClient, entraClient, syncer.Options{
+		DefaultUserRole:         cfg.DefaultUserRole,
+		AllowCreateUsers:        cfg.AllowCreateUsers,
+		AllowRemoveUsers:        cfg.AllowRemoveMembers,
+		DisplayNameTemplate:     displayNameTmpl,
+		NoteTemplate:            noteTmpl,
+		CacheTTL:                cfg.GrafanaCacheTTL,
+		ReadOnly:                cfg.ReadOnlyMode,
+		RemovalGracePeriod:      cfg.RemovalGracePeriod,
+		GroupOwnersAsTeamAdmins: cfg.GroupOwnersAsTeamAdmins,
+		TeamAdminEmailDomains:   cfg.TeamAdminEmailDomains,
+		LoginFormat:             cfg.UserLoginFormat,
+		MemberCacheTTL:          cfg.EntraMemberCacheTTL,
+		RoleRules:               roleRules,
+		WebhookURL:              cfg.WebhookURL,
+		PreviewAlertMinActions:  cfg.PreviewAlertMinActions,
+		AllowedActions:          allowedActions,
+		DeactivateRemovedUsers:  cfg.DeactivateRemovedUsers,
+		AutoEnableUsers:         cfg.GrafanaAutoEnableUsers,
+		ProtectedLogins:         cfg.GrafanaProtectedLogins,
+		NewTenantClient:         newTenantClient,
+		TeamFolderAutoCreate:    cfg.TeamFolderAutoCreate,
+		TeamFolderParentUID:     cfg.TeamFolderParentUID,
+		TeamFolderPermission:    folderPerm,
+		TeamFolderTitleTemplate: folderTmpl,
+		ActionOrder:             actionOrder,
+		TeamSyncCompat:          cfg.GrafanaTeamSyncCompat,
+		UpdateUserProfiles:      cfg.SyncUpdateUserProfiles,
+		AutoCreateOrgs:          cfg.GrafanaAutoCreateOrgs,
+		PlanMaxAge:              cfg.PlanMaxAge,
+		SkipDisabledUsers:       cfg.SkipDisabledGrafanaUsers,
+		SATokenRotationWindow:   cfg.SATokenRotationWindow,
+		SATokenTTL:              cfg.SATokenTTL,
+		AllowRoleDowngrade:      cfg.AllowRoleDowngrade,
+		TeamAvatarURLTemplate:   avatarTmpl,
+		AllowedGroupTypes:       allowedGroupTypes,
+		VerifyTeamIDs:           cfg.GrafanaVerifyTeamIDs,
+		SyncTeamEmail:           cfg.SyncTeamEmail,
+		TeamLabels:              teamLabels,
+		SyncAlert: syncer.SyncAlert{
+			Enabled:        cfg.ProvisionSyncAlerts,
+			ThresholdHours: cfg.SyncAlertThresholdHours,
+			OrgID:          cfg.SyncAlertOrgID,
+			FolderUID:      cfg.SyncAlertFolderUID,
+			DatasourceUID:  cfg.SyncAlertDatasourceUID,
+			ContactPoint:   cfg.SyncAlertContactPoint,
+		},
+	})
+	if cfg.ReadOnlyMode {
+		log.Printf("READ_ONLY_MODE enabled: plans are built and stored but never applied")
+	}
+	if cfg.GrafanaTeamSyncCompat {
+		log.Printf("WARNING: GRAFANA_TEAM_SYNC_COMPAT enabled: existing org members are not added to teams; Grafana team sync must handle their membership")
+	}
+	// Runs after every sync as well; doing it now also removes the rule
+	// promptly after PROVISION_SYNC_ALERTS is turned off.
+	go func() {
+		if err := clientSyncer.ReconcileSyncAlert(); err != nil {
+			log.Printf("sync: reconcile sync alert rule failed: %v", err)
+		}
+	}()
+
+	syncWindow, err := syncer.ParseSyncWindow(cfg.SyncWindowStart, cfg.SyncWindowEnd, cfg.SyncWindowTZ)
+	if err != nil {
+		log.Fatalf("SYNC_WINDOW_START/SYNC_WINDOW_END: %v", err)
+	}
 
-	if cfg.SyncInterval > 0 {
+	// The interval can be changed on the settings page, so it is read again
+	// on every iteration and the ticker is replaced when it changes.
+	syncIntervalChanged := make(chan struct{}, 1)
+	go func() {
+		runScheduledSync := func() {
+			enabled, err := st.AutoSyncEnabled()
+			if err != nil {
+				log.Printf("auto sync status lookup failed: %v", err)
+			} else if enabled && !syncWindow.Contains(time.Now()) {
+				log.Printf("sync: outside window, skipping")
+				clientSyncer.RecordWindowSkip()
+			} else if enabled {
+				waitJitter(cfg.SyncJitter, time.Sleep)
+				if err := clientSyncer.Run(); err != nil {
+					log.Printf("scheduled sync failed: %v", err)
+				}
+			}
+		}
+		currentInterval := func() time.Duration { return currentSyncInterval(st, cfg.SyncInterval) }
+		scheduleSyncs(currentInterval, syncIntervalChanged, runScheduledSync, nil)
+	}()
+
+	if cfg.BackupInterval > 0 && cfg.BackupDir != "" {
 		go func() {
-			ticker := time.NewTicker(cfg.SyncInterval)
+			ticker := time.NewTicker(cfg.BackupInterval)
 			defer ticker.Stop()
-			for {
-				enabled, err := st.AutoSyncEnabled()
+			for range ticker.C {
+				runScheduledBackup(st, cfg.BackupDir, cfg.BackupRetentionDays)
+			}
+		}()
+	}
+
+	if cfg.SQLiteAnalyzeInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(cfg.SQLiteAnalyzeInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				runDBMaintenance("analyze", st.Analyze)
+			}
+		}()
+	}
+
+	if cfg.SQLiteVacuumInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(cfg.SQLiteVacuumInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				runDBMaintenance("vacuum", st.Vacuum)
+			}
+		}()
+	}
+
+	if cfg.PreviewInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(cfg.PreviewInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				plan, err := clientSyncer.Preview()
 				if err != nil {
-					log.Printf("auto sync status lookup failed: %v", err)
-				} else if enabled {
-					if err := clientSyncer.Run(); err != nil {
-						log.Printf("scheduled sync failed: %v", err)
-					}
+					log.Printf("scheduled preview failed: %v", err)
+					continue
 				}
-				<-ticker.C
+				log.Printf("scheduled preview stored plan with %d actions", len(plan.Actions))
+			}
+		}()
+	}
+
+	if cfg.ArchiveInterval > 0 && cfg.ArchiveRetentionDays > 0 {
+		go func() {
+			for {
+				runScheduledArchive(st, cfg.ArchiveRetentionDays)
+				time.Sleep(cfg.ArchiveInterval)
+			}
+		}()
+	}
+
+	if cfg.PlanMaxAge > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Hour)
+			defer ticker.Stop()
+			for range ticker.C {
+				clearStalePlans(st, 2*cfg.PlanMaxAge)
+			}
+		}()
+	}
+
+	if cfg.SATokenRotationWindow > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Hour)
+			defer ticker.Stop()
+			for range ticker.C {
+				planDueTokenRotations(st, clientSyncer)
 			}
 		}()
 	}
 
 	mux := http.NewServeMux()
-	server, err := web.New(st, clientSyncer, grafanaClient, entraClient, filepath.Join("web", "templates"))
+	server, err := web.New(st, clientSyncer, grafanaClient, entraClient, filepath.Join("web", "templates"), cfg.AdminAPIToken)
 	if err != nil {
 		log.Fatalf("templates: %v", err)
 	}
+	server.SetWebhookSecret(cfg.WebhookInboundSecret)
+	server.SetStartupHealth(startupHealth)
+	server.SetLatencyWarnThreshold(cfg.LatencyWarnP99)
+	server.SetAllowedGroupTypes(allowedGroupTypes)
+	server.SetManagedTeamLabel(managedKey, managedValue)
+	server.SetSyncInterval(cfg.SyncInterval, syncIntervalChanged)
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			server.SaveLatency()
+		}
+	}()
 	server.Register(mux)
 	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(filepath.Join("web", "static")))))
 
+	var handler http.Handler = yamlconv.Middleware(mux, "/api/")
+	if cfg.OIDCIssuer != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		authenticator, err := oidc.New(ctx, oidc.Config{
+			Issuer:             cfg.OIDCIssuer,
+			ClientID:           cfg.OIDCClientID,
+			ClientSecret:       cfg.OIDCClientSecret,
+			RedirectURL:        cfg.OIDCRedirectURL,
+			SessionSecret:      cfg.OIDCSessionSecret,
+			AllowedEmailDomain: cfg.OIDCAllowedEmailDomain,
+			AdminToken:         cfg.AdminAPIToken,
+		})
+		cancel()
+		if err != nil {
+			log.Fatalf("oidc: %v", err)
+		}
+		authenticator.Register(mux)
+		handler = authenticator.Middleware(handler)
+		log.Printf("oidc: web UI login enabled via %s", cfg.OIDCIssuer)
+	}
+
+	if cfg.RateLimitPerMinute > 0 || cfg.SyncRateLimitPerMinute > 0 {
+		var general, strict *ratelimit.Limiter
+		if cfg.RateLimitPerMinute > 0 {
+			general = ratelimit.New(cfg.RateLimitPerMinute, cfg.RateLimitBurst)
+		}
+		if cfg.SyncRateLimitPerMinute > 0 {
+			strict = ratelimit.New(cfg.SyncRateLimitPerMinute, cfg.SyncRateLimitPerMinute)
+		}
+		syncPaths := []string{
+			"/sync/run", "/sync/apply", "/sync/apply-selected", "/sync/apply/progress", "/webhooks/sync",
+			"/api/plans/*/apply-by-team", "/api/plans/*/validate", "/api/mappings/*/preview", "/api/cache/refresh",
+		}
+		handler = ratelimit.Middleware(handler, general, strict, syncPaths, []string{"/static/", "/healthz", "/metrics"}, cfg.TrustProxyHeaders)
+	}
+
 	httpServer := &http.Server{
 		Addr:         cfg.ListenAddr,
-		Handler:      mux,
+		Handler:      handler,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 2 * time.Minute,
 		IdleTimeout:  60 * time.Second,
@@ -103,6 +453,194 @@ func main() {
 	}
 }
 
+// runScheduledBackup writes a timestamped database backup into dir and prunes
+// backups older than retentionDays (0 keeps everything).
+func runScheduledBackup(st *store.Store, dir string, retentionDays int) {
+	now := time.Now()
+	path, err := st.WriteBackup(dir, now)
+	if err != nil {
+		log.Printf("scheduled backup failed: %v", err)
+		return
+	}
+	log.Printf("scheduled backup written to %s", path)
+	if retentionDays <= 0 {
+		return
+	}
+	removed, err := store.PruneBackups(dir, now.AddDate(0, 0, -retentionDays))
+	if err != nil {
+		log.Printf("backup prune failed: %v", err)
+	} else if removed > 0 {
+		log.Printf("backup prune removed %d file(s) older than %d days", removed, retentionDays)
+	}
+}
+
+// scheduleSyncs calls runSync once and then every currentInterval until stop is
+// closed. The interval is read again whenever changed fires, and the new one
+// applies from the next tick; a zero interval pauses syncing.
+func scheduleSyncs(currentInterval func() time.Duration, changed <-chan struct{}, runSync func(), stop <-chan struct{}) {
+	var interval time.Duration
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+	run := true
+	for {
+		if next := currentInterval(); next != interval {
+			if ticker != nil {
+				ticker.Stop()
+				ticker, tick = nil, nil
+			}
+			if next > 0 {
+				ticker = time.NewTicker(next)
+				tick = ticker.C
+				log.Printf("scheduled sync: every %s", next)
+			} else {
+				log.Printf("scheduled sync: off")
+			}
+			interval = next
+		}
+		if run && interval > 0 {
+			runSync()
+		}
+		select {
+		case <-tick:
+			run = true
+		case <-changed:
+			run = false
+		case <-stop:
+			return
+		}
+	}
+}
+
+// currentSyncInterval returns the auto-sync interval saved on the settings
+// page, or fallback (SYNC_INTERVAL) when none is saved or it can't be read.
+func currentSyncInterval(st *store.Store, fallback time.Duration) time.Duration {
+	interval, ok, err := st.SyncInterval()
+	if err != nil {
+		log.Printf("sync interval lookup failed: %v", err)
+		return fallback
+	}
+	if !ok {
+		return fallback
+	}
+	return interval
+}
+
+// runDBMaintenance runs one scheduled database maintenance operation and
+// logs how long it took.
+func runDBMaintenance(name string, run func() error) {
+	start := time.Now()
+	if err := run(); err != nil {
+		log.Printf("scheduled %s failed: %v", name, err)
+		return
+	}
+	log.Printf("scheduled %s finished in %s", name, time.Since(start).Round(time.Millisecond))
+}
+
+// runScheduledArchive moves sync actions older than retentionDays into the
+// archive table.
+func runScheduledArchive(st *store.Store, retentionDays int) {
+	start := time.Now()
+	moved, err := st.ArchiveSyncActionsBefore(start.AddDate(0, 0, -retentionDays))
+	if err != nil {
+		log.Printf("sync action archive failed after %d row(s): %v", moved, err)
+		return
+	}
+	if moved > 0 {
+		log.Printf("sync action archive moved %d row(s) older than %d days in %s", moved, retentionDays, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// planDueTokenRotations stores a preview plan when service account tokens
+// are due for rotation and the current plan does not rotate them yet.
+func planDueTokenRotations(st *store.Store, clientSyncer *syncer.Syncer) {
+	due, err := clientSyncer.DueServiceAccountTokens()
+	if err != nil {
+		log.Printf("service account token check failed: %v", err)
+		return
+	}
+	if len(due) == 0 {
+		return
+	}
+	plan, err := st.LatestPlan()
+	if err != nil {
+		log.Printf("service account token check: load plan failed: %v", err)
+		return
+	}
+	if plan != nil && plan.Status != "applied" {
+		for _, action := range plan.Actions {
+			if action.ActionType == "rotate_service_account_token" {
+				return
+			}
+		}
+	}
+	if _, err := clientSyncer.Preview(); err != nil {
+		log.Printf("service account token rotation preview failed: %v", err)
+		return
+	}
+	log.Printf("%d service account token(s) due for rotation; stored a preview plan", len(due))
+}
+
+// clearStalePlans deletes stored plans older than maxAge so an outdated plan
+// is not left on the dashboard.
+func clearStalePlans(st *store.Store, maxAge time.Duration) {
+	cleared, err := st.ClearPlansBefore(time.Now().Add(-maxAge))
+	if err != nil {
+		log.Printf("stale plan cleanup failed: %v", err)
+		return
+	}
+	if cleared > 0 {
+		log.Printf("stale plan cleanup removed %d plan(s) older than %s", cleared, maxAge)
+	}
+}
+
+// checkStartupHealth checks that Grafana and Entra are reachable and accept
+// the configured credentials. Failures are logged as warnings; the caller
+// decides whether they are fatal.
+func checkStartupHealth(grafanaClient interface{ Ping() error }, entraClient interface{ TestAuth() error }) web.StartupHealth {
+	health := web.StartupHealth{CheckedAt: time.Now().UTC()}
+	if err := grafanaClient.Ping(); err != nil {
+		health.GrafanaErr = err.Error()
+		log.Printf("startup check: WARNING grafana unreachable or credentials rejected: %v", err)
+	}
+	if err := entraClient.TestAuth(); err != nil {
+		health.EntraErr = err.Error()
+		log.Printf("startup check: WARNING entra unreachable or credentials rejected: %v", err)
+	}
+	if health.OK() {
+		log.Printf("startup check: grafana and entra OK")
+	}
+	return health
+}
+
+// randomJitter returns a uniformly distributed duration in [0, max]. It uses
+// crypto/rand so instances started at the same moment do not share a seed.
+func randomJitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)+1))
+	if err != nil {
+		return 0
+	}
+	return time.Duration(n.Int64())
+}
+
+// waitJitter sleeps for randomJitter(max) before a scheduled sync. sleep is
+// time.Sleep outside tests.
+func waitJitter(max time.Duration, sleep func(time.Duration)) {
+	if max <= 0 {
+		return
+	}
+	delay := randomJitter(max)
+	log.Printf("scheduled sync: waiting %s jitter", delay.Round(time.Millisecond))
+	sleep(delay)
+}
+
 // logEtcHosts prints the contents of /etc/hosts so we can verify whether the
 // docker `extra_hosts` entries are actually visible inside the container.
 // Lines starting with `#` and blank lines are skipped to keep the log compact.
@@ -130,3 +668,13 @@ func logEtcHosts() {
 		log.Printf("grafana probe: /etc/hosts contained no non-comment entries")
 	}
 }
+
+// parseStoredTime parses an RFC 3339 time saved in the settings table; empty
+// or invalid values give the zero time.
+func parseStoredTime(value string) time.Time {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return parsed
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"grafana-ad-syncher/internal/entra"
+	"grafana-ad-syncher/internal/grafana"
+	"grafana-ad-syncher/internal/store"
+	syncer "grafana-ad-syncher/internal/sync"
+)
+
+func TestRandomJitterWithinBounds(t *testing.T) {
+	const max = 50 * time.Millisecond
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 200; i++ {
+		delay := randomJitter(max)
+		if delay < 0 || delay > max {
+			t.Fatalf("randomJitter(%s) = %s, want within [0, %s]", max, delay, max)
+		}
+		seen[delay] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("randomJitter returned the same delay %d times", 200)
+	}
+	if got := randomJitter(0); got != 0 {
+		t.Errorf("randomJitter(0) = %s, want 0", got)
+	}
+}
+
+func TestWaitJitterSleepsBeforeSync(t *testing.T) {
+	var slept []time.Duration
+	sleep := func(d time.Duration) { slept = append(slept, d) }
+
+	waitJitter(0, sleep)
+	if len(slept) != 0 {
+		t.Fatalf("waitJitter(0) slept %v, want no sleep", slept)
+	}
+
+	const max = time.Minute
+	waitJitter(max, sleep)
+	if len(slept) != 1 {
+		t.Fatalf("waitJitter(%s) slept %d times, want 1", max, len(slept))
+	}
+	if slept[0] < 0 || slept[0] > max {
+		t.Errorf("waitJitter slept %s, want within [0, %s]", slept[0], max)
+	}
+}
+
+func TestPlanDueTokenRotations(t *testing.T) {
+	st, err := store.Open(t.TempDir(), 4096, 2000)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { _ = st.Close() })
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/oauth2/v2.0/token"):
+			w.Write([]byte(`{"access_token":"token","expires_in":3600}`))
+		case strings.HasPrefix(r.URL.Path, "/v1.0/"):
+			w.Write([]byte(`{"value":[]}`))
+		case r.URL.Path == "/api/teams/search":
+			w.Write([]byte(`{"teams":[]}`))
+		default:
+			w.Write([]byte(`[]`))
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	orgID, err := st.CreateOrg(store.Org{GrafanaOrgID: 1, Name: "Main", DefaultRole: "Viewer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mappingID, err := st.CreateMapping(store.Mapping{OrgID: orgID, GrafanaTeamName: "Team", ExternalGroupID: "g1", TeamRole: "member"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	grafanaClient := grafana.New(upstream.URL, "/api", "admin", "admin", "", nil, false, false, grafana.TransportOptions{})
+	entraClient := entra.New("tenant", "client", "secret", upstream.URL, upstream.URL, "v1.0", nil)
+	clientSyncer := syncer.New(st, grafanaClient, entraClient, syncer.Options{DefaultUserRole: "Viewer", SATokenRotationWindow: 48 * time.Hour})
+	rotations := func() int {
+		plan, err := st.LatestPlan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plan == nil {
+			return -1
+		}
+		n := 0
+		for _, action := range plan.Actions {
+			if action.ActionType == "rotate_service_account_token" {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Nothing is due: no plan is stored.
+	if err := st.SetServiceAccountToken(store.ServiceAccountToken{MappingID: mappingID, SAID: 7, TokenID: 70, ExpiresAt: time.Now().Add(30 * 24 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	planDueTokenRotations(st, clientSyncer)
+	if got := rotations(); got != -1 {
+		t.Fatalf("plan stored with %d rotation(s) while nothing is due", got)
+	}
+
+	// A due token gets a preview plan with its rotation.
+	if err := st.SetServiceAccountToken(store.ServiceAccountToken{MappingID: mappingID, SAID: 7, TokenID: 70, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	planDueTokenRotations(st, clientSyncer)
+	plan, err := st.LatestPlan()
+	if err != nil || plan == nil || plan.Status != "preview" || rotations() != 1 {
+		t.Fatalf("plan = %+v, %v; want a preview with one rotation", plan, err)
+	}
+
+	// A pending plan that already rotates the token is kept.
+	planDueTokenRotations(st, clientSyncer)
+	if again, err := st.LatestPlan(); err != nil || again.ID != plan.ID {
+		t.Fatalf("plan replaced: %+v, %v; want plan %d kept", again, err, plan.ID)
+	}
+}
+
+func TestScheduleSyncsPicksUpNewInterval(t *testing.T) {
+	var mu sync.Mutex
+	interval := time.Hour
+	currentInterval := func() time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+		return interval
+	}
+	changed := make(chan struct{}, 1)
+	synced := make(chan struct{}, 10)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		scheduleSyncs(currentInterval, changed, func() { synced <- struct{}{} }, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	select {
+	case <-synced:
+	case <-time.After(time.Second):
+		t.Fatal("no sync at startup")
+	}
+
+	const newInterval = 20 * time.Millisecond
+	mu.Lock()
+	interval = newInterval
+	mu.Unlock()
+	changed <- struct{}{}
+	start := time.Now()
+	select {
+	case <-synced:
+		// One tick of the new interval, plus slack for a busy machine.
+		if elapsed := time.Since(start); elapsed > newInterval+500*time.Millisecond {
+			t.Errorf("sync %s after the change, want within one %s tick", elapsed, newInterval)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no sync after the interval changed from 1h to 20ms")
+	}
+
+	mu.Lock()
+	interval = 0
+	mu.Unlock()
+	changed <- struct{}{}
+	time.Sleep(5 * newInterval)
+	for len(synced) > 0 {
+		<-synced
+	}
+	time.Sleep(5 * newInterval)
+	if n := len(synced); n != 0 {
+		t.Errorf("%d syncs after the interval was set to 0, want none", n)
+	}
+}
+
+type pingFunc func() error
+
+func (f pingFunc) Ping() error { return f() }
+
+type testAuthFunc func() error
+
+func (f testAuthFunc) TestAuth() error { return f() }
+
+func TestCheckStartupHealth(t *testing.T) {
+	ok := func() error { return nil }
+	for _, tc := range []struct {
+		name       string
+		grafana    func() error
+		entra      func() error
+		grafanaErr string
+		entraErr   string
+	}{
+		{name: "healthy", grafana: ok, entra: ok},
+		{name: "grafana down", grafana: func() error { return errors.New("connection refused") }, entra: ok, grafanaErr: "connection refused"},
+		{name: "entra rejects credentials", grafana: ok, entra: func() error { return errors.New("invalid_client") }, entraErr: "invalid_client"},
+		{
+			name:       "both failing",
+			grafana:    func() error { return errors.New("401 unauthorized") },
+			entra:      func() error { return errors.New("timeout") },
+			grafanaErr: "401 unauthorized",
+			entraErr:   "timeout",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			before := time.Now()
+			health := checkStartupHealth(pingFunc(tc.grafana), testAuthFunc(tc.entra))
+			if health.GrafanaErr != tc.grafanaErr || health.EntraErr != tc.entraErr {
+				t.Errorf("health = %+v, want grafana %q and entra %q", health, tc.grafanaErr, tc.entraErr)
+			}
+			if want := tc.grafanaErr == "" && tc.entraErr == ""; health.OK() != want {
+				t.Errorf("OK() = %v, want %v", health.OK(), want)
+			}
+			if health.CheckedAt.Before(before.Add(-time.Second)) || health.CheckedAt.Location() != time.UTC {
+				t.Errorf("CheckedAt = %s, want the current UTC time", health.CheckedAt)
+			}
+		})
+	}
+}
@@ -3,5 +3,18 @@ module grafana-ad-syncher
 go 1.21
 
 require (
+	github.com/coreos/go-oidc/v3 v3.9.0
 	github.com/mattn/go-sqlite3 v1.14.19
+	golang.org/x/oauth2 v0.16.0
+	golang.org/x/sync v0.6.0
+	golang.org/x/time v0.5.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/go-jose/go-jose/v3 v3.0.1 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	golang.org/x/crypto v0.14.0 // indirect
+	google.golang.org/appengine v1.6.8 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
 )
@@ -1,7 +1,12 @@
 package config
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -10,48 +15,294 @@ import (
 type Config struct {
 	ListenAddr           string
 	DataDir              string
+	// AdminAPIToken guards the /api/admin/* endpoints. They are disabled when
+	// it is empty.
+	AdminAPIToken        string
+	// WebhookInboundSecret is the HMAC key for POST /webhooks/sync. The
+	// endpoint is disabled when it is empty.
+	WebhookInboundSecret string
+
+	RateLimitPerMinute     int
+	RateLimitBurst         int
+	SyncRateLimitPerMinute int
+	TrustProxyHeaders      bool
+
+	// OIDC* enable single sign-on for the web UI when OIDCIssuer is set.
+	OIDCIssuer             string
+	OIDCClientID           string
+	OIDCClientSecret       string
+	OIDCRedirectURL        string
+	OIDCSessionSecret      string
+	OIDCAllowedEmailDomain string
+	BackupInterval       time.Duration
+	BackupDir            string
+	BackupRetentionDays  int
+	ArchiveInterval      time.Duration
+	DBPageSize           int
+	DBCacheSizeKB        int
+	// SQLiteAnalyzeInterval and SQLiteVacuumInterval schedule ANALYZE and
+	// VACUUM; zero disables them. DBMaintenanceTimeout bounds each run.
+	SQLiteAnalyzeInterval time.Duration
+	SQLiteVacuumInterval  time.Duration
+	DBMaintenanceTimeout  time.Duration
+	ArchiveRetentionDays int
 	SyncInterval         time.Duration
+	SyncJitter           time.Duration
+	SyncWindowStart      string
+	SyncWindowEnd        string
+	SyncWindowTZ         string
+	// RequireHealthyOnStart exits at startup when Grafana or Entra fail the
+	// credential check instead of only logging a warning.
+	RequireHealthyOnStart bool
+	// LatencyWarnP99 shows a header warning while the p99 latency of Grafana
+	// or Entra requests exceeds it; zero disables the warning.
+	LatencyWarnP99 time.Duration
 	GrafanaURL            string
 	GrafanaAdminUser      string
 	GrafanaAdminPassword  string
 	GrafanaAdminToken     string
+	// GrafanaOrgTokens maps a Grafana org ID to an org-scoped API token that is
+	// used instead of the admin credentials for requests against that org.
+	GrafanaOrgTokens      map[int64]string
+	// DataEncryptionKey derives the AES-256-GCM key for secrets stored in the
+	// database, such as tokens saved through /api/grafana-tokens.
+	DataEncryptionKey string
 	GrafanaInsecureTLS    bool
+	GrafanaTLSSkipVerifyHosts []string
+	GrafanaTLSCertFile    string
+	GrafanaTLSKeyFile     string
+	GrafanaTLSCAFile      string
+	GrafanaHTTPProxy      string
+	EntraHTTPProxy        string
+	EntraHTTPProxyAuth    string
+	NoProxy               string
 	GrafanaDebug          bool
+	// GrafanaOrgUserPageSize is the page size for listing org users and
+	// team members.
+	GrafanaOrgUserPageSize int
+	GrafanaMaxIdleConns    int
+	GrafanaMaxConnsPerHost int
+	GrafanaReadTimeout     time.Duration
+	GrafanaWriteTimeout    time.Duration
+	GrafanaCacheTTL        time.Duration
+	EntraMemberCacheTTL    time.Duration
 	DefaultUserRole       string
+	UserLoginFormat         string
+	RoleFromGroupNamePattern string
+	WebhookURL               string
+	AllowedActionTypes       string
+	ActionOrder              string
+	PreviewInterval          time.Duration
+	PlanMaxAge               time.Duration
+	SATokenRotationWindow    time.Duration
+	SATokenTTL               time.Duration
+	PreviewAlertMinActions   int
+	GrafanaVerifyTeamIDs     bool
+	SyncTeamEmail            bool
+	UserDisplayNameTemplate string
+	NoteTemplate            string
 	AllowCreateUsers      bool
 	AllowRemoveMembers    bool
+	// ReadOnlyMode builds and stores plans but never applies them to Grafana.
+	ReadOnlyMode          bool
+	// RemovalGracePeriod delays removing users who left a mapped Entra group
+	// from the Grafana team. Mappings can override it individually.
+	RemovalGracePeriod    time.Duration
+	GroupOwnersAsTeamAdmins bool
+	TeamAdminEmailDomains   []string
+	DeactivateRemovedUsers  bool
+	GrafanaAutoEnableUsers  bool
+	GrafanaProtectedLogins  []string
+	// TeamFolderAutoCreate creates a team-only folder for every team the
+	// syncer creates, nested under TeamFolderParentUID when it is set.
+	TeamFolderAutoCreate    bool
+	TeamFolderParentUID     string
+	// TeamFolderTitleTemplate names team folders; empty uses the team name.
+	// TeamFolderPermission is View, Edit or Admin.
+	TeamFolderTitleTemplate string
+	TeamFolderPermission    string
+	// TeamAvatarURLTemplate renders the avatar URL set on every mapped team.
+	TeamAvatarURLTemplate   string
+	// TeamManagedLabel is the key=value label recorded on teams the syncer
+	// creates; empty disables it.
+	TeamManagedLabel        string
+	// GrafanaTeamSyncCompat skips add_user_to_team for users already in the
+	// org, leaving them to Grafana's built-in team sync.
+	GrafanaTeamSyncCompat   bool
+	SkipDisabledGrafanaUsers bool
+	AllowRoleDowngrade      bool
+	// SyncUpdateUserProfiles updates Grafana users' name and email when
+	// they change in Entra.
+	SyncUpdateUserProfiles  bool
+	// GrafanaAutoCreateOrgs imports Grafana orgs into the store and creates
+	// mapped orgs that are missing in Grafana.
+	GrafanaAutoCreateOrgs   bool
+	// ProvisionSyncAlerts keeps a Grafana alert rule that fires when no sync
+	// action was recorded for SyncAlertThresholdHours.
+	ProvisionSyncAlerts     bool
+	SyncAlertThresholdHours int
+	SyncAlertOrgID          int64
+	SyncAlertFolderUID      string
+	SyncAlertDatasourceUID  string
+	SyncAlertContactPoint   string
 	EntraTenantID         string
 	EntraClientID         string
 	EntraClientSecret     string
 	EntraAuthorityBaseURL string
+	EntraOAuthScopes      string
+	EntraOAuthExtraParams string
+	// EntraInsecureTLS skips certificate verification on Entra token and
+	// Graph requests; EntraCACertFile trusts a private CA instead.
+	EntraInsecureTLS      bool
+	EntraCACertFile       string
+	// GrafanaExtraHeaders and EntraExtraHeaders are JSON objects of headers
+	// added to every Grafana and Graph API request; see ParseExtraHeaders.
+	GrafanaExtraHeaders   string
+	EntraExtraHeaders     string
+	// GrafanaDisableProvenance sends X-Disable-Provenance on Grafana write
+	// requests so provisioned resources can be changed.
+	GrafanaDisableProvenance bool
+	// EntraGroupFilter is an OData $filter applied when listing groups.
+	EntraGroupFilter      string
+	EntraGroupFilterCount bool
 	GraphAPIBaseURL       string
+	GraphAPIVersion       string
+	GrafanaAPIPathPrefix  string
+
+	// EntraAllowedGroupTypes limits mapped groups to security, m365 and/or
+	// distribution groups; empty or "all" allows every type.
+	EntraAllowedGroupTypes string
 
 	// AutoSyncOnStart, when AutoSyncOnStartSet is true, forces the store's
 	// auto-sync flag to that value on every container start. When unset, the
 	// existing store value (toggled via the web UI) is left alone.
 	AutoSyncOnStart    bool
 	AutoSyncOnStartSet bool
+
+	// secretErr records *_FILE secrets that could not be read; Validate
+	// returns it.
+	secretErr error
 }
 
 func Load() Config {
 	cfg := Config{
 		ListenAddr:           getEnv("LISTEN_ADDR", ":8080"),
 		DataDir:              getEnv("DATA_DIR", "/data"),
+		AdminAPIToken:        getEnv("ADMIN_API_TOKEN", ""),
+		WebhookInboundSecret: getEnv("WEBHOOK_INBOUND_SECRET", ""),
+		RateLimitPerMinute:     getEnvInt("RATE_LIMIT_REQUESTS_PER_MINUTE", 30),
+		RateLimitBurst:         getEnvInt("RATE_LIMIT_BURST", 5),
+		SyncRateLimitPerMinute: getEnvInt("SYNC_RATE_LIMIT_REQUESTS_PER_MINUTE", 2),
+		TrustProxyHeaders:      getEnvBool("TRUST_PROXY_HEADERS", false),
+		OIDCIssuer:             getEnv("OIDC_ISSUER", ""),
+		OIDCClientID:           getEnv("OIDC_CLIENT_ID", ""),
+		OIDCClientSecret:       getEnv("OIDC_CLIENT_SECRET", ""),
+		OIDCRedirectURL:        getEnv("OIDC_REDIRECT_URL", ""),
+		OIDCSessionSecret:      getEnv("OIDC_SESSION_SECRET", ""),
+		OIDCAllowedEmailDomain: getEnv("OIDC_ALLOWED_EMAIL_DOMAIN", ""),
+		BackupInterval:       getEnvDuration("BACKUP_INTERVAL", 0),
+		BackupDir:            getEnv("BACKUP_DIR", ""),
+		BackupRetentionDays:  getEnvInt("BACKUP_RETENTION_DAYS", 7),
+		ArchiveInterval:      getEnvDuration("ARCHIVE_INTERVAL", 0),
+		DBPageSize:           getEnvInt("DB_PAGE_SIZE", 4096),
+		DBCacheSizeKB:        getEnvInt("DB_CACHE_SIZE_KB", 8192),
+		SQLiteAnalyzeInterval: getEnvDuration("SQLITE_ANALYZE_INTERVAL", 24*time.Hour),
+		SQLiteVacuumInterval:  getEnvDuration("SQLITE_VACUUM_INTERVAL", 7*24*time.Hour),
+		DBMaintenanceTimeout:  getEnvDuration("DB_MAINTENANCE_TIMEOUT", 30*time.Second),
+		ArchiveRetentionDays: getEnvInt("ARCHIVE_RETENTION_DAYS", 90),
 		SyncInterval:         getEnvDuration("SYNC_INTERVAL", 15*time.Minute),
+		SyncJitter:           getEnvDuration("SYNC_JITTER", 0),
+		SyncWindowStart:      getEnv("SYNC_WINDOW_START", ""),
+		SyncWindowEnd:        getEnv("SYNC_WINDOW_END", ""),
+		SyncWindowTZ:         getEnv("SYNC_WINDOW_TZ", ""),
+		RequireHealthyOnStart: getEnvBool("REQUIRE_HEALTHY_ON_START", false),
+		LatencyWarnP99:        getEnvDuration("LATENCY_WARN_P99", 2*time.Second),
 		GrafanaURL:            getEnv("GRAFANA_URL", "http://grafana:3000"),
 		GrafanaAdminUser:      getEnv("GRAFANA_ADMIN_USER", "admin"),
 		GrafanaAdminPassword:  getEnv("GRAFANA_ADMIN_PASSWORD", ""),
 		GrafanaAdminToken:     getEnv("GRAFANA_ADMIN_TOKEN", ""),
+		GrafanaOrgTokens:      getEnvOrgTokens("GRAFANA_ORG_TOKENS"),
+		DataEncryptionKey:     getEnv("DATA_ENCRYPTION_KEY", ""),
 		GrafanaInsecureTLS:    getEnvBool("GRAFANA_INSECURE_TLS", false),
+		GrafanaTLSSkipVerifyHosts: splitList(getEnv("GRAFANA_TLS_SKIP_VERIFY_HOSTS", "")),
+		GrafanaTLSCertFile:    getEnv("GRAFANA_TLS_CERT_FILE", ""),
+		GrafanaTLSKeyFile:     getEnv("GRAFANA_TLS_KEY_FILE", ""),
+		GrafanaTLSCAFile:      getEnv("GRAFANA_TLS_CA_FILE", ""),
+		GrafanaHTTPProxy:      getEnv("GRAFANA_HTTP_PROXY", ""),
+		EntraHTTPProxy:        getEnv("ENTRA_HTTP_PROXY", ""),
+		EntraHTTPProxyAuth:    getEnv("ENTRA_HTTP_PROXY_AUTH", ""),
+		NoProxy:               getEnv("NO_PROXY", os.Getenv("no_proxy")),
 		GrafanaDebug:          getEnvBool("GRAFANA_DEBUG", false),
+		GrafanaOrgUserPageSize: getEnvInt("GRAFANA_ORG_USER_PAGE_SIZE", 500),
+		GrafanaMaxIdleConns:    getEnvInt("GRAFANA_MAX_IDLE_CONNS", 20),
+		GrafanaMaxConnsPerHost: getEnvInt("GRAFANA_MAX_CONNS_PER_HOST", 10),
+		GrafanaReadTimeout:     getEnvDuration("GRAFANA_READ_TIMEOUT", 30*time.Second),
+		GrafanaWriteTimeout:    getEnvDuration("GRAFANA_WRITE_TIMEOUT", 30*time.Second),
+		GrafanaCacheTTL:        getEnvDuration("GRAFANA_CACHE_TTL", 0),
+		EntraMemberCacheTTL:    getEnvDuration("ENTRA_MEMBER_CACHE_TTL", 0),
 		DefaultUserRole:       getEnv("DEFAULT_USER_ROLE", "Viewer"),
+		UserLoginFormat:         strings.ToLower(getEnv("USER_LOGIN_FORMAT", "email")),
+		RoleFromGroupNamePattern: getEnv("ROLE_FROM_GROUP_NAME_PATTERN", ""),
+		WebhookURL:               getEnv("WEBHOOK_URL", ""),
+		AllowedActionTypes:       getEnv("ALLOWED_ACTION_TYPES", ""),
+		ActionOrder:              getEnv("ACTION_ORDER", ""),
+		PreviewInterval:          getEnvDuration("PREVIEW_INTERVAL", 0),
+		PlanMaxAge:               getEnvDuration("PLAN_MAX_AGE", 24*time.Hour),
+		SATokenRotationWindow:    getEnvDuration("SA_TOKEN_ROTATION_WINDOW", 48*time.Hour),
+		SATokenTTL:               getEnvDuration("SA_TOKEN_TTL", 30*24*time.Hour),
+		PreviewAlertMinActions:   getEnvInt("PREVIEW_ALERT_MIN_ACTIONS", 1),
+		GrafanaVerifyTeamIDs:     getEnvBool("GRAFANA_VERIFY_TEAM_IDS", false),
+		SyncTeamEmail:            getEnvBool("SYNC_TEAM_EMAIL", false),
+		UserDisplayNameTemplate: getEnv("USER_DISPLAY_NAME_TEMPLATE", "{{.DisplayName}}"),
+		NoteTemplate:            getEnv("NOTE_TEMPLATE", ""),
 		AllowCreateUsers:      getEnvBool("ALLOW_CREATE_USERS", true),
 		AllowRemoveMembers:    getEnvBool("ALLOW_REMOVE_TEAM_MEMBERS", true),
+		ReadOnlyMode:          getEnvBool("READ_ONLY_MODE", false),
+		RemovalGracePeriod:    getEnvDuration("REMOVAL_GRACE_PERIOD", 0),
+		GroupOwnersAsTeamAdmins: getEnvBool("USE_ENTRA_GROUP_OWNERS_AS_TEAM_ADMINS", false),
+		DeactivateRemovedUsers:  getEnvBool("DEACTIVATE_REMOVED_USERS", false),
+		GrafanaAutoEnableUsers:  getEnvBool("GRAFANA_AUTO_ENABLE_USERS", false),
+		GrafanaProtectedLogins:  []string{"admin"},
+		TeamFolderAutoCreate:    getEnvBool("TEAM_FOLDER_AUTO_CREATE", false),
+		TeamFolderParentUID:     getEnv("TEAM_FOLDER_PARENT_UID", ""),
+		TeamFolderTitleTemplate: getEnv("TEAM_FOLDER_TITLE_TEMPLATE", ""),
+		TeamFolderPermission:    getEnv("SYNC_TEAM_FOLDER_PERMISSION_LEVEL", "Edit"),
+		TeamAvatarURLTemplate:   getEnv("TEAM_AVATAR_URL_TEMPLATE", ""),
+		TeamManagedLabel:        getEnv("TEAM_MANAGED_LABEL", "managed-by=grafana-ad-syncher"),
+		GrafanaTeamSyncCompat:   getEnvBool("GRAFANA_TEAM_SYNC_COMPAT", false),
+		SkipDisabledGrafanaUsers: getEnvBool("SKIP_DISABLED_GRAFANA_USERS", false),
+		AllowRoleDowngrade:      getEnvBool("ALLOW_ROLE_DOWNGRADE", true),
+		SyncUpdateUserProfiles:  getEnvBool("SYNC_UPDATE_USER_PROFILES", false),
+		GrafanaAutoCreateOrgs:   getEnvBool("GRAFANA_AUTO_CREATE_ORGS", false),
+		ProvisionSyncAlerts:     getEnvBool("PROVISION_SYNC_ALERTS", false),
+		SyncAlertThresholdHours: getEnvInt("SYNC_ALERT_THRESHOLD_HOURS", 24),
+		SyncAlertOrgID:          int64(getEnvInt("SYNC_ALERT_ORG_ID", 1)),
+		SyncAlertFolderUID:      getEnv("SYNC_ALERT_FOLDER_UID", ""),
+		SyncAlertDatasourceUID:  getEnv("SYNC_ALERT_DATASOURCE_UID", ""),
+		SyncAlertContactPoint:   getEnv("SYNC_ALERT_CONTACT_POINT", ""),
 		EntraTenantID:         getEnv("ENTRA_TENANT_ID", ""),
 		EntraClientID:         getEnv("ENTRA_CLIENT_ID", ""),
 		EntraClientSecret:     getEnv("ENTRA_CLIENT_SECRET", ""),
 		EntraAuthorityBaseURL: getEnv("ENTRA_AUTHORITY_BASE_URL", "https://login.microsoftonline.com"),
-		GraphAPIBaseURL:       getEnv("GRAPH_API_BASE_URL", "https://graph.microsoft.com/v1.0"),
+		EntraOAuthScopes:      getEnv("ENTRA_OAUTH_SCOPES", ""),
+		EntraOAuthExtraParams: getEnv("ENTRA_OAUTH_EXTRA_PARAMS", ""),
+		EntraInsecureTLS:      getEnvBool("ENTRA_INSECURE_TLS", false),
+		EntraCACertFile:       getEnv("ENTRA_CA_CERT_FILE", ""),
+		GrafanaExtraHeaders:   getEnv("GRAFANA_EXTRA_HEADERS", ""),
+		EntraExtraHeaders:     getEnv("ENTRA_EXTRA_HEADERS", ""),
+		GrafanaDisableProvenance: getEnvBool("GRAFANA_DISABLE_PROVENANCE", false),
+		EntraGroupFilter:      getEnv("ENTRA_GROUP_FILTER", ""),
+		EntraGroupFilterCount: getEnvBool("ENTRA_GROUP_FILTER_COUNT", false),
+		EntraAllowedGroupTypes: getEnv("ENTRA_ALLOWED_GROUP_TYPES", ""),
+		GraphAPIBaseURL:       getEnv("GRAPH_API_BASE_URL", "https://graph.microsoft.com"),
+		GraphAPIVersion:       getEnv("GRAPH_API_VERSION", "v1.0"),
+		GrafanaAPIPathPrefix:  getEnv("GRAFANA_API_PATH_PREFIX", "/api"),
+	}
+	if raw, ok := os.LookupEnv("GRAFANA_PROTECTED_LOGINS"); ok {
+		cfg.GrafanaProtectedLogins = strings.Split(raw, ",")
+	}
+	if raw := getEnv("TEAM_ADMIN_EMAIL_DOMAINS", ""); raw != "" {
+		cfg.TeamAdminEmailDomains = strings.Split(raw, ",")
 	}
 	if raw, ok := os.LookupEnv("AUTO_SYNC_ON_START"); ok && strings.TrimSpace(raw) != "" {
 		if parsed, err := strconv.ParseBool(strings.TrimSpace(raw)); err == nil {
@@ -59,9 +310,136 @@ func Load() Config {
 			cfg.AutoSyncOnStartSet = true
 		}
 	}
+	// Secrets can also come from the file named by <KEY>_FILE, as mounted
+	// for Docker and Kubernetes secrets.
+	secrets := []struct {
+		key   string
+		value *string
+	}{
+		{"ADMIN_API_TOKEN", &cfg.AdminAPIToken},
+		{"WEBHOOK_INBOUND_SECRET", &cfg.WebhookInboundSecret},
+		{"OIDC_CLIENT_SECRET", &cfg.OIDCClientSecret},
+		{"OIDC_SESSION_SECRET", &cfg.OIDCSessionSecret},
+		{"GRAFANA_ADMIN_PASSWORD", &cfg.GrafanaAdminPassword},
+		{"GRAFANA_ADMIN_TOKEN", &cfg.GrafanaAdminToken},
+		{"ENTRA_CLIENT_SECRET", &cfg.EntraClientSecret},
+		{"DATA_ENCRYPTION_KEY", &cfg.DataEncryptionKey},
+	}
+	var errs []error
+	for _, secret := range secrets {
+		if err := readSecretFile(secret.key, secret.value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	cfg.secretErr = errors.Join(errs...)
 	return cfg
 }
 
+// readSecretFile replaces *value with the contents of the file named by
+// key+"_FILE", without trailing whitespace. It does nothing when that
+// variable is unset.
+func readSecretFile(key string, value *string) error {
+	file := strings.TrimSpace(os.Getenv(key + "_FILE"))
+	if file == "" {
+		return nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("%s_FILE: %w", key, err)
+	}
+	*value = strings.TrimRight(string(data), " \t\r\n")
+	return nil
+}
+
+// Validate reports combinations of settings that cannot work together.
+func (c Config) Validate() error {
+	if c.secretErr != nil {
+		return c.secretErr
+	}
+	if (c.GrafanaTLSCertFile == "") != (c.GrafanaTLSKeyFile == "") {
+		return errors.New("GRAFANA_TLS_CERT_FILE and GRAFANA_TLS_KEY_FILE must be set together")
+	}
+	if c.GrafanaInsecureTLS && (c.GrafanaTLSCertFile != "" || c.GrafanaTLSCAFile != "") {
+		return errors.New("GRAFANA_INSECURE_TLS cannot be combined with GRAFANA_TLS_CERT_FILE or GRAFANA_TLS_CA_FILE")
+	}
+	if c.EntraInsecureTLS && c.EntraCACertFile != "" {
+		return errors.New("ENTRA_INSECURE_TLS cannot be combined with ENTRA_CA_CERT_FILE")
+	}
+	for _, pattern := range c.GrafanaTLSSkipVerifyHosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("GRAFANA_TLS_SKIP_VERIFY_HOSTS: invalid pattern %q", pattern)
+		}
+	}
+	if c.OIDCIssuer != "" {
+		if c.OIDCClientID == "" || c.OIDCClientSecret == "" || c.OIDCRedirectURL == "" {
+			return errors.New("OIDC_ISSUER requires OIDC_CLIENT_ID, OIDC_CLIENT_SECRET and OIDC_REDIRECT_URL")
+		}
+		if len(c.OIDCSessionSecret) < 32 {
+			return errors.New("OIDC_SESSION_SECRET must be at least 32 characters")
+		}
+	}
+	if c.DBPageSize < 512 || c.DBPageSize > 65536 || c.DBPageSize&(c.DBPageSize-1) != 0 {
+		return errors.New("DB_PAGE_SIZE must be a power of two between 512 and 65536")
+	}
+	if c.DBCacheSizeKB <= 0 {
+		return errors.New("DB_CACHE_SIZE_KB must be positive")
+	}
+	switch c.UserLoginFormat {
+	case "email", "upn", "displayname_slug":
+	default:
+		return fmt.Errorf("USER_LOGIN_FORMAT must be email, upn or displayname_slug, got %q", c.UserLoginFormat)
+	}
+	if c.GrafanaOrgUserPageSize < 1 {
+		return errors.New("GRAFANA_ORG_USER_PAGE_SIZE must be positive")
+	}
+	if !strings.HasPrefix(c.GrafanaAPIPathPrefix, "/") {
+		return errors.New("GRAFANA_API_PATH_PREFIX must start with /")
+	}
+	if c.ProvisionSyncAlerts {
+		if c.SyncAlertFolderUID == "" || c.SyncAlertDatasourceUID == "" {
+			return errors.New("PROVISION_SYNC_ALERTS requires SYNC_ALERT_FOLDER_UID and SYNC_ALERT_DATASOURCE_UID")
+		}
+		if c.SyncAlertThresholdHours <= 0 {
+			return errors.New("SYNC_ALERT_THRESHOLD_HOURS must be positive")
+		}
+	}
+	if version := strings.TrimPrefix(c.GraphAPIVersion, "/"); version == "" || strings.Contains(version, "/") {
+		return errors.New("GRAPH_API_VERSION must be a single path segment such as v1.0 or beta")
+	}
+	if base := strings.TrimRight(c.GraphAPIBaseURL, "/"); strings.HasSuffix(base, "/v1.0") || strings.HasSuffix(base, "/beta") {
+		if baseVersion := path.Base(base); baseVersion != strings.Trim(c.GraphAPIVersion, "/") {
+			return fmt.Errorf("GRAPH_API_BASE_URL ends with %s but GRAPH_API_VERSION is %s; remove the version from the base URL or make them match", baseVersion, c.GraphAPIVersion)
+		}
+	}
+	return nil
+}
+
+// ParseExtraHeaders parses a JSON object of header names to values, such as
+// {"X-API-Key":"secret"}. Headers the clients set themselves cannot be
+// overridden. An empty value returns nil.
+func ParseExtraHeaders(raw string) (map[string]string, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(raw), &headers); err != nil {
+		return nil, fmt.Errorf("must be a JSON object of strings: %w", err)
+	}
+	for name, value := range headers {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		switch strings.ToLower(name) {
+		case "authorization", "content-type":
+			return nil, fmt.Errorf("cannot override %s", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("header %s: value contains a line break", name)
+		}
+	}
+	return headers, nil
+}
+
 func getEnv(key, fallback string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
@@ -69,6 +447,17 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+// splitList splits a comma separated value, dropping blank entries.
+func splitList(value string) []string {
+	var out []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
 func getEnvBool(key string, fallback bool) bool {
 	if v := os.Getenv(key); v != "" {
 		parsed, err := strconv.ParseBool(v)
@@ -79,6 +468,16 @@ func getEnvBool(key string, fallback bool) bool {
 	return fallback
 }
 
+func getEnvInt(key string, fallback int) int {
+	if v := os.Getenv(key); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err == nil {
+			return parsed
+		}
+	}
+	return fallback
+}
+
 func getEnvDuration(key string, fallback time.Duration) time.Duration {
 	if v := os.Getenv(key); v != "" {
 		parsed, err := time.ParseDuration(v)
@@ -88,3 +487,29 @@ func getEnvDuration(key string, fallback time.Duration) time.Duration {
 	}
 	return fallback
 }
+
+// getEnvOrgTokens parses a JSON object of Grafana org ID to token, e.g.
+// {"1":"token_abc","2":"token_xyz"}. Invalid input is logged and ignored.
+func getEnvOrgTokens(key string) map[int64]string {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return nil
+	}
+	var parsed map[string]string
+	if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+		log.Printf("%s: invalid JSON, ignoring: %v", key, err)
+		return nil
+	}
+	tokens := make(map[int64]string, len(parsed))
+	for orgID, token := range parsed {
+		id, err := strconv.ParseInt(strings.TrimSpace(orgID), 10, 64)
+		if err != nil || id <= 0 {
+			log.Printf("%s: invalid org id %q, ignoring", key, orgID)
+			continue
+		}
+		if token = strings.TrimSpace(token); token != "" {
+			tokens[id] = token
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,181 @@
+package config
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateGrafanaTLS(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cfg     func(*Config)
+		wantErr bool
+	}{
+		{name: "none", cfg: func(*Config) {}},
+		{name: "mtls", cfg: func(c *Config) {
+			c.GrafanaTLSCertFile = "c.crt"
+			c.GrafanaTLSKeyFile = "c.key"
+			c.GrafanaTLSCAFile = "ca.crt"
+		}},
+		{name: "insecure", cfg: func(c *Config) { c.GrafanaInsecureTLS = true }},
+		{name: "cert without key", cfg: func(c *Config) { c.GrafanaTLSCertFile = "c.crt" }, wantErr: true},
+		{name: "key without cert", cfg: func(c *Config) { c.GrafanaTLSKeyFile = "c.key" }, wantErr: true},
+		{name: "insecure with mtls", cfg: func(c *Config) {
+			c.GrafanaInsecureTLS = true
+			c.GrafanaTLSCertFile = "c.crt"
+			c.GrafanaTLSKeyFile = "c.key"
+		}, wantErr: true},
+		{name: "insecure with CA", cfg: func(c *Config) { c.GrafanaInsecureTLS = true; c.GrafanaTLSCAFile = "ca.crt" }, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Load with an empty environment gives the defaults, which are valid.
+			cfg := Load()
+			tc.cfg(&cfg)
+			err := cfg.Validate()
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Validate() = %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateGraphAPIVersion(t *testing.T) {
+	for _, tc := range []struct {
+		base, version string
+		wantErr       bool
+	}{
+		{base: "https://graph.microsoft.com", version: "beta"},
+		{base: "https://graph.microsoft.com/v1.0", version: "v1.0"},
+		{base: "https://graph.microsoft.com/beta/", version: "beta"},
+		{base: "https://graph.microsoft.com/v1.0", version: "beta", wantErr: true},
+		{base: "https://graph.microsoft.com/beta", version: "v1.0", wantErr: true},
+		{base: "https://graph.microsoft.com", version: "v1.0/x", wantErr: true},
+	} {
+		cfg := Load()
+		cfg.GraphAPIBaseURL, cfg.GraphAPIVersion = tc.base, tc.version
+		if err := cfg.Validate(); (err != nil) != tc.wantErr {
+			t.Errorf("Validate(%s, %s) = %v, want error %v", tc.base, tc.version, err, tc.wantErr)
+		}
+	}
+}
+
+func TestAllowRoleDowngradeDefault(t *testing.T) {
+	for _, tc := range []struct {
+		env  string
+		want bool
+	}{
+		{env: "", want: true},
+		{env: "true", want: true},
+		{env: "false", want: false},
+	} {
+		t.Setenv("ALLOW_ROLE_DOWNGRADE", tc.env)
+		if got := Load().AllowRoleDowngrade; got != tc.want {
+			t.Errorf("ALLOW_ROLE_DOWNGRADE=%q: AllowRoleDowngrade = %v, want %v", tc.env, got, tc.want)
+		}
+	}
+}
+
+func TestParseExtraHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		raw     string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "empty", raw: ""},
+		{name: "blank", raw: "  "},
+		{name: "headers", raw: `{"X-API-Key":"secret","X-Tenant":"ops"}`, want: map[string]string{"X-API-Key": "secret", "X-Tenant": "ops"}},
+		{name: "authorization", raw: `{"Authorization":"Bearer x"}`, wantErr: true},
+		{name: "authorization lower case", raw: `{"authorization":"Bearer x"}`, wantErr: true},
+		{name: "content type", raw: `{"Content-Type":"text/plain"}`, wantErr: true},
+		{name: "content type mixed case", raw: `{"content-TYPE":"text/plain"}`, wantErr: true},
+		{name: "empty name", raw: `{"":"x"}`, wantErr: true},
+		{name: "name with colon", raw: `{"X-Key:":"x"}`, wantErr: true},
+		{name: "name with space", raw: `{"X Key":"x"}`, wantErr: true},
+		{name: "value with line break", raw: `{"X-Key":"a\r\nX-Evil: b"}`, wantErr: true},
+		{name: "not an object", raw: `["X-Key"]`, wantErr: true},
+		{name: "non-string value", raw: `{"X-Key":1}`, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseExtraHeaders(tc.raw)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseExtraHeaders(%s) error = %v, want error %v", tc.raw, err, tc.wantErr)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("ParseExtraHeaders(%s) = %v, want %v", tc.raw, got, tc.want)
+			}
+			for name, value := range tc.want {
+				if got[name] != value {
+					t.Errorf("header %s = %q, want %q", name, got[name], value)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateEntraTLS(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		insecure string
+		caFile   string
+		wantErr  bool
+	}{
+		{name: "none"},
+		{name: "insecure", insecure: "true"},
+		{name: "CA", caFile: "ca.crt"},
+		{name: "insecure disabled with CA", insecure: "false", caFile: "ca.crt"},
+		{name: "insecure with CA", insecure: "true", caFile: "ca.crt", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("ENTRA_INSECURE_TLS", tc.insecure)
+			t.Setenv("ENTRA_CA_CERT_FILE", tc.caFile)
+			cfg := Load()
+			if cfg.EntraInsecureTLS != (tc.insecure == "true") || cfg.EntraCACertFile != tc.caFile {
+				t.Fatalf("EntraInsecureTLS = %v, EntraCACertFile = %q", cfg.EntraInsecureTLS, cfg.EntraCACertFile)
+			}
+			if err := cfg.Validate(); (err != nil) != tc.wantErr {
+				t.Errorf("Validate() = %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secretFile, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		env     string
+		file    string
+		want    string
+		wantErr bool
+	}{
+		{name: "env only", env: "from-env", want: "from-env"},
+		{name: "file only", file: secretFile, want: "from-file"},
+		{name: "file wins over env", env: "from-env", file: secretFile, want: "from-file"},
+		{name: "missing file", env: "from-env", file: filepath.Join(dir, "missing"), want: "from-env", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("ENTRA_CLIENT_SECRET", tc.env)
+			t.Setenv("ENTRA_CLIENT_SECRET_FILE", tc.file)
+			cfg := Load()
+			if cfg.EntraClientSecret != tc.want {
+				t.Errorf("EntraClientSecret = %q, want %q", cfg.EntraClientSecret, tc.want)
+			}
+			err := cfg.Validate()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Validate() = %v, want error %v", err, tc.wantErr)
+			}
+			if tc.wantErr && (!errors.Is(err, fs.ErrNotExist) || !strings.Contains(err.Error(), "ENTRA_CLIENT_SECRET_FILE")) {
+				t.Errorf("Validate() = %v, want a missing ENTRA_CLIENT_SECRET_FILE error", err)
+			}
+		})
+	}
+}
@@ -2,15 +2,20 @@ package entra
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"sync"
 	"time"
+
+	"grafana-ad-syncher/internal/metrics"
 )
 
 type Client struct {
@@ -21,17 +26,31 @@ type Client struct {
 	graphBase  string
 	httpClient *http.Client
 
+	scopes      []string
+	extraParams map[string]string
+
+	groupFilter      string
+	groupFilterCount bool
+
+	extraHeaders map[string]string
+
 	mu          sync.Mutex
 	accessToken string
 	expiresAt   time.Time
 
-	lastOKMu sync.Mutex
-	lastOK   time.Time
+	lastOKMu  sync.Mutex
+	lastOK    time.Time
+	lastErr   error
+	lastErrAt time.Time
+
+	latency *metrics.Latency
 }
 
 type Member struct {
 	ID          string `json:"id"`
 	DisplayName string `json:"displayName"`
+	GivenName   string `json:"givenName"`
+	Surname     string `json:"surname"`
 	Mail        string `json:"mail"`
 	UPN         string `json:"userPrincipalName"`
 	Department  string `json:"department"`
@@ -43,6 +62,43 @@ type Group struct {
 	Mail            string `json:"mail"`
 	SecurityEnabled bool   `json:"securityEnabled"`
 	MailEnabled     bool   `json:"mailEnabled"`
+	Description     string `json:"description"`
+}
+
+// Type classifies the group as "m365" (mail-enabled), "security" or
+// "distribution" (neither mail- nor security-enabled).
+func (g Group) Type() string {
+	if g.MailEnabled {
+		return "m365"
+	}
+	if !g.SecurityEnabled {
+		return "distribution"
+	}
+	return "security"
+}
+
+// ParseGroupTypes parses ENTRA_ALLOWED_GROUP_TYPES, a comma-separated list
+// of security, m365 and distribution. An empty value or "all" allows every
+// type and returns nil.
+func ParseGroupTypes(raw string) (map[string]bool, error) {
+	allowed := map[string]bool{}
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		switch part {
+		case "":
+			continue
+		case "all":
+			return nil, nil
+		case "security", "m365", "distribution":
+			allowed[part] = true
+		default:
+			return nil, fmt.Errorf("unknown group type %q", part)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, nil
+	}
+	return allowed, nil
 }
 
 type User struct {
@@ -53,15 +109,167 @@ type User struct {
 	AccountEnabled bool   `json:"accountEnabled"`
 }
 
-func New(tenantID, clientID, clientSecret, authBase, graphBase string) *Client {
+// New creates a Graph client. graphVersion ("v1.0", "beta") is appended to
+// graphBase unless graphBase already ends with a version segment. proxy,
+// when non-nil, replaces the proxy selection from the process environment.
+func New(tenantID, clientID, clientSecret, authBase, graphBase, graphVersion string, proxy func(*http.Request) (*url.URL, error)) *Client {
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	if proxy != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = proxy
+		httpClient.Transport = transport
+	}
 	return &Client{
 		ten:        tenantID,
 		clientID:   clientID,
 		secret:     clientSecret,
 		authBase:   strings.TrimRight(authBase, "/"),
-		graphBase:  strings.TrimRight(graphBase, "/"),
-		httpClient: &http.Client{Timeout: 30 * time.Second},
+		graphBase:  graphBaseURL(graphBase, graphVersion),
+		httpClient: httpClient,
+		latency:    metrics.NewLatency(),
+	}
+}
+
+const defaultScope = "https://graph.microsoft.com/.default"
+
+// reservedTokenParams are token request fields ENTRA_OAUTH_EXTRA_PARAMS may
+// not set; scope comes from ENTRA_OAUTH_SCOPES instead.
+var reservedTokenParams = []string{"client_id", "client_secret", "grant_type", "scope"}
+
+// ParseTokenParams parses ENTRA_OAUTH_SCOPES, a space separated list of
+// scopes, and ENTRA_OAUTH_EXTRA_PARAMS, a JSON object of extra token request
+// form fields. Unset values return nil so the defaults apply.
+func ParseTokenParams(scopes, extraJSON string) ([]string, map[string]string, error) {
+	var scopeList []string
+	if scopes != "" {
+		if len(strings.Fields(scopes)) == 0 {
+			return nil, nil, errors.New("at least one scope is required")
+		}
+		for _, scope := range strings.Fields(scopes) {
+			for _, r := range scope {
+				if r < 0x20 || r == 0x7f {
+					return nil, nil, fmt.Errorf("scope %q contains a control character", scope)
+				}
+			}
+			scopeList = append(scopeList, scope)
+		}
+	}
+	var extra map[string]string
+	if strings.TrimSpace(extraJSON) != "" {
+		if err := json.Unmarshal([]byte(extraJSON), &extra); err != nil {
+			return nil, nil, fmt.Errorf("extra params must be a JSON object of strings: %w", err)
+		}
+		for _, reserved := range reservedTokenParams {
+			for key := range extra {
+				if strings.EqualFold(key, reserved) {
+					return nil, nil, fmt.Errorf("extra params cannot set %s", key)
+				}
+			}
+		}
 	}
+	return scopeList, extra, nil
+}
+
+// SetTokenParams replaces the default Graph scope and adds extra form fields
+// to client credential token requests.
+func (c *Client) SetTokenParams(scopes []string, extraParams map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.scopes = scopes
+	c.extraParams = extraParams
+	c.accessToken = ""
+}
+
+// ValidateGroupFilter checks an ENTRA_GROUP_FILTER OData expression. String
+// literals must be closed, so every single quote needs a partner (two single
+// quotes are an escaped quote inside a literal), and control characters are
+// rejected.
+func ValidateGroupFilter(filter string) error {
+	if strings.Count(filter, "'")%2 != 0 {
+		return errors.New("unbalanced single quote")
+	}
+	for _, r := range filter {
+		if r < 0x20 || r == 0x7f {
+			return errors.New("filter contains a control character")
+		}
+	}
+	return nil
+}
+
+// SetTLS configures certificate verification for token and Graph requests,
+// e.g. for a Graph gateway with a self-signed certificate. insecure skips
+// verification; rootCAs, when non-nil, replaces the system pool. Call it
+// before the client is used.
+func (c *Client) SetTLS(insecure bool, rootCAs *x509.CertPool) {
+	if !insecure && rootCAs == nil {
+		return
+	}
+	transport, ok := c.httpClient.Transport.(*http.Transport)
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	transport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: insecure,
+		RootCAs:            rootCAs,
+	}
+	c.httpClient.Transport = transport
+}
+
+// LoadCAFile reads a PEM CA bundle for SetTLS. An empty path returns nil.
+func LoadCAFile(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("CA file %s contains no PEM certificates", path)
+	}
+	return pool, nil
+}
+
+// SetExtraHeaders adds headers, e.g. for an API gateway in front of Graph,
+// to every Graph API request. The token request is not affected.
+func (c *Client) SetExtraHeaders(headers map[string]string) {
+	c.extraHeaders = headers
+}
+
+// SetGroupFilter makes ListGroups ask Graph only for groups matching the
+// OData filter. withCount adds $count=true and the ConsistencyLevel:
+// eventual header, which advanced queries such as endsWith need. Call it
+// before the client is used.
+func (c *Client) SetGroupFilter(filter string, withCount bool) {
+	c.groupFilter = strings.TrimSpace(filter)
+	c.groupFilterCount = withCount
+}
+
+func graphBaseURL(base, version string) string {
+	base = strings.TrimRight(base, "/")
+	version = strings.Trim(version, "/")
+	if version == "" || GraphBaseVersion(base) != "" {
+		return base
+	}
+	return base + "/" + version
+}
+
+// GraphBaseVersion returns the API version a Graph base URL already ends
+// with ("v1.0" or "beta"), or "" when it has none. Such a base URL is used
+// as is and the configured version is ignored.
+func GraphBaseVersion(base string) string {
+	base = strings.TrimRight(base, "/")
+	switch last := base[strings.LastIndex(base, "/")+1:]; last {
+	case "v1.0", "beta":
+		return last
+	}
+	return ""
+}
+
+// Latency returns the durations of recent Graph requests.
+func (c *Client) Latency() *metrics.Latency {
+	return c.latency
 }
 
 func (c *Client) LastOK() time.Time {
@@ -70,13 +278,49 @@ func (c *Client) LastOK() time.Time {
 	return c.lastOK
 }
 
+// LastError returns the most recent failed Graph request, or nil. 404
+// responses are not recorded since Graph was reachable.
+func (c *Client) LastError() error {
+	c.lastOKMu.Lock()
+	defer c.lastOKMu.Unlock()
+	return c.lastErr
+}
+
+// LastErrorAt returns when LastError happened.
+func (c *Client) LastErrorAt() time.Time {
+	c.lastOKMu.Lock()
+	defer c.lastOKMu.Unlock()
+	return c.lastErrAt
+}
+
+// RestoreStatus seeds LastOK, LastError and LastErrorAt with values saved
+// before a restart. An empty lastErr leaves LastError nil.
+func (c *Client) RestoreStatus(lastOK time.Time, lastErr string, lastErrAt time.Time) {
+	c.lastOKMu.Lock()
+	defer c.lastOKMu.Unlock()
+	c.lastOK = lastOK
+	c.lastErr = nil
+	if lastErr != "" {
+		c.lastErr = errors.New(lastErr)
+	}
+	c.lastErrAt = lastErrAt
+}
+
+func (c *Client) recordError(err error) error {
+	c.lastOKMu.Lock()
+	c.lastErr = err
+	c.lastErrAt = time.Now().UTC()
+	c.lastOKMu.Unlock()
+	return err
+}
+
 func (c *Client) ListGroupMembers(groupID string) ([]Member, error) {
 	token, err := c.getToken()
 	if err != nil {
 		return nil, err
 	}
 
-	endpoint := fmt.Sprintf("%s/groups/%s/members?$select=id,displayName,mail,userPrincipalName,department", c.graphBase, url.PathEscape(groupID))
+	endpoint := fmt.Sprintf("%s/groups/%s/members?$select=id,displayName,givenName,surname,mail,userPrincipalName,department", c.graphBase, url.PathEscape(groupID))
 	var members []Member
 	for endpoint != "" {
 		resp, err := c.doRequest("GET", endpoint, token, nil)
@@ -98,16 +342,109 @@ func (c *Client) ListGroupMembers(groupID string) ([]Member, error) {
 	return members, nil
 }
 
+// ErrGroupNotFound is returned by FindGroupByDisplayName when no group has
+// the requested display name.
+var ErrGroupNotFound = errors.New("entra group not found")
+
+// ErrGroupAmbiguous is returned by FindGroupByDisplayName when several groups
+// share the requested display name.
+type ErrGroupAmbiguous struct {
+	Name    string
+	Matches []Group
+}
+
+func (e *ErrGroupAmbiguous) Error() string {
+	ids := make([]string, 0, len(e.Matches))
+	for _, g := range e.Matches {
+		ids = append(ids, g.ID)
+	}
+	return fmt.Sprintf("%d entra groups named %q: %s", len(e.Matches), e.Name, strings.Join(ids, ", "))
+}
+
+// FindGroupByDisplayName returns the only group with the given display name.
+func (c *Client) FindGroupByDisplayName(name string) (*Group, error) {
+	token, err := c.getToken()
+	if err != nil {
+		return nil, err
+	}
+
+	filter := fmt.Sprintf("displayName eq '%s'", strings.ReplaceAll(name, "'", "''"))
+	endpoint := fmt.Sprintf("%s/groups?$select=id,displayName,mail,securityEnabled,mailEnabled&$filter=%s", c.graphBase, url.QueryEscape(filter))
+	var matches []Group
+	for endpoint != "" {
+		resp, err := c.doRequest("GET", endpoint, token, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Value    []Group `json:"value"`
+			NextLink string  `json:"@odata.nextLink"`
+		}
+		if err := json.NewDecoder(resp).Decode(&page); err != nil {
+			_ = resp.Close()
+			return nil, err
+		}
+		_ = resp.Close()
+		matches = append(matches, page.Value...)
+		endpoint = page.NextLink
+	}
+	switch len(matches) {
+	case 0:
+		return nil, ErrGroupNotFound
+	case 1:
+		return &matches[0], nil
+	}
+	return nil, &ErrGroupAmbiguous{Name: name, Matches: matches}
+}
+
+// ListGroupOwners returns the owners of an Entra group.
+func (c *Client) ListGroupOwners(groupID string) ([]Member, error) {
+	token, err := c.getToken()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := fmt.Sprintf("%s/groups/%s/owners?$select=id,displayName,mail,userPrincipalName", c.graphBase, url.PathEscape(groupID))
+	var owners []Member
+	for endpoint != "" {
+		resp, err := c.doRequest("GET", endpoint, token, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Value    []Member `json:"value"`
+			NextLink string   `json:"@odata.nextLink"`
+		}
+		if err := json.NewDecoder(resp).Decode(&page); err != nil {
+			_ = resp.Close()
+			return nil, err
+		}
+		_ = resp.Close()
+		owners = append(owners, page.Value...)
+		endpoint = page.NextLink
+	}
+	return owners, nil
+}
+
 func (c *Client) ListGroups() ([]Group, error) {
 	token, err := c.getToken()
 	if err != nil {
 		return nil, err
 	}
 
-	endpoint := fmt.Sprintf("%s/groups?$select=id,displayName,mail,securityEnabled,mailEnabled", c.graphBase)
+	endpoint := fmt.Sprintf("%s/groups?$select=id,displayName,mail,securityEnabled,mailEnabled,description", c.graphBase)
+	var headers map[string]string
+	if c.groupFilter != "" {
+		// Graph does not read "+" as a space in $filter.
+		endpoint += "&$filter=" + strings.ReplaceAll(url.QueryEscape(c.groupFilter), "+", "%20")
+		if c.groupFilterCount {
+			endpoint += "&$count=true"
+			headers = map[string]string{"ConsistencyLevel": "eventual"}
+		}
+	}
 	var groups []Group
 	for endpoint != "" {
-		resp, err := c.doRequest("GET", endpoint, token, nil)
+		resp, err := c.doRequestWithHeaders("GET", endpoint, token, nil, headers)
 		if err != nil {
 			return nil, err
 		}
@@ -154,6 +491,20 @@ func (c *Client) ListUsers() ([]User, error) {
 	return users, nil
 }
 
+// TestAuth checks the app registration by fetching a token and reading one
+// group, which also needs the Graph permissions the syncer relies on.
+func (c *Client) TestAuth() error {
+	token, err := c.getToken()
+	if err != nil {
+		return c.recordError(err)
+	}
+	resp, err := c.doRequest("GET", c.graphBase+"/groups?$top=1&$select=id", token, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Close()
+}
+
 func (c *Client) getToken() (string, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -164,9 +515,16 @@ func (c *Client) getToken() (string, error) {
 
 	endpoint := fmt.Sprintf("%s/%s/oauth2/v2.0/token", c.authBase, c.ten)
 	form := url.Values{}
+	for key, value := range c.extraParams {
+		form.Set(key, value)
+	}
 	form.Set("client_id", c.clientID)
 	form.Set("client_secret", c.secret)
-	form.Set("scope", "https://graph.microsoft.com/.default")
+	scope := defaultScope
+	if len(c.scopes) > 0 {
+		scope = strings.Join(c.scopes, " ")
+	}
+	form.Set("scope", scope)
 	form.Set("grant_type", "client_credentials")
 
 	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
@@ -177,13 +535,13 @@ func (c *Client) getToken() (string, error) {
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return "", err
+		return "", c.requestError("POST", endpoint, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		payload, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("entra: token request failed: %s", strings.TrimSpace(string(payload)))
+		return "", fmt.Errorf("%s: token request failed: %s", c.logPrefix(), strings.TrimSpace(string(payload)))
 	}
 
 	var tokenResp struct {
@@ -194,7 +552,7 @@ func (c *Client) getToken() (string, error) {
 		return "", err
 	}
 	if tokenResp.AccessToken == "" {
-		return "", errors.New("entra: empty access token")
+		return "", fmt.Errorf("%s: empty access token", c.logPrefix())
 	}
 
 	c.accessToken = tokenResp.AccessToken
@@ -202,7 +560,70 @@ func (c *Client) getToken() (string, error) {
 	return c.accessToken, nil
 }
 
+// logPrefix names the client in errors, e.g.
+// "entra[tenant=...abcd, client=...1234]", so failures in multi-tenant
+// setups show which app registration failed without revealing full IDs.
+func (c *Client) logPrefix() string {
+	return fmt.Sprintf("entra[tenant=%s, client=%s]", maskID(c.ten), maskID(c.clientID))
+}
+
+// maskID keeps only the last four characters of an ID.
+func maskID(id string) string {
+	if len(id) <= 4 {
+		return "..."
+	}
+	return "..." + id[len(id)-4:]
+}
+
+// requestError describes a failed request without the URL net/http puts in
+// its errors, which may carry secrets in the query.
+func (c *Client) requestError(method, endpoint string, err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	return fmt.Errorf("%s: %s %s: %w", c.logPrefix(), method, sanitizeURL(endpoint), err)
+}
+
+// sensitiveParams are query parameters whose values sanitizeURL redacts.
+var sensitiveParams = map[string]bool{
+	"client_secret":    true,
+	"code":             true,
+	"client_assertion": true,
+	"access_token":     true,
+	"refresh_token":    true,
+	"assertion":        true,
+	"password":         true,
+}
+
+// sanitizeURL redacts the values of query parameters such as client_secret
+// and code, so a URL can be logged or put in an error.
+func sanitizeURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	if u.User != nil {
+		u.User = url.User("REDACTED")
+	}
+	if u.RawQuery == "" {
+		return u.String()
+	}
+	query := u.Query()
+	for key := range query {
+		if sensitiveParams[strings.ToLower(key)] {
+			query.Set(key, "REDACTED")
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
 func (c *Client) doRequest(method, endpoint, token string, body any) (io.ReadCloser, error) {
+	return c.doRequestWithHeaders(method, endpoint, token, body, nil)
+}
+
+func (c *Client) doRequestWithHeaders(method, endpoint, token string, body any, headers map[string]string) (io.ReadCloser, error) {
 	var reader io.Reader
 	if body != nil {
 		buf := &bytes.Buffer{}
@@ -225,15 +646,27 @@ func (c *Client) doRequest(method, endpoint, token string, body any) (io.ReadClo
 	if token != "" {
 		req.Header.Set("Authorization", "Bearer "+token)
 	}
+	for key, value := range c.extraHeaders {
+		req.Header.Set(key, value)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
 
+	start := time.Now()
 	resp, err := c.httpClient.Do(req)
+	c.latency.Record(method, time.Since(start))
 	if err != nil {
-		return nil, err
+		return nil, c.recordError(c.requestError(method, endpoint, err))
 	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		payload, _ := io.ReadAll(resp.Body)
 		_ = resp.Body.Close()
-		return nil, fmt.Errorf("entra: %s %s -> %d: %s", method, endpoint, resp.StatusCode, strings.TrimSpace(string(payload)))
+		err := fmt.Errorf("%s: %s %s -> %d: %s", c.logPrefix(), method, sanitizeURL(endpoint), resp.StatusCode, strings.TrimSpace(string(payload)))
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, err
+		}
+		return nil, c.recordError(err)
 	}
 	c.lastOKMu.Lock()
 	c.lastOK = time.Now().UTC()
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -12,49 +14,130 @@ import (
 	"net/http"
 	"net/http/httptrace"
 	"net/url"
+	"os"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"grafana-ad-syncher/internal/metrics"
 )
 
 type Client struct {
 	baseURL       string
+	apiBase       string
 	adminUser     string
 	adminPassword string
 	adminToken    string
-	httpClient    *http.Client
+	orgTokens     map[int64]string
+	tokenProvider TokenProvider
+	readClient    *http.Client
+	writeClient   *http.Client
 	debug         bool
+	userPageSize  int
+	extraHeaders  map[string]string
+	noProvenance  bool
 	mu            sync.Mutex
 	lastOK        time.Time
+	lastErr       error
+	lastErrAt     time.Time
+
+	// flights collapses concurrent identical lookups into one request.
+	flights singleflight.Group
+	latency *metrics.Latency
 }
 
 type User struct {
-	ID    int64  `json:"id"`
-	Name  string `json:"name"`
-	Login string `json:"login"`
-	Email string `json:"email"`
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	Login      string `json:"login"`
+	Email      string `json:"email"`
+	IsDisabled bool   `json:"isDisabled"`
 }
 
-type Team struct {
+// TeamPreferences are a team's UI preferences. Empty fields leave the org or
+// user default in place.
+type TeamPreferences struct {
+	Theme            string `json:"theme,omitempty"`
+	HomeDashboardUID string `json:"homeDashboardUID,omitempty"`
+	Timezone         string `json:"timezone,omitempty"`
+}
+
+// ParseTeamPreferences decodes a JSON object such as
+// {"theme":"dark","homeDashboardUID":"abc123","timezone":"UTC"}.
+func ParseTeamPreferences(raw string) (TeamPreferences, error) {
+	var prefs TeamPreferences
+	dec := json.NewDecoder(strings.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&prefs); err != nil {
+		return TeamPreferences{}, fmt.Errorf("team preferences must be a JSON object with theme, homeDashboardUID and timezone: %w", err)
+	}
+	switch prefs.Theme {
+	case "", "light", "dark", "system":
+	default:
+		return TeamPreferences{}, fmt.Errorf("team theme must be light, dark or system, got %q", prefs.Theme)
+	}
+	return prefs, nil
+}
+
+// Org is a Grafana organization as listed by GET /api/orgs.
+type Org struct {
 	ID   int64  `json:"id"`
 	Name string `json:"name"`
 }
 
+type Team struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	Email       string `json:"email"`
+	Description string `json:"description"`
+	AvatarURL   string `json:"avatarUrl"`
+	// MemberCount is set by the team search endpoint on Grafana versions
+	// that report it.
+	MemberCount *int `json:"memberCount,omitempty"`
+}
+
 type TeamMember struct {
 	ID    int64  `json:"userId"`
 	Name  string `json:"name"`
 	Login string `json:"login"`
 	Email string `json:"email"`
 	Role  string `json:"role"`
+	// Permission is the numeric team role: 0 for members and
+	// TeamPermissionAdmin for admins.
+	Permission int `json:"permission"`
+}
+
+// TeamPermissionAdmin is the team member permission Grafana uses for team
+// admins.
+const TeamPermissionAdmin = 4
+
+// TeamRole returns "admin" or "member". Role is used when Grafana sends it;
+// otherwise Permission decides.
+func (m TeamMember) TeamRole() string {
+	if m.Role != "" {
+		if strings.EqualFold(m.Role, "admin") {
+			return "admin"
+		}
+		return "member"
+	}
+	if m.Permission == TeamPermissionAdmin {
+		return "admin"
+	}
+	return "member"
 }
 
 type OrgUser struct {
-	ID    int64  `json:"userId"`
-	Login string `json:"login"`
-	Email string `json:"email"`
-	Name  string `json:"name"`
-	Role  string `json:"role"`
+	ID         int64  `json:"userId"`
+	Login      string `json:"login"`
+	Email      string `json:"email"`
+	Name       string `json:"name"`
+	Role       string `json:"role"`
+	IsDisabled bool   `json:"isDisabled"`
 }
 
 type Folder struct {
@@ -74,18 +157,267 @@ type FolderPermission struct {
 	Role           string `json:"role"`
 }
 
-func New(baseURL, adminUser, adminPassword, adminToken string, insecureTLS, debug bool) *Client {
-	transport := http.DefaultTransport.(*http.Transport).Clone()
-	if insecureTLS {
-		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+// ContactPoint is a Grafana alerting contact point (receiver integration).
+type ContactPoint struct {
+	UID  string `json:"uid"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type DataSource struct {
+	ID   int64  `json:"id"`
+	UID  string `json:"uid"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// ErrEnterpriseRequired is returned by APIs that only Grafana Enterprise
+// (or Grafana Cloud) serves, such as data source permissions.
+var ErrEnterpriseRequired = errors.New("grafana: feature requires Grafana Enterprise")
+
+// AlertRule is a Grafana-managed alert rule in the provisioning API format.
+type AlertRule struct {
+	UID                  string                     `json:"uid,omitempty"`
+	OrgID                int64                      `json:"orgID"`
+	FolderUID            string                     `json:"folderUID"`
+	RuleGroup            string                     `json:"ruleGroup"`
+	Title                string                     `json:"title"`
+	Condition            string                     `json:"condition"`
+	Data                 []AlertQuery               `json:"data"`
+	NoDataState          string                     `json:"noDataState"`
+	ExecErrState         string                     `json:"execErrState"`
+	For                  string                     `json:"for"`
+	Labels               map[string]string          `json:"labels,omitempty"`
+	Annotations          map[string]string          `json:"annotations,omitempty"`
+	NotificationSettings *AlertNotificationSettings `json:"notification_settings,omitempty"`
+}
+
+// AlertQuery is one query or expression step of an alert rule.
+type AlertQuery struct {
+	RefID             string            `json:"refId"`
+	DatasourceUID     string            `json:"datasourceUid"`
+	RelativeTimeRange RelativeTimeRange `json:"relativeTimeRange"`
+	Model             map[string]any    `json:"model"`
+}
+
+// RelativeTimeRange is a query range in seconds before evaluation time.
+type RelativeTimeRange struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+// AlertNotificationSettings sends a rule's alerts straight to a contact
+// point, bypassing the notification policy tree.
+type AlertNotificationSettings struct {
+	Receiver string `json:"receiver"`
+}
+
+// TeamRouteLabel is the alert label matched by the notification policy
+// routes AssignContactPoint manages; alerts labelled team=<team name> are
+// delivered to the team's contact point.
+const TeamRouteLabel = "team"
+
+// orgIDHeader selects the org a request operates on. Requests carrying it are
+// authenticated with that org's token from GRAFANA_ORG_TOKENS when one is set.
+const orgIDHeader = "X-Grafana-Org-Id"
+
+// disableProvenanceHeader asks Grafana to accept a change to a provisioned
+// resource as a manual override.
+const disableProvenanceHeader = "X-Disable-Provenance"
+
+// TransportOptions tunes the HTTP connection pools used to talk to Grafana.
+// Reads (GET/HEAD) and writes use separate clients: reads are pooled up to
+// MaxConnsPerHost, while writes are serialised over a single connection to
+// avoid Grafana's internal races on concurrent team membership changes.
+type TransportOptions struct {
+	MaxIdleConns    int
+	MaxConnsPerHost int
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+
+	// ClientCertificates are presented to Grafana for mutual TLS and RootCAs,
+	// when set, replaces the system pool for verifying Grafana's certificate.
+	ClientCertificates []tls.Certificate
+	RootCAs            *x509.CertPool
+
+	// Proxy, when non-nil, replaces the proxy selection from the process
+	// environment.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// SkipVerifyHosts are hostname patterns such as "*.dev.internal" whose
+	// certificates are not verified. Other hosts are verified as usual.
+	SkipVerifyHosts []string
+}
+
+// LoadTLSFiles reads the mTLS client certificate/key pair and the optional
+// private CA bundle into opts. Empty paths are skipped.
+func (o *TransportOptions) LoadTLSFiles(certFile, keyFile, caFile string) error {
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return errors.New("both client certificate and key files are required")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("load client certificate: %w", err)
+		}
+		o.ClientCertificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("CA file %s contains no PEM certificates", caFile)
+		}
+		o.RootCAs = pool
+	}
+	return nil
+}
+
+// New creates a Grafana client. apiPathPrefix is appended to baseURL for
+// every API call (normally "/api").
+func New(baseURL, apiPathPrefix, adminUser, adminPassword, adminToken string, orgTokens map[int64]string, insecureTLS, debug bool, opts TransportOptions) *Client {
+	if opts.ReadTimeout <= 0 {
+		opts.ReadTimeout = 30 * time.Second
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = 30 * time.Second
+	}
+	host := ""
+	if u, err := url.Parse(baseURL); err == nil {
+		host = u.Hostname()
+	}
+	readTransport := newTransport(insecureTLS, opts, host)
+	if opts.MaxIdleConns > 0 {
+		readTransport.MaxIdleConns = opts.MaxIdleConns
+		readTransport.MaxIdleConnsPerHost = opts.MaxIdleConns
 	}
+	if opts.MaxConnsPerHost > 0 {
+		readTransport.MaxConnsPerHost = opts.MaxConnsPerHost
+	}
+	writeTransport := newTransport(insecureTLS, opts, host)
+	writeTransport.MaxIdleConns = 1
+	writeTransport.MaxIdleConnsPerHost = 1
+	writeTransport.MaxConnsPerHost = 1
 	return &Client{
 		baseURL:       strings.TrimRight(baseURL, "/"),
+		apiBase:       strings.TrimRight(baseURL, "/") + strings.TrimRight(apiPathPrefix, "/"),
 		adminUser:     adminUser,
 		adminPassword: adminPassword,
 		adminToken:    adminToken,
-		httpClient:    &http.Client{Timeout: 30 * time.Second, Transport: transport},
+		orgTokens:     orgTokens,
+		readClient:    &http.Client{Timeout: opts.ReadTimeout, Transport: readTransport},
+		writeClient:   &http.Client{Timeout: opts.WriteTimeout, Transport: writeTransport},
 		debug:         debug,
+		userPageSize:  DefaultUserPageSize,
+		latency:       metrics.NewLatency(),
+	}
+}
+
+// DefaultUserPageSize is the page size used to list org users and team
+// members unless SetUserPageSize changes it.
+const DefaultUserPageSize = 500
+
+// orgPageSize is the page size used to list orgs, Grafana's own default for
+// the org search.
+const orgPageSize = 1000
+
+// SetExtraHeaders adds headers, e.g. for an API gateway in front of
+// Grafana, to every request. Per-request headers such as X-Grafana-Org-Id
+// take precedence.
+func (c *Client) SetExtraHeaders(headers map[string]string) {
+	c.extraHeaders = headers
+}
+
+// ExtraHeaderCount returns how many extra headers are configured; their
+// values are never logged.
+func (c *Client) ExtraHeaderCount() int {
+	return len(c.extraHeaders)
+}
+
+// SetDisableProvenance makes write requests carry X-Disable-Provenance, so
+// Grafana accepts changes to resources created through provisioning.
+func (c *Client) SetDisableProvenance(disable bool) {
+	c.noProvenance = disable
+}
+
+// DisableProvenance reports whether write requests skip provenance checks.
+func (c *Client) DisableProvenance() bool {
+	return c.noProvenance
+}
+
+// SetUserPageSize sets how many org users or team members are requested per
+// page. Values below 1 restore DefaultUserPageSize.
+func (c *Client) SetUserPageSize(perPage int) {
+	if perPage < 1 {
+		perPage = DefaultUserPageSize
+	}
+	c.userPageSize = perPage
+}
+
+// newTransport builds a transport for Grafana. host is the Grafana hostname,
+// used to match SkipVerifyHosts when TLS carries no server name (IP hosts).
+func newTransport(insecureTLS bool, opts TransportOptions, host string) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.Proxy != nil {
+		transport.Proxy = opts.Proxy
+	}
+	if insecureTLS || len(opts.ClientCertificates) > 0 || opts.RootCAs != nil || len(opts.SkipVerifyHosts) > 0 {
+		transport.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: insecureTLS,
+			Certificates:       opts.ClientCertificates,
+			RootCAs:            opts.RootCAs,
+		}
+		if !insecureTLS && len(opts.SkipVerifyHosts) > 0 {
+			// Go's built-in verification cannot be skipped per host, so turn it
+			// off and verify in VerifyConnection for hosts not on the list.
+			transport.TLSClientConfig.InsecureSkipVerify = true
+			transport.TLSClientConfig.VerifyConnection = verifyUnlessSkipped(opts.SkipVerifyHosts, opts.RootCAs, host)
+		}
+	}
+	return transport
+}
+
+// hostMatches reports whether host matches one of the patterns. Patterns use
+// path.Match syntax, so "*.dev.internal" matches "grafana.dev.internal".
+func hostMatches(host string, patterns []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if ok, err := path.Match(pattern, host); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+func verifyUnlessSkipped(patterns []string, roots *x509.CertPool, fallbackHost string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		host := cs.ServerName
+		if host == "" {
+			host = fallbackHost
+		}
+		if hostMatches(host, patterns) {
+			return nil
+		}
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("grafana: server presented no certificate")
+		}
+		opts := x509.VerifyOptions{
+			DNSName:       host,
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := cs.PeerCertificates[0].Verify(opts)
+		return err
 	}
 }
 
@@ -116,7 +448,7 @@ type ProbeResult struct {
 }
 
 // Probe performs DNS resolution, TCP connect, TLS handshake (if HTTPS) and a
-// GET /api/health on the configured base URL. It is meant for one-shot
+// GET <prefix>/health on the configured base URL. It is meant for one-shot
 // diagnostics from startup or from an admin endpoint.
 func (c *Client) Probe(ctx context.Context) ProbeResult {
 	res := ProbeResult{URL: c.baseURL}
@@ -163,10 +495,11 @@ func (c *Client) Probe(ctx context.Context) ProbeResult {
 	res.TCPAddr = conn.RemoteAddr().String()
 
 	if u.Scheme == "https" {
-		tlsCfg := &tls.Config{ServerName: host}
-		if t, ok := c.httpClient.Transport.(*http.Transport); ok && t.TLSClientConfig != nil {
-			tlsCfg.InsecureSkipVerify = t.TLSClientConfig.InsecureSkipVerify
+		tlsCfg := &tls.Config{}
+		if t, ok := c.readClient.Transport.(*http.Transport); ok && t.TLSClientConfig != nil {
+			tlsCfg = t.TLSClientConfig.Clone()
 		}
+		tlsCfg.ServerName = host
 		tlsConn := tls.Client(conn, tlsCfg)
 		hsCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
 		defer cancel()
@@ -186,7 +519,7 @@ func (c *Client) Probe(ctx context.Context) ProbeResult {
 		_ = conn.Close()
 	}
 
-	healthURL := c.baseURL + "/api/health"
+	healthURL := c.apiBase + "/health"
 	req, err := http.NewRequestWithContext(ctx, "GET", healthURL, nil)
 	if err != nil {
 		res.HealthErr = "build request: " + err.Error()
@@ -194,7 +527,7 @@ func (c *Client) Probe(ctx context.Context) ProbeResult {
 	}
 	req.Header.Set("Accept", "application/json")
 	healthStart := time.Now()
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.readClient.Do(req)
 	res.HealthTook = time.Since(healthStart)
 	if err != nil {
 		res.HealthErr = err.Error()
@@ -228,10 +561,10 @@ func (c *Client) LogProbe(res ProbeResult) {
 		log.Printf("grafana probe: tls ok took=%s version=%s cipher=%s", res.TLSTook, res.TLSVersion, res.TLSCipher)
 	}
 	if res.HealthErr != "" {
-		log.Printf("grafana probe: GET /api/health FAILED took=%s err=%s", res.HealthTook, res.HealthErr)
+		log.Printf("grafana probe: GET %s FAILED took=%s err=%s", c.apiBase+"/health", res.HealthTook, res.HealthErr)
 		return
 	}
-	log.Printf("grafana probe: GET /api/health ok took=%s status=%d body=%q", res.HealthTook, res.HealthStatus, res.HealthBody)
+	log.Printf("grafana probe: GET %s ok took=%s status=%d body=%q", c.apiBase+"/health", res.HealthTook, res.HealthStatus, res.HealthBody)
 }
 
 func tlsVersionName(v uint16) string {
@@ -249,25 +582,118 @@ func tlsVersionName(v uint16) string {
 	}
 }
 
+// Latency returns the durations of recent Grafana requests.
+func (c *Client) Latency() *metrics.Latency {
+	return c.latency
+}
+
 func (c *Client) LastOK() time.Time {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	return c.lastOK
 }
 
+// LastError returns the most recent failed Grafana request, or nil. 404
+// responses are not recorded since Grafana was reachable.
+func (c *Client) LastError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastErr
+}
+
+// LastErrorAt returns when LastError happened.
+func (c *Client) LastErrorAt() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastErrAt
+}
+
+// RestoreStatus seeds LastOK, LastError and LastErrorAt with values saved
+// before a restart. An empty lastErr leaves LastError nil.
+func (c *Client) RestoreStatus(lastOK time.Time, lastErr string, lastErrAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastOK = lastOK
+	c.lastErr = nil
+	if lastErr != "" {
+		c.lastErr = errors.New(lastErr)
+	}
+	c.lastErrAt = lastErrAt
+}
+
+func (c *Client) recordError(err error) error {
+	c.mu.Lock()
+	c.lastErr = err
+	c.lastErrAt = time.Now().UTC()
+	c.mu.Unlock()
+	return err
+}
+
+// flightKey identifies a deduplicated request: base names the call and its
+// arguments, and the per-request headers are appended in sorted order so
+// requests sent with different orgs or tokens never share a result.
+func flightKey(base string, headers map[string]string) string {
+	if len(headers) == 0 {
+		return base
+	}
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(base)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "\x00%s=%s", http.CanonicalHeaderKey(key), headers[key])
+	}
+	return b.String()
+}
+
+// lookupResult is the shared result of a deduplicated LookupUser call.
+type lookupResult struct {
+	user  User
+	found bool
+}
+
+// LookupUser finds a user by login or email. Concurrent lookups of the same
+// value share one request.
 func (c *Client) LookupUser(loginOrEmail string) (*User, bool, error) {
-	endpoint := c.baseURL + "/api/users/lookup?loginOrEmail=" + url.QueryEscape(loginOrEmail)
-	var user User
-	status, err := c.doJSON("GET", endpoint, nil, &user)
-	if err != nil {
-		if status == http.StatusNotFound {
-			return nil, false, nil
+	val, err, _ := c.flights.Do(flightKey("lookup:"+loginOrEmail, nil), func() (any, error) {
+		endpoint := c.apiBase + "/users/lookup?loginOrEmail=" + url.QueryEscape(loginOrEmail)
+		var user User
+		status, err := c.doJSON("GET", endpoint, nil, &user)
+		if err != nil {
+			if status == http.StatusNotFound {
+				return lookupResult{}, nil
+			}
+			return nil, err
 		}
+		return lookupResult{user: user, found: true}, nil
+	})
+	if err != nil {
 		return nil, false, err
 	}
+	result := val.(lookupResult)
+	if !result.found {
+		return nil, false, nil
+	}
+	user := result.user
 	return &user, true, nil
 }
 
+// LookupUserByLogin is LookupUser restricted to an exact login match, so an
+// email that happens to equal another user's login is not returned.
+func (c *Client) LookupUserByLogin(login string) (*User, bool, error) {
+	user, found, err := c.LookupUser(login)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	if !strings.EqualFold(user.Login, login) {
+		return nil, false, nil
+	}
+	return user, true, nil
+}
+
 func (c *Client) CreateUser(email, login, name, password string) (*User, error) {
 	payload := map[string]string{
 		"name":     name,
@@ -275,7 +701,7 @@ func (c *Client) CreateUser(email, login, name, password string) (*User, error)
 		"login":    login,
 		"password": password,
 	}
-	endpoint := c.baseURL + "/api/admin/users"
+	endpoint := c.apiBase + "/admin/users"
 	var resp struct {
 		ID int64 `json:"id"`
 	}
@@ -285,13 +711,157 @@ func (c *Client) CreateUser(email, login, name, password string) (*User, error)
 	return &User{ID: resp.ID, Name: name, Login: login, Email: email}, nil
 }
 
+// UpdateUserProfile sets the name, email and login of a user. All three are
+// sent, so pass the current login to keep it.
+func (c *Client) UpdateUserProfile(userID int64, name, email, login string) error {
+	payload := map[string]string{
+		"name":  name,
+		"email": email,
+		"login": login,
+	}
+	endpoint := fmt.Sprintf("%s/users/%d", c.apiBase, userID)
+	_, err := c.doJSON("PUT", endpoint, payload, nil)
+	return err
+}
+
+// ListAdminOrgs lists every Grafana org. It needs server admin credentials.
+func (c *Client) ListAdminOrgs() ([]Org, error) {
+	var orgs []Org
+	for page := 1; ; page++ {
+		endpoint := fmt.Sprintf("%s/orgs?page=%d&perpage=%d", c.apiBase, page, orgPageSize)
+		var batch []Org
+		if _, err := c.doJSON("GET", endpoint, nil, &batch); err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, batch...)
+		if lastPage(len(batch), orgPageSize) {
+			return orgs, nil
+		}
+	}
+}
+
+// CreateOrg creates a Grafana org and returns its id.
+func (c *Client) CreateOrg(name string) (int64, error) {
+	endpoint := c.apiBase + "/orgs"
+	var resp struct {
+		OrgID int64 `json:"orgId"`
+	}
+	if _, err := c.doJSON("POST", endpoint, map[string]string{"name": name}, &resp); err != nil {
+		return 0, err
+	}
+	return resp.OrgID, nil
+}
+
+// AuthSettings is the part of Grafana's server settings the syncer checks
+// for conflicting team membership management.
+type AuthSettings struct {
+	SAMLEnabled bool
+	// SAMLTeamSync is set when SAML logins also sync team membership:
+	// group_sync is on or a groups assertion attribute is configured.
+	SAMLTeamSync bool
+	// OAuthAutoLogin is set when the login page redirects straight to an
+	// OAuth provider: [auth] oauth_auto_login or an enabled provider's
+	// auto_login. Users then can't sign in with a local password.
+	OAuthAutoLogin bool
+}
+
+// GetAuthSettings reads the auth settings from GET /api/admin/settings,
+// which needs server admin credentials.
+func (c *Client) GetAuthSettings() (*AuthSettings, error) {
+	endpoint := c.apiBase + "/admin/settings"
+	var sections map[string]map[string]string
+	if _, err := c.doJSON("GET", endpoint, nil, &sections); err != nil {
+		return nil, err
+	}
+	saml := sections["auth.saml"]
+	settings := &AuthSettings{
+		SAMLEnabled: strings.EqualFold(saml["enabled"], "true"),
+	}
+	settings.SAMLTeamSync = settings.SAMLEnabled && (strings.EqualFold(saml["group_sync"], "true") || strings.TrimSpace(saml["assertion_attribute_groups"]) != "")
+	settings.OAuthAutoLogin = strings.EqualFold(sections["auth"]["oauth_auto_login"], "true")
+	for name, section := range sections {
+		if strings.HasPrefix(name, "auth.") && strings.EqualFold(section["enabled"], "true") && strings.EqualFold(section["auto_login"], "true") {
+			settings.OAuthAutoLogin = true
+		}
+	}
+	return settings, nil
+}
+
+// OrgInvite is a pending invitation to a Grafana org.
+type OrgInvite struct {
+	Email string `json:"email"`
+	Name  string `json:"name"`
+	Role  string `json:"role"`
+	Code  string `json:"code"`
+}
+
+// inviteUser invites email to the org with role via POST /api/org/invites
+// and returns the invite code, looked up in the org's pending invites.
+func (c *Client) inviteUser(email, name, role string, headers map[string]string) (string, error) {
+	payload := map[string]any{
+		"loginOrEmail": email,
+		"name":         name,
+		"role":         role,
+		"sendEmail":    true,
+	}
+	if _, err := c.doJSONWithHeaders("POST", c.apiBase+"/org/invites", headers, payload, nil); err != nil {
+		return "", err
+	}
+	var invites []OrgInvite
+	if _, err := c.doJSONWithHeaders("GET", c.apiBase+"/org/invites", headers, nil, &invites); err != nil {
+		return "", err
+	}
+	for _, invite := range invites {
+		if strings.EqualFold(invite.Email, email) {
+			return invite.Code, nil
+		}
+	}
+	// Grafana adds existing users to the org directly instead of inviting.
+	return "", nil
+}
+
+// DisableUser disables the account server-wide; the user keeps their org and
+// team memberships but can no longer sign in.
+func (c *Client) DisableUser(userID int64) error {
+	endpoint := fmt.Sprintf("%s/admin/users/%d/disable", c.apiBase, userID)
+	_, err := c.doJSON("POST", endpoint, nil, nil)
+	return err
+}
+
+// Ping checks that Grafana is reachable and accepts the configured
+// credentials by reading the current org.
+func (c *Client) Ping() error {
+	_, err := c.doJSON("GET", c.apiBase+"/org", nil, nil)
+	return err
+}
+
+// IsUserActive reports whether the user's account is enabled.
+func (c *Client) IsUserActive(userID int64) (bool, error) {
+	endpoint := fmt.Sprintf("%s/users/%d", c.apiBase, userID)
+	var user User
+	if _, err := c.doJSON("GET", endpoint, nil, &user); err != nil {
+		return false, err
+	}
+	return !user.IsDisabled, nil
+}
+
+func (c *Client) EnableUser(userID int64) error {
+	endpoint := fmt.Sprintf("%s/admin/users/%d/enable", c.apiBase, userID)
+	_, err := c.doJSON("POST", endpoint, nil, nil)
+	return err
+}
+
 func (c *Client) AddUserToOrg(orgID int64, loginOrEmail, role string) error {
+	return c.addUserToOrg(orgID, loginOrEmail, role, nil)
+}
+
+func (c *Client) addUserToOrg(orgID int64, loginOrEmail, role string, headers map[string]string) error {
 	payload := map[string]string{
 		"loginOrEmail": loginOrEmail,
 		"role":         role,
 	}
-	endpoint := fmt.Sprintf("%s/api/orgs/%d/users", c.baseURL, orgID)
-	status, err := c.doJSON("POST", endpoint, payload, nil)
+	endpoint := fmt.Sprintf("%s/orgs/%d/users", c.apiBase, orgID)
+	status, err := c.doJSONWithHeaders("POST", endpoint, headers, payload, nil)
 	if err != nil && status != http.StatusConflict {
 		return err
 	}
@@ -299,9 +869,13 @@ func (c *Client) AddUserToOrg(orgID int64, loginOrEmail, role string) error {
 }
 
 func (c *Client) UpdateUserRole(orgID, userID int64, role string) error {
+	return c.updateUserRole(orgID, userID, role, nil)
+}
+
+func (c *Client) updateUserRole(orgID, userID int64, role string, headers map[string]string) error {
 	payload := map[string]string{"role": role}
-	endpoint := fmt.Sprintf("%s/api/orgs/%d/users/%d", c.baseURL, orgID, userID)
-	status, err := c.doJSON("PATCH", endpoint, payload, nil)
+	endpoint := fmt.Sprintf("%s/orgs/%d/users/%d", c.apiBase, orgID, userID)
+	status, err := c.doJSONWithHeaders("PATCH", endpoint, headers, payload, nil)
 	if err != nil && status != http.StatusNotFound {
 		return err
 	}
@@ -309,11 +883,15 @@ func (c *Client) UpdateUserRole(orgID, userID int64, role string) error {
 }
 
 func (c *Client) EnsureTeam(orgID int64, name string) (int64, error) {
-	if id, found, err := c.SearchTeam(orgID, name); err == nil && found {
+	return c.ensureTeam(orgID, name, nil)
+}
+
+func (c *Client) ensureTeam(orgID int64, name string, headers map[string]string) (int64, error) {
+	if id, found, err := c.searchTeam(orgID, name, headers); err == nil && found {
 		return id, nil
 	}
 
-	createEndpoint := c.baseURL + "/api/teams"
+	createEndpoint := c.apiBase + "/teams"
 	payload := map[string]any{
 		"name":  name,
 		"orgId": orgID,
@@ -321,7 +899,7 @@ func (c *Client) EnsureTeam(orgID int64, name string) (int64, error) {
 	var createResp struct {
 		TeamID int64 `json:"teamId"`
 	}
-	if _, err := c.doJSON("POST", createEndpoint, payload, &createResp); err != nil {
+	if _, err := c.doJSONWithHeaders("POST", createEndpoint, headers, payload, &createResp); err != nil {
 		return 0, err
 	}
 	if createResp.TeamID == 0 {
@@ -331,108 +909,782 @@ func (c *Client) EnsureTeam(orgID int64, name string) (int64, error) {
 }
 
 func (c *Client) SearchTeam(orgID int64, name string) (int64, bool, error) {
-	searchEndpoint := fmt.Sprintf("%s/api/teams/search?name=%s&orgId=%d", c.baseURL, url.QueryEscape(name), orgID)
-	var searchResp struct {
-		Teams []Team `json:"teams"`
-	}
-	if _, err := c.doJSON("GET", searchEndpoint, nil, &searchResp); err != nil {
-		return 0, false, err
-	}
-	for _, t := range searchResp.Teams {
-		if strings.EqualFold(t.Name, name) {
-			return t.ID, true, nil
-		}
-	}
-	return 0, false, nil
-}
-
-func (c *Client) ListTeamMembers(teamID int64) ([]TeamMember, error) {
-	endpoint := fmt.Sprintf("%s/api/teams/%d/members", c.baseURL, teamID)
-	var members []TeamMember
-	if _, err := c.doJSON("GET", endpoint, nil, &members); err != nil {
-		return nil, err
-	}
-	return members, nil
+	return c.searchTeam(orgID, name, nil)
 }
 
-func (c *Client) ListTeams(orgID int64) ([]Team, error) {
-	var teams []Team
-	page := 1
-	for {
-		endpoint := fmt.Sprintf("%s/api/teams/search?orgId=%d&page=%d&perpage=500", c.baseURL, orgID, page)
-		var resp struct {
+// searchTeam returns the ID of the team with the given name, compared
+// case-insensitively. Concurrent searches for the same org and name share
+// one request.
+func (c *Client) searchTeam(orgID int64, name string, headers map[string]string) (int64, bool, error) {
+	val, err, _ := c.flights.Do(flightKey(fmt.Sprintf("team:%d:%s", orgID, name), headers), func() (any, error) {
+		searchEndpoint := fmt.Sprintf("%s/teams/search?name=%s&orgId=%d", c.apiBase, url.QueryEscape(name), orgID)
+		var searchResp struct {
 			Teams []Team `json:"teams"`
 		}
-		if _, err := c.doJSON("GET", endpoint, nil, &resp); err != nil {
+		if _, err := c.doJSONWithHeaders("GET", searchEndpoint, headers, nil, &searchResp); err != nil {
 			return nil, err
 		}
-		if len(resp.Teams) == 0 {
-			break
+		for _, t := range searchResp.Teams {
+			if strings.EqualFold(t.Name, name) {
+				return t.ID, nil
+			}
 		}
-		teams = append(teams, resp.Teams...)
-		page++
+		return int64(0), nil
+	})
+	if err != nil {
+		return 0, false, err
 	}
-	return teams, nil
+	id := val.(int64)
+	return id, id != 0, nil
 }
 
-func (c *Client) ListAdminUsers() ([]User, error) {
-	var users []User
-	page := 1
-	for {
-		endpoint := fmt.Sprintf("%s/api/admin/users?page=%d&perpage=1000", c.baseURL, page)
-		var resp []User
-		if _, err := c.doJSON("GET", endpoint, nil, &resp); err != nil {
+func (c *Client) ListTeamMembers(teamID int64) ([]TeamMember, error) {
+	return c.listTeamMembers(teamID, nil)
+}
+
+func (c *Client) listTeamMembers(teamID int64, headers map[string]string) ([]TeamMember, error) {
+	var members []TeamMember
+	for page := 1; ; page++ {
+		endpoint := fmt.Sprintf("%s/teams/%d/members?page=%d&perPage=%d", c.apiBase, teamID, page, c.userPageSize)
+		var batch []TeamMember
+		if _, err := c.doJSONWithHeaders("GET", endpoint, headers, nil, &batch); err != nil {
 			return nil, err
 		}
-		if len(resp) == 0 {
-			break
+		members = append(members, batch...)
+		if lastPage(len(batch), c.userPageSize) {
+			return members, nil
 		}
-		users = append(users, resp...)
-		page++
 	}
-	return users, nil
 }
 
-func (c *Client) ListOrgUsers(orgID int64) ([]OrgUser, error) {
-	endpoint := fmt.Sprintf("%s/api/orgs/%d/users", c.baseURL, orgID)
-	var users []OrgUser
-	if _, err := c.doJSON("GET", endpoint, nil, &users); err != nil {
-		return nil, err
-	}
-	return users, nil
+// lastPage reports whether a page of n results ends a paginated listing. A
+// short page is the last one. A page larger than perPage means the Grafana
+// version ignores pagination and already returned everything.
+func lastPage(n, perPage int) bool {
+	return n == 0 || n != perPage
 }
 
-func (c *Client) ListFolders(orgID int64) ([]Folder, error) {
-	endpoint := fmt.Sprintf("%s/api/folders", c.baseURL)
-	var folders []Folder
-	headers := map[string]string{
-		"X-Grafana-Org-Id": strconv.FormatInt(orgID, 10),
-	}
-	if _, err := c.doJSONWithHeaders("GET", endpoint, headers, nil, &folders); err != nil {
-		return nil, err
-	}
-	return folders, nil
+func (c *Client) GetTeam(teamID int64) (*Team, error) {
+	return c.getTeam(teamID, nil)
 }
 
-func (c *Client) ListFolderPermissions(orgID int64, folderUID string) ([]FolderPermission, error) {
-	endpoint := fmt.Sprintf("%s/api/folders/%s/permissions", c.baseURL, url.PathEscape(folderUID))
-	var perms []FolderPermission
-	headers := map[string]string{
-		"X-Grafana-Org-Id": strconv.FormatInt(orgID, 10),
-	}
-	if _, err := c.doJSONWithHeaders("GET", endpoint, headers, nil, &perms); err != nil {
+func (c *Client) getTeam(teamID int64, headers map[string]string) (*Team, error) {
+	endpoint := fmt.Sprintf("%s/teams/%d", c.apiBase, teamID)
+	var team Team
+	if _, err := c.doJSONWithHeaders("GET", endpoint, headers, nil, &team); err != nil {
 		return nil, err
 	}
-	return perms, nil
+	return &team, nil
+}
+
+// TeamExists reports whether a team with this ID exists; a 404 is not an
+// error.
+func (c *Client) TeamExists(teamID int64) (bool, error) {
+	return c.teamExists(teamID, nil)
+}
+
+func (c *Client) teamExists(teamID int64, headers map[string]string) (bool, error) {
+	endpoint := fmt.Sprintf("%s/teams/%d", c.apiBase, teamID)
+	status, err := c.doJSONWithHeaders("GET", endpoint, headers, nil, nil)
+	if status == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// UpdateTeam sets a team's name and description and keeps its email, which
+// Grafana would otherwise clear.
+func (c *Client) UpdateTeam(teamID int64, name, description string) error {
+	return c.updateTeam(teamID, name, description, nil)
+}
+
+func (c *Client) updateTeam(teamID int64, name, description string, headers map[string]string) error {
+	team, err := c.getTeam(teamID, headers)
+	if err != nil {
+		return err
+	}
+	payload := map[string]string{
+		"name":        name,
+		"email":       team.Email,
+		"description": description,
+	}
+	endpoint := fmt.Sprintf("%s/teams/%d", c.apiBase, teamID)
+	_, err = c.doJSONWithHeaders("PUT", endpoint, headers, payload, nil)
+	return err
+}
+
+// SetTeamEmail sets a team's contact email and keeps its name and
+// description.
+func (c *Client) SetTeamEmail(teamID int64, email string) error {
+	return c.setTeamEmail(teamID, email, nil)
+}
+
+func (c *Client) setTeamEmail(teamID int64, email string, headers map[string]string) error {
+	team, err := c.getTeam(teamID, headers)
+	if err != nil {
+		return err
+	}
+	payload := map[string]string{
+		"name":        team.Name,
+		"email":       email,
+		"description": team.Description,
+	}
+	endpoint := fmt.Sprintf("%s/teams/%d", c.apiBase, teamID)
+	_, err = c.doJSONWithHeaders("PUT", endpoint, headers, payload, nil)
+	return err
+}
+
+func (c *Client) GetTeamPreferences(teamID int64) (*TeamPreferences, error) {
+	return c.getTeamPreferences(teamID, nil)
+}
+
+func (c *Client) getTeamPreferences(teamID int64, headers map[string]string) (*TeamPreferences, error) {
+	endpoint := fmt.Sprintf("%s/teams/%d/preferences", c.apiBase, teamID)
+	var prefs TeamPreferences
+	if _, err := c.doJSONWithHeaders("GET", endpoint, headers, nil, &prefs); err != nil {
+		return nil, err
+	}
+	return &prefs, nil
+}
+
+// UpdateTeamPreferences replaces the team's preferences; fields left empty
+// are reset to the defaults.
+func (c *Client) UpdateTeamPreferences(teamID int64, prefs TeamPreferences) error {
+	return c.updateTeamPreferences(teamID, prefs, nil)
+}
+
+func (c *Client) updateTeamPreferences(teamID int64, prefs TeamPreferences, headers map[string]string) error {
+	endpoint := fmt.Sprintf("%s/teams/%d/preferences", c.apiBase, teamID)
+	_, err := c.doJSONWithHeaders("PUT", endpoint, headers, prefs, nil)
+	return err
+}
+
+// UpdateTeamAvatar sets a team's avatar URL and keeps its name, email and
+// description.
+func (c *Client) UpdateTeamAvatar(orgID, teamID int64, avatarURL string) error {
+	headers := map[string]string{
+		orgIDHeader: strconv.FormatInt(orgID, 10),
+	}
+	team, err := c.getTeam(teamID, headers)
+	if err != nil {
+		return err
+	}
+	payload := map[string]string{
+		"name":        team.Name,
+		"email":       team.Email,
+		"description": team.Description,
+		"avatarUrl":   avatarURL,
+	}
+	endpoint := fmt.Sprintf("%s/teams/%d", c.apiBase, teamID)
+	_, err = c.doJSONWithHeaders("PUT", endpoint, headers, payload, nil)
+	return err
+}
+
+// RenameTeam changes a team's name and keeps its email and description.
+func (c *Client) RenameTeam(teamID int64, newName string) error {
+	return c.renameTeam(teamID, newName, nil)
+}
+
+func (c *Client) renameTeam(teamID int64, newName string, headers map[string]string) error {
+	team, err := c.getTeam(teamID, headers)
+	if err != nil {
+		return err
+	}
+	payload := map[string]string{
+		"name":        newName,
+		"email":       team.Email,
+		"description": team.Description,
+	}
+	endpoint := fmt.Sprintf("%s/teams/%d", c.apiBase, teamID)
+	_, err = c.doJSONWithHeaders("PUT", endpoint, headers, payload, nil)
+	return err
+}
+
+func (c *Client) ListTeams(orgID int64) ([]Team, error) {
+	return c.listTeams(orgID, nil)
+}
+
+func (c *Client) listTeams(orgID int64, headers map[string]string) ([]Team, error) {
+	var teams []Team
+	page := 1
+	for {
+		endpoint := fmt.Sprintf("%s/teams/search?orgId=%d&page=%d&perpage=500", c.apiBase, orgID, page)
+		var resp struct {
+			Teams []Team `json:"teams"`
+		}
+		if _, err := c.doJSONWithHeaders("GET", endpoint, headers, nil, &resp); err != nil {
+			return nil, err
+		}
+		if len(resp.Teams) == 0 {
+			break
+		}
+		teams = append(teams, resp.Teams...)
+		page++
+	}
+	return teams, nil
+}
+
+// GetTeamMemberCounts returns the member count of every team in the org,
+// keyed by team ID. The counts come from the team search results, so this
+// costs one request per 500 teams; see TeamMemberCounts for the fallback.
+func (c *Client) GetTeamMemberCounts(orgID int64) (map[int64]int, error) {
+	teams, err := c.listTeams(orgID, map[string]string{
+		orgIDHeader: strconv.FormatInt(orgID, 10),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.TeamMemberCounts(orgID, teams)
+}
+
+// TeamMemberCounts returns the member counts of teams already fetched with
+// ListTeams, keyed by team ID. Only teams whose search entry lacks
+// memberCount (older Grafana versions) cost a member list request. Teams
+// whose members can't be listed are left out of the map and the first such
+// error is returned with the counts that are known.
+func (c *Client) TeamMemberCounts(orgID int64, teams []Team) (map[int64]int, error) {
+	headers := map[string]string{
+		orgIDHeader: strconv.FormatInt(orgID, 10),
+	}
+	counts := make(map[int64]int, len(teams))
+	var firstErr error
+	for _, team := range teams {
+		if team.MemberCount != nil {
+			counts[team.ID] = *team.MemberCount
+			continue
+		}
+		members, err := c.listTeamMembers(team.ID, headers)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("team %d members: %w", team.ID, err)
+			}
+			continue
+		}
+		counts[team.ID] = len(members)
+	}
+	return counts, firstErr
+}
+
+func (c *Client) ListAdminUsers() ([]User, error) {
+	var users []User
+	page := 1
+	for {
+		endpoint := fmt.Sprintf("%s/admin/users?page=%d&perpage=1000", c.apiBase, page)
+		var resp []User
+		if _, err := c.doJSON("GET", endpoint, nil, &resp); err != nil {
+			return nil, err
+		}
+		if len(resp) == 0 {
+			break
+		}
+		users = append(users, resp...)
+		page++
+	}
+	return users, nil
+}
+
+func (c *Client) ListOrgUsers(orgID int64) ([]OrgUser, error) {
+	return c.listOrgUsers(orgID, nil)
+}
+
+// listOrgUsers returns every user of the org. Concurrent listings of the
+// same org share one set of requests; each caller gets its own copy.
+func (c *Client) listOrgUsers(orgID int64, headers map[string]string) ([]OrgUser, error) {
+	val, err, _ := c.flights.Do(flightKey(fmt.Sprintf("orgusers:%d", orgID), headers), func() (any, error) {
+		var users []OrgUser
+		for page := 1; ; page++ {
+			endpoint := fmt.Sprintf("%s/orgs/%d/users?page=%d&perPage=%d", c.apiBase, orgID, page, c.userPageSize)
+			var batch []OrgUser
+			if _, err := c.doJSONWithHeaders("GET", endpoint, headers, nil, &batch); err != nil {
+				return nil, err
+			}
+			users = append(users, batch...)
+			if lastPage(len(batch), c.userPageSize) {
+				return users, nil
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]OrgUser(nil), val.([]OrgUser)...), nil
+}
+
+func (c *Client) ListFolders(orgID int64) ([]Folder, error) {
+	return c.listFolders(orgID, "")
+}
+
+func (c *Client) listFolders(orgID int64, parentUID string) ([]Folder, error) {
+	endpoint := fmt.Sprintf("%s/folders", c.apiBase)
+	if parentUID != "" {
+		endpoint += "?parentUid=" + url.QueryEscape(parentUID)
+	}
+	var folders []Folder
+	headers := map[string]string{
+		orgIDHeader: strconv.FormatInt(orgID, 10),
+	}
+	if _, err := c.doJSONWithHeaders("GET", endpoint, headers, nil, &folders); err != nil {
+		return nil, err
+	}
+	return folders, nil
+}
+
+func (c *Client) ListFolderPermissions(orgID int64, folderUID string) ([]FolderPermission, error) {
+	endpoint := fmt.Sprintf("%s/folders/%s/permissions", c.apiBase, url.PathEscape(folderUID))
+	var perms []FolderPermission
+	headers := map[string]string{
+		orgIDHeader: strconv.FormatInt(orgID, 10),
+	}
+	if _, err := c.doJSONWithHeaders("GET", endpoint, headers, nil, &perms); err != nil {
+		return nil, err
+	}
+	return perms, nil
+}
+
+// CreateFolder creates a folder in the org, nested under parentUID when it
+// is non-empty. Nested folders require Grafana 10 or newer.
+func (c *Client) CreateFolder(orgID int64, title, parentUID string) (*Folder, error) {
+	endpoint := fmt.Sprintf("%s/folders", c.apiBase)
+	payload := map[string]string{"title": title}
+	if parentUID != "" {
+		payload["parentUid"] = parentUID
+	}
+	headers := map[string]string{
+		orgIDHeader: strconv.FormatInt(orgID, 10),
+	}
+	var folder Folder
+	if _, err := c.doJSONWithHeaders("POST", endpoint, headers, payload, &folder); err != nil {
+		return nil, err
+	}
+	return &folder, nil
+}
+
+// FindFolder looks for a folder with this exact title directly under
+// parentUID, or at the top level when parentUID is empty.
+func (c *Client) FindFolder(orgID int64, title, parentUID string) (*Folder, bool, error) {
+	folders, err := c.listFolders(orgID, parentUID)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, folder := range folders {
+		if folder.Title == title {
+			return &folder, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// ParseFolderPermission converts View, Edit or Admin (any case) to Grafana's
+// folder permission value 1, 2 or 4.
+func ParseFolderPermission(level string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "view":
+		return 1, nil
+	case "edit":
+		return 2, nil
+	case "admin":
+		return 4, nil
+	default:
+		return 0, fmt.Errorf("folder permission must be View, Edit or Admin, got %q", level)
+	}
+}
+
+// RestrictFolderToTeam replaces the folder's permissions with a single
+// entry granting the team the given permission (1 view, 2 edit, 4 admin).
+// Org roles lose their default access; Grafana admins keep theirs.
+func (c *Client) RestrictFolderToTeam(orgID int64, folderUID string, teamID int64, permission int) error {
+	endpoint := fmt.Sprintf("%s/folders/%s/permissions", c.apiBase, url.PathEscape(folderUID))
+	payload := map[string]any{
+		"items": []map[string]int64{{"teamId": teamID, "permission": int64(permission)}},
+	}
+	headers := map[string]string{
+		orgIDHeader: strconv.FormatInt(orgID, 10),
+	}
+	_, err := c.doJSONWithHeaders("POST", endpoint, headers, payload, nil)
+	return err
+}
+
+// AddFolderTeamPermission grants the team the given permission on the
+// folder while keeping every other user, team and role entry. An existing
+// entry for the team is replaced.
+func (c *Client) AddFolderTeamPermission(orgID int64, folderUID string, teamID int64, permission int) error {
+	perms, err := c.ListFolderPermissions(orgID, folderUID)
+	if err != nil {
+		return err
+	}
+	items := make([]map[string]any, 0, len(perms)+1)
+	for _, perm := range perms {
+		switch {
+		case perm.TeamID == teamID:
+			continue
+		case perm.TeamID != 0:
+			items = append(items, map[string]any{"teamId": perm.TeamID, "permission": perm.Permission})
+		case perm.UserID != 0:
+			items = append(items, map[string]any{"userId": perm.UserID, "permission": perm.Permission})
+		case perm.Role != "":
+			items = append(items, map[string]any{"role": perm.Role, "permission": perm.Permission})
+		}
+	}
+	items = append(items, map[string]any{"teamId": teamID, "permission": permission})
+	endpoint := fmt.Sprintf("%s/folders/%s/permissions", c.apiBase, url.PathEscape(folderUID))
+	headers := map[string]string{
+		orgIDHeader: strconv.FormatInt(orgID, 10),
+	}
+	_, err = c.doJSONWithHeaders("POST", endpoint, headers, map[string]any{"items": items}, nil)
+	return err
+}
+
+func (c *Client) ListDataSources(orgID int64) ([]DataSource, error) {
+	endpoint := fmt.Sprintf("%s/datasources", c.apiBase)
+	var sources []DataSource
+	headers := map[string]string{
+		orgIDHeader: strconv.FormatInt(orgID, 10),
+	}
+	if _, err := c.doJSONWithHeaders("GET", endpoint, headers, nil, &sources); err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+// DataSourceSpec is the body of a data source create or update request, kept
+// as a generic object so any plugin's jsonData and secureJsonData pass
+// through unchanged.
+type DataSourceSpec map[string]any
+
+// ParseDataSourceSpec decodes a data source definition and checks that it
+// names the data source and its plugin type.
+func ParseDataSourceSpec(raw string) (DataSourceSpec, error) {
+	var spec DataSourceSpec
+	if err := json.Unmarshal([]byte(raw), &spec); err != nil {
+		return nil, fmt.Errorf("data source must be a JSON object: %w", err)
+	}
+	if spec == nil {
+		return nil, errors.New("data source must be a JSON object")
+	}
+	for _, key := range []string{"name", "type"} {
+		value, _ := spec[key].(string)
+		if strings.TrimSpace(value) == "" {
+			return nil, fmt.Errorf("data source %s is required", key)
+		}
+	}
+	return spec, nil
+}
+
+// CreateDataSource adds a data source to the org.
+func (c *Client) CreateDataSource(orgID int64, spec DataSourceSpec) (*DataSource, error) {
+	endpoint := fmt.Sprintf("%s/datasources", c.apiBase)
+	headers := map[string]string{
+		orgIDHeader: strconv.FormatInt(orgID, 10),
+	}
+	var resp struct {
+		DataSource DataSource `json:"datasource"`
+	}
+	if _, err := c.doJSONWithHeaders("POST", endpoint, headers, spec, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.DataSource, nil
+}
+
+// UpdateDataSource replaces the definition of the data source with the
+// given UID.
+func (c *Client) UpdateDataSource(orgID int64, dsUID string, spec DataSourceSpec) error {
+	endpoint := fmt.Sprintf("%s/datasources/uid/%s", c.apiBase, url.PathEscape(dsUID))
+	headers := map[string]string{
+		orgIDHeader: strconv.FormatInt(orgID, 10),
+	}
+	_, err := c.doJSONWithHeaders("PUT", endpoint, headers, spec, nil)
+	return err
+}
+
+// DeleteDataSource removes the data source with the given UID. A data source
+// that no longer exists is not an error.
+func (c *Client) DeleteDataSource(orgID int64, dsUID string) error {
+	endpoint := fmt.Sprintf("%s/datasources/uid/%s", c.apiBase, url.PathEscape(dsUID))
+	headers := map[string]string{
+		orgIDHeader: strconv.FormatInt(orgID, 10),
+	}
+	status, err := c.doJSONWithHeaders("DELETE", endpoint, headers, nil, nil)
+	if status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// DataSourceTeamPermissions returns the permission level (Query, Edit or
+// Admin) each team holds on a data source, keyed by team ID. It returns
+// ErrEnterpriseRequired on Grafana OSS.
+func (c *Client) DataSourceTeamPermissions(orgID int64, dsUID string) (map[int64]string, error) {
+	endpoint := fmt.Sprintf("%s/access-control/datasources/%s", c.apiBase, url.PathEscape(dsUID))
+	var entries []struct {
+		TeamID     int64  `json:"teamId"`
+		Permission string `json:"permission"`
+	}
+	headers := map[string]string{
+		orgIDHeader: strconv.FormatInt(orgID, 10),
+	}
+	status, err := c.doJSONWithHeaders("GET", endpoint, headers, nil, &entries)
+	if status == http.StatusNotFound && c.dataSourcePermissionsUnsupported(headers) {
+		return nil, ErrEnterpriseRequired
+	}
+	if err != nil {
+		return nil, err
+	}
+	perms := map[int64]string{}
+	for _, entry := range entries {
+		if entry.TeamID != 0 {
+			perms[entry.TeamID] = entry.Permission
+		}
+	}
+	return perms, nil
+}
+
+// SetDataSourceTeamPermission grants a team Query, Edit or Admin on a data
+// source, replacing its previous level. It returns ErrEnterpriseRequired on
+// Grafana OSS.
+func (c *Client) SetDataSourceTeamPermission(orgID int64, dsUID string, teamID int64, permission string) error {
+	endpoint := fmt.Sprintf("%s/access-control/datasources/%s/teams/%d", c.apiBase, url.PathEscape(dsUID), teamID)
+	headers := map[string]string{
+		orgIDHeader: strconv.FormatInt(orgID, 10),
+	}
+	status, err := c.doJSONWithHeaders("POST", endpoint, headers, map[string]string{"permission": permission}, nil)
+	if status == http.StatusNotFound && c.dataSourcePermissionsUnsupported(headers) {
+		return ErrEnterpriseRequired
+	}
+	return err
+}
+
+// dataSourcePermissionsUnsupported reports whether Grafana lacks the data
+// source permissions API. It asks the API's description endpoint, so a 404
+// for a missing data source or team is not mistaken for Grafana OSS.
+func (c *Client) dataSourcePermissionsUnsupported(headers map[string]string) bool {
+	endpoint := c.apiBase + "/access-control/datasources/description"
+	status, _ := c.doJSONWithHeaders("GET", endpoint, headers, nil, nil)
+	return status == http.StatusNotFound
+}
+
+// SAToken is a service account token as returned on creation; Key is only
+// available then.
+type SAToken struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// CreateServiceAccountToken creates a token for the service account that
+// expires after ttl; a non-positive ttl creates a token without expiry.
+func (c *Client) CreateServiceAccountToken(orgID, saID int64, name string, ttl time.Duration) (*SAToken, error) {
+	endpoint := fmt.Sprintf("%s/serviceaccounts/%d/tokens", c.apiBase, saID)
+	headers := map[string]string{
+		orgIDHeader: strconv.FormatInt(orgID, 10),
+	}
+	payload := map[string]any{"name": name}
+	if ttl > 0 {
+		payload["secondsToLive"] = int64(ttl / time.Second)
+	}
+	var token SAToken
+	if _, err := c.doJSONWithHeaders("POST", endpoint, headers, payload, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// RevokeServiceAccountToken deletes a service account token. A token that
+// no longer exists counts as revoked.
+func (c *Client) RevokeServiceAccountToken(orgID, saID, tokenID int64) error {
+	endpoint := fmt.Sprintf("%s/serviceaccounts/%d/tokens/%d", c.apiBase, saID, tokenID)
+	headers := map[string]string{
+		orgIDHeader: strconv.FormatInt(orgID, 10),
+	}
+	status, err := c.doJSONWithHeaders("DELETE", endpoint, headers, nil, nil)
+	if status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// ProvisionAlertRule creates an alert rule. Set rule.UID to choose the UID
+// instead of letting Grafana generate one.
+func (c *Client) ProvisionAlertRule(orgID int64, rule AlertRule) error {
+	endpoint := fmt.Sprintf("%s/v1/provisioning/alert-rules", c.apiBase)
+	_, err := c.doJSONWithHeaders("POST", endpoint, alertRuleHeaders(orgID), rule, nil)
+	return err
+}
+
+// UpdateAlertRule replaces the alert rule with rule.UID.
+func (c *Client) UpdateAlertRule(orgID int64, rule AlertRule) error {
+	endpoint := fmt.Sprintf("%s/v1/provisioning/alert-rules/%s", c.apiBase, url.PathEscape(rule.UID))
+	_, err := c.doJSONWithHeaders("PUT", endpoint, alertRuleHeaders(orgID), rule, nil)
+	return err
+}
+
+// GetAlertRule returns the alert rule with the given UID, or nil when it
+// does not exist.
+func (c *Client) GetAlertRule(orgID int64, uid string) (*AlertRule, error) {
+	endpoint := fmt.Sprintf("%s/v1/provisioning/alert-rules/%s", c.apiBase, url.PathEscape(uid))
+	var rule AlertRule
+	status, err := c.doJSONWithHeaders("GET", endpoint, alertRuleHeaders(orgID), nil, &rule)
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// DeleteAlertRule deletes the alert rule with the given UID. A rule that is
+// already gone is not an error.
+func (c *Client) DeleteAlertRule(orgID int64, uid string) error {
+	endpoint := fmt.Sprintf("%s/v1/provisioning/alert-rules/%s", c.apiBase, url.PathEscape(uid))
+	status, err := c.doJSONWithHeaders("DELETE", endpoint, alertRuleHeaders(orgID), nil, nil)
+	if status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// alertRuleHeaders selects the org and keeps provisioned rules editable in
+// the Grafana UI.
+func alertRuleHeaders(orgID int64) map[string]string {
+	return map[string]string{
+		orgIDHeader:            strconv.FormatInt(orgID, 10),
+		"X-Disable-Provenance": "true",
+	}
+}
+
+func (c *Client) ListContactPoints(orgID int64) ([]ContactPoint, error) {
+	endpoint := fmt.Sprintf("%s/v1/provisioning/contact-points", c.apiBase)
+	var points []ContactPoint
+	headers := map[string]string{
+		orgIDHeader: strconv.FormatInt(orgID, 10),
+	}
+	if _, err := c.doJSONWithHeaders("GET", endpoint, headers, nil, &points); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// GetContactPoint returns the contact point with the given UID, or nil when
+// the org has none. The provisioning API has no lookup by UID, so this lists
+// the org's contact points.
+func (c *Client) GetContactPoint(orgID int64, uid string) (*ContactPoint, error) {
+	points, err := c.ListContactPoints(orgID)
+	if err != nil {
+		return nil, err
+	}
+	for _, point := range points {
+		if point.UID == uid {
+			return &point, nil
+		}
+	}
+	return nil, nil
+}
+
+// TeamContactPoint returns the receiver of the notification policy route
+// matching TeamRouteLabel=teamName, if there is one.
+func (c *Client) TeamContactPoint(orgID int64, teamName string) (string, bool, error) {
+	tree, err := c.getPolicyTree(orgID)
+	if err != nil {
+		return "", false, err
+	}
+	for _, route := range policyRoutes(tree) {
+		if isTeamRoute(route, teamName) {
+			receiver, _ := route["receiver"].(string)
+			return receiver, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// AssignContactPoint routes alerts labelled TeamRouteLabel=teamName to the
+// named contact point by adding or updating a top-level route in the org's
+// notification policy tree. Other routes are left untouched.
+func (c *Client) AssignContactPoint(orgID int64, teamName, contactPointName string) error {
+	tree, err := c.getPolicyTree(orgID)
+	if err != nil {
+		return err
+	}
+	routes := policyRoutes(tree)
+	updated := false
+	for _, route := range routes {
+		if isTeamRoute(route, teamName) {
+			route["receiver"] = contactPointName
+			updated = true
+		}
+	}
+	if !updated {
+		routes = append(routes, map[string]any{
+			"receiver":        contactPointName,
+			"object_matchers": [][]string{{TeamRouteLabel, "=", teamName}},
+		})
+	}
+	list := make([]any, len(routes))
+	for i, route := range routes {
+		list[i] = route
+	}
+	tree["routes"] = list
+
+	endpoint := fmt.Sprintf("%s/v1/provisioning/policies", c.apiBase)
+	headers := map[string]string{
+		orgIDHeader: strconv.FormatInt(orgID, 10),
+		// Keep the policy tree editable in the Grafana UI.
+		"X-Disable-Provenance": "true",
+	}
+	_, err = c.doJSONWithHeaders("PUT", endpoint, headers, tree, nil)
+	return err
+}
+
+func (c *Client) getPolicyTree(orgID int64) (map[string]any, error) {
+	endpoint := fmt.Sprintf("%s/v1/provisioning/policies", c.apiBase)
+	tree := map[string]any{}
+	headers := map[string]string{
+		orgIDHeader: strconv.FormatInt(orgID, 10),
+	}
+	if _, err := c.doJSONWithHeaders("GET", endpoint, headers, nil, &tree); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+func policyRoutes(tree map[string]any) []map[string]any {
+	raw, _ := tree["routes"].([]any)
+	routes := make([]map[string]any, 0, len(raw))
+	for _, item := range raw {
+		if route, ok := item.(map[string]any); ok {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+// isTeamRoute reports whether a route's only matcher is
+// TeamRouteLabel=teamName, i.e. it is a route AssignContactPoint manages.
+func isTeamRoute(route map[string]any, teamName string) bool {
+	matchers, _ := route["object_matchers"].([]any)
+	if len(matchers) != 1 {
+		return false
+	}
+	matcher, _ := matchers[0].([]any)
+	if len(matcher) != 3 {
+		return false
+	}
+	return matcher[0] == TeamRouteLabel && matcher[1] == "=" && matcher[2] == teamName
 }
 
 func (c *Client) AddUserToTeam(teamID, userID int64, role string) error {
-	endpoint := fmt.Sprintf("%s/api/teams/%d/members", c.baseURL, teamID)
+	return c.addUserToTeam(teamID, userID, role, nil)
+}
+
+func (c *Client) addUserToTeam(teamID, userID int64, role string, headers map[string]string) error {
+	endpoint := fmt.Sprintf("%s/teams/%d/members", c.apiBase, teamID)
 	payload := map[string]any{"userId": userID}
 	if strings.EqualFold(role, "admin") {
 		payload["role"] = "Admin"
 	}
-	status, err := c.doJSON("POST", endpoint, payload, nil)
+	status, err := c.doJSONWithHeaders("POST", endpoint, headers, payload, nil)
 	if err != nil && status != http.StatusConflict {
 		return err
 	}
@@ -440,12 +1692,18 @@ func (c *Client) AddUserToTeam(teamID, userID int64, role string) error {
 }
 
 func (c *Client) UpdateTeamMemberRole(teamID, userID int64, role string) error {
-	endpoint := fmt.Sprintf("%s/api/teams/%d/members/%d", c.baseURL, teamID, userID)
-	payload := map[string]string{"role": "Member"}
+	return c.updateTeamMemberRole(teamID, userID, role, nil)
+}
+
+func (c *Client) updateTeamMemberRole(teamID, userID int64, role string, headers map[string]string) error {
+	endpoint := fmt.Sprintf("%s/teams/%d/members/%d", c.apiBase, teamID, userID)
+	// Older Grafana versions only honour the numeric permission.
+	payload := map[string]any{"role": "Member", "permission": 0}
 	if strings.EqualFold(role, "admin") {
 		payload["role"] = "Admin"
+		payload["permission"] = TeamPermissionAdmin
 	}
-	status, err := c.doJSON("PUT", endpoint, payload, nil)
+	status, err := c.doJSONWithHeaders("PUT", endpoint, headers, payload, nil)
 	if err != nil && status != http.StatusNotFound {
 		return err
 	}
@@ -453,14 +1711,112 @@ func (c *Client) UpdateTeamMemberRole(teamID, userID int64, role string) error {
 }
 
 func (c *Client) RemoveUserFromTeam(teamID, userID int64) error {
-	endpoint := fmt.Sprintf("%s/api/teams/%d/members/%d", c.baseURL, teamID, userID)
-	status, err := c.doJSON("DELETE", endpoint, nil, nil)
+	return c.removeUserFromTeam(teamID, userID, nil)
+}
+
+func (c *Client) removeUserFromTeam(teamID, userID int64, headers map[string]string) error {
+	endpoint := fmt.Sprintf("%s/teams/%d/members/%d", c.apiBase, teamID, userID)
+	status, err := c.doJSONWithHeaders("DELETE", endpoint, headers, nil, nil)
 	if err != nil && status != http.StatusNotFound {
 		return err
 	}
 	return nil
 }
 
+// OrgClient scopes Grafana API calls to a single org. Every request carries
+// the X-Grafana-Org-Id header, so it is authenticated with the org's token
+// from GRAFANA_ORG_TOKENS when one is configured and with the global admin
+// credentials otherwise.
+type OrgClient struct {
+	client *Client
+	orgID  int64
+}
+
+// WithOrgContext returns a lightweight wrapper that issues org-scoped calls
+// on behalf of the given Grafana org.
+func (c *Client) WithOrgContext(orgID int64) *OrgClient {
+	return &OrgClient{client: c, orgID: orgID}
+}
+
+// OrgID returns the Grafana org the client is scoped to.
+func (o *OrgClient) OrgID() int64 { return o.orgID }
+
+func (o *OrgClient) headers() map[string]string {
+	return map[string]string{orgIDHeader: strconv.FormatInt(o.orgID, 10)}
+}
+
+func (o *OrgClient) AddUserToOrg(loginOrEmail, role string) error {
+	return o.client.addUserToOrg(o.orgID, loginOrEmail, role, o.headers())
+}
+
+func (o *OrgClient) InviteUser(email, name, role string) (string, error) {
+	return o.client.inviteUser(email, name, role, o.headers())
+}
+
+func (o *OrgClient) UpdateUserRole(userID int64, role string) error {
+	return o.client.updateUserRole(o.orgID, userID, role, o.headers())
+}
+
+func (o *OrgClient) ListOrgUsers() ([]OrgUser, error) {
+	return o.client.listOrgUsers(o.orgID, o.headers())
+}
+
+func (o *OrgClient) EnsureTeam(name string) (int64, error) {
+	return o.client.ensureTeam(o.orgID, name, o.headers())
+}
+
+func (o *OrgClient) SearchTeam(name string) (int64, bool, error) {
+	return o.client.searchTeam(o.orgID, name, o.headers())
+}
+
+func (o *OrgClient) ListTeams() ([]Team, error) {
+	return o.client.listTeams(o.orgID, o.headers())
+}
+
+func (o *OrgClient) GetTeam(teamID int64) (*Team, error) {
+	return o.client.getTeam(teamID, o.headers())
+}
+
+func (o *OrgClient) TeamExists(teamID int64) (bool, error) {
+	return o.client.teamExists(teamID, o.headers())
+}
+
+func (o *OrgClient) UpdateTeam(teamID int64, name, description string) error {
+	return o.client.updateTeam(teamID, name, description, o.headers())
+}
+
+func (o *OrgClient) SetTeamEmail(teamID int64, email string) error {
+	return o.client.setTeamEmail(teamID, email, o.headers())
+}
+
+func (o *OrgClient) GetTeamPreferences(teamID int64) (*TeamPreferences, error) {
+	return o.client.getTeamPreferences(teamID, o.headers())
+}
+
+func (o *OrgClient) UpdateTeamPreferences(teamID int64, prefs TeamPreferences) error {
+	return o.client.updateTeamPreferences(teamID, prefs, o.headers())
+}
+
+func (o *OrgClient) RenameTeam(teamID int64, newName string) error {
+	return o.client.renameTeam(teamID, newName, o.headers())
+}
+
+func (o *OrgClient) ListTeamMembers(teamID int64) ([]TeamMember, error) {
+	return o.client.listTeamMembers(teamID, o.headers())
+}
+
+func (o *OrgClient) AddUserToTeam(teamID, userID int64, role string) error {
+	return o.client.addUserToTeam(teamID, userID, role, o.headers())
+}
+
+func (o *OrgClient) UpdateTeamMemberRole(teamID, userID int64, role string) error {
+	return o.client.updateTeamMemberRole(teamID, userID, role, o.headers())
+}
+
+func (o *OrgClient) RemoveUserFromTeam(teamID, userID int64) error {
+	return o.client.removeUserFromTeam(teamID, userID, o.headers())
+}
+
 func (c *Client) doJSON(method, endpoint string, body any, out any) (int, error) {
 	return c.doJSONWithHeaders(method, endpoint, nil, body, out)
 }
@@ -482,11 +1838,19 @@ func (c *Client) doJSONWithHeaders(method, endpoint string, headers map[string]s
 	if body != nil {
 		req.Header.Set("Content-Type", "application/json")
 	}
-	if c.adminToken != "" {
+	if token := c.orgToken(headers[orgIDHeader]); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if c.adminToken != "" {
 		req.Header.Set("Authorization", "Bearer "+c.adminToken)
 	} else if c.adminUser != "" || c.adminPassword != "" {
 		req.SetBasicAuth(c.adminUser, c.adminPassword)
 	}
+	for key, value := range c.extraHeaders {
+		req.Header.Set(key, value)
+	}
+	if c.noProvenance && method != http.MethodGet && method != http.MethodHead {
+		req.Header.Set(disableProvenanceHeader, "true")
+	}
 	for key, value := range headers {
 		if key == "" {
 			continue
@@ -500,14 +1864,20 @@ func (c *Client) doJSONWithHeaders(method, endpoint string, headers map[string]s
 		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace.clientTrace()))
 	}
 
+	httpClient := c.writeClient
+	if method == http.MethodGet || method == http.MethodHead {
+		httpClient = c.readClient
+	}
+
 	start := time.Now()
-	resp, err := c.httpClient.Do(req)
+	resp, err := httpClient.Do(req)
 	elapsed := time.Since(start)
+	c.latency.Record(method, elapsed)
 	if err != nil {
 		if c.debug {
 			log.Printf("grafana http: %s %s FAILED took=%s err=%v %s", method, endpoint, elapsed.Round(time.Millisecond), err, trace.summary())
 		}
-		return 0, err
+		return 0, c.recordError(err)
 	}
 	defer resp.Body.Close()
 
@@ -517,7 +1887,14 @@ func (c *Client) doJSONWithHeaders(method, endpoint string, headers map[string]s
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		payload, _ := io.ReadAll(resp.Body)
-		return resp.StatusCode, fmt.Errorf("grafana: %s %s -> %d: %s", method, endpoint, resp.StatusCode, strings.TrimSpace(string(payload)))
+		err := fmt.Errorf("grafana: %s %s -> %d: %s", method, endpoint, resp.StatusCode, strings.TrimSpace(string(payload)))
+		if resp.StatusCode == http.StatusNotFound {
+			return resp.StatusCode, err
+		}
+		if !c.noProvenance && isProvenanceError(payload) {
+			err = fmt.Errorf("%w (the resource is provisioned; set GRAFANA_DISABLE_PROVENANCE=true to change it anyway)", err)
+		}
+		return resp.StatusCode, c.recordError(err)
 	}
 
 	c.mu.Lock()
@@ -532,6 +1909,47 @@ func (c *Client) doJSONWithHeaders(method, endpoint string, headers map[string]s
 	return resp.StatusCode, nil
 }
 
+// isProvenanceError reports whether an error response says the resource is
+// protected by its provisioning provenance.
+func isProvenanceError(payload []byte) bool {
+	return bytes.Contains(bytes.ToLower(payload), []byte("provenance"))
+}
+
+// TokenProvider supplies org-scoped API tokens managed at runtime, such as
+// the ones saved through /api/grafana-tokens. An empty token means the org
+// has none.
+type TokenProvider interface {
+	GetToken(orgID int64) (string, error)
+}
+
+// SetTokenProvider makes org-scoped requests use the provider's token for
+// their org, ahead of GRAFANA_ORG_TOKENS and the admin credentials.
+func (c *Client) SetTokenProvider(provider TokenProvider) {
+	c.tokenProvider = provider
+}
+
+// orgToken returns the token for the org named by an X-Grafana-Org-Id header
+// value: the token provider's, else the GRAFANA_ORG_TOKENS entry, or "" when
+// there is none.
+func (c *Client) orgToken(orgHeader string) string {
+	if orgHeader == "" || (len(c.orgTokens) == 0 && c.tokenProvider == nil) {
+		return ""
+	}
+	orgID, err := strconv.ParseInt(orgHeader, 10, 64)
+	if err != nil {
+		return ""
+	}
+	if c.tokenProvider != nil {
+		token, err := c.tokenProvider.GetToken(orgID)
+		if err != nil {
+			log.Printf("grafana: token lookup for org %d failed: %v", orgID, err)
+		} else if token != "" {
+			return token
+		}
+	}
+	return c.orgTokens[orgID]
+}
+
 // requestTrace collects timings and resolved addresses for a single HTTP
 // request via net/http/httptrace.
 type requestTrace struct {
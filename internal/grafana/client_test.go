@@ -0,0 +1,614 @@
+package grafana
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and key signed by a test CA, both PEM encoded.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+	kpem []byte
+}
+
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("serial: %v", err)
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	return &testCert{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		kpem: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+	return path
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "grafana"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	client := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "syncer"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+
+	serverPair, err := tls.X509KeyPair(server.pem, server.kpem)
+	if err != nil {
+		t.Fatalf("server key pair: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].Subject.CommonName != "syncer" {
+			http.Error(w, "no client certificate", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"id":1,"name":"Main Org."}`))
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	certFile := writeTestFile(t, dir, "client.crt", client.pem)
+	keyFile := writeTestFile(t, dir, "client.key", client.kpem)
+	caFile := writeTestFile(t, dir, "ca.crt", ca.pem)
+
+	var opts TransportOptions
+	if err := opts.LoadTLSFiles(certFile, keyFile, caFile); err != nil {
+		t.Fatalf("LoadTLSFiles: %v", err)
+	}
+	if err := New(srv.URL, "/api", "admin", "admin", "", nil, false, false, opts).Ping(); err != nil {
+		t.Fatalf("Ping with client certificate: %v", err)
+	}
+
+	var caOnly TransportOptions
+	if err := caOnly.LoadTLSFiles("", "", caFile); err != nil {
+		t.Fatalf("LoadTLSFiles: %v", err)
+	}
+	if err := New(srv.URL, "/api", "admin", "admin", "", nil, false, false, caOnly).Ping(); err == nil {
+		t.Fatal("Ping without client certificate succeeded, want TLS error")
+	}
+}
+
+func TestLoadTLSFilesErrors(t *testing.T) {
+	dir := t.TempDir()
+	garbage := writeTestFile(t, dir, "garbage.pem", []byte("not a certificate"))
+	var opts TransportOptions
+	if err := opts.LoadTLSFiles(garbage, garbage, ""); err == nil {
+		t.Error("LoadTLSFiles accepted an unparsable key pair")
+	}
+	if err := opts.LoadTLSFiles(garbage, "", ""); err == nil {
+		t.Error("LoadTLSFiles accepted a certificate without a key")
+	}
+	if err := opts.LoadTLSFiles("", "", garbage); err == nil {
+		t.Error("LoadTLSFiles accepted a CA file without certificates")
+	}
+	if err := opts.LoadTLSFiles("", "", filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("LoadTLSFiles accepted a missing CA file")
+	}
+}
+
+func TestSkipVerifyHosts(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":1,"name":"Main Org."}`))
+	}))
+	defer srv.Close()
+	trusted := x509.NewCertPool()
+	trusted.AddCert(srv.Certificate())
+
+	for _, tc := range []struct {
+		name    string
+		opts    TransportOptions
+		wantErr bool
+	}{
+		{name: "matching pattern skips verification", opts: TransportOptions{SkipVerifyHosts: []string{"*.dev.internal", "127.0.0.*"}}},
+		{name: "other pattern still verifies", opts: TransportOptions{SkipVerifyHosts: []string{"*.dev.internal"}}, wantErr: true},
+		{name: "other pattern verifies against the CA", opts: TransportOptions{SkipVerifyHosts: []string{"*.dev.internal"}, RootCAs: trusted}},
+		{name: "no patterns", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := New(srv.URL, "/api", "admin", "admin", "", nil, false, false, tc.opts).Ping()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Ping error = %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestHostMatches(t *testing.T) {
+	patterns := []string{" *.Dev.Internal ", "grafana.local", ""}
+	for host, want := range map[string]bool{
+		"grafana.dev.internal":  true,
+		"GRAFANA.DEV.INTERNAL.": true,
+		"dev.internal":          false,
+		"grafana.local":         true,
+		"grafana.example.com":   false,
+	} {
+		if got := hostMatches(host, patterns); got != want {
+			t.Errorf("hostMatches(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestAssignContactPointRoutesTeamLabel(t *testing.T) {
+	var tree map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/provisioning/policies" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodPut {
+			tree = map[string]any{}
+			json.NewDecoder(r.Body).Decode(&tree)
+			w.Write([]byte(`{}`))
+			return
+		}
+		w.Write([]byte(`{"receiver":"default","routes":[{"receiver":"db-oncall","object_matchers":[["service","=","db"]]},{"receiver":"old","object_matchers":[["team","=","Ops"]]}]}`))
+	}))
+	defer srv.Close()
+	client := New(srv.URL, "/api", "admin", "admin", "", nil, false, false, TransportOptions{})
+
+	receivers := func() map[string]string {
+		out := map[string]string{}
+		for _, item := range tree["routes"].([]any) {
+			route := item.(map[string]any)
+			matcher := route["object_matchers"].([]any)[0].([]any)
+			out[fmt.Sprint(matcher[0], "=", matcher[2])] = route["receiver"].(string)
+		}
+		return out
+	}
+	if err := client.AssignContactPoint(1, "Ops", "ops-pager"); err != nil {
+		t.Fatalf("AssignContactPoint: %v", err)
+	}
+	if got := receivers(); len(got) != 2 || got["team=Ops"] != "ops-pager" || got["service=db"] != "db-oncall" {
+		t.Fatalf("routes after updating Ops = %v", got)
+	}
+	if err := client.AssignContactPoint(1, "Dev", "dev-chat"); err != nil {
+		t.Fatalf("AssignContactPoint: %v", err)
+	}
+	if got := receivers(); len(got) != 3 || got["team=Dev"] != "dev-chat" || got["team=Ops"] != "old" {
+		t.Fatalf("routes after adding Dev = %v", got)
+	}
+}
+
+func TestConcurrentLookupsShareOneRequest(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/users/lookup":
+			calls.Add(1)
+			<-release
+			w.Write([]byte(`{"id":7,"login":"dana","email":"dana@example.com"}`))
+		case "/api/orgs/2/users":
+			calls.Add(1)
+			<-release
+			w.Write([]byte(`[{"userId":7,"login":"dana"}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	client := New(srv.URL, "/api", "admin", "admin", "", nil, false, false, TransportOptions{})
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{"LookupUser", func() error {
+			user, found, err := client.LookupUser("dana@example.com")
+			if err == nil && (!found || user.ID != 7) {
+				err = fmt.Errorf("user = %+v, found = %v", user, found)
+			}
+			return err
+		}},
+		{"ListOrgUsers", func() error {
+			users, err := client.ListOrgUsers(2)
+			if err == nil && len(users) != 1 {
+				err = fmt.Errorf("users = %+v", users)
+			}
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls.Store(0)
+			release = make(chan struct{})
+			const callers = 8
+			errs := make(chan error, callers)
+			for i := 0; i < callers; i++ {
+				go func() { errs <- tt.call() }()
+			}
+			// Hold the first request until every caller has had time to join it.
+			for calls.Load() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+			for i := 0; i < callers; i++ {
+				if err := <-errs; err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := calls.Load(); got != 1 {
+				t.Fatalf("HTTP calls = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestFlightKeyIncludesHeaders(t *testing.T) {
+	org1 := map[string]string{orgIDHeader: "1"}
+	tests := []struct {
+		name string
+		a, b map[string]string
+		same bool
+	}{
+		{"no headers", nil, map[string]string{}, true},
+		{"same headers", org1, map[string]string{orgIDHeader: "1"}, true},
+		{"header case", org1, map[string]string{"x-grafana-org-id": "1"}, true},
+		{"other org", org1, map[string]string{orgIDHeader: "2"}, false},
+		{"extra header", org1, map[string]string{orgIDHeader: "1", "Authorization": "Bearer org-token"}, false},
+		{"headers vs none", org1, nil, false},
+	}
+	for _, tt := range tests {
+		if got := flightKey("team:1:Ops", tt.a) == flightKey("team:1:Ops", tt.b); got != tt.same {
+			t.Errorf("%s: keys equal = %v, want %v", tt.name, got, tt.same)
+		}
+	}
+}
+
+// teamSearchServer serves n teams through the search endpoint, with
+// memberCount when withCounts is set, and three members per team. It counts
+// the requests it answers.
+func teamSearchServer(tb testing.TB, n int, withCounts bool) (*httptest.Server, *atomic.Int64) {
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path != "/api/teams/search" {
+			w.Write([]byte(`[{"userId":1},{"userId":2},{"userId":3}]`))
+			return
+		}
+		teams := []map[string]any{}
+		if r.URL.Query().Get("page") == "1" {
+			for i := 1; i <= n; i++ {
+				team := map[string]any{"id": i, "name": fmt.Sprintf("team-%d", i)}
+				if withCounts {
+					team["memberCount"] = 3
+				}
+				teams = append(teams, team)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"teams": teams})
+	}))
+	tb.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func BenchmarkTeamMemberCounts(b *testing.B) {
+	for _, bc := range []struct {
+		name       string
+		withCounts bool
+	}{
+		{"search memberCount", true},
+		{"member list fallback", false},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			srv, requests := teamSearchServer(b, 200, bc.withCounts)
+			client := New(srv.URL, "/api", "admin", "admin", "", nil, false, false, TransportOptions{})
+			requests.Store(0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				counts, err := client.GetTeamMemberCounts(1)
+				if err != nil || len(counts) != 200 {
+					b.Fatalf("counts = %d, %v", len(counts), err)
+				}
+			}
+			b.ReportMetric(float64(requests.Load())/float64(b.N), "requests/op")
+		})
+	}
+}
+
+func TestTeamMemberCountsLeavesFailedTeamsOut(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/teams/2/members" {
+			http.Error(w, `{"message":"boom"}`, http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`[{"userId":1}]`))
+	}))
+	defer srv.Close()
+	client := New(srv.URL, "/api", "admin", "admin", "", nil, false, false, TransportOptions{})
+	five := 5
+	counts, err := client.TeamMemberCounts(1, []Team{{ID: 1}, {ID: 2}, {ID: 3, MemberCount: &five}})
+	if err == nil {
+		t.Fatal("want an error for team 2")
+	}
+	if len(counts) != 2 || counts[1] != 1 || counts[3] != 5 {
+		t.Fatalf("counts = %v, want team 1 = 1 and team 3 = 5 only", counts)
+	}
+}
+
+func TestListAdminOrgsPageSize(t *testing.T) {
+	var perPage []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		perPage = append(perPage, r.URL.Query().Get("perpage"))
+		_ = json.NewEncoder(w).Encode([]Org{{ID: 1, Name: "Main"}})
+	}))
+	defer srv.Close()
+	c := New(srv.URL, "/api", "admin", "admin", "", nil, false, false, TransportOptions{})
+	c.SetUserPageSize(1)
+
+	orgs, err := c.ListAdminOrgs()
+	if err != nil {
+		t.Fatalf("ListAdminOrgs: %v", err)
+	}
+	if len(orgs) != 1 || len(perPage) != 1 {
+		t.Fatalf("got %d orgs in %d requests, want 1 in 1", len(orgs), len(perPage))
+	}
+	if perPage[0] != fmt.Sprint(orgPageSize) {
+		t.Errorf("perpage = %s, want %d regardless of the user page size", perPage[0], orgPageSize)
+	}
+}
+
+func TestExtraHeaders(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		_ = json.NewEncoder(w).Encode(map[string]any{"teams": []Team{}})
+	}))
+	defer srv.Close()
+	c := New(srv.URL, "/api", "admin", "admin", "", nil, false, false, TransportOptions{})
+	c.SetExtraHeaders(map[string]string{"X-API-Key": "secret", orgIDHeader: "99"})
+	if n := c.ExtraHeaderCount(); n != 2 {
+		t.Fatalf("ExtraHeaderCount() = %d, want 2", n)
+	}
+
+	if _, _, err := c.WithOrgContext(3).SearchTeam("Ops"); err != nil {
+		t.Fatalf("SearchTeam: %v", err)
+	}
+	if got.Get("X-API-Key") != "secret" {
+		t.Errorf("X-API-Key = %q, want secret", got.Get("X-API-Key"))
+	}
+	if got.Get(orgIDHeader) != "3" {
+		t.Errorf("%s = %q, want the per-request 3", orgIDHeader, got.Get(orgIDHeader))
+	}
+	if user, _, ok := (&http.Request{Header: got}).BasicAuth(); !ok || user != "admin" {
+		t.Errorf("Authorization = %q, want basic auth for admin", got.Get("Authorization"))
+	}
+}
+
+func TestDataSourcePermissionsNotFound(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		hasPermissions bool
+		wantEnterprise bool
+	}{
+		{name: "grafana oss", hasPermissions: false, wantEnterprise: true},
+		{name: "missing data source", hasPermissions: true, wantEnterprise: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/api/access-control/datasources/description" && tc.hasPermissions {
+					w.Write([]byte(`{"assignments":{"teams":true},"permissions":["Query","Edit","Admin"]}`))
+					return
+				}
+				http.Error(w, `{"message":"Not found"}`, http.StatusNotFound)
+			}))
+			defer srv.Close()
+			c := New(srv.URL, "/api", "admin", "admin", "", nil, false, false, TransportOptions{})
+
+			_, err := c.DataSourceTeamPermissions(1, "missing")
+			if err == nil || errors.Is(err, ErrEnterpriseRequired) != tc.wantEnterprise {
+				t.Errorf("DataSourceTeamPermissions error = %v, want ErrEnterpriseRequired %v", err, tc.wantEnterprise)
+			}
+			err = c.SetDataSourceTeamPermission(1, "missing", 7, "Query")
+			if err == nil || errors.Is(err, ErrEnterpriseRequired) != tc.wantEnterprise {
+				t.Errorf("SetDataSourceTeamPermission error = %v, want ErrEnterpriseRequired %v", err, tc.wantEnterprise)
+			}
+		})
+	}
+}
+
+func TestDataSourceTeamPermissions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/access-control/datasources/ds1" || r.Header.Get("X-Grafana-Org-Id") != "2" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`[{"teamId":7,"permission":"Edit"},{"userId":3,"permission":"Admin"},{"teamId":8,"permission":"Query"}]`))
+	}))
+	defer srv.Close()
+	c := New(srv.URL, "/api", "admin", "admin", "", nil, false, false, TransportOptions{})
+
+	perms, err := c.DataSourceTeamPermissions(2, "ds1")
+	if err != nil {
+		t.Fatalf("DataSourceTeamPermissions: %v", err)
+	}
+	if len(perms) != 2 || perms[7] != "Edit" || perms[8] != "Query" {
+		t.Errorf("perms = %v, want team 7 Edit and team 8 Query", perms)
+	}
+}
+
+// fakeTokenProvider is a TokenProvider backed by a map; err fails every
+// lookup.
+type fakeTokenProvider struct {
+	tokens map[int64]string
+	err    error
+}
+
+func (p fakeTokenProvider) GetToken(orgID int64) (string, error) {
+	return p.tokens[orgID], p.err
+}
+
+func TestOrgTokenProviderFallback(t *testing.T) {
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		_ = json.NewEncoder(w).Encode(map[string]any{"teams": []Team{}})
+	}))
+	defer srv.Close()
+	orgTokens := map[int64]string{2: "static-2", 3: "static-3"}
+	for _, tc := range []struct {
+		name     string
+		provider TokenProvider
+		orgID    int64
+		want     string
+	}{
+		{name: "no provider", orgID: 2, want: "Bearer static-2"},
+		{name: "provider token wins", provider: fakeTokenProvider{tokens: map[int64]string{2: "saved-2"}}, orgID: 2, want: "Bearer saved-2"},
+		{name: "no saved token", provider: fakeTokenProvider{tokens: map[int64]string{2: "saved-2"}}, orgID: 3, want: "Bearer static-3"},
+		{name: "provider error", provider: fakeTokenProvider{err: errors.New("decrypt failed")}, orgID: 2, want: "Bearer static-2"},
+		{name: "admin credentials", provider: fakeTokenProvider{}, orgID: 4, want: "Basic YWRtaW46YWRtaW4="},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := New(srv.URL, "/api", "admin", "admin", "", orgTokens, false, false, TransportOptions{})
+			if tc.provider != nil {
+				c.SetTokenProvider(tc.provider)
+			}
+			if _, _, err := c.WithOrgContext(tc.orgID).SearchTeam("Ops"); err != nil {
+				t.Fatalf("SearchTeam: %v", err)
+			}
+			if auth != tc.want {
+				t.Errorf("Authorization = %q, want %q", auth, tc.want)
+			}
+		})
+	}
+}
+
+func TestUserListingsFollowPages(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path+"?"+r.URL.RawQuery)
+		// Two full pages of two, then a short one.
+		page := r.URL.Query().Get("page")
+		ids := map[string][]int64{"1": {1, 2}, "2": {3, 4}, "3": {5}}[page]
+		switch r.URL.Path {
+		case "/api/orgs/1/users":
+			users := []OrgUser{}
+			for _, id := range ids {
+				users = append(users, OrgUser{ID: id, Login: fmt.Sprintf("user%d", id)})
+			}
+			_ = json.NewEncoder(w).Encode(users)
+		case "/api/teams/7/members":
+			members := []TeamMember{}
+			for _, id := range ids {
+				members = append(members, TeamMember{ID: id, Login: fmt.Sprintf("user%d", id)})
+			}
+			_ = json.NewEncoder(w).Encode(members)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name string
+		list func(c *Client) (int, error)
+		path string
+	}{
+		{
+			name: "org users",
+			list: func(c *Client) (int, error) {
+				users, err := c.ListOrgUsers(1)
+				return len(users), err
+			},
+			path: "/api/orgs/1/users",
+		},
+		{
+			name: "team members",
+			list: func(c *Client) (int, error) {
+				members, err := c.ListTeamMembers(7)
+				return len(members), err
+			},
+			path: "/api/teams/7/members",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			requests = nil
+			c := New(srv.URL, "/api", "admin", "admin", "", nil, false, false, TransportOptions{})
+			c.SetUserPageSize(2)
+			n, err := tc.list(c)
+			if err != nil {
+				t.Fatalf("list: %v", err)
+			}
+			if n != 5 {
+				t.Errorf("listed %d users, want 5 across three pages", n)
+			}
+			want := []string{
+				tc.path + "?page=1&perPage=2",
+				tc.path + "?page=2&perPage=2",
+				tc.path + "?page=3&perPage=2",
+			}
+			if fmt.Sprint(requests) != fmt.Sprint(want) {
+				t.Errorf("requests = %v, want %v", requests, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultWindow is how many recent durations a LatencyTracker keeps.
+const DefaultWindow = 1000
+
+// LatencyTracker keeps the most recent request durations in a ring buffer
+// and reports their percentiles.
+type LatencyTracker struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+// NewLatencyTracker returns a tracker for the last size durations; sizes
+// below 1 use DefaultWindow.
+func NewLatencyTracker(size int) *LatencyTracker {
+	if size < 1 {
+		size = DefaultWindow
+	}
+	return &LatencyTracker{samples: make([]time.Duration, size)}
+}
+
+// Record adds a duration, replacing the oldest one once the buffer is full.
+func (t *LatencyTracker) Record(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples[t.next] = d
+	t.next++
+	if t.next == len(t.samples) {
+		t.next = 0
+		t.full = true
+	}
+}
+
+// Count returns how many durations are held.
+func (t *LatencyTracker) Count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.full {
+		return len(t.samples)
+	}
+	return t.next
+}
+
+// Percentiles returns the nearest-rank 50th, 95th and 99th percentiles of
+// the held durations, or zeros when none have been recorded.
+func (t *LatencyTracker) Percentiles() (p50, p95, p99 time.Duration) {
+	t.mu.Lock()
+	n := t.next
+	if t.full {
+		n = len(t.samples)
+	}
+	sorted := append([]time.Duration(nil), t.samples[:n]...)
+	t.mu.Unlock()
+	if n == 0 {
+		return 0, 0, 0
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := func(p float64) time.Duration {
+		return sorted[int(math.Ceil(p*float64(n)))-1]
+	}
+	return rank(0.50), rank(0.95), rank(0.99)
+}
+
+// Latency tracks read (GET and HEAD) and write requests to one service
+// separately.
+type Latency struct {
+	Read  *LatencyTracker
+	Write *LatencyTracker
+}
+
+// NewLatency returns trackers holding DefaultWindow durations each.
+func NewLatency() *Latency {
+	return &Latency{
+		Read:  NewLatencyTracker(DefaultWindow),
+		Write: NewLatencyTracker(DefaultWindow),
+	}
+}
+
+// Record adds the duration of a request made with method.
+func (l *Latency) Record(method string, d time.Duration) {
+	if method == http.MethodGet || method == http.MethodHead {
+		l.Read.Record(d)
+		return
+	}
+	l.Write.Record(d)
+}
@@ -0,0 +1,293 @@
+package oidc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	gooidc "github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	sessionCookie = "syncd_session"
+	flowCookie    = "syncd_oidc_flow"
+	sessionTTL    = 8 * time.Hour
+	flowTTL       = 10 * time.Minute
+)
+
+// exemptPrefixes are served without a session so probes, scrapers and
+// webhook senders keep working.
+var exemptPrefixes = []string{"/healthz", "/metrics", "/webhooks/", "/static/"}
+
+type Config struct {
+	Issuer             string
+	ClientID           string
+	ClientSecret       string
+	RedirectURL        string
+	SessionSecret      string
+	AllowedEmailDomain string
+	// AdminToken is ADMIN_API_TOKEN. /api/admin/* requests bearing it skip
+	// the session check; other bearer tokens do not.
+	AdminToken string
+}
+
+// Authenticator protects the web UI with the OIDC authorization code flow
+// (with PKCE) and keeps the signed-in email in an HMAC-signed cookie.
+type Authenticator struct {
+	cfg          Config
+	callbackPath string
+	httpClient   *http.Client
+	oauth        oauth2.Config
+	verifier     *gooidc.IDTokenVerifier
+}
+
+// New loads the provider's discovery document. Its signing keys are
+// fetched, and refreshed on rotation, by the go-oidc verifier.
+func New(ctx context.Context, cfg Config) (*Authenticator, error) {
+	redirect, err := url.Parse(cfg.RedirectURL)
+	if err != nil || redirect.Path == "" {
+		return nil, fmt.Errorf("invalid redirect url %q", cfg.RedirectURL)
+	}
+	a := &Authenticator{
+		cfg:          cfg,
+		callbackPath: redirect.Path,
+		httpClient:   &http.Client{Timeout: 15 * time.Second},
+	}
+	provider, err := gooidc.NewProvider(gooidc.ClientContext(ctx, a.httpClient), cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	a.oauth = oauth2.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		RedirectURL:  cfg.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{gooidc.ScopeOpenID, "email", "profile"},
+	}
+	a.verifier = provider.Verifier(&gooidc.Config{ClientID: cfg.ClientID})
+	return a, nil
+}
+
+// Register adds the callback and logout handlers.
+func (a *Authenticator) Register(mux *http.ServeMux) {
+	mux.HandleFunc(a.callbackPath, a.handleCallback)
+	mux.HandleFunc("/logout", a.handleLogout)
+}
+
+// Middleware redirects requests without a valid session to the provider.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.exempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, ok := a.sessionEmail(r); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet || strings.HasPrefix(r.URL.Path, "/api/") {
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		a.startLogin(w, r)
+	})
+}
+
+func (a *Authenticator) exempt(r *http.Request) bool {
+	if r.URL.Path == a.callbackPath {
+		return true
+	}
+	for _, prefix := range exemptPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return a.adminTokenRequest(r)
+}
+
+// adminTokenRequest reports whether r is an /api/admin/ call carrying
+// ADMIN_API_TOKEN, so automation can use the admin API without a session.
+func (a *Authenticator) adminTokenRequest(r *http.Request) bool {
+	if a.cfg.AdminToken == "" || !strings.HasPrefix(r.URL.Path, "/api/admin/") {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(a.cfg.AdminToken)) == 1
+}
+
+func (a *Authenticator) startLogin(w http.ResponseWriter, r *http.Request) {
+	state, nonce, verifier := randomString(), randomString(), randomString()
+	returnTo := r.URL.RequestURI()
+	a.setSignedCookie(w, flowCookie, strings.Join([]string{state, nonce, verifier, returnTo}, "|"), flowTTL)
+
+	http.Redirect(w, r, a.oauth.AuthCodeURL(state, gooidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), http.StatusFound)
+}
+
+func (a *Authenticator) handleCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flow, ok := a.signedCookie(r, flowCookie)
+	if !ok {
+		http.Error(w, "login session expired, reload the page", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: flowCookie, Path: "/", MaxAge: -1})
+	parts := strings.SplitN(flow, "|", 4)
+	if len(parts) != 4 || r.URL.Query().Get("state") != parts[0] {
+		http.Error(w, "invalid login state", http.StatusBadRequest)
+		return
+	}
+	if errParam := r.URL.Query().Get("error"); errParam != "" {
+		http.Error(w, "login failed: "+errParam, http.StatusUnauthorized)
+		return
+	}
+
+	rawIDToken, err := a.exchange(r.Context(), r.URL.Query().Get("code"), parts[2])
+	if err != nil {
+		log.Printf("oidc: token exchange failed: %v", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	email, err := a.verifyIDToken(r.Context(), rawIDToken, parts[1])
+	if err != nil {
+		log.Printf("oidc: id token rejected: %v", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	if domain := strings.ToLower(strings.TrimPrefix(a.cfg.AllowedEmailDomain, "@")); domain != "" && !strings.HasSuffix(email, "@"+domain) {
+		log.Printf("oidc: login denied for %s: domain not allowed", email)
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+
+	a.setSignedCookie(w, sessionCookie, fmt.Sprintf("%s|%d", email, time.Now().Add(sessionTTL).Unix()), sessionTTL)
+	log.Printf("oidc: %s signed in", email)
+	returnTo := parts[3]
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") {
+		returnTo = "/"
+	}
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
+
+func (a *Authenticator) handleLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func (a *Authenticator) exchange(ctx context.Context, code, verifier string) (string, error) {
+	if code == "" {
+		return "", errors.New("missing code")
+	}
+	token, err := a.oauth.Exchange(gooidc.ClientContext(ctx, a.httpClient), code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return "", err
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	if rawIDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return rawIDToken, nil
+}
+
+// verifyIDToken checks the token's signature, issuer, audience and expiry
+// with the go-oidc verifier, then its nonce, and returns its email.
+func (a *Authenticator) verifyIDToken(ctx context.Context, raw, nonce string) (string, error) {
+	idToken, err := a.verifier.Verify(gooidc.ClientContext(ctx, a.httpClient), raw)
+	if err != nil {
+		return "", err
+	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		return "", errors.New("nonce mismatch")
+	}
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified *bool  `json:"email_verified"`
+		PreferredName string `json:"preferred_username"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return "", fmt.Errorf("claims: %w", err)
+	}
+	if claims.EmailVerified != nil && !*claims.EmailVerified {
+		return "", errors.New("email not verified")
+	}
+	email := claims.Email
+	if email == "" && strings.Contains(claims.PreferredName, "@") {
+		email = claims.PreferredName
+	}
+	if email == "" {
+		return "", errors.New("token has no email claim")
+	}
+	return strings.ToLower(email), nil
+}
+
+func (a *Authenticator) sessionEmail(r *http.Request) (string, bool) {
+	value, ok := a.signedCookie(r, sessionCookie)
+	if !ok {
+		return "", false
+	}
+	email, expiry, ok := strings.Cut(value, "|")
+	if !ok {
+		return "", false
+	}
+	var expiresAt int64
+	if _, err := fmt.Sscan(expiry, &expiresAt); err != nil || time.Now().Unix() > expiresAt {
+		return "", false
+	}
+	return email, true
+}
+
+func (a *Authenticator) setSignedCookie(w http.ResponseWriter, name, value string, ttl time.Duration) {
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(value))
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    encoded + "." + a.sign(name, encoded),
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(a.cfg.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (a *Authenticator) signedCookie(r *http.Request, name string) (string, bool) {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return "", false
+	}
+	encoded, mac, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(mac), []byte(a.sign(name, encoded))) {
+		return "", false
+	}
+	value, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	return string(value), true
+}
+
+func (a *Authenticator) sign(name, value string) string {
+	mac := hmac.New(sha256.New, []byte(a.cfg.SessionSecret))
+	mac.Write([]byte(name + "=" + value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func randomString() string {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("oidc: random source failed: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
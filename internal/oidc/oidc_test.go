@@ -0,0 +1,254 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockProvider is a minimal OIDC provider: discovery, JWKS and a token
+// endpoint that checks the PKCE verifier of the code issued by authorize.
+type mockProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+	// email, nonce and audience override the ID token claims when set.
+	email, nonce, audience string
+}
+
+type mockGrant struct {
+	challenge string
+	nonce     string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	p := &mockProvider{key: key, codes: map[string]mockGrant{}, email: "alice@example.com"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"issuer":                                p.URL,
+			"authorization_endpoint":                p.URL + "/authorize",
+			"token_endpoint":                        p.URL + "/token",
+			"jwks_uri":                              p.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		p.mu.Lock()
+		grant, ok := p.codes[r.PostForm.Get("code")]
+		p.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     p.idToken(t, grant.nonce),
+		})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// authorize plays the user signing in at the redirect target and returns
+// the callback URL the provider would send the browser to.
+func (p *mockProvider) authorize(t *testing.T, location string) string {
+	t.Helper()
+	target, err := url.Parse(location)
+	if err != nil || !strings.HasPrefix(location, p.URL+"/authorize") {
+		t.Fatalf("redirect to %q, want the provider's authorize endpoint", location)
+	}
+	query := target.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Fatalf("authorize request without PKCE: %s", location)
+	}
+	p.mu.Lock()
+	p.codes["code-1"] = mockGrant{challenge: query.Get("code_challenge"), nonce: query.Get("nonce")}
+	p.mu.Unlock()
+	return "/callback?code=code-1&state=" + url.QueryEscape(query.Get("state"))
+}
+
+func (p *mockProvider) idToken(t *testing.T, nonce string) string {
+	if p.nonce != "" {
+		nonce = p.nonce
+	}
+	audience := "client"
+	if p.audience != "" {
+		audience = p.audience
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":            p.URL,
+		"aud":            audience,
+		"sub":            "user-1",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          nonce,
+		"email":          p.email,
+		"email_verified": true,
+	})
+	signing := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signing))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Errorf("sign: %v", err)
+	}
+	return signing + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func newTestAuthenticator(t *testing.T, provider *mockProvider) http.Handler {
+	t.Helper()
+	auth, err := New(context.Background(), Config{
+		Issuer:             provider.URL,
+		ClientID:           "client",
+		ClientSecret:       "secret",
+		RedirectURL:        "http://syncd.example.com/callback",
+		SessionSecret:      strings.Repeat("s", 32),
+		AllowedEmailDomain: "example.com",
+		AdminToken:         "admin-token",
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("app")) })
+	auth.Register(mux)
+	return auth.Middleware(mux)
+}
+
+// signIn runs the login flow for target and returns the final response.
+func signIn(t *testing.T, handler http.Handler, provider *mockProvider, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("GET %s = %d, want redirect to the provider", target, rec.Code)
+	}
+	callback := httptest.NewRequest(http.MethodGet, provider.authorize(t, rec.Header().Get("Location")), nil)
+	for _, cookie := range rec.Result().Cookies() {
+		callback.AddCookie(cookie)
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, callback)
+	return rec
+}
+
+func TestLoginFlow(t *testing.T) {
+	provider := newMockProvider(t)
+	handler := newTestAuthenticator(t, provider)
+
+	rec := signIn(t, handler, provider, "/mappings?x=1")
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/mappings?x=1" {
+		t.Fatalf("callback = %d to %q, want redirect back to /mappings?x=1", rec.Code, rec.Header().Get("Location"))
+	}
+	var session *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == sessionCookie && cookie.MaxAge > 0 {
+			session = cookie
+		}
+	}
+	if session == nil {
+		t.Fatal("callback set no session cookie")
+	}
+	req := httptest.NewRequest(http.MethodGet, "/mappings", nil)
+	req.AddCookie(session)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "app" {
+		t.Fatalf("GET with session = %d %q", rec.Code, rec.Body)
+	}
+
+	session.Value = "x" + session.Value
+	req = httptest.NewRequest(http.MethodGet, "/api/mappings", nil)
+	req.AddCookie(session)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("GET with tampered session = %d, want 401", rec.Code)
+	}
+}
+
+func TestLoginRejectsBadTokens(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		setup    func(*mockProvider)
+		wantCode int
+	}{
+		{name: "domain not allowed", setup: func(p *mockProvider) { p.email = "eve@other.com" }, wantCode: http.StatusForbidden},
+		{name: "nonce mismatch", setup: func(p *mockProvider) { p.nonce = "replayed" }, wantCode: http.StatusUnauthorized},
+		{name: "wrong audience", setup: func(p *mockProvider) { p.audience = "other-client" }, wantCode: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			provider := newMockProvider(t)
+			tc.setup(provider)
+			rec := signIn(t, newTestAuthenticator(t, provider), provider, "/")
+			if rec.Code != tc.wantCode {
+				t.Fatalf("callback = %d, want %d", rec.Code, tc.wantCode)
+			}
+		})
+	}
+}
+
+func TestExemptPaths(t *testing.T) {
+	handler := newTestAuthenticator(t, newMockProvider(t))
+	for _, tc := range []struct {
+		path, auth string
+		wantCode   int
+	}{
+		{path: "/healthz", wantCode: http.StatusOK},
+		{path: "/metrics", wantCode: http.StatusOK},
+		{path: "/webhooks/sync", wantCode: http.StatusOK},
+		{path: "/api/admin/backup", auth: "Bearer admin-token", wantCode: http.StatusOK},
+		{path: "/api/admin/backup", auth: "Bearer guessed", wantCode: http.StatusUnauthorized},
+		{path: "/api/mappings", auth: "Bearer admin-token", wantCode: http.StatusUnauthorized},
+		{path: "/", wantCode: http.StatusFound},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.wantCode {
+			t.Errorf("GET %s (%q) = %d, want %d", tc.path, tc.auth, rec.Code, tc.wantCode)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Func returns an http.Transport Proxy function that sends requests through
+// rawURL unless the target host matches noProxy (NO_PROXY syntax: a comma
+// separated list of hosts, domain suffixes, IPs, CIDRs or "*"). auth, in
+// "user:password" form, overrides any credentials embedded in rawURL.
+// An empty rawURL returns nil so callers keep the transport default.
+func Func(rawURL, auth, noProxy string) (func(*http.Request) (*url.URL, error), error) {
+	rawURL = strings.TrimSpace(rawURL)
+	if rawURL == "" {
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url %q", Redact(rawURL))
+	}
+	if proxyURL.Scheme == "" || proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy url %q: scheme and host are required", Redact(rawURL))
+	}
+	if auth = strings.TrimSpace(auth); auth != "" {
+		user, pass, ok := strings.Cut(auth, ":")
+		if !ok {
+			return nil, fmt.Errorf("proxy auth must be in user:password form")
+		}
+		proxyURL.User = url.UserPassword(user, pass)
+	}
+	exclusions := parseNoProxy(noProxy)
+	return func(req *http.Request) (*url.URL, error) {
+		if exclusions.match(req.URL) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}, nil
+}
+
+// Redact removes the password from a proxy URL so it can be logged or
+// returned in error messages.
+func Redact(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		if at := strings.LastIndex(rawURL, "@"); at >= 0 {
+			return "xxxxx" + rawURL[at:]
+		}
+		return rawURL
+	}
+	return parsed.Redacted()
+}
+
+type noProxyList struct {
+	all     bool
+	nets    []*net.IPNet
+	entries []noProxyEntry
+}
+
+type noProxyEntry struct {
+	host string
+	port string
+}
+
+func parseNoProxy(raw string) noProxyList {
+	var list noProxyList
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.ToLower(strings.TrimSpace(field))
+		if field == "" {
+			continue
+		}
+		if field == "*" {
+			list.all = true
+			continue
+		}
+		if _, ipNet, err := net.ParseCIDR(field); err == nil {
+			list.nets = append(list.nets, ipNet)
+			continue
+		}
+		entry := noProxyEntry{host: field}
+		if host, port, err := net.SplitHostPort(field); err == nil {
+			entry = noProxyEntry{host: host, port: port}
+		}
+		entry.host = strings.TrimPrefix(entry.host, "*")
+		list.entries = append(list.entries, entry)
+	}
+	return list
+}
+
+func (l noProxyList) match(target *url.URL) bool {
+	if l.all {
+		return true
+	}
+	host := strings.ToLower(target.Hostname())
+	port := target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, ipNet := range l.nets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	for _, entry := range l.entries {
+		if entry.port != "" && entry.port != port {
+			continue
+		}
+		if strings.HasPrefix(entry.host, ".") {
+			if strings.HasSuffix(host, entry.host) || host == entry.host[1:] {
+				return true
+			}
+			continue
+		}
+		if host == entry.host || strings.HasSuffix(host, "."+entry.host) {
+			return true
+		}
+	}
+	return false
+}
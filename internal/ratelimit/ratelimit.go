@@ -0,0 +1,152 @@
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limiter keeps one golang.org/x/time/rate token bucket per client key.
+// Buckets refill at perMinute tokens per minute up to burst tokens.
+type Limiter struct {
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*rate.Limiter
+	lastSweep time.Time
+}
+
+func New(perMinute, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		limit:   rate.Limit(float64(perMinute) / 60),
+		burst:   burst,
+		buckets: map[string]*rate.Limiter{},
+	}
+}
+
+// Allow takes a token for key. When the bucket is empty it returns false and
+// how long until the next token is available.
+func (l *Limiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = rate.NewLimiter(l.limit, l.burst)
+		l.buckets[key] = bucket
+	}
+	reservation := bucket.ReserveN(now, 1)
+	if !reservation.OK() {
+		return false, time.Minute
+	}
+	if wait := reservation.DelayFrom(now); wait > 0 {
+		// Rejected requests must not use up the client's future tokens.
+		reservation.CancelAt(now)
+		if l.limit <= 0 {
+			return false, time.Minute
+		}
+		return false, wait
+	}
+	return true, 0
+}
+
+// sweep drops buckets that are full again, since a new bucket is the same.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, bucket := range l.buckets {
+		if bucket.TokensAt(now) >= float64(l.burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Middleware limits requests per client IP. Non-GET requests to one of
+// strictPaths are counted against strict instead of general; a "*" segment
+// in a strict path matches any single segment, as in
+// "/api/plans/*/apply-by-team". Paths with a prefix in exemptPrefixes are not
+// limited. When trustProxy is set the
+// left-most X-Forwarded-For address identifies the client.
+func Middleware(next http.Handler, general, strict *Limiter, strictPaths, exemptPrefixes []string, trustProxy bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range exemptPrefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		limiter := general
+		for _, path := range strictPaths {
+			if r.Method != http.MethodGet && pathMatches(path, r.URL.Path) {
+				limiter = strict
+				break
+			}
+		}
+		if limiter != nil {
+			if ok, wait := limiter.Allow(clientIP(r, trustProxy), time.Now()); !ok {
+				seconds := int(math.Ceil(wait.Seconds()))
+				if seconds < 1 {
+					seconds = 1
+				}
+				w.Header().Set("Retry-After", strconv.Itoa(seconds))
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// pathMatches reports whether path equals pattern, where a "*" segment of
+// pattern stands for any one non-empty segment.
+func pathMatches(pattern, path string) bool {
+	if !strings.Contains(pattern, "*") {
+		return pattern == path
+	}
+	want := strings.Split(pattern, "/")
+	got := strings.Split(path, "/")
+	if len(want) != len(got) {
+		return false
+	}
+	for i := range want {
+		if want[i] == "*" {
+			if got[i] == "" {
+				return false
+			}
+			continue
+		}
+		if want[i] != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			if ip := strings.TrimSpace(first); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
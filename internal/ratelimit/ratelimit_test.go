@@ -0,0 +1,119 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiterAllow(t *testing.T) {
+	l := New(60, 2)
+	now := time.Unix(1000, 0)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("a", now); !ok {
+			t.Fatalf("request %d within burst rejected", i+1)
+		}
+	}
+	ok, wait := l.Allow("a", now)
+	if ok || wait <= 0 || wait > time.Second {
+		t.Fatalf("Allow over burst = %v, %s; want rejected with wait up to 1s", ok, wait)
+	}
+	if ok, _ := l.Allow("b", now); !ok {
+		t.Fatal("another client shares the bucket")
+	}
+	// Rejected requests don't consume tokens: one second refills exactly one.
+	if ok, _ := l.Allow("a", now.Add(time.Second)); !ok {
+		t.Fatal("request after refill rejected")
+	}
+	if ok, _ := l.Allow("a", now.Add(time.Second)); ok {
+		t.Fatal("second request after a one-token refill allowed")
+	}
+}
+
+func TestLimiterSweepsFullBuckets(t *testing.T) {
+	l := New(60, 1)
+	now := time.Unix(1000, 0)
+	l.Allow("a", now)
+	l.Allow("b", now.Add(2*time.Minute))
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("idle full bucket was kept")
+	}
+	if _, ok := l.buckets["b"]; !ok {
+		t.Error("active bucket was dropped")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := Middleware(next, New(60, 2), New(1, 1), []string{"/sync/run"}, []string{"/static/"}, true)
+	do := func(method, path, forwardedFor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPost, "/sync/run", ""); rec.Code != http.StatusOK {
+		t.Fatalf("first sync = %d", rec.Code)
+	}
+	rec := do(http.MethodPost, "/sync/run", "")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" {
+		t.Fatalf("second sync = %d, Retry-After %q; want 429 and 60", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := do(http.MethodGet, "/sync/run", ""); rec.Code != http.StatusOK {
+		t.Fatalf("GET of a strict path used the strict limit: %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/sync/run", "192.0.2.7, 10.0.0.1"); rec.Code != http.StatusOK {
+		t.Fatalf("forwarded client shares the proxy's bucket: %d", rec.Code)
+	}
+	for i := 0; i < 5; i++ {
+		if rec := do(http.MethodGet, "/static/app.css", ""); rec.Code != http.StatusOK {
+			t.Fatalf("exempt path limited: %d", rec.Code)
+		}
+	}
+}
+
+func TestPathMatches(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/sync/run", "/sync/run", true},
+		{"/sync/run", "/sync/run/", false},
+		{"/api/plans/*/apply-by-team", "/api/plans/12/apply-by-team", true},
+		{"/api/plans/*/apply-by-team", "/api/plans//apply-by-team", false},
+		{"/api/plans/*/apply-by-team", "/api/plans/12/summary", false},
+		{"/api/plans/*/apply-by-team", "/api/plans/12/apply-by-team/x", false},
+		{"/api/mappings/*/preview", "/api/mappings/3/preview", true},
+	} {
+		if got := pathMatches(tc.pattern, tc.path); got != tc.want {
+			t.Errorf("pathMatches(%q, %q) = %v, want %v", tc.pattern, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestMiddlewareStrictPattern(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := Middleware(next, nil, New(1, 1), []string{"/api/plans/*/apply-by-team"}, nil, false)
+	do := func(path string) int {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := do("/api/plans/1/apply-by-team"); code != http.StatusOK {
+		t.Fatalf("first apply = %d", code)
+	}
+	if code := do("/api/plans/2/apply-by-team"); code != http.StatusTooManyRequests {
+		t.Fatalf("second apply of another plan = %d, want 429", code)
+	}
+	if code := do("/api/plans/2/summary"); code != http.StatusOK {
+		t.Fatalf("non-strict path = %d, want the general limit (none)", code)
+	}
+}
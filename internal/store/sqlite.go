@@ -1,27 +1,87 @@
 package store
 
 import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"net/url"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
+
+	"grafana-ad-syncher/internal/entra"
 )
 
 type Store struct {
 	db *sql.DB
+	// maintenanceTimeout bounds ANALYZE and VACUUM; SQLite interrupts the
+	// statement once it expires.
+	maintenanceTimeout time.Duration
+	// encryptionKey is the AES-256 key for secrets kept at rest, such as
+	// Grafana org tokens; nil until SetEncryptionKey is called.
+	encryptionKey []byte
+
+	// tokens caches GetToken results by Grafana org ID, so org-scoped
+	// Grafana requests don't query and decrypt the token every time.
+	// tokenGen counts cache clears; a lookup that raced with one is not
+	// cached.
+	tokenMu  sync.Mutex
+	tokens   map[int64]cachedToken
+	tokenGen int
+}
+
+// cachedToken is a decrypted Grafana org token, "" for none, and when the
+// cache entry stops being valid.
+type cachedToken struct {
+	token     string
+	validTill time.Time
 }
 
+// tokenCacheTTL bounds how long GetToken serves a cached token, in case the
+// database is changed by something other than this Store.
+const tokenCacheTTL = time.Minute
+
+// defaultMaintenanceTimeout is used until SetMaintenanceTimeout is called.
+const defaultMaintenanceTimeout = 30 * time.Second
+
 const autoSyncSettingKey = "auto_sync_enabled"
 
+const syncIntervalSettingKey = "sync_interval_seconds"
+
 type Org struct {
 	ID           int64
 	GrafanaOrgID int64
 	Name         string
 	DefaultRole  string
+	// TenantID is the tenants.id whose Entra credentials serve this org; 0
+	// uses the default ENTRA_* tenant.
+	TenantID int64
+}
+
+// Tenant holds the Entra app registration for one tenant. Empty base URLs
+// fall back to the global ENTRA_AUTHORITY_BASE_URL and GRAPH_API_BASE_URL.
+type Tenant struct {
+	ID               int64  `json:"id"`
+	Name             string `json:"name"`
+	TenantID         string `json:"tenant_id"`
+	ClientID         string `json:"client_id"`
+	ClientSecret     string `json:"client_secret,omitempty"`
+	AuthorityBaseURL string `json:"authority_base_url"`
+	GraphBaseURL     string `json:"graph_base_url"`
 }
 
 type Mapping struct {
@@ -33,6 +93,44 @@ type Mapping struct {
 	ExternalGroupName string
 	TeamRole          string
 	RoleOverride      string
+	// RemovalGracePeriod overrides REMOVAL_GRACE_PERIOD for this mapping. It is
+	// a Go duration string; empty means the global default applies.
+	RemovalGracePeriod string
+	// AllowRemoveMembers overrides ALLOW_REMOVE_TEAM_MEMBERS for this
+	// mapping; nil means the global setting applies.
+	AllowRemoveMembers *bool
+	// ContactPointUID names a Grafana alerting contact point that alerts
+	// labelled with this team are routed to; empty means none.
+	ContactPointUID string
+	// TeamPrefsJSON holds the team preferences (theme, homeDashboardUID,
+	// timezone) as a JSON object; empty means they are not managed.
+	TeamPrefsJSON string
+	// DataSourceTemplateJSON is a text/template producing the JSON body of a
+	// data source provisioned for the team; empty means none is managed.
+	DataSourceTemplateJSON string
+	// PreviousGrafanaTeamName is the team name before the mapping was last
+	// renamed, kept until the syncer has renamed the Grafana team.
+	PreviousGrafanaTeamName string
+}
+
+// DataSourcePermission grants a mapping's Grafana team a permission level
+// (Query, Edit or Admin) on a data source. Applying it needs Grafana
+// Enterprise.
+type DataSourcePermission struct {
+	MappingID     int64  `json:"mapping_id"`
+	DataSourceUID string `json:"datasource_uid"`
+	Permission    string `json:"permission"`
+}
+
+// MappingDataSource records the data source provisioned for a mapping's team
+// and the rendered definition it was last created or updated with.
+type MappingDataSource struct {
+	MappingID     int64
+	GrafanaOrgID  int64
+	DataSourceID  int64
+	DataSourceUID string
+	SpecJSON      string
+	CreatedAt     time.Time
 }
 
 type Plan struct {
@@ -40,6 +138,11 @@ type Plan struct {
 	CreatedAt string
 	Status    string
 	Actions   []PlanAction
+	// Warnings are diagnostics found while building the plan.
+	Warnings []string
+	// SAMLConflict is set when Grafana's SAML team sync may revert the
+	// plan's team removals.
+	SAMLConflict bool
 }
 
 type PlanAction struct {
@@ -56,17 +159,71 @@ type PlanAction struct {
 	DisplayName    string
 	Role           string
 	ExternalGroupID string
+	// Login is the Grafana login used when the action creates the user.
+	Login          string
+	// Description is the team description set by update_team_description.
+	Description    string
+	// ContactPointUID is the contact point linked by assign_contact_point.
+	ContactPointUID string
+	// TeamPrefsJSON holds the preferences set by set_team_preferences.
+	TeamPrefsJSON  string
+	// MappingID is the mapping a create_team_folder action creates the
+	// folder for.
+	MappingID      int64
+	// DataSourceUID and Permission describe a set_datasource_permission
+	// action.
+	DataSourceUID  string
+	Permission     string
+	// DataSourceSpecJSON is the rendered data source definition of a
+	// provision_datasource or update_datasource action.
+	DataSourceSpecJSON string
+	// AvatarURL is the team avatar set by set_team_avatar.
+	AvatarURL      string
+	// TeamEmail is the team contact email set by update_team_email.
+	TeamEmail      string
 	Note           string
 }
 
+// PendingRemoval records a team member that left the mapped Entra group but
+// is kept in the Grafana team until the removal grace period has elapsed.
+type PendingRemoval struct {
+	ID          int64
+	MappingID   int64
+	TeamID      int64
+	UserID      int64
+	Email       string
+	FirstSeenAt time.Time
+}
+
+// ServiceAccountToken is a Grafana service account token, used by a
+// mapping's team, that the syncer rotates before it expires.
+type ServiceAccountToken struct {
+	MappingID int64     `json:"mapping_id"`
+	SAID      int64     `json:"sa_id"`
+	TokenID   int64     `json:"token_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Key is the secret of the last token the syncer created, encrypted at
+	// rest; it is empty for tokens registered through the API.
+	Key string `json:"key,omitempty"`
+}
+
+// UserInvite is a Grafana org invitation sent instead of creating a user
+// with a local password.
+type UserInvite struct {
+	GrafanaOrgID int64     `json:"grafana_org_id"`
+	Email        string    `json:"email"`
+	Code         string    `json:"code"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
 type SyncAction struct {
-	ID           int64
-	CreatedAt    string
-	OrgID        int64
-	GrafanaOrgID int64
-	ActionType   string
-	TeamName     string
-	Email        string
+	ID           int64  `json:"id"`
+	CreatedAt    string `json:"created_at"`
+	OrgID        int64  `json:"org_id"`
+	GrafanaOrgID int64  `json:"-"`
+	ActionType   string `json:"action_type"`
+	TeamName     string `json:"team_name"`
+	Email        string `json:"-"`
 }
 
 func (s *Store) GetSetting(key string) (string, bool, error) {
@@ -97,6 +254,73 @@ func (s *Store) SetSetting(key, value string) error {
 	return nil
 }
 
+// ConnStatus is the last known connectivity of one external service. Times
+// are RFC 3339 and empty when unknown.
+type ConnStatus struct {
+	LastOK      string `json:"last_ok"`
+	LastError   string `json:"last_error"`
+	LastErrorAt string `json:"last_error_at"`
+}
+
+// ConnHistory is the persisted connectivity of Grafana and Entra.
+type ConnHistory struct {
+	Grafana ConnStatus `json:"grafana"`
+	Entra   ConnStatus `json:"entra"`
+}
+
+// GetConnectivityHistory returns the connectivity saved by
+// SetConnectivity; services never saved have an empty ConnStatus.
+func (s *Store) GetConnectivityHistory() (ConnHistory, error) {
+	var history ConnHistory
+	for service, status := range map[string]*ConnStatus{"grafana": &history.Grafana, "entra": &history.Entra} {
+		for suffix, field := range map[string]*string{"_last_ok": &status.LastOK, "_last_error": &status.LastError, "_last_error_at": &status.LastErrorAt} {
+			value, _, err := s.GetSetting(service + suffix)
+			if err != nil {
+				return ConnHistory{}, err
+			}
+			*field = value
+		}
+	}
+	return history, nil
+}
+
+// SetConnectivity saves the connectivity of service ("grafana" or "entra").
+func (s *Store) SetConnectivity(service string, status ConnStatus) error {
+	if err := s.SetSetting(service+"_last_ok", status.LastOK); err != nil {
+		return err
+	}
+	if err := s.SetSetting(service+"_last_error", status.LastError); err != nil {
+		return err
+	}
+	return s.SetSetting(service+"_last_error_at", status.LastErrorAt)
+}
+
+// latencySettingKey is the settings key holding the saved p99 latency of
+// one request category ("read" or "write") of service.
+func latencySettingKey(service, category string) string {
+	return fmt.Sprintf("%s_latency_%s_p99_ms", service, category)
+}
+
+// SetLatencyP99 saves the p99 latency of a request category of service
+// ("grafana" or "entra").
+func (s *Store) SetLatencyP99(service, category string, p99 time.Duration) error {
+	return s.SetSetting(latencySettingKey(service, category), strconv.FormatInt(p99.Milliseconds(), 10))
+}
+
+// GetLatencyP99 returns the p99 latency saved by SetLatencyP99; ok is false
+// when none has been saved.
+func (s *Store) GetLatencyP99(service, category string) (p99 time.Duration, ok bool, err error) {
+	value, ok, err := s.GetSetting(latencySettingKey(service, category))
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, false, nil
+	}
+	return time.Duration(ms) * time.Millisecond, true, nil
+}
+
 func (s *Store) AutoSyncEnabled() (bool, error) {
 	value, ok, err := s.GetSetting(autoSyncSettingKey)
 	if err != nil {
@@ -116,25 +340,180 @@ func (s *Store) SetAutoSyncEnabled(enabled bool) error {
 	return s.SetSetting(autoSyncSettingKey, strconv.FormatBool(enabled))
 }
 
-func Open(dataDir string) (*Store, error) {
+// SyncInterval returns the auto-sync interval saved on the settings page.
+// ok is false when none has been saved; zero means automatic sync is off.
+func (s *Store) SyncInterval() (time.Duration, bool, error) {
+	value, ok, err := s.GetSetting(syncIntervalSettingKey)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, false, nil
+	}
+	return time.Duration(seconds) * time.Second, true, nil
+}
+
+func (s *Store) SetSyncInterval(interval time.Duration) error {
+	return s.SetSetting(syncIntervalSettingKey, strconv.Itoa(int(interval/time.Second)))
+}
+
+// Open opens (and migrates) the database in dataDir. pageSize only applies
+// to a new database file; an existing one keeps its page size until it is
+// vacuumed. cacheSizeKB and synchronous=NORMAL are applied to every
+// connection through the DSN.
+func Open(dataDir string, pageSize, cacheSizeKB int) (*Store, error) {
 	path := filepath.Join(dataDir, "sync.db")
-	db, err := sql.Open("sqlite3", path)
-	if err != nil {
-		return nil, err
+	params := url.Values{
+		"_synchronous": {"NORMAL"},
+		"_cache_size":  {strconv.Itoa(-cacheSizeKB)},
 	}
+	dsn := "file:" + escapeURIPath(path) + "?" + params.Encode()
+	// page_size must be set before the first table is created. It is set on
+	// every new connection so it applies whichever pooled connection runs
+	// the migration.
+	db := sql.OpenDB(sqliteConnector{dsn: dsn, driver: &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if _, err := conn.Exec(fmt.Sprintf(`PRAGMA page_size = %d`, pageSize), nil); err != nil {
+				return fmt.Errorf("set page size: %w", err)
+			}
+			return nil
+		},
+	}})
 	if err := migrate(db); err != nil {
 		_ = db.Close()
 		return nil, err
 	}
-	return &Store{db: db}, nil
+	var actual int
+	if err := db.QueryRow(`PRAGMA page_size`).Scan(&actual); err == nil && actual != pageSize {
+		log.Printf("store: page size is %d, DB_PAGE_SIZE=%d takes effect after VACUUM", actual, pageSize)
+	}
+	s := &Store{db: db, maintenanceTimeout: defaultMaintenanceTimeout}
+	if err := s.Analyze(); err != nil {
+		log.Printf("store: analyze after migration failed: %v", err)
+	}
+	return s, nil
+}
+
+// sqliteConnector opens connections with a driver carrying a ConnectHook,
+// which sql.Open by driver name can't do without registering a driver.
+type sqliteConnector struct {
+	dsn    string
+	driver *sqlite3.SQLiteDriver
+}
+
+func (c sqliteConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c sqliteConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// escapeURIPath escapes the characters that end or escape the path of an
+// SQLite URI filename.
+func escapeURIPath(path string) string {
+	return strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(path)
+}
+
+// SetMaintenanceTimeout bounds how long Analyze and Vacuum may hold the
+// database; a non-positive value restores the default.
+func (s *Store) SetMaintenanceTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = defaultMaintenanceTimeout
+	}
+	s.maintenanceTimeout = timeout
+}
+
+// Analyze refreshes the statistics SQLite's query planner uses.
+func (s *Store) Analyze() error {
+	return s.maintenance("ANALYZE")
+}
+
+// Vacuum rebuilds the database file, returning free pages to the file
+// system. An interrupted VACUUM leaves the database unchanged.
+func (s *Store) Vacuum() error {
+	return s.maintenance("VACUUM")
+}
+
+func (s *Store) maintenance(statement string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.maintenanceTimeout)
+	defer cancel()
+	if _, err := s.db.ExecContext(ctx, statement); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s interrupted after %s: %w", strings.ToLower(statement), s.maintenanceTimeout, ctx.Err())
+		}
+		return fmt.Errorf("%s: %w", strings.ToLower(statement), err)
+	}
+	return nil
 }
 
 func (s *Store) Close() error {
 	return s.db.Close()
 }
 
+// backupPrefix and backupSuffix frame the names of backup files written by
+// WriteBackup; PruneBackups only touches files matching them.
+const (
+	backupPrefix = "sync-backup-"
+	backupSuffix = ".db"
+)
+
+// BackupFileName returns the file name used for a backup taken at t.
+func BackupFileName(t time.Time) string {
+	return backupPrefix + t.UTC().Format("20060102T150405Z") + backupSuffix
+}
+
+// Backup writes a consistent copy of the live database to path using
+// SQLite's VACUUM INTO. The target file must not exist yet.
+func (s *Store) Backup(path string) error {
+	if _, err := s.db.Exec(`VACUUM INTO ?`, path); err != nil {
+		return fmt.Errorf("backup to %s: %w", path, err)
+	}
+	return nil
+}
+
+// WriteBackup writes a timestamped backup into dir and returns its path.
+func (s *Store) WriteBackup(dir string, now time.Time) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, BackupFileName(now))
+	if err := s.Backup(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// PruneBackups deletes backup files in dir last modified before cutoff and
+// returns how many were removed.
+func PruneBackups(dir string, cutoff time.Time) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return removed, err
+		}
+		if info.ModTime().Before(cutoff) {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
 func (s *Store) ListOrgs() ([]Org, error) {
-	rows, err := s.db.Query(`SELECT id, grafana_org_id, name, default_role FROM orgs ORDER BY grafana_org_id`)
+	rows, err := s.db.Query(`SELECT id, grafana_org_id, name, default_role, COALESCE(tenant_id, 0) FROM orgs ORDER BY grafana_org_id`)
 	if err != nil {
 		return nil, err
 	}
@@ -143,7 +522,7 @@ func (s *Store) ListOrgs() ([]Org, error) {
 	var orgs []Org
 	for rows.Next() {
 		var org Org
-		if err := rows.Scan(&org.ID, &org.GrafanaOrgID, &org.Name, &org.DefaultRole); err != nil {
+		if err := rows.Scan(&org.ID, &org.GrafanaOrgID, &org.Name, &org.DefaultRole, &org.TenantID); err != nil {
 			return nil, err
 		}
 		orgs = append(orgs, org)
@@ -151,194 +530,1190 @@ func (s *Store) ListOrgs() ([]Org, error) {
 	return orgs, rows.Err()
 }
 
-func (s *Store) CreateOrg(org Org) (int64, error) {
-	res, err := s.db.Exec(`INSERT INTO orgs (grafana_org_id, name, default_role) VALUES (?, ?, ?)`, org.GrafanaOrgID, org.Name, org.DefaultRole)
-	if err != nil {
-		return 0, err
-	}
-	return res.LastInsertId()
-}
+// ErrDuplicate is returned when an insert violates a unique constraint.
+var ErrDuplicate = errors.New("already exists")
 
-func (s *Store) DeleteOrg(id int64) error {
-	_, err := s.db.Exec(`DELETE FROM orgs WHERE id = ?`, id)
-	return err
-}
+// ErrNoEncryptionKey is returned when a secret is stored or read before
+// SetEncryptionKey was called with a non-empty secret.
+var ErrNoEncryptionKey = errors.New("DATA_ENCRYPTION_KEY not set")
 
-func (s *Store) ListMappings() ([]Mapping, error) {
-	rows, err := s.db.Query(`SELECT id, org_id, grafana_team_name, grafana_team_id, external_group_id, external_group_name, team_role, role_override FROM mappings ORDER BY id`)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+func isUniqueViolation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
 
-	var mappings []Mapping
-	for rows.Next() {
-		var m Mapping
-		if err := rows.Scan(&m.ID, &m.OrgID, &m.GrafanaTeamName, &m.GrafanaTeamID, &m.ExternalGroupID, &m.ExternalGroupName, &m.TeamRole, &m.RoleOverride); err != nil {
-			return nil, err
+// GetOrg returns the org with the given id, or nil if it does not exist.
+func (s *Store) GetOrg(id int64) (*Org, error) {
+	row := s.db.QueryRow(`SELECT id, grafana_org_id, name, default_role, COALESCE(tenant_id, 0) FROM orgs WHERE id = ?`, id)
+	var org Org
+	if err := row.Scan(&org.ID, &org.GrafanaOrgID, &org.Name, &org.DefaultRole, &org.TenantID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
 		}
-		mappings = append(mappings, m)
+		return nil, err
 	}
-	return mappings, rows.Err()
+	return &org, nil
 }
 
-func (s *Store) GetMapping(id int64) (*Mapping, error) {
-	row := s.db.QueryRow(`SELECT id, org_id, grafana_team_name, grafana_team_id, external_group_id, external_group_name, team_role, role_override FROM mappings WHERE id = ?`, id)
-	var m Mapping
-	if err := row.Scan(&m.ID, &m.OrgID, &m.GrafanaTeamName, &m.GrafanaTeamID, &m.ExternalGroupID, &m.ExternalGroupName, &m.TeamRole, &m.RoleOverride); err != nil {
+// GetOrgByGrafanaID returns the org configured for the given Grafana org
+// id, or nil if none is.
+func (s *Store) GetOrgByGrafanaID(grafanaOrgID int64) (*Org, error) {
+	row := s.db.QueryRow(`SELECT id, grafana_org_id, name, default_role, COALESCE(tenant_id, 0) FROM orgs WHERE grafana_org_id = ?`, grafanaOrgID)
+	var org Org
+	if err := row.Scan(&org.ID, &org.GrafanaOrgID, &org.Name, &org.DefaultRole, &org.TenantID); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
 		return nil, err
 	}
-	return &m, nil
+	return &org, nil
 }
 
-func (s *Store) CreateMapping(m Mapping) (int64, error) {
-	res, err := s.db.Exec(`INSERT INTO mappings (org_id, grafana_team_name, grafana_team_id, external_group_id, external_group_name, team_role, role_override) VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		m.OrgID, m.GrafanaTeamName, m.GrafanaTeamID, m.ExternalGroupID, m.ExternalGroupName, m.TeamRole, m.RoleOverride)
+func (s *Store) CreateOrg(org Org) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO orgs (grafana_org_id, name, default_role, tenant_id) VALUES (?, ?, ?, ?)`, org.GrafanaOrgID, org.Name, org.DefaultRole, nullInt64(org.TenantID))
+	if isUniqueViolation(err) {
+		return 0, ErrDuplicate
+	}
 	if err != nil {
 		return 0, err
 	}
 	return res.LastInsertId()
 }
 
-func (s *Store) DeleteMapping(id int64) error {
-	_, err := s.db.Exec(`DELETE FROM mappings WHERE id = ?`, id)
+func (s *Store) DeleteOrg(id int64) error {
+	_, err := s.db.Exec(`DELETE FROM orgs WHERE id = ?`, id)
 	return err
 }
 
-func (s *Store) UpdateMapping(m Mapping) error {
-	_, err := s.db.Exec(`UPDATE mappings SET org_id = ?, grafana_team_name = ?, grafana_team_id = ?, external_group_id = ?, external_group_name = ?, team_role = ?, role_override = ?, updated_at = ? WHERE id = ?`,
-		m.OrgID,
-		m.GrafanaTeamName,
-		m.GrafanaTeamID,
-		m.ExternalGroupID,
-		m.ExternalGroupName,
-		m.TeamRole,
-		m.RoleOverride,
-		time.Now().UTC().Format(time.RFC3339),
-		m.ID,
-	)
+// UpdateOrgDefaultRole changes only an org's default role.
+func (s *Store) UpdateOrgDefaultRole(id int64, role string) error {
+	_, err := s.db.Exec(`UPDATE orgs SET default_role = ? WHERE id = ?`, role, id)
 	return err
 }
 
-func (s *Store) DeleteMappingsNotInGroupIDs(groupIDs []string) (int64, error) {
-	if len(groupIDs) == 0 {
-		return 0, nil
+// SetOrgGrafanaID points an org at a different Grafana org, e.g. one the
+// syncer just created for it.
+func (s *Store) SetOrgGrafanaID(orgID, grafanaOrgID int64) error {
+	_, err := s.db.Exec(`UPDATE orgs SET grafana_org_id = ? WHERE id = ?`, grafanaOrgID, orgID)
+	if isUniqueViolation(err) {
+		return ErrDuplicate
 	}
-	placeholders := make([]string, 0, len(groupIDs))
-	args := make([]any, 0, len(groupIDs))
-	for _, id := range groupIDs {
-		placeholders = append(placeholders, "?")
-		args = append(args, id)
-	}
-	query := fmt.Sprintf(`DELETE FROM mappings WHERE external_group_id NOT IN (%s)`, strings.Join(placeholders, ","))
-	res, err := s.db.Exec(query, args...)
-	if err != nil {
-		return 0, err
-	}
-	return res.RowsAffected()
+	return err
 }
 
-func (s *Store) UpdateMappingTeamID(id int64, teamID int64) error {
-	_, err := s.db.Exec(`UPDATE mappings SET grafana_team_id = ?, updated_at = ? WHERE id = ?`, teamID, time.Now().UTC().Format(time.RFC3339), id)
+// SetOrgTenant assigns an org to a tenant; tenantID 0 reverts it to the
+// default tenant.
+func (s *Store) SetOrgTenant(orgID, tenantID int64) error {
+	_, err := s.db.Exec(`UPDATE orgs SET tenant_id = ? WHERE id = ?`, nullInt64(tenantID), orgID)
 	return err
 }
 
-func (s *Store) UpdateMappingTeamIDForName(orgID int64, teamName string, teamID int64) error {
-	_, err := s.db.Exec(`UPDATE mappings SET grafana_team_id = ?, updated_at = ? WHERE org_id = ? AND grafana_team_name = ?`, teamID, time.Now().UTC().Format(time.RFC3339), orgID, teamName)
-	return err
+func nullInt64(v int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: v, Valid: v != 0}
 }
 
-func (s *Store) ReplacePlan(plan Plan) (int64, error) {
-	tx, err := s.db.Begin()
+// ListTenants returns the tenants with their client secrets decrypted.
+func (s *Store) ListTenants() ([]Tenant, error) {
+	rows, err := s.db.Query(`SELECT id, name, tenant_id, client_id, client_secret, secret_encrypted, authority_base_url, graph_base_url FROM tenants ORDER BY name`)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	if _, err := tx.Exec(`DELETE FROM plan_actions`); err != nil {
-		_ = tx.Rollback()
-		return 0, err
+	defer rows.Close()
+
+	var tenants []Tenant
+	for rows.Next() {
+		t, err := s.scanTenant(rows)
+		if err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, t)
 	}
-	if _, err := tx.Exec(`DELETE FROM plans`); err != nil {
-		_ = tx.Rollback()
-		return 0, err
+	return tenants, rows.Err()
+}
+
+// GetTenant returns the tenant with the given id, or nil if it does not exist.
+func (s *Store) GetTenant(id int64) (*Tenant, error) {
+	row := s.db.QueryRow(`SELECT id, name, tenant_id, client_id, client_secret, secret_encrypted, authority_base_url, graph_base_url FROM tenants WHERE id = ?`, id)
+	t, err := s.scanTenant(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
 	}
-	res, err := tx.Exec(`INSERT INTO plans (created_at, status) VALUES (?, ?)`, plan.CreatedAt, plan.Status)
+	return &t, nil
+}
+
+// scanTenant reads a tenant row and decrypts its client secret. Rows saved
+// before secrets were encrypted hold the plain secret.
+func (s *Store) scanTenant(row interface{ Scan(...any) error }) (Tenant, error) {
+	var t Tenant
+	var encrypted bool
+	if err := row.Scan(&t.ID, &t.Name, &t.TenantID, &t.ClientID, &t.ClientSecret, &encrypted, &t.AuthorityBaseURL, &t.GraphBaseURL); err != nil {
+		return Tenant{}, err
+	}
+	if encrypted {
+		secret, err := s.decrypt(t.ClientSecret)
+		if err != nil {
+			return Tenant{}, fmt.Errorf("client secret of tenant %d: %w", t.ID, err)
+		}
+		t.ClientSecret = secret
+	}
+	return t, nil
+}
+
+// CreateTenant stores a tenant with its client secret encrypted by the
+// DATA_ENCRYPTION_KEY; without one it returns ErrNoEncryptionKey.
+func (s *Store) CreateTenant(t Tenant) (int64, error) {
+	secret, err := s.encrypt(t.ClientSecret)
 	if err != nil {
-		_ = tx.Rollback()
 		return 0, err
 	}
-	planID, err := res.LastInsertId()
+	res, err := s.db.Exec(`INSERT INTO tenants (name, tenant_id, client_id, client_secret, secret_encrypted, authority_base_url, graph_base_url) VALUES (?, ?, ?, ?, 1, ?, ?)`,
+		t.Name, t.TenantID, t.ClientID, secret, t.AuthorityBaseURL, t.GraphBaseURL)
+	if isUniqueViolation(err) {
+		return 0, ErrDuplicate
+	}
 	if err != nil {
-		_ = tx.Rollback()
 		return 0, err
 	}
-	stmt, err := tx.Prepare(`INSERT INTO plan_actions (plan_id, action_type, org_id, grafana_org_id, team_id, team_name, team_role, user_id, email, display_name, role, external_group_id, note) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	return res.LastInsertId()
+}
+
+// UpdateTenant replaces a tenant, encrypting its client secret like
+// CreateTenant.
+func (s *Store) UpdateTenant(t Tenant) error {
+	secret, err := s.encrypt(t.ClientSecret)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`UPDATE tenants SET name = ?, tenant_id = ?, client_id = ?, client_secret = ?, secret_encrypted = 1, authority_base_url = ?, graph_base_url = ? WHERE id = ?`,
+		t.Name, t.TenantID, t.ClientID, secret, t.AuthorityBaseURL, t.GraphBaseURL, t.ID)
+	if isUniqueViolation(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// EncryptTenantSecrets encrypts the client secrets of tenants saved before
+// secrets were encrypted and returns how many it encrypted. Without a
+// DATA_ENCRYPTION_KEY it returns ErrNoEncryptionKey if any are left.
+func (s *Store) EncryptTenantSecrets() (int, error) {
+	rows, err := s.db.Query(`SELECT id, client_secret FROM tenants WHERE secret_encrypted = 0`)
 	if err != nil {
-		_ = tx.Rollback()
 		return 0, err
 	}
-	defer stmt.Close()
-	for _, action := range plan.Actions {
-		if _, err := stmt.Exec(planID, action.ActionType, action.OrgID, action.GrafanaOrgID, action.TeamID, action.TeamName, action.TeamRole, action.UserID, action.Email, action.DisplayName, action.Role, action.ExternalGroupID, action.Note); err != nil {
-			_ = tx.Rollback()
+	plain := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var secret string
+		if err := rows.Scan(&id, &secret); err != nil {
+			rows.Close()
 			return 0, err
 		}
+		plain[id] = secret
 	}
-	if err := tx.Commit(); err != nil {
+	rows.Close()
+	if err := rows.Err(); err != nil {
 		return 0, err
 	}
-	return planID, nil
+	for id, secret := range plain {
+		encrypted, err := s.encrypt(secret)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := s.db.Exec(`UPDATE tenants SET client_secret = ?, secret_encrypted = 1 WHERE id = ? AND secret_encrypted = 0`, encrypted, id); err != nil {
+			return 0, err
+		}
+	}
+	return len(plain), nil
 }
 
-func (s *Store) ClearPlan() error {
+// DeleteTenant removes a tenant and moves its orgs back to the default
+// tenant.
+func (s *Store) DeleteTenant(id int64) error {
 	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
-	if _, err := tx.Exec(`DELETE FROM plan_actions`); err != nil {
-		_ = tx.Rollback()
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE orgs SET tenant_id = NULL WHERE tenant_id = ?`, id); err != nil {
 		return err
 	}
-	if _, err := tx.Exec(`DELETE FROM plans`); err != nil {
-		_ = tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM tenants WHERE id = ?`, id); err != nil {
 		return err
 	}
 	return tx.Commit()
 }
 
-func (s *Store) LatestPlan() (*Plan, error) {
-	row := s.db.QueryRow(`SELECT id, created_at, status FROM plans ORDER BY id DESC LIMIT 1`)
-	var plan Plan
-	if err := row.Scan(&plan.ID, &plan.CreatedAt, &plan.Status); err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
+// CountMappingsByOrg returns the number of mappings in orgID.
+func (s *Store) CountMappingsByOrg(orgID int64) (int, error) {
+	row := s.db.QueryRow(`SELECT COUNT(*) FROM mappings WHERE org_id = ?`, orgID)
+	var count int
+	if err := row.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (s *Store) ListMappings() ([]Mapping, error) {
+	return s.queryMappings("")
+}
+
+// GetMappingByTeamName returns the first mapping of the org whose Grafana
+// team name matches teamName case-insensitively, or nil when none does.
+func (s *Store) GetMappingByTeamName(orgID int64, teamName string) (*Mapping, error) {
+	mappings, err := s.queryMappings(`WHERE org_id = ? AND LOWER(grafana_team_name) = LOWER(?)`, orgID, teamName)
+	if err != nil || len(mappings) == 0 {
 		return nil, err
 	}
-	rows, err := s.db.Query(`SELECT id, plan_id, action_type, org_id, grafana_org_id, team_id, team_name, team_role, user_id, email, display_name, role, external_group_id, note FROM plan_actions WHERE plan_id = ? ORDER BY id`, plan.ID)
+	return &mappings[0], nil
+}
+
+// GetMappingByGroupID returns the mappings of the org for an Entra group.
+func (s *Store) GetMappingByGroupID(orgID int64, groupID string) ([]Mapping, error) {
+	return s.queryMappings(`WHERE org_id = ? AND external_group_id = ?`, orgID, groupID)
+}
+
+// queryMappings loads the mappings matching where, ordered by id.
+func (s *Store) queryMappings(where string, args ...any) ([]Mapping, error) {
+	rows, err := s.db.Query(`SELECT id, org_id, grafana_team_name, grafana_team_id, external_group_id, external_group_name, team_role, role_override, removal_grace_period, allow_remove_members, contact_point_uid, team_prefs_json, datasource_template_json, previous_grafana_team_name FROM mappings `+where+` ORDER BY id`, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
+
+	var mappings []Mapping
 	for rows.Next() {
-		var action PlanAction
-		if err := rows.Scan(&action.ID, &action.PlanID, &action.ActionType, &action.OrgID, &action.GrafanaOrgID, &action.TeamID, &action.TeamName, &action.TeamRole, &action.UserID, &action.Email, &action.DisplayName, &action.Role, &action.ExternalGroupID, &action.Note); err != nil {
+		var m Mapping
+		var allowRemove sql.NullBool
+		if err := rows.Scan(&m.ID, &m.OrgID, &m.GrafanaTeamName, &m.GrafanaTeamID, &m.ExternalGroupID, &m.ExternalGroupName, &m.TeamRole, &m.RoleOverride, &m.RemovalGracePeriod, &allowRemove, &m.ContactPointUID, &m.TeamPrefsJSON, &m.DataSourceTemplateJSON, &m.PreviousGrafanaTeamName); err != nil {
 			return nil, err
 		}
-		plan.Actions = append(plan.Actions, action)
-	}
-	if err := rows.Err(); err != nil {
-		return nil, err
+		m.AllowRemoveMembers = nullBoolPtr(allowRemove)
+		mappings = append(mappings, m)
 	}
-	return &plan, nil
+	return mappings, rows.Err()
 }
 
-func (s *Store) UpdatePlanStatus(planID int64, status string) error {
-	_, err := s.db.Exec(`UPDATE plans SET status = ? WHERE id = ?`, status, planID)
-	return err
-}
+func (s *Store) GetMapping(id int64) (*Mapping, error) {
+	row := s.db.QueryRow(`SELECT id, org_id, grafana_team_name, grafana_team_id, external_group_id, external_group_name, team_role, role_override, removal_grace_period, allow_remove_members, contact_point_uid, team_prefs_json, datasource_template_json, previous_grafana_team_name FROM mappings WHERE id = ?`, id)
+	var m Mapping
+	var allowRemove sql.NullBool
+	if err := row.Scan(&m.ID, &m.OrgID, &m.GrafanaTeamName, &m.GrafanaTeamID, &m.ExternalGroupID, &m.ExternalGroupName, &m.TeamRole, &m.RoleOverride, &m.RemovalGracePeriod, &allowRemove, &m.ContactPointUID, &m.TeamPrefsJSON, &m.DataSourceTemplateJSON, &m.PreviousGrafanaTeamName); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	m.AllowRemoveMembers = nullBoolPtr(allowRemove)
+	return &m, nil
+}
+
+func nullBoolPtr(v sql.NullBool) *bool {
+	if !v.Valid {
+		return nil
+	}
+	b := v.Bool
+	return &b
+}
+
+func (s *Store) CreateMapping(m Mapping) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO mappings (org_id, grafana_team_name, grafana_team_id, external_group_id, external_group_name, team_role, role_override, removal_grace_period, allow_remove_members, contact_point_uid, team_prefs_json, datasource_template_json) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		m.OrgID, m.GrafanaTeamName, m.GrafanaTeamID, m.ExternalGroupID, m.ExternalGroupName, m.TeamRole, m.RoleOverride, m.RemovalGracePeriod, m.AllowRemoveMembers, m.ContactPointUID, m.TeamPrefsJSON, m.DataSourceTemplateJSON)
+	if isUniqueViolation(err) {
+		return 0, ErrDuplicate
+	}
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *Store) DeleteMapping(id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM datasource_permissions WHERE mapping_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM mappings WHERE id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateMapping saves m. When the team name changes within the same org, the
+// old name is kept in previous_grafana_team_name so the syncer can rename the
+// Grafana team; renaming again keeps the original name, and renaming back
+// clears it. Names are compared case-insensitively like Grafana team names.
+func (s *Store) UpdateMapping(m Mapping) error {
+	_, err := s.db.Exec(`UPDATE mappings SET previous_grafana_team_name = CASE
+			WHEN org_id <> ? THEN ''
+			WHEN grafana_team_name = ? COLLATE NOCASE THEN previous_grafana_team_name
+			WHEN previous_grafana_team_name = ? COLLATE NOCASE THEN ''
+			WHEN previous_grafana_team_name <> '' THEN previous_grafana_team_name
+			ELSE grafana_team_name
+		END, org_id = ?, grafana_team_name = ?, grafana_team_id = ?, external_group_id = ?, external_group_name = ?, team_role = ?, role_override = ?, removal_grace_period = ?, allow_remove_members = ?, contact_point_uid = ?, team_prefs_json = ?, datasource_template_json = ?, updated_at = ? WHERE id = ?`,
+		m.OrgID,
+		m.GrafanaTeamName,
+		m.GrafanaTeamName,
+		m.OrgID,
+		m.GrafanaTeamName,
+		m.GrafanaTeamID,
+		m.ExternalGroupID,
+		m.ExternalGroupName,
+		m.TeamRole,
+		m.RoleOverride,
+		m.RemovalGracePeriod,
+		m.AllowRemoveMembers,
+		m.ContactPointUID,
+		m.TeamPrefsJSON,
+		m.DataSourceTemplateJSON,
+		time.Now().UTC().Format(time.RFC3339),
+		m.ID,
+	)
+	if isUniqueViolation(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// ListDataSourcePermissions returns the data source permissions of one
+// mapping, or of all mappings when mappingID is 0.
+func (s *Store) ListDataSourcePermissions(mappingID int64) ([]DataSourcePermission, error) {
+	query := `SELECT mapping_id, datasource_uid, permission_level FROM datasource_permissions`
+	var args []any
+	if mappingID != 0 {
+		query += ` WHERE mapping_id = ?`
+		args = append(args, mappingID)
+	}
+	rows, err := s.db.Query(query+` ORDER BY mapping_id, datasource_uid`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var perms []DataSourcePermission
+	for rows.Next() {
+		var p DataSourcePermission
+		if err := rows.Scan(&p.MappingID, &p.DataSourceUID, &p.Permission); err != nil {
+			return nil, err
+		}
+		perms = append(perms, p)
+	}
+	return perms, rows.Err()
+}
+
+// SetDataSourcePermission adds or replaces a mapping's permission on a data
+// source.
+func (s *Store) SetDataSourcePermission(p DataSourcePermission) error {
+	_, err := s.db.Exec(`INSERT INTO datasource_permissions (mapping_id, datasource_uid, permission_level) VALUES (?, ?, ?)
+		ON CONFLICT(mapping_id, datasource_uid) DO UPDATE SET permission_level = excluded.permission_level`,
+		p.MappingID, p.DataSourceUID, p.Permission)
+	return err
+}
+
+// DeleteDataSourcePermission removes a mapping's permission on a data source
+// from the store. The grant already applied in Grafana is left in place.
+func (s *Store) DeleteDataSourcePermission(mappingID int64, dataSourceUID string) error {
+	_, err := s.db.Exec(`DELETE FROM datasource_permissions WHERE mapping_id = ? AND datasource_uid = ?`, mappingID, dataSourceUID)
+	return err
+}
+
+// ClearPreviousTeamName forgets a mapping's old team name once the Grafana
+// team has been renamed.
+func (s *Store) ClearPreviousTeamName(mappingID int64) error {
+	_, err := s.db.Exec(`UPDATE mappings SET previous_grafana_team_name = '' WHERE id = ?`, mappingID)
+	return err
+}
+
+// GetTeamFolder returns the UID of the folder created for a mapping's team,
+// or "" when none has been created.
+func (s *Store) GetTeamFolder(mappingID int64) (string, error) {
+	row := s.db.QueryRow(`SELECT folder_uid FROM team_folders WHERE mapping_id = ?`, mappingID)
+	var uid string
+	if err := row.Scan(&uid); err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+	return uid, nil
+}
+
+// IsTeamFolder reports whether folderUID is recorded as any mapping's team
+// folder.
+func (s *Store) IsTeamFolder(folderUID string) (bool, error) {
+	var n int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM team_folders WHERE folder_uid = ?`, folderUID).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// SetTeamFolder records the folder created for a mapping's team.
+func (s *Store) SetTeamFolder(mappingID int64, folderUID string) error {
+	_, err := s.db.Exec(`INSERT INTO team_folders (mapping_id, folder_uid, created_at) VALUES (?, ?, ?)
+		ON CONFLICT(mapping_id) DO UPDATE SET folder_uid = excluded.folder_uid, created_at = excluded.created_at`,
+		mappingID, folderUID, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// GetMappingDataSource returns the data source provisioned for a mapping's
+// team, or nil when none has been provisioned.
+func (s *Store) GetMappingDataSource(mappingID int64) (*MappingDataSource, error) {
+	row := s.db.QueryRow(`SELECT mapping_id, grafana_org_id, datasource_id, datasource_uid, spec_json, created_at FROM mapping_datasources WHERE mapping_id = ?`, mappingID)
+	var ds MappingDataSource
+	var createdAt string
+	if err := row.Scan(&ds.MappingID, &ds.GrafanaOrgID, &ds.DataSourceID, &ds.DataSourceUID, &ds.SpecJSON, &createdAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	ds.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	return &ds, nil
+}
+
+// ListMappingDataSources returns every provisioned data source, including
+// those whose mapping has since been deleted.
+func (s *Store) ListMappingDataSources() ([]MappingDataSource, error) {
+	rows, err := s.db.Query(`SELECT mapping_id, grafana_org_id, datasource_id, datasource_uid, spec_json, created_at FROM mapping_datasources ORDER BY mapping_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sources []MappingDataSource
+	for rows.Next() {
+		var ds MappingDataSource
+		var createdAt string
+		if err := rows.Scan(&ds.MappingID, &ds.GrafanaOrgID, &ds.DataSourceID, &ds.DataSourceUID, &ds.SpecJSON, &createdAt); err != nil {
+			return nil, err
+		}
+		ds.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+		sources = append(sources, ds)
+	}
+	return sources, rows.Err()
+}
+
+// SetMappingDataSource records the data source provisioned for a mapping's
+// team, replacing any previous record.
+func (s *Store) SetMappingDataSource(ds MappingDataSource) error {
+	_, err := s.db.Exec(`INSERT INTO mapping_datasources (mapping_id, grafana_org_id, datasource_id, datasource_uid, spec_json, created_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(mapping_id) DO UPDATE SET grafana_org_id = excluded.grafana_org_id, datasource_id = excluded.datasource_id, datasource_uid = excluded.datasource_uid, spec_json = excluded.spec_json`,
+		ds.MappingID, ds.GrafanaOrgID, ds.DataSourceID, ds.DataSourceUID, ds.SpecJSON, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// DeleteMappingDataSource forgets the data source provisioned for a mapping.
+func (s *Store) DeleteMappingDataSource(mappingID int64) error {
+	_, err := s.db.Exec(`DELETE FROM mapping_datasources WHERE mapping_id = ?`, mappingID)
+	return err
+}
+
+// GetTeamAvatarURL returns the avatar URL last set on a Grafana team by the
+// syncer, or "" when none has been set.
+func (s *Store) GetTeamAvatarURL(grafanaOrgID, teamID int64) (string, error) {
+	row := s.db.QueryRow(`SELECT avatar_url FROM team_metadata WHERE grafana_org_id = ? AND team_id = ?`, grafanaOrgID, teamID)
+	var avatarURL string
+	if err := row.Scan(&avatarURL); err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+	return avatarURL, nil
+}
+
+// SetTeamAvatarURL records the avatar URL set on a Grafana team.
+func (s *Store) SetTeamAvatarURL(grafanaOrgID, teamID int64, avatarURL string) error {
+	_, err := s.db.Exec(`INSERT INTO team_metadata (grafana_org_id, team_id, avatar_url, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(grafana_org_id, team_id) DO UPDATE SET avatar_url = excluded.avatar_url, updated_at = excluded.updated_at`,
+		grafanaOrgID, teamID, avatarURL, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// GetTeamEmail returns the contact email update_team_email last set on a
+// Grafana team, or "" when none has been set.
+func (s *Store) GetTeamEmail(grafanaOrgID, teamID int64) (string, error) {
+	row := s.db.QueryRow(`SELECT email FROM team_metadata WHERE grafana_org_id = ? AND team_id = ?`, grafanaOrgID, teamID)
+	var email string
+	if err := row.Scan(&email); err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+	return email, nil
+}
+
+// SetTeamEmail records the contact email update_team_email set on a
+// Grafana team.
+func (s *Store) SetTeamEmail(grafanaOrgID, teamID int64, email string) error {
+	_, err := s.db.Exec(`INSERT INTO team_metadata (grafana_org_id, team_id, email, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(grafana_org_id, team_id) DO UPDATE SET email = excluded.email, updated_at = excluded.updated_at`,
+		grafanaOrgID, teamID, email, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// GetTeamDescription returns the description update_team_description last
+// set on a Grafana team, or "" when none has been set. Grafana does not
+// return team descriptions, so plans compare against this.
+func (s *Store) GetTeamDescription(grafanaOrgID, teamID int64) (string, error) {
+	row := s.db.QueryRow(`SELECT description FROM team_metadata WHERE grafana_org_id = ? AND team_id = ?`, grafanaOrgID, teamID)
+	var description string
+	if err := row.Scan(&description); err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+	return description, nil
+}
+
+// SetTeamDescription records the description set on a Grafana team.
+func (s *Store) SetTeamDescription(grafanaOrgID, teamID int64, description string) error {
+	_, err := s.db.Exec(`INSERT INTO team_metadata (grafana_org_id, team_id, description, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(grafana_org_id, team_id) DO UPDATE SET description = excluded.description, updated_at = excluded.updated_at`,
+		grafanaOrgID, teamID, description, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// SetEncryptionKey derives the AES-256-GCM key for secrets stored at rest
+// from secret (DATA_ENCRYPTION_KEY). An empty secret disables storing them.
+func (s *Store) SetEncryptionKey(secret string) {
+	s.forgetTokens()
+	if secret == "" {
+		s.encryptionKey = nil
+		return
+	}
+	key := sha256.Sum256([]byte(secret))
+	s.encryptionKey = key[:]
+}
+
+func (s *Store) encrypt(plaintext string) (string, error) {
+	gcm, err := s.gcm()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *Store) decrypt(ciphertext string) (string, error) {
+	gcm, err := s.gcm()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+	nonce, data := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, data, nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypt: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+func (s *Store) gcm() (cipher.AEAD, error) {
+	if s.encryptionKey == nil {
+		return nil, ErrNoEncryptionKey
+	}
+	block, err := aes.NewCipher(s.encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SetGrafanaToken encrypts and saves the API token for a Grafana org,
+// replacing any previous one. A zero expiresAt means it does not expire.
+func (s *Store) SetGrafanaToken(grafanaOrgID int64, token string, expiresAt time.Time) error {
+	encrypted, err := s.encrypt(token)
+	if err != nil {
+		return err
+	}
+	expires := ""
+	if !expiresAt.IsZero() {
+		expires = expiresAt.UTC().Format(time.RFC3339)
+	}
+	_, err = s.db.Exec(`INSERT INTO grafana_tokens (grafana_org_id, token, expires_at, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(grafana_org_id) DO UPDATE SET token = excluded.token, expires_at = excluded.expires_at, created_at = excluded.created_at`,
+		grafanaOrgID, encrypted, expires, time.Now().UTC().Format(time.RFC3339))
+	s.forgetTokens()
+	return err
+}
+
+// DeleteGrafanaToken removes the saved token of a Grafana org and reports
+// whether there was one.
+func (s *Store) DeleteGrafanaToken(grafanaOrgID int64) (bool, error) {
+	res, err := s.db.Exec(`DELETE FROM grafana_tokens WHERE grafana_org_id = ?`, grafanaOrgID)
+	s.forgetTokens()
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// GetToken returns the decrypted token saved for a Grafana org, or "" when
+// there is none or it has expired. It makes Store a grafana.TokenProvider.
+// Results are cached for up to tokenCacheTTL and never past the token's
+// expiry; saving or deleting a token clears the cache.
+func (s *Store) GetToken(grafanaOrgID int64) (string, error) {
+	now := time.Now()
+	s.tokenMu.Lock()
+	cached, ok := s.tokens[grafanaOrgID]
+	gen := s.tokenGen
+	s.tokenMu.Unlock()
+	if ok && now.Before(cached.validTill) {
+		return cached.token, nil
+	}
+
+	row := s.db.QueryRow(`SELECT token, expires_at FROM grafana_tokens WHERE grafana_org_id = ?`, grafanaOrgID)
+	var encrypted, expires string
+	if err := row.Scan(&encrypted, &expires); err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	cached = cachedToken{validTill: now.Add(tokenCacheTTL)}
+	if expires != "" {
+		expiresAt, err := time.Parse(time.RFC3339, expires)
+		if err == nil && !now.Before(expiresAt) {
+			encrypted = ""
+		} else if err == nil && expiresAt.Before(cached.validTill) {
+			cached.validTill = expiresAt
+		}
+	}
+	if encrypted != "" {
+		token, err := s.decrypt(encrypted)
+		if err != nil {
+			return "", err
+		}
+		cached.token = token
+	}
+	s.tokenMu.Lock()
+	if s.tokenGen == gen {
+		if s.tokens == nil {
+			s.tokens = map[int64]cachedToken{}
+		}
+		s.tokens[grafanaOrgID] = cached
+	}
+	s.tokenMu.Unlock()
+	return cached.token, nil
+}
+
+// forgetTokens empties the GetToken cache.
+func (s *Store) forgetTokens() {
+	s.tokenMu.Lock()
+	s.tokens = nil
+	s.tokenGen++
+	s.tokenMu.Unlock()
+}
+
+// SetServiceAccountToken records the current token of a mapping's service
+// account, replacing the previous one. A non-empty Key is encrypted with the
+// DATA_ENCRYPTION_KEY; without one it returns ErrNoEncryptionKey.
+func (s *Store) SetServiceAccountToken(t ServiceAccountToken) error {
+	key, encrypted := "", false
+	if t.Key != "" {
+		var err error
+		if key, err = s.encrypt(t.Key); err != nil {
+			return err
+		}
+		encrypted = true
+	}
+	_, err := s.db.Exec(`INSERT INTO service_account_tokens (mapping_id, sa_id, token_id, expires_at, token_key, key_encrypted) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(mapping_id, sa_id) DO UPDATE SET token_id = excluded.token_id, expires_at = excluded.expires_at, token_key = excluded.token_key, key_encrypted = excluded.key_encrypted`,
+		t.MappingID, t.SAID, t.TokenID, t.ExpiresAt.UTC().Format(time.RFC3339), key, encrypted)
+	return err
+}
+
+// GetServiceAccountToken returns the tracked token of a mapping's service
+// account, or nil when there is none.
+func (s *Store) GetServiceAccountToken(mappingID, saID int64) (*ServiceAccountToken, error) {
+	tokens, err := s.queryServiceAccountTokens(`WHERE mapping_id = ? AND sa_id = ?`, mappingID, saID)
+	if err != nil || len(tokens) == 0 {
+		return nil, err
+	}
+	return &tokens[0], nil
+}
+
+// ListServiceAccountTokens returns all tracked tokens, soonest expiry first.
+func (s *Store) ListServiceAccountTokens() ([]ServiceAccountToken, error) {
+	return s.queryServiceAccountTokens("")
+}
+
+// queryServiceAccountTokens reads tokens and decrypts their keys. A key
+// that can't be decrypted, for example because DATA_ENCRYPTION_KEY is not
+// set, is left empty so rotation keeps working without it.
+func (s *Store) queryServiceAccountTokens(where string, args ...any) ([]ServiceAccountToken, error) {
+	rows, err := s.db.Query(`SELECT mapping_id, sa_id, token_id, expires_at, token_key, key_encrypted FROM service_account_tokens `+where+` ORDER BY expires_at`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tokens []ServiceAccountToken
+	for rows.Next() {
+		var t ServiceAccountToken
+		var expiresAt, key string
+		var encrypted bool
+		if err := rows.Scan(&t.MappingID, &t.SAID, &t.TokenID, &expiresAt, &key, &encrypted); err != nil {
+			return nil, err
+		}
+		t.ExpiresAt, _ = time.Parse(time.RFC3339, expiresAt)
+		if encrypted {
+			if t.Key, err = s.decrypt(key); err != nil {
+				log.Printf("store: service account %d token key not readable: %v", t.SAID, err)
+				t.Key = ""
+			}
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// EncryptServiceAccountTokenKeys encrypts the token keys saved before keys
+// were encrypted and returns how many it encrypted. Without a
+// DATA_ENCRYPTION_KEY it returns ErrNoEncryptionKey if any are left.
+func (s *Store) EncryptServiceAccountTokenKeys() (int, error) {
+	rows, err := s.db.Query(`SELECT mapping_id, sa_id, token_key FROM service_account_tokens WHERE key_encrypted = 0 AND token_key != ''`)
+	if err != nil {
+		return 0, err
+	}
+	type tokenRef struct{ mappingID, saID int64 }
+	plain := map[tokenRef]string{}
+	for rows.Next() {
+		var ref tokenRef
+		var key string
+		if err := rows.Scan(&ref.mappingID, &ref.saID, &key); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		plain[ref] = key
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for ref, key := range plain {
+		encrypted, err := s.encrypt(key)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := s.db.Exec(`UPDATE service_account_tokens SET token_key = ?, key_encrypted = 1 WHERE mapping_id = ? AND sa_id = ? AND key_encrypted = 0`, encrypted, ref.mappingID, ref.saID); err != nil {
+			return 0, err
+		}
+	}
+	return len(plain), nil
+}
+
+// HasEncryptionKey reports whether SetEncryptionKey was called with a
+// non-empty secret, so secrets can be stored.
+func (s *Store) HasEncryptionKey() bool {
+	return s.encryptionKey != nil
+}
+
+// SetUserInvite records the latest invitation of email to a Grafana org.
+func (s *Store) SetUserInvite(invite UserInvite) error {
+	_, err := s.db.Exec(`INSERT INTO user_invites (grafana_org_id, email, code, created_at) VALUES (?, LOWER(?), ?, ?)
+		ON CONFLICT(grafana_org_id, email) DO UPDATE SET code = excluded.code, created_at = excluded.created_at`,
+		invite.GrafanaOrgID, invite.Email, invite.Code, invite.CreatedAt.UTC().Format(time.RFC3339))
+	return err
+}
+
+// GetUserInvite returns the latest invitation of email to a Grafana org, or
+// nil when none was sent.
+func (s *Store) GetUserInvite(grafanaOrgID int64, email string) (*UserInvite, error) {
+	row := s.db.QueryRow(`SELECT email, code, created_at FROM user_invites WHERE grafana_org_id = ? AND email = LOWER(?)`, grafanaOrgID, email)
+	invite := UserInvite{GrafanaOrgID: grafanaOrgID}
+	var createdAt string
+	if err := row.Scan(&invite.Email, &invite.Code, &createdAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	invite.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	return &invite, nil
+}
+
+// RecordDisabledUser remembers that the syncer disabled a Grafana user, so
+// that only those accounts are re-enabled automatically.
+func (s *Store) RecordDisabledUser(userID int64, email string) error {
+	_, err := s.db.Exec(`INSERT INTO disabled_users (user_id, email, disabled_at) VALUES (?, LOWER(?), ?)
+		ON CONFLICT(user_id) DO UPDATE SET email = excluded.email, disabled_at = excluded.disabled_at`,
+		userID, email, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// ForgetDisabledUser removes a user re-enabled by the syncer.
+func (s *Store) ForgetDisabledUser(userID int64) error {
+	_, err := s.db.Exec(`DELETE FROM disabled_users WHERE user_id = ?`, userID)
+	return err
+}
+
+// ListDisabledUserIDs returns the Grafana users the syncer has disabled.
+func (s *Store) ListDisabledUserIDs() (map[int64]bool, error) {
+	rows, err := s.db.Query(`SELECT user_id FROM disabled_users`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := map[int64]bool{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+// FindDuplicateMappings returns groups of mappings sharing the same org,
+// Grafana team and Entra group. Team names are compared case-insensitively,
+// as they are everywhere else. The unique index prevents new duplicates,
+// but databases created before it may still hold some.
+func (s *Store) FindDuplicateMappings() ([][]Mapping, error) {
+	mappings, err := s.ListMappings()
+	if err != nil {
+		return nil, err
+	}
+	var all [][]Mapping
+	for _, m := range mappings {
+		matched := false
+		for i, group := range all {
+			first := group[0]
+			if first.OrgID == m.OrgID && first.ExternalGroupID == m.ExternalGroupID && strings.EqualFold(first.GrafanaTeamName, m.GrafanaTeamName) {
+				all[i] = append(group, m)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			all = append(all, []Mapping{m})
+		}
+	}
+	var groups [][]Mapping
+	for _, group := range all {
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
+
+func (s *Store) DeleteMappingsNotInGroupIDs(groupIDs []string) (int64, error) {
+	if len(groupIDs) == 0 {
+		return 0, nil
+	}
+	placeholders := make([]string, 0, len(groupIDs))
+	args := make([]any, 0, len(groupIDs))
+	for _, id := range groupIDs {
+		placeholders = append(placeholders, "?")
+		args = append(args, id)
+	}
+	query := fmt.Sprintf(`DELETE FROM mappings WHERE external_group_id NOT IN (%s)`, strings.Join(placeholders, ","))
+	res, err := s.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *Store) UpdateMappingTeamID(id int64, teamID int64) error {
+	_, err := s.db.Exec(`UPDATE mappings SET grafana_team_id = ?, updated_at = ? WHERE id = ?`, teamID, time.Now().UTC().Format(time.RFC3339), id)
+	return err
+}
+
+func (s *Store) UpdateMappingTeamIDForName(orgID int64, teamName string, teamID int64) error {
+	_, err := s.db.Exec(`UPDATE mappings SET grafana_team_id = ?, updated_at = ? WHERE org_id = ? AND grafana_team_name = ?`, teamID, time.Now().UTC().Format(time.RFC3339), orgID, teamName)
+	return err
+}
+
+// UpsertPendingRemoval records a pending removal if it is not known yet and
+// returns the time it was first seen.
+func (s *Store) UpsertPendingRemoval(r PendingRemoval) (time.Time, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	email := strings.ToLower(strings.TrimSpace(r.Email))
+	if _, err := s.db.Exec(`INSERT OR IGNORE INTO pending_removals (mapping_id, team_id, user_id, email, first_seen_at) VALUES (?, ?, ?, ?, ?)`,
+		r.MappingID, r.TeamID, r.UserID, email, now); err != nil {
+		return time.Time{}, err
+	}
+	row := s.db.QueryRow(`SELECT first_seen_at FROM pending_removals WHERE mapping_id = ? AND team_id = ? AND email = ?`, r.MappingID, r.TeamID, email)
+	var raw string
+	if err := row.Scan(&raw); err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, raw)
+}
+
+func (s *Store) ListPendingRemovals() ([]PendingRemoval, error) {
+	rows, err := s.db.Query(`SELECT id, mapping_id, team_id, user_id, email, first_seen_at FROM pending_removals ORDER BY first_seen_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var removals []PendingRemoval
+	for rows.Next() {
+		var r PendingRemoval
+		var firstSeen string
+		if err := rows.Scan(&r.ID, &r.MappingID, &r.TeamID, &r.UserID, &r.Email, &firstSeen); err != nil {
+			return nil, err
+		}
+		r.FirstSeenAt, _ = time.Parse(time.RFC3339, firstSeen)
+		removals = append(removals, r)
+	}
+	return removals, rows.Err()
+}
+
+// PruneRestoredRemovals forgets pending removals of a user from a team, e.g.
+// because the user reappeared in the mapped Entra group or was removed.
+func (s *Store) PruneRestoredRemovals(email string, teamID int64) error {
+	_, err := s.db.Exec(`DELETE FROM pending_removals WHERE email = ? AND team_id = ?`, strings.ToLower(strings.TrimSpace(email)), teamID)
+	return err
+}
+
+func (s *Store) ReplacePlan(plan Plan) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM plan_actions`); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM plans`); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	res, err := tx.Exec(`INSERT INTO plans (created_at, status, warnings, saml_conflict_detected) VALUES (?, ?, ?, ?)`, plan.CreatedAt, plan.Status, strings.Join(plan.Warnings, "\n"), plan.SAMLConflict)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	planID, err := res.LastInsertId()
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO plan_actions (plan_id, action_type, org_id, grafana_org_id, team_id, team_name, team_role, user_id, email, display_name, role, external_group_id, login, description, contact_point_uid, team_prefs_json, mapping_id, datasource_uid, permission, datasource_spec_json, avatar_url, team_email, note) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	defer stmt.Close()
+	for _, action := range plan.Actions {
+		if _, err := stmt.Exec(planID, action.ActionType, action.OrgID, action.GrafanaOrgID, action.TeamID, action.TeamName, action.TeamRole, action.UserID, action.Email, action.DisplayName, action.Role, action.ExternalGroupID, action.Login, action.Description, action.ContactPointUID, action.TeamPrefsJSON, action.MappingID, action.DataSourceUID, action.Permission, action.DataSourceSpecJSON, action.AvatarURL, action.TeamEmail, action.Note); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return planID, nil
+}
+
+func (s *Store) ClearPlan() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM plan_actions`); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM plans`); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// IsExpired reports whether the plan was built more than maxAge ago. A
+// non-positive maxAge never expires plans.
+func (p *Plan) IsExpired(maxAge time.Duration) bool {
+	if maxAge <= 0 {
+		return false
+	}
+	return p.Age() > maxAge
+}
+
+// Age returns how long ago the plan was built, or zero when CreatedAt does
+// not parse.
+func (p *Plan) Age() time.Duration {
+	createdAt, err := time.Parse(time.RFC3339, p.CreatedAt)
+	if err != nil {
+		return 0
+	}
+	return time.Since(createdAt)
+}
+
+// ClearPlansBefore deletes plans built before the given time and their
+// actions, returning the number of plans removed.
+func (s *Store) ClearPlansBefore(before time.Time) (int64, error) {
+	cutoff := before.UTC().Format(time.RFC3339)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM plan_actions WHERE plan_id IN (SELECT id FROM plans WHERE created_at < ?)`, cutoff); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	res, err := tx.Exec(`DELETE FROM plans WHERE created_at < ?`, cutoff)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *Store) LatestPlan() (*Plan, error) {
+	row := s.db.QueryRow(`SELECT id, created_at, status, warnings, saml_conflict_detected FROM plans ORDER BY id DESC LIMIT 1`)
+	var plan Plan
+	var warnings string
+	if err := row.Scan(&plan.ID, &plan.CreatedAt, &plan.Status, &warnings, &plan.SAMLConflict); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if warnings != "" {
+		plan.Warnings = strings.Split(warnings, "\n")
+	}
+	actions, err := s.queryPlanActions(`WHERE plan_id = ?`, plan.ID)
+	if err != nil {
+		return nil, err
+	}
+	plan.Actions = actions
+	return &plan, nil
+}
+
+// GetPlanActionsByTeam returns the actions of plan planID whose team is one
+// of teamNames, in plan order.
+func (s *Store) GetPlanActionsByTeam(planID int64, teamNames []string) ([]PlanAction, error) {
+	if len(teamNames) == 0 {
+		return nil, nil
+	}
+	args := []any{planID}
+	for _, name := range teamNames {
+		args = append(args, name)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(teamNames)), ",")
+	return s.queryPlanActions(`WHERE plan_id = ? AND team_name IN (`+placeholders+`)`, args...)
+}
+
+// queryPlanActions loads the plan actions matching where, ordered by id.
+func (s *Store) queryPlanActions(where string, args ...any) ([]PlanAction, error) {
+	rows, err := s.db.Query(`SELECT id, plan_id, action_type, org_id, grafana_org_id, team_id, team_name, team_role, user_id, email, display_name, role, external_group_id, login, description, contact_point_uid, team_prefs_json, mapping_id, datasource_uid, permission, datasource_spec_json, avatar_url, team_email, note FROM plan_actions `+where+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var actions []PlanAction
+	for rows.Next() {
+		var action PlanAction
+		if err := rows.Scan(&action.ID, &action.PlanID, &action.ActionType, &action.OrgID, &action.GrafanaOrgID, &action.TeamID, &action.TeamName, &action.TeamRole, &action.UserID, &action.Email, &action.DisplayName, &action.Role, &action.ExternalGroupID, &action.Login, &action.Description, &action.ContactPointUID, &action.TeamPrefsJSON, &action.MappingID, &action.DataSourceUID, &action.Permission, &action.DataSourceSpecJSON, &action.AvatarURL, &action.TeamEmail, &action.Note); err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+	}
+	return actions, rows.Err()
+}
+
+// PlanSummary is a plan's status with its actions counted by type and by
+// team.
+type PlanSummary struct {
+	PlanID       int64          `json:"plan_id"`
+	Status       string         `json:"status"`
+	CreatedAt    string         `json:"created_at"`
+	ActionCounts map[string]int `json:"action_counts"`
+	TeamCounts   map[string]int `json:"team_counts"`
+	Total        int            `json:"total"`
+	SAMLConflict bool           `json:"saml_conflict_detected"`
+}
+
+// GetPlanSummary counts the actions of plan id by type without loading them,
+// or returns nil if the plan does not exist.
+func (s *Store) GetPlanSummary(id int64) (*PlanSummary, error) {
+	var summary PlanSummary
+	row := s.db.QueryRow(`SELECT id, created_at, status, saml_conflict_detected FROM plans WHERE id = ?`, id)
+	if err := row.Scan(&summary.PlanID, &summary.CreatedAt, &summary.Status, &summary.SAMLConflict); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var err error
+	if summary.ActionCounts, err = s.CountPlanActionsByType(id); err != nil {
+		return nil, err
+	}
+	if summary.TeamCounts, err = s.CountPlanActionsByTeam(id); err != nil {
+		return nil, err
+	}
+	for _, count := range summary.ActionCounts {
+		summary.Total += count
+	}
+	return &summary, nil
+}
+
+// CountPlanActionsByType counts the actions of plan planID by action type.
+// An empty or missing plan gives an empty map.
+func (s *Store) CountPlanActionsByType(planID int64) (map[string]int, error) {
+	return s.countPlanActions("action_type", planID)
+}
+
+// CountPlanActionsByTeam counts the actions of plan planID by team name.
+// Actions without a team, such as org-wide ones, are counted under "".
+func (s *Store) CountPlanActionsByTeam(planID int64) (map[string]int, error) {
+	return s.countPlanActions("team_name", planID)
+}
+
+// countPlanActions groups the actions of a plan by column, which must be a
+// trusted column name.
+func (s *Store) countPlanActions(column string, planID int64) (map[string]int, error) {
+	rows, err := s.db.Query(`SELECT COALESCE(`+column+`, ''), COUNT(*) FROM plan_actions WHERE plan_id = ? GROUP BY 1`, planID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	for rows.Next() {
+		var key string
+		var count int
+		if err := rows.Scan(&key, &count); err != nil {
+			return nil, err
+		}
+		counts[key] = count
+	}
+	return counts, rows.Err()
+}
+
+func (s *Store) UpdatePlanStatus(planID int64, status string) error {
+	_, err := s.db.Exec(`UPDATE plans SET status = ? WHERE id = ?`, status, planID)
+	return err
+}
 
 func (s *Store) RecordSyncAction(action PlanAction, at time.Time) error {
 	createdAt := at.UTC().Format(time.RFC3339)
@@ -354,6 +1729,287 @@ func (s *Store) RecordSyncAction(action PlanAction, at time.Time) error {
 	return err
 }
 
+// ListSyncActionsForUser returns the newest applied actions for an email
+// address across all orgs, including archived ones, matching the address
+// case-insensitively.
+func (s *Store) ListSyncActionsForUser(email string, limit int) ([]SyncAction, error) {
+	email = strings.TrimSpace(email)
+	rows, err := s.db.Query(`SELECT id, created_at, org_id, COALESCE(grafana_org_id, 0), action_type, COALESCE(team_name, ''), email
+		FROM sync_actions WHERE LOWER(email) = LOWER(?)
+		UNION ALL
+		SELECT id, created_at, org_id, COALESCE(grafana_org_id, 0), action_type, COALESCE(team_name, ''), email
+		FROM sync_actions_archive WHERE LOWER(email) = LOWER(?)
+		ORDER BY created_at DESC, id DESC LIMIT ?`, email, email, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var actions []SyncAction
+	for rows.Next() {
+		var a SyncAction
+		if err := rows.Scan(&a.ID, &a.CreatedAt, &a.OrgID, &a.GrafanaOrgID, &a.ActionType, &a.TeamName, &a.Email); err != nil {
+			return nil, err
+		}
+		actions = append(actions, a)
+	}
+	return actions, rows.Err()
+}
+
+// GetGroupMemberCache returns the cached members of an Entra group and when
+// they were cached. A zero time means there is no cache entry.
+func (s *Store) GetGroupMemberCache(groupID string) ([]entra.Member, time.Time, error) {
+	var raw, cachedAt string
+	err := s.db.QueryRow(`SELECT member_json, cached_at FROM group_member_cache WHERE group_id = ?`, groupID).Scan(&raw, &cachedAt)
+	if err == sql.ErrNoRows {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var members []entra.Member
+	if err := json.Unmarshal([]byte(raw), &members); err != nil {
+		return nil, time.Time{}, fmt.Errorf("decode cached members of %s: %w", groupID, err)
+	}
+	at, err := time.Parse(time.RFC3339, cachedAt)
+	if err != nil {
+		return nil, time.Time{}, nil
+	}
+	return members, at, nil
+}
+
+// SetGroupMemberCache replaces the cached members of an Entra group.
+func (s *Store) SetGroupMemberCache(groupID string, members []entra.Member) error {
+	raw, err := json.Marshal(members)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO group_member_cache (group_id, member_json, cached_at) VALUES (?, ?, ?)
+		ON CONFLICT(group_id) DO UPDATE SET member_json = excluded.member_json, cached_at = excluded.cached_at`,
+		groupID, string(raw), time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// SyncActionRecord is a row of the sync action history.
+type SyncActionRecord struct {
+	ID           int64     `json:"id"`
+	CreatedAt    time.Time `json:"created_at"`
+	OrgID        int64     `json:"org_id"`
+	GrafanaOrgID int64     `json:"grafana_org_id"`
+	ActionType   string    `json:"action_type"`
+	TeamName     string    `json:"team_name"`
+	Email        string    `json:"email"`
+}
+
+// SyncActionFilter narrows a sync action history query. Zero values match
+// everything; Limit defaults to 100.
+type SyncActionFilter struct {
+	OrgID      int64
+	Email      string
+	ActionType string
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+}
+
+const archiveBatchSize = 1000
+
+// ArchiveSyncActionsBefore moves sync actions created before the given time
+// into sync_actions_archive, in batches so writers are not blocked for long.
+// It returns the number of rows moved.
+func (s *Store) ArchiveSyncActionsBefore(before time.Time) (int64, error) {
+	cutoff := before.UTC().Format(time.RFC3339)
+	batch := `SELECT id FROM sync_actions WHERE created_at < ? ORDER BY id LIMIT ?`
+	var total int64
+	for {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return total, err
+		}
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO sync_actions_archive (id, created_at, org_id, grafana_org_id, action_type, team_name, email)
+			SELECT id, created_at, org_id, grafana_org_id, action_type, team_name, email FROM sync_actions WHERE id IN (`+batch+`)`, cutoff, archiveBatchSize); err != nil {
+			_ = tx.Rollback()
+			return total, err
+		}
+		res, err := tx.Exec(`DELETE FROM sync_actions WHERE id IN (`+batch+`)`, cutoff, archiveBatchSize)
+		if err != nil {
+			_ = tx.Rollback()
+			return total, err
+		}
+		if err := tx.Commit(); err != nil {
+			return total, err
+		}
+		moved, _ := res.RowsAffected()
+		total += moved
+		if moved < archiveBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// ListArchivedSyncActions queries sync_actions_archive, newest first.
+func (s *Store) ListArchivedSyncActions(filter SyncActionFilter) ([]SyncActionRecord, error) {
+	query := `SELECT id, created_at, org_id, COALESCE(grafana_org_id, 0), action_type, COALESCE(team_name, ''), COALESCE(email, '') FROM sync_actions_archive WHERE 1 = 1`
+	var args []any
+	if filter.OrgID > 0 {
+		query += ` AND org_id = ?`
+		args = append(args, filter.OrgID)
+	}
+	if filter.Email != "" {
+		query += ` AND email = ?`
+		args = append(args, strings.ToLower(strings.TrimSpace(filter.Email)))
+	}
+	if filter.ActionType != "" {
+		query += ` AND action_type = ?`
+		args = append(args, filter.ActionType)
+	}
+	if !filter.Since.IsZero() {
+		query += ` AND created_at >= ?`
+		args = append(args, filter.Since.UTC().Format(time.RFC3339))
+	}
+	if !filter.Until.IsZero() {
+		query += ` AND created_at < ?`
+		args = append(args, filter.Until.UTC().Format(time.RFC3339))
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	query += ` ORDER BY created_at DESC, id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []SyncActionRecord
+	for rows.Next() {
+		var record SyncActionRecord
+		var createdAt string
+		if err := rows.Scan(&record.ID, &createdAt, &record.OrgID, &record.GrafanaOrgID, &record.ActionType, &record.TeamName, &record.Email); err != nil {
+			return nil, err
+		}
+		record.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// SetTeamLabels replaces the labels recorded for a Grafana team. Grafana
+// teams have no labels of their own, so they are kept here.
+func (s *Store) SetTeamLabels(grafanaOrgID, teamID int64, labels map[string]string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM team_labels WHERE grafana_org_id = ? AND team_id = ?`, grafanaOrgID, teamID); err != nil {
+		return err
+	}
+	for name, value := range labels {
+		if _, err := tx.Exec(`INSERT INTO team_labels (grafana_org_id, team_id, name, value) VALUES (?, ?, ?, ?)`, grafanaOrgID, teamID, name, value); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteTeamLabels removes the labels recorded for a Grafana team, for teams
+// deleted from Grafana.
+func (s *Store) DeleteTeamLabels(grafanaOrgID, teamID int64) error {
+	_, err := s.db.Exec(`DELETE FROM team_labels WHERE grafana_org_id = ? AND team_id = ?`, grafanaOrgID, teamID)
+	return err
+}
+
+// TeamLabels returns the recorded labels of every team in a Grafana org,
+// keyed by team ID.
+func (s *Store) TeamLabels(grafanaOrgID int64) (map[int64]map[string]string, error) {
+	rows, err := s.db.Query(`SELECT team_id, name, value FROM team_labels WHERE grafana_org_id = ?`, grafanaOrgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	labels := map[int64]map[string]string{}
+	for rows.Next() {
+		var teamID int64
+		var name, value string
+		if err := rows.Scan(&teamID, &name, &value); err != nil {
+			return nil, err
+		}
+		if labels[teamID] == nil {
+			labels[teamID] = map[string]string{}
+		}
+		labels[teamID][name] = value
+	}
+	return labels, rows.Err()
+}
+
+// SyncRun is one scheduled or manual sync run. Only read-only runs store
+// their plan, so PlanID is zero for runs that applied their actions.
+type SyncRun struct {
+	ID             int64     `json:"id"`
+	StartedAt      time.Time `json:"started_at"`
+	FinishedAt     time.Time `json:"finished_at"`
+	Status         string    `json:"status"`
+	PlanID         int64     `json:"plan_id,omitempty"`
+	ActionsApplied int       `json:"actions_applied"`
+	DurationMS     int64     `json:"duration_ms"`
+}
+
+// RecordSyncRun stores a finished sync run and returns its ID.
+func (s *Store) RecordSyncRun(run SyncRun) (int64, error) {
+	var planID any
+	if run.PlanID > 0 {
+		planID = run.PlanID
+	}
+	res, err := s.db.Exec(`INSERT INTO sync_runs (started_at, finished_at, status, plan_id, actions_applied, duration_ms) VALUES (?, ?, ?, ?, ?, ?)`,
+		run.StartedAt.UTC().Format(time.RFC3339), run.FinishedAt.UTC().Format(time.RFC3339), run.Status, planID, run.ActionsApplied, run.DurationMS)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// ListSyncRuns returns up to limit sync runs, newest first.
+func (s *Store) ListSyncRuns(limit int) ([]SyncRun, error) {
+	rows, err := s.db.Query(`SELECT id, started_at, finished_at, status, COALESCE(plan_id, 0), actions_applied, duration_ms FROM sync_runs ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var runs []SyncRun
+	for rows.Next() {
+		var run SyncRun
+		var startedAt, finishedAt string
+		if err := rows.Scan(&run.ID, &startedAt, &finishedAt, &run.Status, &run.PlanID, &run.ActionsApplied, &run.DurationMS); err != nil {
+			return nil, err
+		}
+		run.StartedAt, _ = time.Parse(time.RFC3339, startedAt)
+		run.FinishedAt, _ = time.Parse(time.RFC3339, finishedAt)
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// LastSyncActionTime returns when the newest sync action in any org was
+// recorded, or the zero time when there is none.
+func (s *Store) LastSyncActionTime() (time.Time, error) {
+	row := s.db.QueryRow(`SELECT MAX(created_at) FROM sync_actions`)
+	var raw sql.NullString
+	if err := row.Scan(&raw); err != nil {
+		return time.Time{}, err
+	}
+	if !raw.Valid || raw.String == "" {
+		return time.Time{}, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, raw.String)
+	if err != nil {
+		return time.Time{}, nil
+	}
+	return parsed, nil
+}
+
 func (s *Store) LatestSyncActionTime(orgID int64) (time.Time, error) {
 	row := s.db.QueryRow(`SELECT MAX(created_at) FROM sync_actions WHERE org_id = ?`, orgID)
 	var raw sql.NullString
@@ -370,12 +2026,23 @@ func (s *Store) LatestSyncActionTime(orgID int64) (time.Time, error) {
 	return parsed, nil
 }
 
+// CountSyncActionsSince counts the sync actions recorded for orgID since the
+// given time.
+func (s *Store) CountSyncActionsSince(orgID int64, since time.Time) (int, error) {
+	row := s.db.QueryRow(`SELECT COUNT(*) FROM sync_actions WHERE org_id = ? AND created_at >= ?`, orgID, since.UTC().Format(time.RFC3339))
+	var count int
+	if err := row.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
 func (s *Store) CountDistinctUserChangesSince(orgID int64, since time.Time) (int, error) {
 	query := `SELECT COUNT(DISTINCT email) FROM sync_actions
 		WHERE org_id = ?
 		  AND created_at >= ?
 		  AND email <> ''
-		  AND action_type IN ('create_user','add_user_to_org','update_user_role','add_user_to_team','update_team_role','remove_user_from_team')`
+		  AND action_type IN ('create_user','add_user_to_org','update_user_role','add_user_to_team','update_team_role','remove_user_from_team','disable_user','enable_user')`
 	row := s.db.QueryRow(query, orgID, since.UTC().Format(time.RFC3339))
 	var count int
 	if err := row.Scan(&count); err != nil {
@@ -416,12 +2083,38 @@ func migrate(db *sql.DB) error {
 		)`,
 		`CREATE INDEX IF NOT EXISTS idx_sync_actions_org_id ON sync_actions(org_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_sync_actions_created_at ON sync_actions(created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_sync_actions_email ON sync_actions(LOWER(email))`,
+		`CREATE TABLE IF NOT EXISTS sync_actions_archive (
+			id INTEGER PRIMARY KEY,
+			created_at TEXT NOT NULL,
+			org_id INTEGER NOT NULL,
+			grafana_org_id INTEGER,
+			action_type TEXT NOT NULL,
+			team_name TEXT,
+			email TEXT
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_sync_actions_archive_created_at ON sync_actions_archive(created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_sync_actions_archive_email ON sync_actions_archive(LOWER(email))`,
+		`CREATE TABLE IF NOT EXISTS group_member_cache (
+			group_id TEXT PRIMARY KEY,
+			member_json TEXT NOT NULL,
+			cached_at TEXT NOT NULL
+		)`,
 		`CREATE TABLE IF NOT EXISTS orgs (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			grafana_org_id INTEGER NOT NULL UNIQUE,
 			name TEXT,
 			default_role TEXT NOT NULL
 		)`,
+		`CREATE TABLE IF NOT EXISTS tenants (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			tenant_id TEXT NOT NULL,
+			client_id TEXT NOT NULL,
+			client_secret TEXT NOT NULL,
+			authority_base_url TEXT NOT NULL DEFAULT '',
+			graph_base_url TEXT NOT NULL DEFAULT ''
+		)`,
 		`CREATE TABLE IF NOT EXISTS mappings (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			org_id INTEGER NOT NULL,
@@ -435,6 +2128,8 @@ func migrate(db *sql.DB) error {
 			FOREIGN KEY(org_id) REFERENCES orgs(id)
 		)`,
 		`CREATE INDEX IF NOT EXISTS idx_mappings_org_id ON mappings(org_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_mappings_org_team ON mappings(org_id, LOWER(grafana_team_name))`,
+		`CREATE INDEX IF NOT EXISTS idx_mappings_org_group ON mappings(org_id, external_group_id)`,
 		`CREATE TABLE IF NOT EXISTS plans (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			created_at TEXT NOT NULL,
@@ -458,6 +2153,84 @@ func migrate(db *sql.DB) error {
 			FOREIGN KEY(plan_id) REFERENCES plans(id)
 		)`,
 		`CREATE INDEX IF NOT EXISTS idx_plan_actions_plan_id ON plan_actions(plan_id)`,
+		`CREATE TABLE IF NOT EXISTS team_folders (
+			mapping_id INTEGER PRIMARY KEY,
+			folder_uid TEXT NOT NULL,
+			created_at TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS grafana_tokens (
+			grafana_org_id INTEGER PRIMARY KEY,
+			token TEXT NOT NULL,
+			expires_at TEXT NOT NULL DEFAULT '',
+			created_at TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS team_metadata (
+			grafana_org_id INTEGER NOT NULL,
+			team_id INTEGER NOT NULL,
+			avatar_url TEXT NOT NULL DEFAULT '',
+			updated_at TEXT NOT NULL,
+			PRIMARY KEY (grafana_org_id, team_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS mapping_datasources (
+			mapping_id INTEGER PRIMARY KEY,
+			grafana_org_id INTEGER NOT NULL,
+			datasource_id INTEGER NOT NULL,
+			datasource_uid TEXT NOT NULL,
+			spec_json TEXT NOT NULL,
+			created_at TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS service_account_tokens (
+			mapping_id INTEGER NOT NULL,
+			sa_id INTEGER NOT NULL,
+			token_id INTEGER NOT NULL,
+			expires_at TEXT NOT NULL,
+			token_key TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY(mapping_id, sa_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_invites (
+			grafana_org_id INTEGER NOT NULL,
+			email TEXT NOT NULL,
+			code TEXT NOT NULL DEFAULT '',
+			created_at TEXT NOT NULL,
+			PRIMARY KEY(grafana_org_id, email)
+		)`,
+		`CREATE TABLE IF NOT EXISTS disabled_users (
+			user_id INTEGER PRIMARY KEY,
+			email TEXT NOT NULL,
+			disabled_at TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS datasource_permissions (
+			mapping_id INTEGER NOT NULL,
+			datasource_uid TEXT NOT NULL,
+			permission_level TEXT NOT NULL,
+			PRIMARY KEY(mapping_id, datasource_uid)
+		)`,
+		`CREATE TABLE IF NOT EXISTS pending_removals (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			mapping_id INTEGER NOT NULL,
+			team_id INTEGER NOT NULL,
+			user_id INTEGER,
+			email TEXT NOT NULL,
+			first_seen_at TEXT NOT NULL,
+			UNIQUE(mapping_id, team_id, email)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_pending_removals_team_email ON pending_removals(team_id, email)`,
+		`CREATE TABLE IF NOT EXISTS team_labels (
+			grafana_org_id INTEGER NOT NULL,
+			team_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			value TEXT NOT NULL,
+			PRIMARY KEY(grafana_org_id, team_id, name)
+		)`,
+		`CREATE TABLE IF NOT EXISTS sync_runs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			started_at TEXT NOT NULL,
+			finished_at TEXT NOT NULL,
+			status TEXT NOT NULL,
+			plan_id INTEGER,
+			actions_applied INTEGER NOT NULL DEFAULT 0,
+			duration_ms INTEGER NOT NULL
+		)`,
 	}
 	for _, q := range queries {
 		if _, err := db.Exec(q); err != nil {
@@ -470,9 +2243,115 @@ func migrate(db *sql.DB) error {
 	if err := addColumnIfMissing(db, "plan_actions", "team_role TEXT"); err != nil {
 		return err
 	}
+	if err := addColumnIfMissing(db, "mappings", "removal_grace_period TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "plan_actions", "description TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "plan_actions", "login TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "mappings", "allow_remove_members BOOLEAN"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "tenants", "secret_encrypted INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "orgs", "tenant_id INTEGER REFERENCES tenants(id)"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "mappings", "contact_point_uid TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "plan_actions", "contact_point_uid TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "plan_actions", "mapping_id INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "mappings", "previous_grafana_team_name TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "plan_actions", "datasource_uid TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "plan_actions", "permission TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "plans", "warnings TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "plans", "saml_conflict_detected INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "mappings", "team_prefs_json TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "plan_actions", "team_prefs_json TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "mappings", "datasource_template_json TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "plan_actions", "datasource_spec_json TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "plan_actions", "avatar_url TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "plan_actions", "team_email TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "team_metadata", "email TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "team_metadata", "description TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "service_account_tokens", "key_encrypted INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	// Grafana team names are case-insensitive, so the unique index is too.
+	// Older databases may already hold duplicate mappings; keep running with
+	// the case-sensitive index and list the duplicates so the operator can
+	// remove them, rather than refusing to start.
+	if _, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_mappings_unique_nocase ON mappings(org_id, external_group_id, LOWER(grafana_team_name))`); err != nil {
+		log.Printf("store: unique mapping index not created, remove duplicate mappings to enable it: %v", err)
+		if err := logDuplicateMappings(db); err != nil {
+			log.Printf("store: listing duplicate mappings failed: %v", err)
+		}
+		if _, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_mappings_unique ON mappings(org_id, external_group_id, grafana_team_name)`); err != nil {
+			log.Printf("store: case-sensitive unique mapping index not created: %v", err)
+		}
+		return nil
+	}
+	if _, err := db.Exec(`DROP INDEX IF EXISTS idx_mappings_unique`); err != nil {
+		return err
+	}
 	return nil
 }
 
+// logDuplicateMappings logs every set of mappings that blocks the unique
+// mapping index. GET /api/mappings/duplicates lists the same sets.
+func logDuplicateMappings(db *sql.DB) error {
+	rows, err := db.Query(`SELECT org_id, external_group_id, MIN(grafana_team_name), GROUP_CONCAT(id, ', ')
+		FROM mappings GROUP BY org_id, external_group_id, LOWER(grafana_team_name) HAVING COUNT(*) > 1`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var orgID int64
+		var groupID, teamName, ids string
+		if err := rows.Scan(&orgID, &groupID, &teamName, &ids); err != nil {
+			return err
+		}
+		log.Printf("store: duplicate mappings %s: org %d, group %s, team %q", ids, orgID, groupID, teamName)
+	}
+	return rows.Err()
+}
+
 func addColumnIfMissing(db *sql.DB, table, definition string) error {
 	_, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table, definition))
 	if err != nil {
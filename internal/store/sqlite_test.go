@@ -0,0 +1,793 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+	st, err := Open(t.TempDir(), 4096, 2000)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { _ = st.Close() })
+	return st
+}
+
+func TestWriteBackupIsValidSQLite(t *testing.T) {
+	st := openTestStore(t)
+	if _, err := st.CreateOrg(Org{GrafanaOrgID: 1, Name: "Main", DefaultRole: "Viewer"}); err != nil {
+		t.Fatalf("create org: %v", err)
+	}
+	dir := filepath.Join(t.TempDir(), "backups")
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	path, err := st.WriteBackup(dir, now)
+	if err != nil {
+		t.Fatalf("WriteBackup: %v", err)
+	}
+	if got, want := filepath.Base(path), "sync-backup-20260102T030405Z.db"; got != want {
+		t.Errorf("backup name = %q, want %q", got, want)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read backup: %v", err)
+	}
+	if !bytes.HasPrefix(data, []byte("SQLite format 3\x00")) {
+		t.Fatalf("backup does not start with the SQLite header")
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("open backup: %v", err)
+	}
+	defer db.Close()
+	var check string
+	if err := db.QueryRow(`PRAGMA integrity_check`).Scan(&check); err != nil || check != "ok" {
+		t.Fatalf("integrity_check = %q, %v", check, err)
+	}
+	var name string
+	if err := db.QueryRow(`SELECT name FROM orgs WHERE grafana_org_id = 1`).Scan(&name); err != nil || name != "Main" {
+		t.Fatalf("org in backup = %q, %v", name, err)
+	}
+
+	if _, err := st.WriteBackup(dir, now); err == nil {
+		t.Error("WriteBackup overwrote an existing backup")
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	old := filepath.Join(dir, BackupFileName(now.AddDate(0, 0, -10)))
+	recent := filepath.Join(dir, BackupFileName(now))
+	other := filepath.Join(dir, "notes.db")
+	for _, path := range []string{old, recent, other} {
+		if err := os.WriteFile(path, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{old, other} {
+		if err := os.Chtimes(path, now.AddDate(0, 0, -10), now.AddDate(0, 0, -10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removed, err := PruneBackups(dir, now.AddDate(0, 0, -7))
+	if err != nil || removed != 1 {
+		t.Fatalf("PruneBackups = %d, %v; want 1, nil", removed, err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Error("old backup was kept")
+	}
+	for _, path := range []string{recent, other} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was removed: %v", filepath.Base(path), err)
+		}
+	}
+}
+
+// seedSyncActions inserts old actions from a year ago and recent ones from
+// the last day.
+func seedSyncActions(b *testing.B, st *Store, old, recent int) {
+	b.Helper()
+	tx, err := st.db.Begin()
+	if err != nil {
+		b.Fatal(err)
+	}
+	stmt, err := tx.Prepare(`INSERT INTO sync_actions (created_at, org_id, grafana_org_id, action_type, team_name, email) VALUES (?, 1, 1, 'add_user_to_team', ?, ?)`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	now := time.Now()
+	for i := 0; i < old+recent; i++ {
+		at := now.AddDate(-1, 0, 0).Add(time.Duration(i) * time.Second)
+		if i >= old {
+			at = now.Add(-time.Duration(i-old) * time.Second)
+		}
+		if _, err := stmt.Exec(at.UTC().Format(time.RFC3339), fmt.Sprintf("team-%d", i%50), fmt.Sprintf("user%d@example.com", i%5000)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkCountDistinctUserChanges compares the /api/status change count
+// over a year of history before and after archiving everything older than
+// 90 days.
+func BenchmarkCountDistinctUserChanges(b *testing.B) {
+	for _, archived := range []bool{false, true} {
+		b.Run(fmt.Sprintf("archived=%v", archived), func(b *testing.B) {
+			st, err := Open(b.TempDir(), 4096, 2000)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer st.Close()
+			seedSyncActions(b, st, 200000, 2000)
+			if archived {
+				if _, err := st.ArchiveSyncActionsBefore(time.Now().AddDate(0, 0, -90)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			since := time.Now().AddDate(0, 0, -7)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := st.CountDistinctUserChangesSince(1, since); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestArchiveSyncActionsBefore(t *testing.T) {
+	st := openTestStore(t)
+	now := time.Now()
+	for i := 0; i < archiveBatchSize+5; i++ {
+		if err := st.RecordSyncAction(PlanAction{OrgID: 1, ActionType: "add_user_to_team", Email: "old@example.com"}, now.AddDate(0, 0, -100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.RecordSyncAction(PlanAction{OrgID: 1, ActionType: "add_user_to_team", Email: "new@example.com"}, now); err != nil {
+		t.Fatal(err)
+	}
+	moved, err := st.ArchiveSyncActionsBefore(now.AddDate(0, 0, -90))
+	if err != nil || moved != archiveBatchSize+5 {
+		t.Fatalf("ArchiveSyncActionsBefore = %d, %v; want %d", moved, err, archiveBatchSize+5)
+	}
+	archived, err := st.ListArchivedSyncActions(SyncActionFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range archived {
+		if action.Email != "old@example.com" {
+			t.Fatalf("recent action archived: %+v", action)
+		}
+	}
+	if count, err := st.CountDistinctUserChangesSince(1, now.AddDate(0, 0, -1)); err != nil || count != 1 {
+		t.Fatalf("recent changes = %d, %v; want 1", count, err)
+	}
+}
+
+func TestOpenAppliesPragmas(t *testing.T) {
+	// The directory name needs escaping in the SQLite URI.
+	dir := filepath.Join(t.TempDir(), "data?x=1#frag%20")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	st, err := Open(dir, 8192, 1234)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sync.db")); err != nil {
+		t.Fatalf("database not created in %s: %v", dir, err)
+	}
+	// Pin one connection so every PRAGMA reads the same one.
+	conn, err := st.db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pragma, want := range map[string]int{"page_size": 8192, "cache_size": -1234, "synchronous": 1} {
+		var got int
+		if err := conn.QueryRowContext(context.Background(), "PRAGMA "+pragma).Scan(&got); err != nil || got != want {
+			t.Errorf("PRAGMA %s = %d, %v; want %d", pragma, got, err, want)
+		}
+	}
+	conn.Close()
+	st.Close()
+
+	// An existing database keeps its page size until VACUUM.
+	st, err = Open(dir, 4096, 1234)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer st.Close()
+	var got int
+	if err := st.db.QueryRow(`PRAGMA page_size`).Scan(&got); err != nil || got != 8192 {
+		t.Errorf("page_size after reopen = %d, %v; want 8192", got, err)
+	}
+}
+
+func TestUniqueMappingIndexIsCaseInsensitive(t *testing.T) {
+	st := openTestStore(t)
+	orgID, err := st.CreateOrg(Org{GrafanaOrgID: 1, Name: "Main", DefaultRole: "Viewer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateMapping(Mapping{OrgID: orgID, GrafanaTeamName: "Ops", ExternalGroupID: "g1", TeamRole: "member"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateMapping(Mapping{OrgID: orgID, GrafanaTeamName: "OPS", ExternalGroupID: "g1", TeamRole: "member"}); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("CreateMapping with a differently cased team = %v, want ErrDuplicate", err)
+	}
+	if _, err := st.CreateMapping(Mapping{OrgID: orgID, GrafanaTeamName: "OPS", ExternalGroupID: "g2", TeamRole: "member"}); err != nil {
+		t.Fatalf("CreateMapping for another group: %v", err)
+	}
+}
+
+func TestMigrateReportsDuplicateMappings(t *testing.T) {
+	dir := t.TempDir()
+	st, err := Open(dir, 4096, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orgID, err := st.CreateOrg(Org{GrafanaOrgID: 1, Name: "Main", DefaultRole: "Viewer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a database from before the case-insensitive index.
+	for _, stmt := range []string{
+		`DROP INDEX idx_mappings_unique_nocase`,
+		fmt.Sprintf(`INSERT INTO mappings (org_id, grafana_team_name, external_group_id, team_role) VALUES (%d, 'Ops', 'g1', 'member'), (%d, 'ops', 'g1', 'member')`, orgID, orgID),
+	} {
+		if _, err := st.db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	st.Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	st, err = Open(dir, 4096, 2000)
+	if err != nil {
+		t.Fatalf("Open with duplicates: %v", err)
+	}
+	defer st.Close()
+	if !strings.Contains(logs.String(), "duplicate mappings 1, 2: org 1, group g1") {
+		t.Errorf("duplicates not reported, log:\n%s", logs.String())
+	}
+	var indexes int
+	if err := st.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'idx_mappings_unique_nocase'`).Scan(&indexes); err != nil || indexes != 0 {
+		t.Errorf("case-insensitive index present = %d, %v; want absent while duplicates exist", indexes, err)
+	}
+}
+
+func TestTenantClientSecretEncrypted(t *testing.T) {
+	st := openTestStore(t)
+	tenant := Tenant{Name: "Sub", TenantID: "sub", ClientID: "client", ClientSecret: "s3cret"}
+	if _, err := st.CreateTenant(tenant); !errors.Is(err, ErrNoEncryptionKey) {
+		t.Fatalf("CreateTenant without key = %v, want ErrNoEncryptionKey", err)
+	}
+	// A tenant saved before secrets were encrypted.
+	if _, err := st.db.Exec(`INSERT INTO tenants (name, tenant_id, client_id, client_secret, authority_base_url, graph_base_url) VALUES ('Old', 'old', 'client', 'legacy', '', '')`); err != nil {
+		t.Fatal(err)
+	}
+	st.SetEncryptionKey("test-key")
+	id, err := st.CreateTenant(tenant)
+	if err != nil {
+		t.Fatalf("CreateTenant: %v", err)
+	}
+	if n, err := st.EncryptTenantSecrets(); err != nil || n != 1 {
+		t.Fatalf("EncryptTenantSecrets = %d, %v; want 1", n, err)
+	}
+	rows, err := st.db.Query(`SELECT client_secret FROM tenants`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var stored string
+		if err := rows.Scan(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if stored == "s3cret" || stored == "legacy" {
+			t.Errorf("client secret stored in plain text: %q", stored)
+		}
+	}
+	tenants, err := st.ListTenants()
+	if err != nil || len(tenants) != 2 || tenants[0].ClientSecret != "legacy" || tenants[1].ClientSecret != "s3cret" {
+		t.Fatalf("ListTenants = %+v, %v; want decrypted secrets", tenants, err)
+	}
+	tenant.ID, tenant.ClientSecret = id, "rotated"
+	if err := st.UpdateTenant(tenant); err != nil {
+		t.Fatal(err)
+	}
+	got, err := st.GetTenant(id)
+	if err != nil || got.ClientSecret != "rotated" {
+		t.Fatalf("GetTenant = %+v, %v; want the rotated secret", got, err)
+	}
+}
+
+func TestListSyncActionsForUserIncludesArchive(t *testing.T) {
+	st := openTestStore(t)
+	now := time.Now()
+	for _, a := range []struct {
+		email, team string
+		at          time.Time
+	}{
+		{"Alice@Example.com", "Old", now.AddDate(0, 0, -100)},
+		{"alice@example.com", "New", now.Add(-time.Hour)},
+		{"bob@example.com", "New", now},
+	} {
+		if err := st.RecordSyncAction(PlanAction{OrgID: 1, ActionType: "add_user_to_team", TeamName: a.team, Email: a.email}, a.at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := st.ArchiveSyncActionsBefore(now.AddDate(0, 0, -90)); err != nil {
+		t.Fatal(err)
+	}
+
+	actions, err := st.ListSyncActionsForUser(" ALICE@example.COM ", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 2 || actions[0].TeamName != "New" || actions[1].TeamName != "Old" {
+		t.Fatalf("history = %+v, want the live New action before the archived Old one", actions)
+	}
+	if actions, err = st.ListSyncActionsForUser("alice@example.com", 1); err != nil || len(actions) != 1 || actions[0].TeamName != "New" {
+		t.Fatalf("history with limit 1 = %+v, %v", actions, err)
+	}
+}
+
+func TestGetOrgLookups(t *testing.T) {
+	st := openTestStore(t)
+	id, err := st.CreateOrg(Org{GrafanaOrgID: 5, Name: "Main", DefaultRole: "Viewer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateOrg(Org{GrafanaOrgID: 5, Name: "Copy", DefaultRole: "Viewer"}); err != ErrDuplicate {
+		t.Fatalf("second org with Grafana org 5: err = %v, want ErrDuplicate", err)
+	}
+	tests := []struct {
+		name   string
+		lookup func() (*Org, error)
+		want   string
+	}{
+		{"GetOrg", func() (*Org, error) { return st.GetOrg(id) }, "Main"},
+		{"GetOrg not found", func() (*Org, error) { return st.GetOrg(id + 100) }, ""},
+		{"GetOrgByGrafanaID", func() (*Org, error) { return st.GetOrgByGrafanaID(5) }, "Main"},
+		{"GetOrgByGrafanaID not found", func() (*Org, error) { return st.GetOrgByGrafanaID(6) }, ""},
+	}
+	for _, tt := range tests {
+		org, err := tt.lookup()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		switch {
+		case tt.want == "" && org != nil:
+			t.Errorf("%s = %+v, want nil", tt.name, org)
+		case tt.want != "" && (org == nil || org.Name != tt.want):
+			t.Errorf("%s = %+v, want %s", tt.name, org, tt.want)
+		}
+	}
+}
+
+func TestServiceAccountTokenKeyEncrypted(t *testing.T) {
+	st := openTestStore(t)
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	token := ServiceAccountToken{MappingID: 1, SAID: 7, TokenID: 70, ExpiresAt: expires, Key: "glsa_new"}
+	if err := st.SetServiceAccountToken(token); !errors.Is(err, ErrNoEncryptionKey) {
+		t.Fatalf("SetServiceAccountToken without key = %v, want ErrNoEncryptionKey", err)
+	}
+	// Tokens registered through the API have no key and need no encryption.
+	if err := st.SetServiceAccountToken(ServiceAccountToken{MappingID: 1, SAID: 8, TokenID: 80, ExpiresAt: expires}); err != nil {
+		t.Fatalf("SetServiceAccountToken without a key: %v", err)
+	}
+	// A key saved in plain text before keys were encrypted.
+	if _, err := st.db.Exec(`INSERT INTO service_account_tokens (mapping_id, sa_id, token_id, expires_at, token_key) VALUES (2, 9, 90, ?, 'glsa_legacy')`, expires.Format(time.RFC3339)); err != nil {
+		t.Fatal(err)
+	}
+	st.SetEncryptionKey("test-key")
+	if err := st.SetServiceAccountToken(token); err != nil {
+		t.Fatalf("SetServiceAccountToken: %v", err)
+	}
+	if n, err := st.EncryptServiceAccountTokenKeys(); err != nil || n != 1 {
+		t.Fatalf("EncryptServiceAccountTokenKeys = %d, %v; want 1", n, err)
+	}
+	rows, err := st.db.Query(`SELECT token_key FROM service_account_tokens`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var stored string
+		if err := rows.Scan(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(stored, "glsa_") {
+			t.Errorf("token key stored in plain text: %q", stored)
+		}
+	}
+	keys := map[int64]string{}
+	tokens, err := st.ListServiceAccountTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range tokens {
+		keys[token.SAID] = token.Key
+	}
+	if len(keys) != 3 || keys[7] != "glsa_new" || keys[8] != "" || keys[9] != "glsa_legacy" {
+		t.Fatalf("keys = %v, want decrypted keys", keys)
+	}
+
+	// Without the key the tokens still list, for rotation, without keys.
+	st.SetEncryptionKey("")
+	got, err := st.GetServiceAccountToken(1, 7)
+	if err != nil || got == nil || got.TokenID != 70 || got.Key != "" {
+		t.Fatalf("GetServiceAccountToken without key = %+v, %v", got, err)
+	}
+}
+
+func TestUpdateMappingPreviousTeamName(t *testing.T) {
+	st := openTestStore(t)
+	orgID, err := st.CreateOrg(Org{GrafanaOrgID: 1, Name: "Main", DefaultRole: "Viewer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := st.CreateMapping(Mapping{OrgID: orgID, GrafanaTeamName: "Ops", ExternalGroupID: "g1", TeamRole: "member"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []struct {
+		name         string
+		wantPrevious string
+	}{
+		{name: "OPS", wantPrevious: ""},
+		{name: "Platform", wantPrevious: "OPS"},
+		{name: "SRE", wantPrevious: "OPS"},
+		{name: "sre", wantPrevious: "OPS"},
+		{name: "ops", wantPrevious: ""},
+	} {
+		m, err := st.GetMapping(id)
+		if err != nil || m == nil {
+			t.Fatalf("get mapping: %+v, %v", m, err)
+		}
+		m.GrafanaTeamName = step.name
+		if err := st.UpdateMapping(*m); err != nil {
+			t.Fatalf("rename to %s: %v", step.name, err)
+		}
+		if m, err = st.GetMapping(id); err != nil {
+			t.Fatal(err)
+		}
+		if m.PreviousGrafanaTeamName != step.wantPrevious {
+			t.Errorf("after renaming to %s previous team name = %q, want %q", step.name, m.PreviousGrafanaTeamName, step.wantPrevious)
+		}
+	}
+}
+
+func TestGrafanaTokenEncryptedAndCached(t *testing.T) {
+	st := openTestStore(t)
+	if err := st.SetGrafanaToken(2, "glsa_secret", time.Time{}); !errors.Is(err, ErrNoEncryptionKey) {
+		t.Fatalf("SetGrafanaToken without key = %v, want ErrNoEncryptionKey", err)
+	}
+	st.SetEncryptionKey("test-key")
+	if err := st.SetGrafanaToken(2, "glsa_secret", time.Time{}); err != nil {
+		t.Fatalf("SetGrafanaToken: %v", err)
+	}
+	var stored string
+	if err := st.db.QueryRow(`SELECT token FROM grafana_tokens WHERE grafana_org_id = 2`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored == "" || strings.Contains(stored, "glsa_secret") {
+		t.Fatalf("token stored as %q, want it encrypted", stored)
+	}
+	if token, err := st.GetToken(2); err != nil || token != "glsa_secret" {
+		t.Fatalf("GetToken = %q, %v; want the decrypted token", token, err)
+	}
+	if token, err := st.GetToken(3); err != nil || token != "" {
+		t.Fatalf("GetToken of an org without token = %q, %v; want none", token, err)
+	}
+
+	// Lookups are served from the cache until a token is saved or deleted.
+	if _, err := st.db.Exec(`UPDATE grafana_tokens SET token = 'garbage'`); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := st.GetToken(2); err != nil || token != "glsa_secret" {
+		t.Fatalf("cached GetToken = %q, %v; want glsa_secret", token, err)
+	}
+	if err := st.SetGrafanaToken(3, "glsa_other", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := st.GetToken(3); err != nil || token != "glsa_other" {
+		t.Fatalf("GetToken after save = %q, %v; want glsa_other", token, err)
+	}
+	if _, err := st.GetToken(2); err == nil {
+		t.Fatal("GetToken after the cache was cleared decrypted garbage without error")
+	}
+	if deleted, err := st.DeleteGrafanaToken(3); err != nil || !deleted {
+		t.Fatalf("DeleteGrafanaToken = %v, %v", deleted, err)
+	}
+	if token, err := st.GetToken(3); err != nil || token != "" {
+		t.Fatalf("GetToken after delete = %q, %v; want none", token, err)
+	}
+
+	// A cached token is not served past its expiry.
+	expiresAt := time.Now().Add(10 * time.Second).Truncate(time.Second)
+	if err := st.SetGrafanaToken(4, "glsa_short", expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := st.GetToken(4); err != nil || token != "glsa_short" {
+		t.Fatalf("GetToken = %q, %v; want glsa_short", token, err)
+	}
+	st.tokenMu.Lock()
+	validTill := st.tokens[4].validTill
+	st.tokenMu.Unlock()
+	if validTill.After(expiresAt) {
+		t.Fatalf("token cached until %s, past its expiry %s", validTill, expiresAt)
+	}
+	if _, err := st.db.Exec(`UPDATE grafana_tokens SET expires_at = ? WHERE grafana_org_id = 4`, time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)); err != nil {
+		t.Fatal(err)
+	}
+	st.forgetTokens()
+	if token, err := st.GetToken(4); err != nil || token != "" {
+		t.Fatalf("GetToken of an expired token = %q, %v; want none", token, err)
+	}
+}
+
+// seedMappings creates n mappings in one org, team-N for group gN.
+func seedMappings(tb testing.TB, st *Store, n int) int64 {
+	tb.Helper()
+	orgID, err := st.CreateOrg(Org{GrafanaOrgID: 1, Name: "Main", DefaultRole: "Viewer"})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := st.CreateMapping(Mapping{OrgID: orgID, GrafanaTeamName: fmt.Sprintf("team-%d", i), ExternalGroupID: fmt.Sprintf("g%d", i), TeamRole: "member"}); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return orgID
+}
+
+func TestMappingLookupsAvoidTableScans(t *testing.T) {
+	st := openTestStore(t)
+	orgID := seedMappings(t, st, 20)
+	for _, tc := range []struct {
+		query string
+		args  []any
+	}{
+		{query: `SELECT id FROM mappings WHERE org_id = ? AND LOWER(grafana_team_name) = LOWER(?)`, args: []any{orgID, "TEAM-3"}},
+		{query: `SELECT id FROM mappings WHERE org_id = ? AND external_group_id = ?`, args: []any{orgID, "g3"}},
+	} {
+		rows, err := st.db.Query(`EXPLAIN QUERY PLAN `+tc.query, tc.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var plan []string
+		for rows.Next() {
+			var id, parent, notUsed int
+			var detail string
+			if err := rows.Scan(&id, &parent, &notUsed, &detail); err != nil {
+				t.Fatal(err)
+			}
+			plan = append(plan, detail)
+		}
+		rows.Close()
+		if detail := strings.Join(plan, "; "); !strings.Contains(detail, "SEARCH mappings USING") {
+			t.Errorf("query plan of %q = %s, want an index search instead of a table scan", tc.query, detail)
+		}
+	}
+	if m, err := st.GetMappingByTeamName(orgID, "TEAM-3"); err != nil || m == nil || m.ExternalGroupID != "g3" {
+		t.Errorf("GetMappingByTeamName(TEAM-3) = %+v, %v; want the g3 mapping", m, err)
+	}
+	if m, err := st.GetMappingByTeamName(orgID, "missing"); err != nil || m != nil {
+		t.Errorf("GetMappingByTeamName(missing) = %+v, %v; want nil", m, err)
+	}
+	if ms, err := st.GetMappingByGroupID(orgID, "g7"); err != nil || len(ms) != 1 || ms[0].GrafanaTeamName != "team-7" {
+		t.Errorf("GetMappingByGroupID(g7) = %+v, %v; want team-7", ms, err)
+	}
+}
+
+// BenchmarkMappingLookup compares finding one mapping of a 500 mapping store
+// by team name with the indexed query and with a ListMappings scan. The
+// rows/op metric is the number of mappings loaded per lookup.
+func BenchmarkMappingLookup(b *testing.B) {
+	st, err := Open(b.TempDir(), 4096, 2000)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer st.Close()
+	orgID := seedMappings(b, st, 500)
+	const teamName = "TEAM-250"
+
+	b.Run("GetMappingByTeamName", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			m, err := st.GetMappingByTeamName(orgID, teamName)
+			if err != nil || m == nil {
+				b.Fatalf("GetMappingByTeamName = %+v, %v", m, err)
+			}
+		}
+		b.ReportMetric(1, "rows/op")
+	})
+	b.Run("ListMappings", func(b *testing.B) {
+		rows := 0
+		for i := 0; i < b.N; i++ {
+			mappings, err := st.ListMappings()
+			if err != nil {
+				b.Fatal(err)
+			}
+			rows += len(mappings)
+			found := false
+			for _, m := range mappings {
+				if m.OrgID == orgID && strings.EqualFold(m.GrafanaTeamName, teamName) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				b.Fatal("mapping not found")
+			}
+		}
+		b.ReportMetric(float64(rows)/float64(b.N), "rows/op")
+	})
+}
+
+func TestCountPlanActionsEmptyPlan(t *testing.T) {
+	st := openTestStore(t)
+	planID, err := st.ReplacePlan(Plan{Status: "pending"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{planID, planID + 1} {
+		byType, err := st.CountPlanActionsByType(id)
+		if err != nil || byType == nil || len(byType) != 0 {
+			t.Errorf("CountPlanActionsByType(%d) = %v, %v; want an empty map", id, byType, err)
+		}
+		byTeam, err := st.CountPlanActionsByTeam(id)
+		if err != nil || byTeam == nil || len(byTeam) != 0 {
+			t.Errorf("CountPlanActionsByTeam(%d) = %v, %v; want an empty map", id, byTeam, err)
+		}
+	}
+	summary, err := st.GetPlanSummary(planID)
+	if err != nil || summary == nil {
+		t.Fatalf("GetPlanSummary = %+v, %v", summary, err)
+	}
+	if summary.Total != 0 || summary.ActionCounts == nil || len(summary.ActionCounts) != 0 {
+		t.Errorf("summary = %+v, want no actions and an empty, non-nil count map", summary)
+	}
+	if summary, err := st.GetPlanSummary(planID + 1); err != nil || summary != nil {
+		t.Errorf("GetPlanSummary of a missing plan = %+v, %v; want nil", summary, err)
+	}
+}
+
+// BenchmarkPlanSummary compares counting the actions of a 10,000 action
+// plan in SQL with loading the plan and counting them in Go.
+func BenchmarkPlanSummary(b *testing.B) {
+	st, err := Open(b.TempDir(), 4096, 2000)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer st.Close()
+	actionTypes := []string{"create_team", "add_user_to_org", "add_user_to_team", "remove_user_from_team"}
+	actions := make([]PlanAction, 10000)
+	for i := range actions {
+		actions[i] = PlanAction{
+			ActionType:   actionTypes[i%len(actionTypes)],
+			OrgID:        1,
+			GrafanaOrgID: 1,
+			TeamName:     fmt.Sprintf("team-%d", i%100),
+			Email:        fmt.Sprintf("user%d@example.com", i),
+		}
+	}
+	planID, err := st.ReplacePlan(Plan{Status: "pending", Actions: actions})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("CountPlanActionsByType", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			counts, err := st.CountPlanActionsByType(planID)
+			if err != nil || counts["add_user_to_team"] != 2500 {
+				b.Fatalf("CountPlanActionsByType = %v, %v", counts, err)
+			}
+		}
+	})
+	b.Run("LatestPlan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			plan, err := st.LatestPlan()
+			if err != nil {
+				b.Fatal(err)
+			}
+			counts := map[string]int{}
+			for _, action := range plan.Actions {
+				counts[action.ActionType]++
+			}
+			if counts["add_user_to_team"] != 2500 {
+				b.Fatalf("counts = %v", counts)
+			}
+		}
+	})
+}
+
+func TestMaintenance(t *testing.T) {
+	st := openTestStore(t)
+	planID, err := st.ReplacePlan(Plan{Status: "pending", Actions: []PlanAction{{ActionType: "create_team", OrgID: 1, GrafanaOrgID: 1, TeamName: "Ops"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		timeout time.Duration
+		wantErr string
+	}{
+		{name: "default timeout"},
+		{name: "expired timeout", timeout: time.Nanosecond, wantErr: "interrupted after 1ns"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st.SetMaintenanceTimeout(tc.timeout)
+			defer st.SetMaintenanceTimeout(0)
+			for name, run := range map[string]func() error{"Analyze": st.Analyze, "Vacuum": st.Vacuum} {
+				err := run()
+				if tc.wantErr == "" && err != nil {
+					t.Errorf("%s: %v", name, err)
+				}
+				if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr) || !errors.Is(err, context.DeadlineExceeded)) {
+					t.Errorf("%s error = %v, want %q", name, err, tc.wantErr)
+				}
+			}
+		})
+	}
+	if summary, err := st.GetPlanSummary(planID); err != nil || summary == nil || summary.Total != 1 {
+		t.Fatalf("plan after maintenance = %+v, %v; want it kept", summary, err)
+	}
+}
+
+func TestSyncRuns(t *testing.T) {
+	st := openTestStore(t)
+	// Timestamps are kept to the second; DurationMS keeps the precise time.
+	start := time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC)
+	runs := []SyncRun{
+		{StartedAt: start, FinishedAt: start.Add(time.Second), Status: "ok", ActionsApplied: 3, DurationMS: 1500},
+		{StartedAt: start.Add(time.Hour), FinishedAt: start.Add(time.Hour + time.Second), Status: "failed", PlanID: 7, DurationMS: 1000},
+		{StartedAt: start.Add(2 * time.Hour), FinishedAt: start.Add(2*time.Hour + 2*time.Second), Status: "ok", DurationMS: 2000},
+	}
+	for _, run := range runs {
+		if _, err := st.RecordSyncRun(run); err != nil {
+			t.Fatalf("RecordSyncRun: %v", err)
+		}
+	}
+	for _, tc := range []struct {
+		limit int
+		want  []SyncRun
+	}{
+		{limit: 10, want: []SyncRun{runs[2], runs[1], runs[0]}},
+		{limit: 1, want: []SyncRun{runs[2]}},
+	} {
+		got, err := st.ListSyncRuns(tc.limit)
+		if err != nil {
+			t.Fatalf("ListSyncRuns(%d): %v", tc.limit, err)
+		}
+		if len(got) != len(tc.want) {
+			t.Fatalf("ListSyncRuns(%d) returned %d runs, want %d", tc.limit, len(got), len(tc.want))
+		}
+		for i, run := range got {
+			want := tc.want[i]
+			if run.ID == 0 || !run.StartedAt.Equal(want.StartedAt) || !run.FinishedAt.Equal(want.FinishedAt) ||
+				run.Status != want.Status || run.PlanID != want.PlanID || run.ActionsApplied != want.ActionsApplied || run.DurationMS != want.DurationMS {
+				t.Errorf("ListSyncRuns(%d)[%d] = %+v, want %+v", tc.limit, i, run, want)
+			}
+		}
+	}
+}
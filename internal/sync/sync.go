@@ -1,13 +1,21 @@
 package syncer
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"grafana-ad-syncher/internal/entra"
@@ -22,10 +30,96 @@ type Syncer struct {
 	defaultUserRole  string
 	allowCreateUsers bool
 	allowRemoveUsers bool
+	displayNameTmpl  *template.Template
+	noteTmpl         *template.Template
+	cache            *grafanaCache
+	readOnly         bool
+	removalGrace     time.Duration
+	ownersAsAdmins   bool
+	loginFormat      string
+	memberCacheTTL   time.Duration
+	roleRules        []RoleRule
+	webhookURL       string
+	previewMinAlert  int
+	webhookClient    *http.Client
+	allowedActions   map[string]bool
+	deactivateUsers  bool
+	autoEnableUsers  bool
+	protectedLogins  map[string]bool
+	adminDomains     map[string]bool
+	newTenantClient  func(store.Tenant) *entra.Client
+	teamFolders      bool
+	teamFolderParent string
+	teamFolderPerm   int
+	folderTmpl       *template.Template
+	actionOrder      map[string]int
+	teamSyncCompat   bool
+	updateProfiles   bool
+	autoCreateOrgs   bool
+	planMaxAge       time.Duration
+	skipDisabled     bool
+	saTokenWindow    time.Duration
+	saTokenTTL       time.Duration
+	allowDowngrade   bool
+	syncAlert        SyncAlert
+	avatarTmpl       *template.Template
+	groupTypes       map[string]bool
+	verifyTeamIDs    bool
+	teamLabels       map[string]string
+	syncTeamEmail    bool
+
+	tenantMu      sync.RWMutex
+	tenantClients map[int64]*entra.Client
 
 	mu          sync.Mutex
 	lastRun     time.Time
 	lastMessage string
+	lastIssues  []MappingValidationIssue
+	windowSkips int64
+	autoLogin   bool
+}
+
+// MappingValidationIssue describes a mapping whose stored Grafana team ID no
+// longer matches the team Grafana returns for the mapped team name.
+type MappingValidationIssue struct {
+	MappingID    int64  `json:"mapping_id"`
+	OrgID        int64  `json:"org_id"`
+	GrafanaOrgID int64  `json:"grafana_org_id"`
+	TeamName     string `json:"team_name"`
+	StoredTeamID int64  `json:"stored_team_id"`
+	ActualTeamID int64  `json:"actual_team_id"`
+	Issue        string `json:"issue"`
+	Corrected    bool   `json:"corrected"`
+}
+
+// ErrReadOnly is returned by ApplyPlan when READ_ONLY_MODE is enabled.
+var ErrReadOnly = errors.New("read-only mode enabled")
+
+// ErrMappingNotFound is returned by PreviewMapping for an unknown mapping.
+var ErrMappingNotFound = errors.New("mapping not found")
+
+// MappingDiff is the team membership change one mapping would cause, as
+// returned by PreviewMapping.
+type MappingDiff struct {
+	MappingID int64  `json:"mapping_id"`
+	TeamName  string `json:"team_name"`
+	// TeamID is 0 when the team does not exist yet and would be created.
+	TeamID      int64          `json:"team_id"`
+	Added       []MemberChange `json:"added"`
+	Removed     []MemberChange `json:"removed"`
+	RoleUpdates []MemberChange `json:"role_updates"`
+	// RemovalsAllowed is false when Removed members would be kept because
+	// removing members is disabled for the mapping.
+	RemovalsAllowed bool `json:"removals_allowed"`
+	// Skipped says why plans leave the mapping out, such as a group type
+	// not in ENTRA_ALLOWED_GROUP_TYPES. The change lists are empty then.
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// MemberChange is one team member in a MappingDiff.
+type MemberChange struct {
+	Email    string `json:"email"`
+	TeamRole string `json:"team_role,omitempty"`
 }
 
 type Action struct {
@@ -43,15 +137,719 @@ type Action struct {
 	Note            string
 }
 
-func New(store *store.Store, grafana *grafana.Client, entra *entra.Client, defaultRole string, allowCreateUsers bool, allowRemoveUsers bool) *Syncer {
-	return &Syncer{
+// displayNameData is the value passed to the USER_DISPLAY_NAME_TEMPLATE when
+// rendering the Grafana name of a user created from an Entra member.
+type displayNameData struct {
+	DisplayName string
+	GivenName   string
+	Surname     string
+	Department  string
+	UPN         string
+}
+
+// noteData is the input of NOTE_TEMPLATE. Note is the note the syncer built
+// itself, so templates can extend it rather than replace it.
+type noteData struct {
+	ActionType string
+	OrgName    string
+	TeamName   string
+	GroupName  string
+	GroupID    string
+	Email      string
+	Role       string
+	TeamRole   string
+	Note       string
+	Time       time.Time
+}
+
+// grafanaCache keeps Grafana team members and org users between plan builds.
+// Entries are served as-is within ttl; once expired the stale copy is still
+// returned while a single background refresh replaces it. A zero ttl disables
+// the cache.
+//
+// Every field is guarded by mu. Callers get their own copy of an entry, and
+// generation is bumped by invalidate so a fetch that started before an
+// apply cannot store what it read over the invalidation.
+type grafanaCache struct {
+	ttl time.Duration
+
+	mu          sync.Mutex
+	generation  uint64
+	teamMembers map[int64]cachedTeamMembers
+	orgUsers    map[int64]cachedOrgUsers
+	refreshing  map[string]struct{}
+}
+
+type cachedTeamMembers struct {
+	members   []grafana.TeamMember
+	expiresAt time.Time
+}
+
+type cachedOrgUsers struct {
+	users     []grafana.OrgUser
+	expiresAt time.Time
+}
+
+// Options configures how a Syncer builds and applies plans.
+type Options struct {
+	DefaultUserRole     string
+	AllowCreateUsers    bool
+	AllowRemoveUsers    bool
+	DisplayNameTemplate *template.Template
+	// NoteTemplate, when set, replaces every plan action note with its
+	// rendering of a noteData value.
+	NoteTemplate *template.Template
+	// CacheTTL enables caching of Grafana team members and org users.
+	CacheTTL time.Duration
+	// ReadOnly builds and stores plans but never applies them.
+	ReadOnly bool
+	// RemovalGracePeriod is the default delay before removing team members
+	// who left the mapped Entra group.
+	RemovalGracePeriod time.Duration
+	// GroupOwnersAsTeamAdmins makes Entra group owners team admins of
+	// mappings whose team role is member.
+	GroupOwnersAsTeamAdmins bool
+	// TeamAdminEmailDomains makes members whose email is in one of these
+	// domains team admins of every mapped team, whatever the mapping's
+	// team role.
+	TeamAdminEmailDomains []string
+	// LoginFormat selects the Grafana login of created users: "email"
+	// (default), "upn" or "displayname_slug".
+	LoginFormat string
+	// MemberCacheTTL reuses Entra group members persisted in the store for
+	// this long instead of asking Graph on every plan.
+	MemberCacheTTL time.Duration
+	// RoleRules derive the org role from the mapped group's display name
+	// when the mapping has no role override.
+	RoleRules []RoleRule
+	// WebhookURL receives a JSON POST: a plan_applied event after a plan is
+	// applied without error, and a preview_ready event when a preview finds
+	// at least PreviewAlertMinActions actions.
+	WebhookURL             string
+	PreviewAlertMinActions int
+	// AllowedActions limits plans to these action types; empty allows all.
+	AllowedActions map[string]bool
+	// DeactivateRemovedUsers disables Grafana accounts of users removed from
+	// their last mapped team and re-enables them when they reappear.
+	DeactivateRemovedUsers bool
+	// AutoEnableUsers re-enables disabled Grafana accounts of users who are
+	// in a mapped group, without DeactivateRemovedUsers' disabling.
+	AutoEnableUsers bool
+	// ProtectedLogins are Grafana logins whose org membership and role are
+	// never changed, such as the built-in admin account.
+	ProtectedLogins []string
+	// NewTenantClient builds the Entra client for an org assigned to a
+	// tenant from the tenants table. Without it every org uses the default
+	// client.
+	NewTenantClient func(store.Tenant) *entra.Client
+	// TeamFolderAutoCreate adds a create_team_folder action for every team
+	// the plan creates: a folder named after the team that only the team
+	// can access. TeamFolderParentUID nests these folders under an existing
+	// folder.
+	TeamFolderAutoCreate bool
+	TeamFolderParentUID  string
+	// TeamFolderPermission is the permission the team gets on its folder
+	// (see grafana.ParseFolderPermission); zero means edit.
+	TeamFolderPermission int
+	// TeamFolderTitleTemplate renders the folder title from a teamFolderData
+	// value; nil uses the team name.
+	TeamFolderTitleTemplate *template.Template
+	// ActionOrder sets the order ApplyPlan applies action types in; nil
+	// uses DefaultActionOrder.
+	ActionOrder map[string]int
+	// TeamSyncCompat leaves team membership of users already in the org to
+	// Grafana's own team sync: add_user_to_team is not planned for them.
+	TeamSyncCompat bool
+	// UpdateUserProfiles plans update_user_profile when a Grafana user's
+	// name or email no longer matches Entra.
+	UpdateUserProfiles bool
+	// AutoCreateOrgs imports Grafana orgs missing from the store and plans
+	// create_grafana_org for mapped orgs missing from Grafana.
+	AutoCreateOrgs bool
+	// PlanMaxAge is how long a stored plan may be applied after it was
+	// built. Zero disables expiry.
+	PlanMaxAge time.Duration
+	// SkipDisabledUsers replaces add_user_to_team and update_user_role for
+	// disabled Grafana users with blocked_disabled_user.
+	SkipDisabledUsers bool
+	// SATokenRotationWindow plans rotate_service_account_token for tracked
+	// tokens expiring within it. Zero disables rotation.
+	SATokenRotationWindow time.Duration
+	// SATokenTTL is the lifetime of rotated tokens.
+	SATokenTTL time.Duration
+	// AllowRoleDowngrade lets update_user_role lower an org role that is
+	// higher than the mappings grant. Without it roles are only raised.
+	// ALLOW_ROLE_DOWNGRADE sets it and defaults to true.
+	AllowRoleDowngrade bool
+	// SyncAlert configures the stale-sync alert rule kept in Grafana by
+	// ReconcileSyncAlert.
+	SyncAlert SyncAlert
+	// TeamAvatarURLTemplate, when set, renders the avatar URL of every
+	// mapped team from a teamAvatarData value.
+	TeamAvatarURLTemplate *template.Template
+	// AllowedGroupTypes, when non-nil, skips mappings whose Entra group type
+	// (see entra.Group.Type) is not in the set.
+	AllowedGroupTypes map[string]bool
+	// VerifyTeamIDs checks that team IDs stored on mappings still exist in
+	// Grafana. Plans fall back to a name search (and create_team), and
+	// membership actions for a team deleted since the plan are skipped.
+	VerifyTeamIDs bool
+	// TeamLabels are recorded on every team create_team creates or reuses,
+	// together with entra-group-id.
+	TeamLabels map[string]string
+	// SyncTeamEmail plans update_team_email so every mapped team's email
+	// matches the mail address of its Entra group.
+	SyncTeamEmail bool
+}
+
+// SyncAlert describes the Grafana alert rule provisioned when
+// PROVISION_SYNC_ALERTS is enabled. The rule queries a Prometheus data source
+// scraping /metrics and fires when no sync action has been recorded for
+// ThresholdHours.
+type SyncAlert struct {
+	Enabled        bool
+	ThresholdHours int
+	OrgID          int64
+	FolderUID      string
+	DatasourceUID  string
+	// ContactPoint, when set, receives the alert directly instead of going
+	// through the notification policy tree.
+	ContactPoint string
+}
+
+// syncAlertRuleSettingKey stores the UID of the provisioned sync alert rule
+// so it is updated rather than duplicated.
+const syncAlertRuleSettingKey = "sync_alert_rule_uid"
+
+// LastSyncActionMetric is the gauge served on /metrics that the sync alert
+// rule queries.
+const LastSyncActionMetric = "grafana_ad_syncher_last_sync_action_timestamp_seconds"
+
+// SyncWindowSkippedMetric is the counter served on /metrics of scheduled
+// syncs skipped outside SYNC_WINDOW_START and SYNC_WINDOW_END.
+const SyncWindowSkippedMetric = "sync_window_skipped_total"
+
+// Settings keys for the values that can be changed on the settings page.
+// Unset keys fall back to the Options the syncer was created with.
+const (
+	allowCreateUsersSettingKey   = "allow_create_users"
+	allowRemoveMembersSettingKey = "allow_remove_members"
+	defaultUserRoleSettingKey    = "default_user_role"
+)
+
+// RuntimeSettings are the sync settings that take effect on the next plan
+// without a restart.
+type RuntimeSettings struct {
+	AllowCreateUsers   bool
+	AllowRemoveMembers bool
+	DefaultUserRole    string
+}
+
+// RuntimeSettings returns the stored settings, falling back to the env var
+// values for keys that were never saved or cannot be read.
+func (s *Syncer) RuntimeSettings() RuntimeSettings {
+	settings := RuntimeSettings{
+		AllowCreateUsers:   s.allowCreateUsers,
+		AllowRemoveMembers: s.allowRemoveUsers,
+		DefaultUserRole:    s.defaultUserRole,
+	}
+	if value, ok, err := s.store.GetSetting(allowCreateUsersSettingKey); err != nil {
+		log.Printf("sync: load setting %s failed: %v", allowCreateUsersSettingKey, err)
+	} else if enabled, err := strconv.ParseBool(value); ok && err == nil {
+		settings.AllowCreateUsers = enabled
+	}
+	if value, ok, err := s.store.GetSetting(allowRemoveMembersSettingKey); err != nil {
+		log.Printf("sync: load setting %s failed: %v", allowRemoveMembersSettingKey, err)
+	} else if enabled, err := strconv.ParseBool(value); ok && err == nil {
+		settings.AllowRemoveMembers = enabled
+	}
+	if value, ok, err := s.store.GetSetting(defaultUserRoleSettingKey); err != nil {
+		log.Printf("sync: load setting %s failed: %v", defaultUserRoleSettingKey, err)
+	} else if ok && value != "" {
+		settings.DefaultUserRole = value
+	}
+	return settings
+}
+
+// SetRuntimeSettings saves settings for the next plan. DefaultUserRole must
+// already be a canonical Grafana role.
+func (s *Syncer) SetRuntimeSettings(settings RuntimeSettings) error {
+	switch settings.DefaultUserRole {
+	case "Viewer", "Editor", "Admin":
+	default:
+		return fmt.Errorf("default user role must be Viewer, Editor or Admin, got %q", settings.DefaultUserRole)
+	}
+	if err := s.store.SetSetting(allowCreateUsersSettingKey, strconv.FormatBool(settings.AllowCreateUsers)); err != nil {
+		return err
+	}
+	if err := s.store.SetSetting(allowRemoveMembersSettingKey, strconv.FormatBool(settings.AllowRemoveMembers)); err != nil {
+		return err
+	}
+	return s.store.SetSetting(defaultUserRoleSettingKey, settings.DefaultUserRole)
+}
+
+// ActionTypes lists every action type BuildPlan can emit.
+var ActionTypes = []string{
+	"create_grafana_org",
+	"rename_team",
+	"create_team",
+	"create_team_folder",
+	"set_team_avatar",
+	"provision_datasource",
+	"create_user",
+	"invite_user",
+	"blocked_create_user",
+	"blocked_protected_user",
+	"blocked_disabled_user",
+	"add_user_to_org",
+	"update_user_role",
+	"update_user_profile",
+	"add_user_to_team",
+	"update_team_role",
+	"update_team_description",
+	"update_team_email",
+	"set_team_preferences",
+	"rotate_service_account_token",
+	"assign_contact_point",
+	"set_datasource_permission",
+	"update_datasource",
+	"remove_user_from_team",
+	"delete_datasource",
+	"disable_user",
+	"enable_user",
+}
+
+// DefaultActionOrder is the order ApplyPlan applies action types in unless
+// ACTION_ORDER overrides it. Lower values run first; actions with equal
+// values keep their plan order.
+var DefaultActionOrder = map[string]int{
+	"blocked_create_user":          0,
+	"blocked_protected_user":       0,
+	"blocked_disabled_user":        0,
+	"create_grafana_org":           0,
+	"rename_team":                  1,
+	"create_team":                  1,
+	"create_user":                  2,
+	"invite_user":                  2,
+	"create_team_folder":           2,
+	"set_team_avatar":              2,
+	"provision_datasource":         2,
+	"enable_user":                  2,
+	"add_user_to_org":              3,
+	"update_user_role":             4,
+	"update_user_profile":          4,
+	"add_user_to_team":             5,
+	"update_team_role":             6,
+	"update_team_description":      6,
+	"update_team_email":            6,
+	"set_team_preferences":         6,
+	"rotate_service_account_token": 6,
+	"assign_contact_point":         6,
+	"set_datasource_permission":    6,
+	"update_datasource":            6,
+	"remove_user_from_team":        7,
+	"delete_datasource":            7,
+	"disable_user":                 8,
+}
+
+// ParseActionOrder parses an ACTION_ORDER value, a JSON object mapping every
+// action type in ActionTypes to its priority. An empty string returns
+// DefaultActionOrder.
+func ParseActionOrder(text string) (map[string]int, error) {
+	if strings.TrimSpace(text) == "" {
+		return DefaultActionOrder, nil
+	}
+	var order map[string]int
+	if err := json.Unmarshal([]byte(text), &order); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	known := map[string]bool{}
+	var missing []string
+	for _, actionType := range ActionTypes {
+		known[actionType] = true
+		if _, ok := order[actionType]; !ok {
+			missing = append(missing, actionType)
+		}
+	}
+	for actionType := range order {
+		if !known[actionType] {
+			return nil, fmt.Errorf("unknown action type %q (known: %s)", actionType, strings.Join(ActionTypes, ", "))
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing action types: %s", strings.Join(missing, ", "))
+	}
+	return order, nil
+}
+
+// ParseActionAllowlist parses an ALLOWED_ACTION_TYPES value, a comma
+// separated list of action types. An empty string allows all actions.
+func ParseActionAllowlist(text string) (map[string]bool, error) {
+	allowed := map[string]bool{}
+	for _, entry := range strings.Split(text, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		known := false
+		for _, actionType := range ActionTypes {
+			if entry == actionType {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown action type %q (known: %s)", entry, strings.Join(ActionTypes, ", "))
+		}
+		allowed[entry] = true
+	}
+	return allowed, nil
+}
+
+func New(store *store.Store, grafana *grafana.Client, entra *entra.Client, opts Options) *Syncer {
+	s := &Syncer{
 		store:            store,
 		grafana:          grafana,
 		entra:            entra,
-		defaultUserRole:  defaultRole,
-		allowCreateUsers: allowCreateUsers,
-		allowRemoveUsers: allowRemoveUsers,
+		defaultUserRole:  opts.DefaultUserRole,
+		allowCreateUsers: opts.AllowCreateUsers,
+		allowRemoveUsers: opts.AllowRemoveUsers,
+		displayNameTmpl:  opts.DisplayNameTemplate,
+		noteTmpl:         opts.NoteTemplate,
+		readOnly:         opts.ReadOnly,
+		removalGrace:     opts.RemovalGracePeriod,
+		ownersAsAdmins:   opts.GroupOwnersAsTeamAdmins,
+		loginFormat:      opts.LoginFormat,
+		memberCacheTTL:   opts.MemberCacheTTL,
+		roleRules:        opts.RoleRules,
+		webhookURL:       opts.WebhookURL,
+		previewMinAlert:  opts.PreviewAlertMinActions,
+		webhookClient:    &http.Client{Timeout: 10 * time.Second},
+		allowedActions:   opts.AllowedActions,
+		deactivateUsers:  opts.DeactivateRemovedUsers,
+		autoEnableUsers:  opts.AutoEnableUsers,
+		protectedLogins:  protectedLoginSet(opts.ProtectedLogins),
+		adminDomains:     emailDomainSet(opts.TeamAdminEmailDomains),
+		newTenantClient:  opts.NewTenantClient,
+		teamFolders:      opts.TeamFolderAutoCreate,
+		teamFolderParent: opts.TeamFolderParentUID,
+		teamFolderPerm:   opts.TeamFolderPermission,
+		folderTmpl:       opts.TeamFolderTitleTemplate,
+		actionOrder:      opts.ActionOrder,
+		teamSyncCompat:   opts.TeamSyncCompat,
+		updateProfiles:   opts.UpdateUserProfiles,
+		autoCreateOrgs:   opts.AutoCreateOrgs,
+		planMaxAge:       opts.PlanMaxAge,
+		skipDisabled:     opts.SkipDisabledUsers,
+		saTokenWindow:    opts.SATokenRotationWindow,
+		saTokenTTL:       opts.SATokenTTL,
+		allowDowngrade:   opts.AllowRoleDowngrade,
+		syncAlert:        opts.SyncAlert,
+		avatarTmpl:       opts.TeamAvatarURLTemplate,
+		groupTypes:       opts.AllowedGroupTypes,
+		verifyTeamIDs:    opts.VerifyTeamIDs,
+		teamLabels:       opts.TeamLabels,
+		syncTeamEmail:    opts.SyncTeamEmail,
+		cache: &grafanaCache{
+			ttl:         opts.CacheTTL,
+			teamMembers: map[int64]cachedTeamMembers{},
+			orgUsers:    map[int64]cachedOrgUsers{},
+			refreshing:  map[string]struct{}{},
+		},
+	}
+	if s.actionOrder == nil {
+		s.actionOrder = DefaultActionOrder
+	}
+	if err := s.ReloadTenants(); err != nil {
+		log.Printf("sync: load tenants failed: %v", err)
+	}
+	return s
+}
+
+// ReloadTenants rebuilds the per-tenant Entra clients from the store. Call
+// it after tenants are created, changed or deleted.
+func (s *Syncer) ReloadTenants() error {
+	if s.newTenantClient == nil {
+		return nil
+	}
+	tenants, err := s.store.ListTenants()
+	if err != nil {
+		return err
+	}
+	clients := make(map[int64]*entra.Client, len(tenants))
+	for _, tenant := range tenants {
+		clients[tenant.ID] = s.newTenantClient(tenant)
+	}
+	s.tenantMu.Lock()
+	s.tenantClients = clients
+	s.tenantMu.Unlock()
+	return nil
+}
+
+// EntraForOrg returns the Entra client serving an org's tenant.
+func (s *Syncer) EntraForOrg(org store.Org) *entra.Client {
+	return s.entraFor(org.TenantID)
+}
+
+// entraFor returns the Entra client serving the given tenant, or the
+// default client for tenant 0 and unknown tenants.
+func (s *Syncer) entraFor(tenantID int64) *entra.Client {
+	if tenantID == 0 {
+		return s.entra
+	}
+	s.tenantMu.RLock()
+	client, ok := s.tenantClients[tenantID]
+	s.tenantMu.RUnlock()
+	if !ok {
+		log.Printf("sync: tenant %d has no Entra client, using default", tenantID)
+		return s.entra
+	}
+	return client
+}
+
+// ParseDisplayNameTemplate parses a USER_DISPLAY_NAME_TEMPLATE value. An empty
+// string falls back to the member's Entra display name.
+func ParseDisplayNameTemplate(text string) (*template.Template, error) {
+	if strings.TrimSpace(text) == "" {
+		text = "{{.DisplayName}}"
+	}
+	tmpl, err := template.New("display_name").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse display name template: %w", err)
+	}
+	if err := tmpl.Execute(io.Discard, displayNameData{}); err != nil {
+		return nil, fmt.Errorf("execute display name template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// ParseNoteTemplate parses a NOTE_TEMPLATE value. An empty string returns nil,
+// which keeps the syncer's own notes.
+func ParseNoteTemplate(text string) (*template.Template, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("note").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse note template: %w", err)
+	}
+	if err := tmpl.Execute(io.Discard, noteData{}); err != nil {
+		return nil, fmt.Errorf("execute note template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// teamAvatarData is the data TEAM_AVATAR_URL_TEMPLATE is rendered with.
+type teamAvatarData struct {
+	TeamName string
+	// OrgID is the Grafana org ID.
+	OrgID int64
+}
+
+// EntraGroupLabel is the team label holding the Entra group ID of the
+// mapping a team was created for.
+const EntraGroupLabel = "entra-group-id"
+
+// ParseTeamLabel splits a TEAM_MANAGED_LABEL value of the form key=value.
+// An empty string returns an empty key.
+func ParseTeamLabel(raw string) (string, string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", "", nil
+	}
+	key, value, ok := strings.Cut(raw, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return "", "", fmt.Errorf("label must be key=value, got %q", raw)
+	}
+	if key == EntraGroupLabel {
+		return "", "", fmt.Errorf("label key %s is reserved", EntraGroupLabel)
+	}
+	return key, strings.TrimSpace(value), nil
+}
+
+func (s *Syncer) createdTeamLabels(action store.PlanAction) map[string]string {
+	labels := make(map[string]string, len(s.teamLabels)+1)
+	for key, value := range s.teamLabels {
+		labels[key] = value
+	}
+	if action.ExternalGroupID != "" {
+		labels[EntraGroupLabel] = action.ExternalGroupID
+	}
+	return labels
+}
+
+// teamFolderData is the data TEAM_FOLDER_TITLE_TEMPLATE is rendered with.
+type teamFolderData struct {
+	TeamName string
+	// OrgID is the Grafana org ID.
+	OrgID int64
+}
+
+// ParseTeamFolderTemplate parses a TEAM_FOLDER_TITLE_TEMPLATE value. An
+// empty string returns nil, which names folders after their team.
+func ParseTeamFolderTemplate(text string) (*template.Template, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("team_folder").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse team folder template: %w", err)
+	}
+	if err := tmpl.Execute(io.Discard, teamFolderData{}); err != nil {
+		return nil, fmt.Errorf("execute team folder template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// ParseTeamAvatarTemplate parses a TEAM_AVATAR_URL_TEMPLATE value. An empty
+// string returns nil, which leaves team avatars alone.
+func ParseTeamAvatarTemplate(text string) (*template.Template, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("team_avatar").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse team avatar template: %w", err)
+	}
+	if err := tmpl.Execute(io.Discard, teamAvatarData{}); err != nil {
+		return nil, fmt.Errorf("execute team avatar template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// RoleRule assigns Role to members of groups whose display name matches
+// Pattern.
+type RoleRule struct {
+	Pattern *regexp.Regexp
+	Role    string
+}
+
+// ParseRoleRules parses a ROLE_FROM_GROUP_NAME_PATTERN value: a JSON array
+// of {"regex": "...", "role": "Admin|Editor|Viewer"} objects, evaluated in
+// order. An empty string yields no rules.
+func ParseRoleRules(text string) ([]RoleRule, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	var raw []struct {
+		Regex string `json:"regex"`
+		Role  string `json:"role"`
+	}
+	if err := json.Unmarshal([]byte(text), &raw); err != nil {
+		return nil, fmt.Errorf("parse role rules: %w", err)
+	}
+	rules := make([]RoleRule, 0, len(raw))
+	for i, r := range raw {
+		pattern, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("role rule %d: %w", i+1, err)
+		}
+		role := ""
+		for _, valid := range []string{"Viewer", "Editor", "Admin"} {
+			if strings.EqualFold(r.Role, valid) {
+				role = valid
+			}
+		}
+		if role == "" {
+			return nil, fmt.Errorf("role rule %d: role must be Viewer, Editor or Admin, got %q", i+1, r.Role)
+		}
+		rules = append(rules, RoleRule{Pattern: pattern, Role: role})
+	}
+	return rules, nil
+}
+
+// matchRoleRule returns the first role rule matching groupName.
+func (s *Syncer) matchRoleRule(groupName string) (RoleRule, bool) {
+	if groupName == "" {
+		return RoleRule{}, false
+	}
+	for _, rule := range s.roleRules {
+		if rule.Pattern.MatchString(groupName) {
+			return rule, true
+		}
+	}
+	return RoleRule{}, false
+}
+
+// ReadOnly reports whether the syncer only builds plans and never applies them.
+func (s *Syncer) ReadOnly() bool { return s.readOnly }
+
+// PlanMaxAge returns how long a stored plan stays applicable.
+func (s *Syncer) PlanMaxAge() time.Duration { return s.planMaxAge }
+
+// RecordWindowSkip counts a scheduled sync skipped because it fell outside
+// the sync window.
+func (s *Syncer) RecordWindowSkip() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.windowSkips++
+}
+
+// WindowSkips returns how many scheduled syncs RecordWindowSkip counted.
+func (s *Syncer) WindowSkips() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.windowSkips
+}
+
+// SyncWindow is a daily time range in which scheduled syncs may run. When
+// End is before Start the window spans midnight.
+type SyncWindow struct {
+	Start    time.Duration
+	End      time.Duration
+	Location *time.Location
+}
+
+// ParseSyncWindow parses SYNC_WINDOW_START, SYNC_WINDOW_END (HH:MM) and
+// SYNC_WINDOW_TZ. It returns nil when no window is configured.
+func ParseSyncWindow(start, end, tz string) (*SyncWindow, error) {
+	start, end = strings.TrimSpace(start), strings.TrimSpace(end)
+	if start == "" && end == "" {
+		return nil, nil
+	}
+	if start == "" || end == "" {
+		return nil, fmt.Errorf("start and end must be set together")
+	}
+	window := &SyncWindow{Location: time.UTC}
+	var err error
+	if window.Start, err = parseClock(start); err != nil {
+		return nil, err
+	}
+	if window.End, err = parseClock(end); err != nil {
+		return nil, err
+	}
+	if window.Start == window.End {
+		return nil, fmt.Errorf("start and end must differ")
+	}
+	if tz = strings.TrimSpace(tz); tz != "" {
+		if window.Location, err = time.LoadLocation(tz); err != nil {
+			return nil, fmt.Errorf("timezone %q: %w", tz, err)
+		}
+	}
+	return window, nil
+}
+
+func parseClock(value string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", value)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// Contains reports whether t falls inside the window. The start is
+// inclusive and the end exclusive. A nil window contains every time.
+func (w *SyncWindow) Contains(t time.Time) bool {
+	if w == nil {
+		return true
 	}
+	local := t.In(w.Location)
+	clock := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute + time.Duration(local.Second())*time.Second
+	if w.Start < w.End {
+		return clock >= w.Start && clock < w.End
+	}
+	return clock >= w.Start || clock < w.End
 }
 
 func (s *Syncer) LastRun() (time.Time, string) {
@@ -75,212 +873,1141 @@ func (s *Syncer) Run() error {
 	start := time.Now()
 	log.Printf("sync: starting")
 
+	if err := s.ImportGrafanaOrgs(); err != nil {
+		log.Printf("sync: import grafana orgs failed: %v", err)
+	}
+	if _, err := s.ValidateMappings(context.Background()); err != nil {
+		log.Printf("sync: validate mappings failed: %v", err)
+	}
 	plan, err := s.BuildPlan()
 	if err != nil {
-		return s.finish(start, err)
+		return s.finish(start, 0, 0, err)
+	}
+	if s.readOnly {
+		plan.Status = "preview"
+		planID, err := s.store.ReplacePlan(*plan)
+		if err != nil {
+			return s.finish(start, 0, 0, fmt.Errorf("store plan: %w", err))
+		}
+		log.Printf("sync: read-only mode, stored plan with %d actions without applying", len(plan.Actions))
+		return s.finish(start, planID, 0, nil)
+	}
+	// ApplyPlan stops at the first failing action; the last progress event
+	// tells how many were applied before it.
+	progress := make(chan ProgressEvent, len(plan.Actions))
+	err = s.ApplyPlan(plan.Actions, progress)
+	close(progress)
+	applied := 0
+	for event := range progress {
+		applied = event.Applied
+	}
+	if err != nil {
+		return s.finish(start, 0, applied, err)
 	}
-	if err := s.ApplyPlan(plan.Actions); err != nil {
-		return s.finish(start, err)
+	if err := s.ReconcileSyncAlert(); err != nil {
+		log.Printf("sync: reconcile sync alert rule failed: %v", err)
 	}
-	return s.finish(start, nil)
+	return s.finish(start, 0, applied, nil)
 }
 
-func (s *Syncer) ApplyPlan(actions []store.PlanAction) error {
-	if len(actions) == 0 {
+// ReconcileSyncAlert creates or updates the stale-sync alert rule when
+// PROVISION_SYNC_ALERTS is enabled, and deletes a previously provisioned rule
+// when it is not.
+func (s *Syncer) ReconcileSyncAlert() error {
+	if s.readOnly {
 		return nil
 	}
-	sortActions(actions)
-	userIDs := map[string]int64{}
-	teamIDs := map[string]int64{}
+	uid, _, err := s.store.GetSetting(syncAlertRuleSettingKey)
+	if err != nil {
+		return fmt.Errorf("load rule uid: %w", err)
+	}
+	if !s.syncAlert.Enabled {
+		if uid == "" {
+			return nil
+		}
+		if err := s.grafana.DeleteAlertRule(s.syncAlert.OrgID, uid); err != nil {
+			return fmt.Errorf("delete rule %s: %w", uid, err)
+		}
+		log.Printf("sync: deleted sync alert rule %s", uid)
+		return s.store.SetSetting(syncAlertRuleSettingKey, "")
+	}
+	rule := s.syncAlertRule()
+	if uid != "" {
+		existing, err := s.grafana.GetAlertRule(s.syncAlert.OrgID, uid)
+		if err != nil {
+			return fmt.Errorf("get rule %s: %w", uid, err)
+		}
+		if existing != nil {
+			rule.UID = uid
+			return s.grafana.UpdateAlertRule(s.syncAlert.OrgID, rule)
+		}
+	}
+	rule.UID = newAlertRuleUID()
+	if err := s.grafana.ProvisionAlertRule(s.syncAlert.OrgID, rule); err != nil {
+		return fmt.Errorf("create rule: %w", err)
+	}
+	log.Printf("sync: provisioned sync alert rule %s", rule.UID)
+	return s.store.SetSetting(syncAlertRuleSettingKey, rule.UID)
+}
+
+func (s *Syncer) syncAlertRule() grafana.AlertRule {
+	threshold := s.syncAlert.ThresholdHours
+	rule := grafana.AlertRule{
+		OrgID:     s.syncAlert.OrgID,
+		FolderUID: s.syncAlert.FolderUID,
+		RuleGroup: "grafana-ad-syncher",
+		Title:     fmt.Sprintf("sync_not_run_in_%d_hours", threshold),
+		Condition: "C",
+		Data: []grafana.AlertQuery{
+			{
+				RefID:             "A",
+				DatasourceUID:     s.syncAlert.DatasourceUID,
+				RelativeTimeRange: grafana.RelativeTimeRange{From: 600},
+				Model: map[string]any{
+					"refId":   "A",
+					"expr":    fmt.Sprintf("time() - max(%s)", LastSyncActionMetric),
+					"instant": true,
+				},
+			},
+			{
+				RefID:         "C",
+				DatasourceUID: "__expr__",
+				Model: map[string]any{
+					"refId":      "C",
+					"type":       "threshold",
+					"expression": "A",
+					"conditions": []map[string]any{
+						{"evaluator": map[string]any{"type": "gt", "params": []int{threshold * 3600}}},
+					},
+				},
+			},
+		},
+		// A missing metric means the syncer is not being scraped or has
+		// never recorded an action; both deserve attention.
+		NoDataState:  "Alerting",
+		ExecErrState: "Error",
+		For:          "5m",
+		Annotations: map[string]string{
+			"summary": fmt.Sprintf("grafana-ad-syncher has not applied any sync action in the last %d hours", threshold),
+		},
+	}
+	if s.syncAlert.ContactPoint != "" {
+		rule.NotificationSettings = &grafana.AlertNotificationSettings{Receiver: s.syncAlert.ContactPoint}
+	}
+	return rule
+}
+
+func newAlertRuleUID() string {
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return fmt.Sprintf("ad-syncher-%d", time.Now().UnixNano())
+	}
+	return fmt.Sprintf("ad-syncher-%x", buf)
+}
+
+// ProgressEvent reports that one more plan action has been applied.
+type ProgressEvent struct {
+	Applied    int    `json:"applied"`
+	Total      int    `json:"total"`
+	ActionType string `json:"action_type"`
+	Team       string `json:"team"`
+}
+
+// PlanValidation is the outcome of ValidatePlan. Errors are actions that
+// would fail if applied now; warnings are actions that would not change
+// anything.
+type PlanValidation struct {
+	Valid    bool     `json:"valid"`
+	Warnings []string `json:"warnings,omitempty"`
+	Errors   []string `json:"errors,omitempty"`
+}
 
+// ValidatePlan checks actions against Grafana without changing anything:
+// create_team against existing teams, create_user against existing users
+// and add_user_to_team against current team members. Other action types
+// are not checked.
+func (s *Syncer) ValidatePlan(actions []store.PlanAction) PlanValidation {
+	result := PlanValidation{}
+	members := map[int64]map[string]bool{}
 	for _, action := range actions {
-		email := action.Email
+		email := strings.ToLower(strings.TrimSpace(action.Email))
 		switch action.ActionType {
 		case "create_team":
-			teamID, err := s.grafana.EnsureTeam(action.GrafanaOrgID, action.TeamName)
+			_, found, err := s.grafana.WithOrgContext(action.GrafanaOrgID).SearchTeam(action.TeamName)
 			if err != nil {
-				return err
-			}
-			teamIDs[teamKey(action.OrgID, action.TeamName)] = teamID
-			if err := s.store.UpdateMappingTeamIDForName(action.OrgID, action.TeamName, teamID); err != nil {
-				log.Printf("sync: update team id for %s failed: %v", action.TeamName, err)
-			}
-			if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
-				log.Printf("sync: record action failed: %v", err)
+				result.Errors = append(result.Errors, fmt.Sprintf("action %d: search team %q: %v", action.ID, action.TeamName, err))
+			} else if found {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("action %d: team %q already exists in Grafana org %d and will be reused", action.ID, action.TeamName, action.GrafanaOrgID))
 			}
 		case "create_user":
-			name := action.DisplayName
-			if name == "" {
-				name = email
-			}
-			created, err := s.grafana.CreateUser(email, email, name, randomPassword())
+			_, found, err := s.grafana.LookupUser(email)
 			if err != nil {
-				return err
-			}
-			userIDs[email] = created.ID
-			if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
-				log.Printf("sync: record action failed: %v", err)
-			}
-		case "add_user_to_org":
-			if err := s.grafana.AddUserToOrg(action.GrafanaOrgID, email, action.Role); err != nil {
-				return err
-			}
-			if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
-				log.Printf("sync: record action failed: %v", err)
-			}
-		case "update_user_role":
-			id := action.UserID
-			if id == 0 {
-				id = userIDs[email]
-			}
-			if id == 0 {
-				user, found, err := s.grafana.LookupUser(email)
-				if err != nil {
-					return err
-				}
-				if found {
-					id = user.ID
-				}
-			}
-			if id != 0 {
-				if err := s.grafana.UpdateUserRole(action.GrafanaOrgID, id, action.Role); err != nil {
-					if isExternallySyncedUserErr(err) {
-						log.Printf("sync: skip update role for externally synced user %s: %v", email, err)
-						continue
-					}
-					return err
-				}
-			}
-			if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
-				log.Printf("sync: record action failed: %v", err)
+				result.Errors = append(result.Errors, fmt.Sprintf("action %d: look up user %s: %v", action.ID, email, err))
+			} else if found {
+				result.Errors = append(result.Errors, fmt.Sprintf("action %d: user %s already exists in Grafana", action.ID, email))
 			}
 		case "add_user_to_team":
-			teamID := action.TeamID
-			if teamID == 0 {
-				teamID = teamIDs[teamKey(action.OrgID, action.TeamName)]
-			}
-			if teamID == 0 {
-				return fmt.Errorf("missing team id for %s", action.TeamName)
-			}
-			id := action.UserID
-			if id == 0 {
-				id = userIDs[email]
-			}
-			if id == 0 {
-				user, found, err := s.grafana.LookupUser(email)
-				if err != nil {
-					return err
-				}
-				if found {
-					id = user.ID
-				}
-			}
-			if id != 0 {
-				if err := s.grafana.AddUserToTeam(teamID, id, action.TeamRole); err != nil {
-					return err
-				}
-			}
-			if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
-				log.Printf("sync: record action failed: %v", err)
-			}
-		case "update_team_role":
-			teamID := action.TeamID
-			if teamID == 0 {
-				teamID = teamIDs[teamKey(action.OrgID, action.TeamName)]
-			}
-			if teamID == 0 {
-				return fmt.Errorf("missing team id for %s", action.TeamName)
-			}
-			id := action.UserID
-			if id == 0 {
-				user, found, err := s.grafana.LookupUser(email)
-				if err != nil {
-					return err
-				}
-				if found {
-					id = user.ID
-				}
-			}
-			if id != 0 {
-				if err := s.grafana.UpdateTeamMemberRole(teamID, id, action.TeamRole); err != nil {
-					return err
-				}
-			}
-			if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
-				log.Printf("sync: record action failed: %v", err)
-			}
-		case "remove_user_from_team":
-			teamID := action.TeamID
-			if teamID == 0 {
-				teamID = teamIDs[teamKey(action.OrgID, action.TeamName)]
-			}
-			if teamID == 0 {
-				return fmt.Errorf("missing team id for %s", action.TeamName)
+			// Teams created by the same plan have no ID yet and no members.
+			if action.TeamID == 0 {
+				continue
 			}
-			id := action.UserID
-			if id == 0 {
-				user, found, err := s.grafana.LookupUser(email)
+			if members[action.TeamID] == nil {
+				teamMembers, err := s.grafana.WithOrgContext(action.GrafanaOrgID).ListTeamMembers(action.TeamID)
 				if err != nil {
-					return err
-				}
-				if found {
-					id = user.ID
+					result.Errors = append(result.Errors, fmt.Sprintf("action %d: list members of team %q: %v", action.ID, action.TeamName, err))
+					continue
 				}
-			}
-			if id != 0 {
-				if err := s.grafana.RemoveUserFromTeam(teamID, id); err != nil {
-					return err
+				members[action.TeamID] = map[string]bool{}
+				for _, member := range teamMembers {
+					members[action.TeamID][strings.ToLower(strings.TrimSpace(member.Email))] = true
 				}
 			}
-			if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
-				log.Printf("sync: record action failed: %v", err)
+			if members[action.TeamID][email] {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("action %d: %s is already a member of team %q", action.ID, email, action.TeamName))
 			}
-		default:
-			continue
 		}
 	}
-	return nil
+	result.Valid = len(result.Errors) == 0
+	return result
 }
 
-func (s *Syncer) BuildPlan() (*store.Plan, error) {
-	orgs, err := s.store.ListOrgs()
+// ApplyPlan applies actions in dependency order. When progress is non-nil an
+// event is sent on it after each applied action; the caller owns the channel.
+func (s *Syncer) ApplyPlan(actions []store.PlanAction, progress chan<- ProgressEvent) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if len(actions) == 0 {
+		return nil
+	}
+	sortActions(actions, s.actionOrder)
+	userIDs := map[string]int64{}
+	teamIDs := map[string]int64{}
+	defer s.invalidateCache(actions, teamIDs)
+
+	for i, action := range actions {
+		if err := s.applyAction(action, userIDs, teamIDs); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress <- ProgressEvent{
+				Applied:    i + 1,
+				Total:      len(actions),
+				ActionType: action.ActionType,
+				Team:       action.TeamName,
+			}
+		}
+	}
+	s.notify(webhookEvent{Event: "plan_applied", ActionCount: len(actions), ActionCounts: countActionTypes(actions)})
+	return nil
+}
+
+// DryRunPlan builds a plan like BuildPlan and returns it without writing to
+// the store, sending webhooks or validating mappings, so the stored plan,
+// pending removals and member cache are left as they are. It returns ctx's
+// error when ctx is done before or while the plan is built.
+func (s *Syncer) DryRunPlan(ctx context.Context) (*store.Plan, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	plan, err := s.buildPlan(ctx, false)
 	if err != nil {
-		return nil, fmt.Errorf("list orgs: %w", err)
+		return nil, err
 	}
-	orgByID := make(map[int64]store.Org, len(orgs))
-	orgNameByID := make(map[int64]string, len(orgs))
-	for _, org := range orgs {
-		orgByID[org.ID] = org
-		orgNameByID[org.ID] = org.Name
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
+	return plan, nil
+}
 
+// PreviewMapping compares the members of one mapping's Entra group with its
+// Grafana team, using BuildPlan's team lookup, group type filter, team role
+// and team sync compat rules, without building a plan or writing to the
+// store. Team roles take the team's other mappings into account; the
+// removal grace period is ignored.
+func (s *Syncer) PreviewMapping(ctx context.Context, mappingID int64) (*MappingDiff, error) {
+	mapping, err := s.store.GetMapping(mappingID)
+	if err != nil {
+		return nil, fmt.Errorf("load mapping: %w", err)
+	}
+	if mapping == nil {
+		return nil, ErrMappingNotFound
+	}
+	org, err := s.store.GetOrg(mapping.OrgID)
+	if err != nil {
+		return nil, fmt.Errorf("load org: %w", err)
+	}
+	if org == nil {
+		return nil, fmt.Errorf("mapping %d references missing org %d", mapping.ID, mapping.OrgID)
+	}
+	allowRemove := s.RuntimeSettings().AllowRemoveMembers
+	if mapping.AllowRemoveMembers != nil {
+		allowRemove = *mapping.AllowRemoveMembers
+	}
+	diff := &MappingDiff{
+		MappingID:       mapping.ID,
+		TeamName:        mapping.GrafanaTeamName,
+		Added:           []MemberChange{},
+		Removed:         []MemberChange{},
+		RoleUpdates:     []MemberChange{},
+		RemovalsAllowed: allowRemove,
+	}
+	entraClient := s.entraFor(org.TenantID)
+	var groupTypes map[string]string
+	if s.groupTypes != nil {
+		groupTypes = s.listGroupInfo(entraClient).types
+		if groupType, skipped := s.skippedGroupType(groupTypes, mapping.ExternalGroupID); skipped {
+			diff.Skipped = fmt.Sprintf("group %s is a %s group", mapping.ExternalGroupID, groupType)
+			return diff, nil
+		}
+	}
+
+	// Members are listed for every mapping of the team, in BuildPlan's
+	// order, so each one gets the highest team role any mapping grants.
 	mappings, err := s.store.ListMappings()
 	if err != nil {
 		return nil, fmt.Errorf("list mappings: %w", err)
 	}
+	teamRoles := map[string]string{}
+	var want map[string]entra.Member
+	for _, other := range mappings {
+		if teamKey(other.OrgID, other.GrafanaTeamName) != teamKey(mapping.OrgID, mapping.GrafanaTeamName) {
+			continue
+		}
+		if _, skipped := s.skippedGroupType(groupTypes, other.ExternalGroupID); skipped {
+			continue
+		}
+		members, err := s.mappingMembers(entraClient, other, teamRoles, false)
+		if other.ID == mapping.ID {
+			if err != nil {
+				return nil, fmt.Errorf("list group members %s: %w", mapping.ExternalGroupID, err)
+			}
+			want = members
+		} else if err != nil {
+			log.Printf("sync: list group members %s failed: %v", other.ExternalGroupID, err)
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
 
-	var actions []store.PlanAction
+	teamID, _, err := s.mappingTeamID(*org, *mapping)
+	if err != nil {
+		return nil, err
+	}
+	diff.TeamID = teamID
+	have := map[string]grafana.TeamMember{}
+	if teamID != 0 {
+		teamMembers, err := s.ListTeamMembers(org.GrafanaOrgID, teamID)
+		if err != nil {
+			return nil, fmt.Errorf("list team members %d: %w", teamID, err)
+		}
+		for _, tm := range teamMembers {
+			if email := strings.TrimSpace(strings.ToLower(tm.Email)); email != "" {
+				have[email] = tm
+			}
+		}
+	}
+	// In team sync compat mode BuildPlan leaves the team membership of org
+	// members to Grafana.
+	orgMembers := map[string]bool{}
+	if s.teamSyncCompat {
+		users, err := s.ListOrgUsers(org.GrafanaOrgID)
+		if err != nil {
+			return nil, fmt.Errorf("list org users %d: %w", org.GrafanaOrgID, err)
+		}
+		for _, user := range users {
+			orgMembers[strings.ToLower(strings.TrimSpace(user.Email))] = true
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for email := range want {
+		role := teamRoles[email]
+		if role == "" {
+			role = "member"
+		}
+		member, ok := have[email]
+		switch {
+		case !ok && !orgMembers[email]:
+			diff.Added = append(diff.Added, MemberChange{Email: email, TeamRole: role})
+		case ok && role == "admin" && member.TeamRole() != "admin":
+			diff.RoleUpdates = append(diff.RoleUpdates, MemberChange{Email: email, TeamRole: role})
+		}
+	}
+	for email, member := range have {
+		if _, ok := want[email]; !ok {
+			diff.Removed = append(diff.Removed, MemberChange{Email: email, TeamRole: member.TeamRole()})
+		}
+	}
+	for _, changes := range [][]MemberChange{diff.Added, diff.Removed, diff.RoleUpdates} {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Email < changes[j].Email })
+	}
+	return diff, nil
+}
+
+// Preview imports missing Grafana orgs, then builds and stores a plan without
+// applying it. When the plan has at least PreviewAlertMinActions actions a
+// preview_ready webhook is sent.
+func (s *Syncer) Preview() (*store.Plan, error) {
+	if err := s.ImportGrafanaOrgs(); err != nil {
+		log.Printf("sync: import grafana orgs failed: %v", err)
+	}
+	if _, err := s.ValidateMappings(context.Background()); err != nil {
+		log.Printf("sync: validate mappings failed: %v", err)
+	}
+	plan, err := s.BuildPlan()
+	if err != nil {
+		return nil, err
+	}
+	plan.Status = "preview"
+	if _, err := s.store.ReplacePlan(*plan); err != nil {
+		return nil, fmt.Errorf("store plan: %w", err)
+	}
+	minActions := s.previewMinAlert
+	if minActions < 1 {
+		minActions = 1
+	}
+	if len(plan.Actions) >= minActions {
+		s.notify(webhookEvent{Event: "preview_ready", ActionCount: len(plan.Actions)})
+	}
+	return plan, nil
+}
+
+type webhookEvent struct {
+	Event        string         `json:"event"`
+	ActionCount  int            `json:"action_count"`
+	ActionCounts map[string]int `json:"action_counts,omitempty"`
+}
+
+// countActionTypes counts actions by type, as in a plan summary.
+func countActionTypes(actions []store.PlanAction) map[string]int {
+	counts := make(map[string]int)
+	for _, action := range actions {
+		counts[action.ActionType]++
+	}
+	return counts
+}
+
+// notify posts event to the configured webhook in the background.
+func (s *Syncer) notify(event webhookEvent) {
+	if s.webhookURL == "" {
+		return
+	}
+	go func() {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+		resp, err := s.webhookClient.Post(s.webhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("sync: webhook %s failed: %v", event.Event, err)
+			return
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("sync: webhook %s returned %s", event.Event, resp.Status)
+		}
+	}()
+}
+
+func (s *Syncer) applyAction(action store.PlanAction, userIDs map[string]int64, teamIDs map[string]int64) error {
+	email := action.Email
+	switch action.ActionType {
+	case "create_team":
+		teamID, err := s.grafana.WithOrgContext(action.GrafanaOrgID).EnsureTeam(action.TeamName)
+		if err != nil {
+			return err
+		}
+		teamIDs[teamKey(action.OrgID, action.TeamName)] = teamID
+		if err := s.store.UpdateMappingTeamIDForName(action.OrgID, action.TeamName, teamID); err != nil {
+			log.Printf("sync: update team id for %s failed: %v", action.TeamName, err)
+		}
+		if err := s.store.SetTeamLabels(action.GrafanaOrgID, teamID, s.createdTeamLabels(action)); err != nil {
+			log.Printf("sync: record labels for team %s failed: %v", action.TeamName, err)
+		}
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	case "create_user":
+		name := action.DisplayName
+		if name == "" {
+			name = email
+		}
+		login := action.Login
+		if login == "" {
+			login = email
+		}
+		created, err := s.grafana.CreateUser(email, login, name, randomPassword())
+		if err != nil {
+			return err
+		}
+		userIDs[email] = created.ID
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	case "invite_user":
+		name := action.DisplayName
+		if name == "" {
+			name = email
+		}
+		code, err := s.grafana.WithOrgContext(action.GrafanaOrgID).InviteUser(email, name, action.Role)
+		if err != nil {
+			return err
+		}
+		if err := s.store.SetUserInvite(store.UserInvite{GrafanaOrgID: action.GrafanaOrgID, Email: email, Code: code, CreatedAt: time.Now()}); err != nil {
+			log.Printf("sync: record invite %s failed: %v", email, err)
+		}
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	case "add_user_to_org":
+		if err := s.grafana.WithOrgContext(action.GrafanaOrgID).AddUserToOrg(email, action.Role); err != nil {
+			return err
+		}
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	case "update_user_role":
+		id := action.UserID
+		if id == 0 {
+			id = userIDs[email]
+		}
+		if id == 0 {
+			user, found, err := s.grafana.LookupUser(email)
+			if err != nil {
+				return err
+			}
+			if found {
+				id = user.ID
+			}
+		}
+		if id != 0 {
+			if err := s.grafana.WithOrgContext(action.GrafanaOrgID).UpdateUserRole(id, action.Role); err != nil {
+				if isExternallySyncedUserErr(err) {
+					log.Printf("sync: skip update role for externally synced user %s: %v", email, err)
+					return nil
+				}
+				return err
+			}
+		}
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	case "add_user_to_team":
+		teamID := action.TeamID
+		if teamID == 0 {
+			teamID = teamIDs[teamKey(action.OrgID, action.TeamName)]
+		}
+		if teamID == 0 {
+			return fmt.Errorf("missing team id for %s", action.TeamName)
+		}
+		if s.teamDeleted(action, teamID, teamIDs) {
+			return nil
+		}
+		id := action.UserID
+		if id == 0 {
+			id = userIDs[email]
+		}
+		if id == 0 {
+			user, found, err := s.grafana.LookupUser(email)
+			if err != nil {
+				return err
+			}
+			if found {
+				id = user.ID
+			}
+		}
+		if id != 0 {
+			if err := s.grafana.WithOrgContext(action.GrafanaOrgID).AddUserToTeam(teamID, id, action.TeamRole); err != nil {
+				return err
+			}
+		}
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	case "update_team_role":
+		teamID := action.TeamID
+		if teamID == 0 {
+			teamID = teamIDs[teamKey(action.OrgID, action.TeamName)]
+		}
+		if teamID == 0 {
+			return fmt.Errorf("missing team id for %s", action.TeamName)
+		}
+		if s.teamDeleted(action, teamID, teamIDs) {
+			return nil
+		}
+		id := action.UserID
+		if id == 0 {
+			user, found, err := s.grafana.LookupUser(email)
+			if err != nil {
+				return err
+			}
+			if found {
+				id = user.ID
+			}
+		}
+		if id != 0 {
+			if err := s.grafana.WithOrgContext(action.GrafanaOrgID).UpdateTeamMemberRole(teamID, id, action.TeamRole); err != nil {
+				return err
+			}
+		}
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	case "remove_user_from_team":
+		teamID := action.TeamID
+		if teamID == 0 {
+			teamID = teamIDs[teamKey(action.OrgID, action.TeamName)]
+		}
+		if teamID == 0 {
+			return fmt.Errorf("missing team id for %s", action.TeamName)
+		}
+		if s.teamDeleted(action, teamID, teamIDs) {
+			return nil
+		}
+		id := action.UserID
+		if id == 0 {
+			user, found, err := s.grafana.LookupUser(email)
+			if err != nil {
+				return err
+			}
+			if found {
+				id = user.ID
+			}
+		}
+		if id != 0 {
+			if err := s.grafana.WithOrgContext(action.GrafanaOrgID).RemoveUserFromTeam(teamID, id); err != nil {
+				return err
+			}
+		}
+		if err := s.store.PruneRestoredRemovals(email, teamID); err != nil {
+			log.Printf("sync: prune pending removal %s team=%d failed: %v", email, teamID, err)
+		}
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	case "update_team_description":
+		if err := s.grafana.WithOrgContext(action.GrafanaOrgID).UpdateTeam(action.TeamID, action.TeamName, action.Description); err != nil {
+			return err
+		}
+		if err := s.store.SetTeamDescription(action.GrafanaOrgID, action.TeamID, action.Description); err != nil {
+			log.Printf("sync: record description of team %d failed: %v", action.TeamID, err)
+		}
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	case "update_team_email":
+		teamID := action.TeamID
+		if teamID == 0 {
+			teamID = teamIDs[teamKey(action.OrgID, action.TeamName)]
+		}
+		if teamID == 0 {
+			return fmt.Errorf("missing team id for %s", action.TeamName)
+		}
+		if err := s.grafana.WithOrgContext(action.GrafanaOrgID).SetTeamEmail(teamID, action.TeamEmail); err != nil {
+			return err
+		}
+		if err := s.store.SetTeamEmail(action.GrafanaOrgID, teamID, action.TeamEmail); err != nil {
+			log.Printf("sync: record email of team %d failed: %v", teamID, err)
+		}
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	case "set_team_preferences":
+		teamID := action.TeamID
+		if teamID == 0 {
+			teamID = teamIDs[teamKey(action.OrgID, action.TeamName)]
+		}
+		if teamID == 0 {
+			return fmt.Errorf("missing team id for %s", action.TeamName)
+		}
+		want, err := grafana.ParseTeamPreferences(action.TeamPrefsJSON)
+		if err != nil {
+			return err
+		}
+		orgClient := s.grafana.WithOrgContext(action.GrafanaOrgID)
+		current, err := orgClient.GetTeamPreferences(teamID)
+		if err != nil {
+			return err
+		}
+		if err := orgClient.UpdateTeamPreferences(teamID, mergeTeamPreferences(*current, want)); err != nil {
+			return err
+		}
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	case "rotate_service_account_token":
+		current, err := s.store.GetServiceAccountToken(action.MappingID, action.UserID)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			return fmt.Errorf("service account %d of mapping %d is no longer tracked", action.UserID, action.MappingID)
+		}
+		// The new key is kept encrypted; check before creating a token that
+		// could not be stored.
+		if !s.store.HasEncryptionKey() {
+			return fmt.Errorf("rotate token of service account %d: %w", action.UserID, store.ErrNoEncryptionKey)
+		}
+		// Create the new token before revoking the old one so clients are
+		// never left without a valid token.
+		name := fmt.Sprintf("grafana-ad-syncher-%s", time.Now().UTC().Format("20060102-150405"))
+		token, err := s.grafana.CreateServiceAccountToken(action.GrafanaOrgID, action.UserID, name, s.saTokenTTL)
+		if err != nil {
+			return err
+		}
+		expiresAt := time.Time{}
+		if s.saTokenTTL > 0 {
+			expiresAt = time.Now().Add(s.saTokenTTL)
+		}
+		if err := s.store.SetServiceAccountToken(store.ServiceAccountToken{
+			MappingID: action.MappingID,
+			SAID:      action.UserID,
+			TokenID:   token.ID,
+			ExpiresAt: expiresAt,
+			Key:       token.Key,
+		}); err != nil {
+			return fmt.Errorf("store token %d of service account %d: %w", token.ID, action.UserID, err)
+		}
+		if err := s.grafana.RevokeServiceAccountToken(action.GrafanaOrgID, action.UserID, current.TokenID); err != nil {
+			return fmt.Errorf("revoke token %d of service account %d: %w", current.TokenID, action.UserID, err)
+		}
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	case "rename_team":
+		if err := s.grafana.WithOrgContext(action.GrafanaOrgID).RenameTeam(action.TeamID, action.TeamName); err != nil {
+			return err
+		}
+		teamIDs[teamKey(action.OrgID, action.TeamName)] = action.TeamID
+		if err := s.store.UpdateMappingTeamIDForName(action.OrgID, action.TeamName, action.TeamID); err != nil {
+			log.Printf("sync: update team id for %s failed: %v", action.TeamName, err)
+		}
+		if err := s.store.ClearPreviousTeamName(action.MappingID); err != nil {
+			log.Printf("sync: clear previous team name of mapping %d failed: %v", action.MappingID, err)
+		}
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	case "create_team_folder":
+		teamID := action.TeamID
+		if teamID == 0 {
+			teamID = teamIDs[teamKey(action.OrgID, action.TeamName)]
+		}
+		if teamID == 0 {
+			id, found, err := s.grafana.WithOrgContext(action.GrafanaOrgID).SearchTeam(action.TeamName)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return fmt.Errorf("missing team id for %s", action.TeamName)
+			}
+			teamID = id
+		}
+		title, err := s.teamFolderTitle(action.TeamName, action.GrafanaOrgID)
+		if err != nil {
+			return err
+		}
+		// An existing folder with the same title is reused instead of
+		// adding a second one. Only folders this syncer created for a team
+		// are restricted; a folder made by hand keeps its permissions and
+		// the team is added to them.
+		folder, found, err := s.grafana.FindFolder(action.GrafanaOrgID, title, s.teamFolderParent)
+		if err != nil {
+			return err
+		}
+		owned := !found
+		if found {
+			if owned, err = s.store.IsTeamFolder(folder.UID); err != nil {
+				return err
+			}
+			log.Printf("sync: team folder %q exists (%s), reusing it for team %s", title, folder.UID, action.TeamName)
+		} else if folder, err = s.grafana.CreateFolder(action.GrafanaOrgID, title, s.teamFolderParent); err != nil {
+			return err
+		}
+		// Only a folder the team has been granted is recorded as its folder.
+		if owned {
+			if err := s.grafana.RestrictFolderToTeam(action.GrafanaOrgID, folder.UID, teamID, s.teamFolderPermission()); err != nil {
+				return fmt.Errorf("restrict folder %s to team %s: %w", folder.UID, action.TeamName, err)
+			}
+		} else {
+			log.Printf("sync: team folder %s was not created by the syncer, adding team %s without changing its other permissions", folder.UID, action.TeamName)
+			if err := s.grafana.AddFolderTeamPermission(action.GrafanaOrgID, folder.UID, teamID, s.teamFolderPermission()); err != nil {
+				return fmt.Errorf("grant team %s on folder %s: %w", action.TeamName, folder.UID, err)
+			}
+		}
+		if err := s.store.SetTeamFolder(action.MappingID, folder.UID); err != nil {
+			log.Printf("sync: record team folder %s for mapping %d failed: %v", folder.UID, action.MappingID, err)
+		}
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	case "set_team_avatar":
+		teamID := action.TeamID
+		if teamID == 0 {
+			teamID = teamIDs[teamKey(action.OrgID, action.TeamName)]
+		}
+		if teamID == 0 {
+			return fmt.Errorf("missing team id for %s", action.TeamName)
+		}
+		if err := s.grafana.UpdateTeamAvatar(action.GrafanaOrgID, teamID, action.AvatarURL); err != nil {
+			return err
+		}
+		if err := s.store.SetTeamAvatarURL(action.GrafanaOrgID, teamID, action.AvatarURL); err != nil {
+			log.Printf("sync: record avatar of team %d failed: %v", teamID, err)
+		}
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	case "provision_datasource":
+		spec, err := grafana.ParseDataSourceSpec(action.DataSourceSpecJSON)
+		if err != nil {
+			return err
+		}
+		ds, err := s.grafana.CreateDataSource(action.GrafanaOrgID, spec)
+		if err != nil {
+			return err
+		}
+		if err := s.store.SetMappingDataSource(store.MappingDataSource{
+			MappingID:     action.MappingID,
+			GrafanaOrgID:  action.GrafanaOrgID,
+			DataSourceID:  ds.ID,
+			DataSourceUID: ds.UID,
+			SpecJSON:      action.DataSourceSpecJSON,
+		}); err != nil {
+			log.Printf("sync: record data source %s for mapping %d failed: %v", ds.UID, action.MappingID, err)
+		}
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	case "update_datasource":
+		spec, err := grafana.ParseDataSourceSpec(action.DataSourceSpecJSON)
+		if err != nil {
+			return err
+		}
+		if err := s.grafana.UpdateDataSource(action.GrafanaOrgID, action.DataSourceUID, spec); err != nil {
+			return err
+		}
+		current, err := s.store.GetMappingDataSource(action.MappingID)
+		if err != nil {
+			log.Printf("sync: get data source for mapping %d failed: %v", action.MappingID, err)
+		} else if current != nil {
+			current.SpecJSON = action.DataSourceSpecJSON
+			if err := s.store.SetMappingDataSource(*current); err != nil {
+				log.Printf("sync: record data source %s for mapping %d failed: %v", current.DataSourceUID, action.MappingID, err)
+			}
+		}
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	case "delete_datasource":
+		if err := s.grafana.DeleteDataSource(action.GrafanaOrgID, action.DataSourceUID); err != nil {
+			return err
+		}
+		// A mapping that moved org has its new data source provisioned
+		// first; only the record of the deleted one is forgotten.
+		current, err := s.store.GetMappingDataSource(action.MappingID)
+		if err != nil {
+			log.Printf("sync: get data source for mapping %d failed: %v", action.MappingID, err)
+		} else if current != nil && current.DataSourceUID == action.DataSourceUID && current.GrafanaOrgID == action.GrafanaOrgID {
+			if err := s.store.DeleteMappingDataSource(action.MappingID); err != nil {
+				log.Printf("sync: forget data source %s of mapping %d failed: %v", action.DataSourceUID, action.MappingID, err)
+			}
+		}
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	case "set_datasource_permission":
+		teamID := action.TeamID
+		if teamID == 0 {
+			teamID = teamIDs[teamKey(action.OrgID, action.TeamName)]
+		}
+		if teamID == 0 {
+			return fmt.Errorf("missing team id for %s", action.TeamName)
+		}
+		err := s.grafana.SetDataSourceTeamPermission(action.GrafanaOrgID, action.DataSourceUID, teamID, action.Permission)
+		if errors.Is(err, grafana.ErrEnterpriseRequired) {
+			log.Printf("sync: skipping data source permission %s for team %s: %v", action.DataSourceUID, action.TeamName, err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	case "assign_contact_point":
+		point, err := s.grafana.GetContactPoint(action.GrafanaOrgID, action.ContactPointUID)
+		if err != nil {
+			return err
+		}
+		if point == nil {
+			return fmt.Errorf("contact point %q not found in org %d", action.ContactPointUID, action.GrafanaOrgID)
+		}
+		if err := s.grafana.AssignContactPoint(action.GrafanaOrgID, action.TeamName, point.Name); err != nil {
+			return err
+		}
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	case "create_grafana_org":
+		orgID, err := s.grafana.CreateOrg(action.Description)
+		if err != nil {
+			return err
+		}
+		if err := s.store.SetOrgGrafanaID(action.OrgID, orgID); err != nil {
+			return fmt.Errorf("store grafana org id %d for org %d: %w", orgID, action.OrgID, err)
+		}
+		log.Printf("sync: created grafana org %d (%s) for org %d", orgID, action.Description, action.OrgID)
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	case "update_user_profile":
+		if err := s.grafana.UpdateUserProfile(action.UserID, action.DisplayName, email, action.Login); err != nil {
+			return err
+		}
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	case "disable_user", "enable_user":
+		id := action.UserID
+		if id == 0 {
+			user, found, err := s.grafana.LookupUser(email)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return nil
+			}
+			id = user.ID
+		}
+		var err error
+		if action.ActionType == "disable_user" {
+			if err = s.grafana.DisableUser(id); err == nil {
+				err = s.store.RecordDisabledUser(id, email)
+			}
+		} else {
+			if err = s.grafana.EnableUser(id); err == nil {
+				err = s.store.ForgetDisabledUser(id)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.store.RecordSyncAction(action, time.Now()); err != nil {
+			log.Printf("sync: record action failed: %v", err)
+		}
+	default:
+		return nil
+	}
+	return nil
+}
+
+// teamDeleted reports whether VerifyTeamIDs is on and the team an action
+// refers to was deleted from Grafana after the plan was built. Teams created,
+// renamed or already verified during this apply are not checked again.
+func (s *Syncer) teamDeleted(action store.PlanAction, teamID int64, teamIDs map[string]int64) bool {
+	key := teamKey(action.OrgID, action.TeamName)
+	if !s.verifyTeamIDs || teamIDs[key] == teamID {
+		return false
+	}
+	exists, err := s.grafana.WithOrgContext(action.GrafanaOrgID).TeamExists(teamID)
+	if err != nil {
+		log.Printf("sync: verify team %d failed: %v", teamID, err)
+		return false
+	}
+	if !exists {
+		log.Printf("sync: team %d (%s) not found in grafana org %d, skipping %s for %s; the next plan re-creates it", teamID, action.TeamName, action.GrafanaOrgID, action.ActionType, action.Email)
+		s.forgetTeamLabels(action.GrafanaOrgID, teamID)
+		return true
+	}
+	teamIDs[key] = teamID
+	return false
+}
+
+// mappingTeamID returns the ID of the mapping's Grafana team, or 0 when it
+// does not exist yet. The stored team ID is used while the team exists,
+// which is only checked with VERIFY_TEAM_IDS; otherwise the team is looked
+// up by name. stale reports that the stored team was not found. When the
+// check fails the stored ID is returned with the error; when the search
+// fails, 0 is.
+func (s *Syncer) mappingTeamID(org store.Org, mapping store.Mapping) (teamID int64, stale bool, err error) {
+	teamID = mapping.GrafanaTeamID
+	if teamID != 0 && s.verifyTeamIDs {
+		exists, err := s.grafana.WithOrgContext(org.GrafanaOrgID).TeamExists(teamID)
+		if err != nil {
+			return teamID, false, fmt.Errorf("verify team %d: %w", teamID, err)
+		}
+		if !exists {
+			log.Printf("sync: mapping %d team %d (%s) not found in grafana org %d, searching by name", mapping.ID, teamID, mapping.GrafanaTeamName, org.GrafanaOrgID)
+			teamID, stale = 0, true
+		}
+	}
+	if teamID == 0 {
+		id, found, err := s.grafana.WithOrgContext(org.GrafanaOrgID).SearchTeam(mapping.GrafanaTeamName)
+		if err != nil {
+			return 0, stale, fmt.Errorf("search team %q: %w", mapping.GrafanaTeamName, err)
+		}
+		if found {
+			teamID = id
+		}
+	}
+	return teamID, stale, nil
+}
+
+// forgetTeamLabels drops the labels recorded for a team that was deleted
+// from Grafana.
+func (s *Syncer) forgetTeamLabels(grafanaOrgID, teamID int64) {
+	if err := s.store.DeleteTeamLabels(grafanaOrgID, teamID); err != nil {
+		log.Printf("sync: delete labels of team %d failed: %v", teamID, err)
+	}
+}
+
+// BuildPlan computes the actions needed to bring Grafana in line with the
+// mappings. It never stores the plan; callers persist it with
+// store.ReplacePlan. It does record when a pending removal was first seen,
+// since that must happen on every plan for grace periods to be right, and
+// forgets previous team names that no longer need a rename. New
+// Grafana orgs are imported by ImportGrafanaOrgs, not here.
+func (s *Syncer) BuildPlan() (*store.Plan, error) {
+	return s.buildPlan(context.Background(), true)
+}
+
+// buildPlan is BuildPlan. With persist false nothing is written to the
+// store: pending removals are neither recorded nor pruned, previous team
+// names and the labels of deleted teams are kept, and the group member
+// cache is read but not refreshed. Removals not yet pending are then treated
+// as first seen now. buildPlan returns ctx's error once ctx is done.
+func (s *Syncer) buildPlan(ctx context.Context, persist bool) (*store.Plan, error) {
+	settings := s.RuntimeSettings()
+	authSettings := s.authSettings()
+	inviteUsers := settings.AllowCreateUsers && authSettings.OAuthAutoLogin
+	mappings, err := s.store.ListMappings()
+	if err != nil {
+		return nil, fmt.Errorf("list mappings: %w", err)
+	}
+	// orgByID holds the orgs mappings reference. Without AutoCreateOrgs they
+	// are loaded one by one as mappings need them.
+	orgByID := map[int64]store.Org{}
+	orgNameByID := map[int64]string{}
+	var orgActions []store.PlanAction
+	if s.autoCreateOrgs {
+		orgs, err := s.store.ListOrgs()
+		if err != nil {
+			return nil, fmt.Errorf("list orgs: %w", err)
+		}
+		orgs, orgActions, err = s.planGrafanaOrgs(orgs, mappings)
+		if err != nil {
+			return nil, err
+		}
+		for _, org := range orgs {
+			orgByID[org.ID] = org
+			orgNameByID[org.ID] = org.Name
+		}
+	}
+	mappingOrg := func(orgID int64) (store.Org, bool, error) {
+		if org, ok := orgByID[orgID]; ok || s.autoCreateOrgs {
+			return org, ok, nil
+		}
+		org, err := s.store.GetOrg(orgID)
+		if err != nil || org == nil {
+			return store.Org{}, false, err
+		}
+		orgByID[org.ID] = *org
+		orgNameByID[org.ID] = org.Name
+		return *org, true, nil
+	}
+
+	pendingRemovals, err := s.store.ListPendingRemovals()
+	if err != nil {
+		return nil, fmt.Errorf("list pending removals: %w", err)
+	}
+	pendingByTeamEmail := map[string]struct{}{}
+	pendingFirstSeen := map[string]time.Time{}
+	for _, r := range pendingRemovals {
+		pendingByTeamEmail[fmt.Sprintf("%d:%s", r.TeamID, r.Email)] = struct{}{}
+		pendingFirstSeen[fmt.Sprintf("%d:%d:%s", r.MappingID, r.TeamID, r.Email)] = r.FirstSeenAt
+	}
+
+	actions := orgActions
 	userCache := map[string]*grafana.User{}
 	roleByOrgEmail := map[int64]map[string]string{}
 	roleSourceByOrgEmail := map[int64]map[string]string{}
 	addedTeamUsers := map[string]int{}
 	teamRoleByTeamEmail := map[string]map[string]string{}
 	updatedTeamRoles := map[string]struct{}{}
+	updatedProfiles := map[string]struct{}{}
+	invitedUsers := map[string]int{}
+	groupInfoByTenant := map[int64]*groupInfo{}
+	tenantGroups := func(tenantID int64, client *entra.Client) *groupInfo {
+		if groupInfoByTenant[tenantID] == nil {
+			groupInfoByTenant[tenantID] = s.listGroupInfo(client)
+		}
+		return groupInfoByTenant[tenantID]
+	}
+	plannedFolders := map[string]struct{}{}
+	plannedAvatars := map[string]struct{}{}
+	pickedEmails := map[string]struct{}{}
+	dsPerms, err := s.store.ListDataSourcePermissions(0)
+	if err != nil {
+		return nil, fmt.Errorf("list datasource permissions: %w", err)
+	}
+	dsPermsByMapping := map[int64][]store.DataSourcePermission{}
+	for _, perm := range dsPerms {
+		dsPermsByMapping[perm.MappingID] = append(dsPermsByMapping[perm.MappingID], perm)
+	}
+	dsState := &dataSourceState{uids: map[int64]map[string]bool{}}
+	disabledBySync := map[int64]bool{}
+	if s.deactivateUsers && !s.autoEnableUsers {
+		if disabledBySync, err = s.store.ListDisabledUserIDs(); err != nil {
+			return nil, fmt.Errorf("list disabled users: %w", err)
+		}
+	}
+	mappedTeams := map[string]int{}
+	for _, mapping := range mappings {
+		mappedTeams[teamKey(mapping.OrgID, mapping.GrafanaTeamName)]++
+	}
 
 	for _, mapping := range mappings {
-		org, ok := orgByID[mapping.OrgID]
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		org, ok, err := mappingOrg(mapping.OrgID)
+		if err != nil {
+			return nil, fmt.Errorf("load org %d: %w", mapping.OrgID, err)
+		}
 		if !ok {
 			log.Printf("sync: mapping %d references missing org %d", mapping.ID, mapping.OrgID)
 			continue
 		}
+		entraClient := s.entraFor(org.TenantID)
+		if s.groupTypes != nil {
+			if groupType, skipped := s.skippedGroupType(tenantGroups(org.TenantID, entraClient).types, mapping.ExternalGroupID); skipped {
+				log.Printf("sync: mapping %d skipped, group %s is a %s group", mapping.ID, mapping.ExternalGroupID, groupType)
+				continue
+			}
+		}
 
-		teamID := mapping.GrafanaTeamID
-		if teamID == 0 {
-			id, found, err := s.grafana.SearchTeam(org.GrafanaOrgID, mapping.GrafanaTeamName)
-			if err != nil {
-				log.Printf("sync: search team %q failed: %v", mapping.GrafanaTeamName, err)
-			} else if found {
-				teamID = id
+		teamID, stale, err := s.mappingTeamID(org, mapping)
+		if err != nil {
+			log.Printf("sync: %v", err)
+		}
+		if stale && persist {
+			s.forgetTeamLabels(org.GrafanaOrgID, mapping.GrafanaTeamID)
+		}
+		renamed := false
+		if teamID != 0 && mapping.PreviousGrafanaTeamName != "" && persist {
+			s.forgetPreviousTeamName(mapping, "team already exists under the new name")
+		}
+		if teamID == 0 && mapping.PreviousGrafanaTeamName != "" {
+			if action, ok := s.renameTeamAction(org, mapping, mappedTeams, persist); ok {
+				action.Note = appendNote(mappingNote(orgNameByID[org.ID], mapping), action.Note)
+				actions = append(actions, action)
+				teamID = action.TeamID
+				renamed = true
 			}
 		}
 		if teamID == 0 {
@@ -293,32 +2020,72 @@ func (s *Syncer) BuildPlan() (*store.Plan, error) {
 				ExternalGroupID: mapping.ExternalGroupID,
 				Note:          mappingNote(orgNameByID[org.ID], mapping),
 			})
+			if _, planned := plannedFolders[teamKey(org.ID, mapping.GrafanaTeamName)]; s.teamFolders && !planned {
+				if action, ok := s.teamFolderAction(org, mapping); ok {
+					plannedFolders[teamKey(org.ID, mapping.GrafanaTeamName)] = struct{}{}
+					actions = append(actions, action)
+				}
+			}
 		}
 
-		members, err := s.entra.ListGroupMembers(mapping.ExternalGroupID)
-		if err != nil {
-			log.Printf("sync: list group members %s failed: %v", mapping.ExternalGroupID, err)
-			continue
+		// A description update would send the team's current, old name;
+		// renamed teams pick up their description on the next plan.
+		if teamID != 0 && !renamed {
+			description := tenantGroups(org.TenantID, entraClient).descriptions[mapping.ExternalGroupID]
+			if action, ok := s.teamDescriptionAction(org, teamID, mapping, description); ok {
+				action.Note = appendNote(mappingNote(orgNameByID[org.ID], mapping), fmt.Sprintf("description: %q", action.Description))
+				actions = append(actions, action)
+			}
 		}
-
-		want := make(map[string]entra.Member)
-		for _, member := range members {
-			email := strings.TrimSpace(strings.ToLower(pickEmail(member)))
-			if email == "" {
-				continue
+		// A team shared by several mappings takes the mail of the first
+		// mapping, by ID, whose group has one.
+		mail := ""
+		if s.syncTeamEmail {
+			mail = tenantGroups(org.TenantID, entraClient).mails[mapping.ExternalGroupID]
+		}
+		if _, picked := pickedEmails[teamKey(org.ID, mapping.GrafanaTeamName)]; mail != "" && !picked {
+			pickedEmails[teamKey(org.ID, mapping.GrafanaTeamName)] = struct{}{}
+			if action, ok := s.teamEmailAction(org, teamID, mapping, mail); ok {
+				action.Note = appendNote(mappingNote(orgNameByID[org.ID], mapping), action.Note)
+				actions = append(actions, action)
 			}
-			want[email] = member
-			key := teamKey(org.ID, mapping.GrafanaTeamName)
-			if teamRoleByTeamEmail[key] == nil {
-				teamRoleByTeamEmail[key] = map[string]string{}
+		}
+		if action, ok := s.contactPointAction(org, teamID, mapping); ok {
+			action.Note = appendNote(mappingNote(orgNameByID[org.ID], mapping), action.Note)
+			actions = append(actions, action)
+		}
+		if _, planned := plannedAvatars[teamKey(org.ID, mapping.GrafanaTeamName)]; s.avatarTmpl != nil && !planned {
+			if action, ok := s.teamAvatarAction(org, teamID, mapping); ok {
+				plannedAvatars[teamKey(org.ID, mapping.GrafanaTeamName)] = struct{}{}
+				action.Note = appendNote(mappingNote(orgNameByID[org.ID], mapping), action.Note)
+				actions = append(actions, action)
 			}
-			current := teamRoleByTeamEmail[key][email]
-			teamRoleByTeamEmail[key][email] = maxTeamRole(current, normalizeTeamRole(mapping.TeamRole))
+		}
+		if action, ok := s.teamPreferencesAction(org, teamID, mapping); ok {
+			action.Note = appendNote(mappingNote(orgNameByID[org.ID], mapping), action.Note)
+			actions = append(actions, action)
+		}
+		for _, action := range s.dataSourcePermissionActions(org, teamID, mapping, dsPermsByMapping[mapping.ID], dsState) {
+			action.Note = appendNote(mappingNote(orgNameByID[org.ID], mapping), action.Note)
+			actions = append(actions, action)
+		}
+		if action, ok := s.provisionedDataSourceAction(org, mapping); ok {
+			action.Note = appendNote(mappingNote(orgNameByID[org.ID], mapping), action.Note)
+			actions = append(actions, action)
+		}
+
+		if teamRoleByTeamEmail[teamKey(org.ID, mapping.GrafanaTeamName)] == nil {
+			teamRoleByTeamEmail[teamKey(org.ID, mapping.GrafanaTeamName)] = map[string]string{}
+		}
+		want, err := s.mappingMembers(entraClient, mapping, teamRoleByTeamEmail[teamKey(org.ID, mapping.GrafanaTeamName)], persist)
+		if err != nil {
+			log.Printf("sync: list group members %s failed: %v", mapping.ExternalGroupID, err)
+			continue
 		}
 
 		have := make(map[string]grafana.TeamMember)
 		if teamID != 0 {
-			teamMembers, err := s.grafana.ListTeamMembers(teamID)
+			teamMembers, err := s.ListTeamMembers(org.GrafanaOrgID, teamID)
 			if err != nil {
 				log.Printf("sync: list team members %d failed: %v", teamID, err)
 				continue
@@ -338,17 +2105,28 @@ func (s *Syncer) BuildPlan() (*store.Plan, error) {
 				role = org.DefaultRole
 				roleSource = fmt.Sprintf("org default role: %s", org.DefaultRole)
 			} else {
-				role = s.defaultUserRole
-				roleSource = fmt.Sprintf("service default role: %s", s.defaultUserRole)
+				role = settings.DefaultUserRole
+				roleSource = fmt.Sprintf("service default role: %s", settings.DefaultUserRole)
 			}
 		} else {
 			roleSource = fmt.Sprintf("mapping role override: %s", role)
 		}
+		if mapping.RoleOverride == "" {
+			if rule, ok := s.matchRoleRule(mapping.ExternalGroupName); ok {
+				role = rule.Role
+				roleSource = fmt.Sprintf("group name rule %q: %s", rule.Pattern.String(), rule.Role)
+			}
+		}
 
 		for email, member := range want {
 			user, ok := userCache[email]
 			if !ok {
 				foundUser, found, err := s.grafana.LookupUser(email)
+				if err == nil && !found {
+					if login := s.userLogin(member, email); login != email {
+						foundUser, found, err = s.grafana.LookupUser(login)
+					}
+				}
 				if err != nil {
 					log.Printf("sync: lookup user %s failed: %v", email, err)
 					continue
@@ -360,7 +2138,7 @@ func (s *Syncer) BuildPlan() (*store.Plan, error) {
 			}
 
 			if user == nil {
-				if !s.allowCreateUsers {
+				if !settings.AllowCreateUsers {
 					actions = append(actions, store.PlanAction{
 						ActionType:    "blocked_create_user",
 						OrgID:         org.ID,
@@ -371,14 +2149,49 @@ func (s *Syncer) BuildPlan() (*store.Plan, error) {
 						DisplayName:   member.DisplayName,
 						Role:          role,
 						ExternalGroupID: mapping.ExternalGroupID,
+						Login:         s.userLogin(member, email),
 						Note:          appendNote("user not found and creation disabled", mappingNote(orgNameByID[org.ID], mapping)),
 					})
 					continue
 				}
-				name := member.DisplayName
+				name := s.displayName(member)
 				if name == "" {
 					name = email
 				}
+				if inviteUsers {
+					// Team and org membership follow on a later sync,
+					// once the invitation is accepted.
+					key := fmt.Sprintf("%d:%s", org.ID, email)
+					if idx, seen := invitedUsers[key]; seen {
+						if idx >= 0 {
+							actions[idx].Role = maxRole(actions[idx].Role, role)
+						}
+						continue
+					}
+					invitedUsers[key] = -1
+					invite, err := s.store.GetUserInvite(org.GrafanaOrgID, email)
+					if err != nil {
+						log.Printf("sync: load invite %s org=%d failed: %v", email, org.GrafanaOrgID, err)
+						continue
+					}
+					if invite != nil && time.Since(invite.CreatedAt) < inviteResendAfter {
+						continue
+					}
+					actions = append(actions, store.PlanAction{
+						ActionType:    "invite_user",
+						OrgID:         org.ID,
+						GrafanaOrgID:  org.GrafanaOrgID,
+						TeamID:        teamID,
+						TeamName:      mapping.GrafanaTeamName,
+						Email:         email,
+						DisplayName:   name,
+						Role:          role,
+						ExternalGroupID: mapping.ExternalGroupID,
+						Note:          appendNote("Grafana OAuth auto-login is on; team membership follows once the invite is accepted", mappingNote(orgNameByID[org.ID], mapping)),
+					})
+					invitedUsers[key] = len(actions) - 1
+					continue
+				}
 				actions = append(actions, store.PlanAction{
 					ActionType:    "create_user",
 					OrgID:         org.ID,
@@ -389,8 +2202,16 @@ func (s *Syncer) BuildPlan() (*store.Plan, error) {
 					DisplayName:   name,
 					Role:          role,
 					ExternalGroupID: mapping.ExternalGroupID,
+					Login:         s.userLogin(member, email),
 					Note:          mappingNote(orgNameByID[org.ID], mapping),
 				})
+			} else if s.updateProfiles {
+				if _, done := updatedProfiles[email]; !done {
+					updatedProfiles[email] = struct{}{}
+					if action, ok := s.profileAction(user, member, email); ok {
+						actions = append(actions, action)
+					}
+				}
 			}
 
 			if roleByOrgEmail[org.ID] == nil {
@@ -435,7 +2256,7 @@ func (s *Syncer) BuildPlan() (*store.Plan, error) {
 				}
 			} else {
 				teamRole := teamRoleByTeamEmail[teamKey(org.ID, mapping.GrafanaTeamName)][email]
-				if teamRole == "admin" {
+				if teamRole == "admin" && have[email].TeamRole() != "admin" {
 					updateKey := teamKey(org.ID, mapping.GrafanaTeamName) + ":" + email
 					if _, exists := updatedTeamRoles[updateKey]; !exists {
 						actions = append(actions, store.PlanAction{
@@ -456,11 +2277,48 @@ func (s *Syncer) BuildPlan() (*store.Plan, error) {
 			}
 		}
 
-	if s.allowRemoveUsers {
+		for email := range want {
+			key := fmt.Sprintf("%d:%s", teamID, email)
+			if _, pending := pendingByTeamEmail[key]; !pending || !persist {
+				continue
+			}
+			if err := s.store.PruneRestoredRemovals(email, teamID); err != nil {
+				log.Printf("sync: prune restored removal %s team=%d failed: %v", email, teamID, err)
+			}
+		}
+
+		allowRemove := settings.AllowRemoveMembers
+		if mapping.AllowRemoveMembers != nil {
+			allowRemove = *mapping.AllowRemoveMembers
+		}
+		if allowRemove {
+			grace := s.removalGracePeriod(mapping)
 			for email, user := range have {
 				if _, ok := want[email]; ok {
 					continue
 				}
+				note := mappingNote(orgNameByID[org.ID], mapping)
+				if grace > 0 {
+					firstSeen, seen := pendingFirstSeen[fmt.Sprintf("%d:%d:%s", mapping.ID, teamID, email)]
+					if persist {
+						firstSeen, err = s.store.UpsertPendingRemoval(store.PendingRemoval{
+							MappingID: mapping.ID,
+							TeamID:    teamID,
+							UserID:    user.ID,
+							Email:     email,
+						})
+						if err != nil {
+							log.Printf("sync: record pending removal %s team=%d failed: %v", email, teamID, err)
+							continue
+						}
+					} else if !seen {
+						firstSeen = time.Now()
+					}
+					if time.Since(firstSeen) < grace {
+						continue
+					}
+					note = appendNote(note, fmt.Sprintf("pending removal since %s", firstSeen.Format(time.RFC3339)))
+				}
 				actions = append(actions, store.PlanAction{
 					ActionType:    "remove_user_from_team",
 					OrgID:         org.ID,
@@ -470,15 +2328,19 @@ func (s *Syncer) BuildPlan() (*store.Plan, error) {
 					UserID:        user.ID,
 					Email:         email,
 					ExternalGroupID: mapping.ExternalGroupID,
-					Note:          mappingNote(orgNameByID[org.ID], mapping),
+					Note:          note,
 				})
 			}
 		}
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	actions = append(actions, s.orphanedDataSourceActions(mappings, orgByID)...)
 
 	orgUsersByOrgEmail := map[int64]map[string]grafana.OrgUser{}
-	for _, org := range orgs {
-		users, err := s.grafana.ListOrgUsers(org.GrafanaOrgID)
+	for _, org := range orgByID {
+		users, err := s.ListOrgUsers(org.GrafanaOrgID)
 		if err != nil {
 			log.Printf("sync: list org users %d failed: %v", org.GrafanaOrgID, err)
 			continue
@@ -494,7 +2356,15 @@ func (s *Syncer) BuildPlan() (*store.Plan, error) {
 			orgUsersByOrgEmail[org.ID][email] = user
 		}
 	}
+	if s.teamSyncCompat {
+		var suppressed int
+		actions, suppressed = dropTeamAddsForOrgMembers(actions, orgUsersByOrgEmail)
+		if suppressed > 0 {
+			log.Printf("sync: WARNING team sync compat mode: suppressed %d add_user_to_team action(s) for existing org members; Grafana team sync must manage their team membership", suppressed)
+		}
+	}
 
+	protectedEmails := s.protectedEmails()
 	for orgID, roleMap := range roleByOrgEmail {
 		org := orgByID[orgID]
 		orgUsers := orgUsersByOrgEmail[orgID]
@@ -506,7 +2376,25 @@ func (s *Syncer) BuildPlan() (*store.Plan, error) {
 				existing, found = orgUsers[key]
 			}
 			user := userCache[email]
+			// Protected users are only reported when the plan would have
+			// changed their org membership or role.
+			protected := s.isProtected(key, user, protectedEmails)
+			blocked := func(change string) store.PlanAction {
+				return store.PlanAction{
+					ActionType:   "blocked_protected_user",
+					OrgID:        orgID,
+					GrafanaOrgID: org.GrafanaOrgID,
+					UserID:       userID(user),
+					Email:        email,
+					Role:         role,
+					Note:         appendNote(fmt.Sprintf("protected login, %s skipped", change), roleSourceByOrgEmail[orgID][email]),
+				}
+			}
 			if !found {
+				if protected {
+					actions = append(actions, blocked("add_user_to_org"))
+					continue
+				}
 				note := roleSourceByOrgEmail[orgID][email]
 				if orgUsers == nil {
 					note = appendNote(note, "org user lookup failed")
@@ -523,6 +2411,18 @@ func (s *Syncer) BuildPlan() (*store.Plan, error) {
 				continue
 			}
 			if !strings.EqualFold(existing.Role, role) {
+				if !s.allowDowngrade && roleRank(role) < roleRank(existing.Role) {
+					continue
+				}
+				// Disabled accounts keep their role until they are
+				// re-enabled.
+				if existing.IsDisabled && !s.autoEnableUsers && !disabledBySync[existing.ID] {
+					continue
+				}
+				if protected {
+					actions = append(actions, blocked(fmt.Sprintf("update_user_role from %s", existing.Role)))
+					continue
+				}
 				userIDValue := userID(user)
 				if userIDValue == 0 {
 					userIDValue = existing.ID
@@ -540,28 +2440,589 @@ func (s *Syncer) BuildPlan() (*store.Plan, error) {
 		}
 	}
 
-	plan := &store.Plan{
-		CreatedAt: time.Now().UTC().Format(time.RFC3339),
-		Status:    "planned",
-		Actions:   actions,
+	if s.deactivateUsers || s.autoEnableUsers {
+		actions = append(actions, userStateActions(actions, roleByOrgEmail, orgByID, userCache, s.deactivateUsers, s.autoEnableUsers, disabledBySync)...)
+	}
+	if s.skipDisabled {
+		actions = s.blockDisabledUsers(actions, userCache)
+	}
+
+	if s.saTokenWindow > 0 {
+		actions = append(actions, s.serviceAccountTokenActions(orgByID, mappings)...)
+	}
+
+	if len(s.allowedActions) > 0 {
+		allowed := actions[:0]
+		for _, action := range actions {
+			if s.allowedActions[action.ActionType] {
+				allowed = append(allowed, action)
+			}
+		}
+		actions = allowed
+	}
+
+	plan := &store.Plan{
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Status:    "planned",
+		Actions:   actions,
+	}
+	if inviteUsers {
+		plan.Warnings = append(plan.Warnings, "Grafana OAuth auto-login is on: missing users are invited instead of created with a local password")
+	}
+	if authSettings.SAMLTeamSync {
+		plan.SAMLConflict = true
+		plan.Warnings = append(plan.Warnings, "Grafana SAML team sync is active: team removals in this plan may be reverted on the user's next SAML login")
+		for i := range plan.Actions {
+			if plan.Actions[i].ActionType == "remove_user_from_team" {
+				plan.Actions[i].Note = appendNote(plan.Actions[i].Note, samlRemovalNote)
+			}
+		}
+		log.Printf("sync: WARNING Grafana SAML team sync is active; team removals may be reverted")
+	}
+	if s.noteTmpl != nil {
+		groupNames := map[string]string{}
+		for _, mapping := range mappings {
+			if mapping.ExternalGroupName != "" {
+				groupNames[mapping.ExternalGroupID] = mapping.ExternalGroupName
+			}
+		}
+		now := time.Now().UTC()
+		for i, action := range plan.Actions {
+			plan.Actions[i].Note = s.renderNote(action, orgNameByID[action.OrgID], groupNames[action.ExternalGroupID], now)
+		}
+	}
+	return plan, nil
+}
+
+// renderNote renders NOTE_TEMPLATE for action. On failure the syncer's own
+// note is kept.
+func (s *Syncer) renderNote(action store.PlanAction, orgName, groupName string, now time.Time) string {
+	var buf strings.Builder
+	err := s.noteTmpl.Execute(&buf, noteData{
+		ActionType: action.ActionType,
+		OrgName:    orgName,
+		TeamName:   action.TeamName,
+		GroupName:  groupName,
+		GroupID:    action.ExternalGroupID,
+		Email:      action.Email,
+		Role:       action.Role,
+		TeamRole:   action.TeamRole,
+		Note:       action.Note,
+		Time:       now,
+	})
+	if err != nil {
+		log.Printf("sync: render note for %s failed: %v", action.ActionType, err)
+		return action.Note
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+const samlRemovalNote = "SAML team sync active; removal may be reverted"
+
+// inviteResendAfter is how long a pending invitation is waited on before the
+// user is invited again. It matches Grafana's default invite lifetime.
+const inviteResendAfter = 24 * time.Hour
+
+// ImportGrafanaOrgs adds the Grafana orgs missing from the store with the
+// default user role. It does nothing without AutoCreateOrgs.
+func (s *Syncer) ImportGrafanaOrgs() error {
+	if !s.autoCreateOrgs {
+		return nil
+	}
+	orgs, err := s.store.ListOrgs()
+	if err != nil {
+		return fmt.Errorf("list orgs: %w", err)
+	}
+	grafanaOrgs, err := s.grafana.ListAdminOrgs()
+	if err != nil {
+		return fmt.Errorf("list grafana orgs: %w", err)
+	}
+	stored := make(map[int64]bool, len(orgs))
+	for _, org := range orgs {
+		stored[org.GrafanaOrgID] = true
+	}
+	defaultRole := s.RuntimeSettings().DefaultUserRole
+	for _, grafanaOrg := range grafanaOrgs {
+		if stored[grafanaOrg.ID] {
+			continue
+		}
+		org := store.Org{GrafanaOrgID: grafanaOrg.ID, Name: grafanaOrg.Name, DefaultRole: defaultRole}
+		if _, err := s.store.CreateOrg(org); err != nil && !errors.Is(err, store.ErrDuplicate) {
+			return fmt.Errorf("import grafana org %d: %w", grafanaOrg.ID, err)
+		}
+		log.Printf("sync: imported grafana org %d (%s)", grafanaOrg.ID, grafanaOrg.Name)
+	}
+	return nil
+}
+
+// planGrafanaOrgs plans create_grafana_org for stored orgs that mappings use
+// but Grafana lacks. It returns the stored orgs that exist in Grafana; the
+// mappings of the others are planned once their org has been created.
+func (s *Syncer) planGrafanaOrgs(orgs []store.Org, mappings []store.Mapping) ([]store.Org, []store.PlanAction, error) {
+	grafanaOrgs, err := s.grafana.ListAdminOrgs()
+	if err != nil {
+		return nil, nil, fmt.Errorf("list grafana orgs: %w", err)
+	}
+	inGrafana := make(map[int64]bool, len(grafanaOrgs))
+	for _, grafanaOrg := range grafanaOrgs {
+		inGrafana[grafanaOrg.ID] = true
+	}
+
+	mapped := map[int64]bool{}
+	for _, mapping := range mappings {
+		mapped[mapping.OrgID] = true
+	}
+	present := orgs[:0]
+	var actions []store.PlanAction
+	for _, org := range orgs {
+		if inGrafana[org.GrafanaOrgID] {
+			present = append(present, org)
+			continue
+		}
+		if !mapped[org.ID] {
+			continue
+		}
+		name := org.Name
+		if name == "" {
+			name = fmt.Sprintf("Org %d", org.GrafanaOrgID)
+		}
+		actions = append(actions, store.PlanAction{
+			ActionType:   "create_grafana_org",
+			OrgID:        org.ID,
+			GrafanaOrgID: org.GrafanaOrgID,
+			Description:  name,
+			Note:         "org missing in Grafana; its mappings are planned on the next sync",
+		})
+	}
+	return present, actions, nil
+}
+
+// authSettings reads Grafana's auth settings and remembers whether OAuth
+// auto-login is on. Settings that cannot be read count as all disabled.
+func (s *Syncer) authSettings() grafana.AuthSettings {
+	settings, err := s.grafana.GetAuthSettings()
+	if err != nil {
+		log.Printf("sync: read grafana auth settings failed: %v", err)
+		return grafana.AuthSettings{}
+	}
+	s.mu.Lock()
+	s.autoLogin = settings.OAuthAutoLogin
+	s.mu.Unlock()
+	return *settings
+}
+
+// OAuthAutoLogin reports whether the last plan found Grafana's OAuth
+// auto-login enabled.
+func (s *Syncer) OAuthAutoLogin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.autoLogin
+}
+
+// ValidateMappings cross-checks each mapping's stored Grafana team ID against
+// the team Grafana returns for its name. Stale IDs are corrected in the store;
+// IDs of teams that no longer exist are reset so the next plan recreates them.
+func (s *Syncer) ValidateMappings(ctx context.Context) ([]MappingValidationIssue, error) {
+	orgs, err := s.store.ListOrgs()
+	if err != nil {
+		return nil, fmt.Errorf("list orgs: %w", err)
+	}
+	orgByID := make(map[int64]store.Org, len(orgs))
+	for _, org := range orgs {
+		orgByID[org.ID] = org
+	}
+	mappings, err := s.store.ListMappings()
+	if err != nil {
+		return nil, fmt.Errorf("list mappings: %w", err)
+	}
+
+	var issues []MappingValidationIssue
+	for _, mapping := range mappings {
+		if err := ctx.Err(); err != nil {
+			return issues, err
+		}
+		org, ok := orgByID[mapping.OrgID]
+		if !ok || mapping.GrafanaTeamID == 0 || strings.TrimSpace(mapping.GrafanaTeamName) == "" {
+			continue
+		}
+		actualID, found, err := s.grafana.WithOrgContext(org.GrafanaOrgID).SearchTeam(mapping.GrafanaTeamName)
+		if err != nil {
+			log.Printf("sync: validate mapping %d search team %q failed: %v", mapping.ID, mapping.GrafanaTeamName, err)
+			continue
+		}
+		if found && actualID == mapping.GrafanaTeamID {
+			continue
+		}
+		issue := MappingValidationIssue{
+			MappingID:    mapping.ID,
+			OrgID:        org.ID,
+			GrafanaOrgID: org.GrafanaOrgID,
+			TeamName:     mapping.GrafanaTeamName,
+			StoredTeamID: mapping.GrafanaTeamID,
+			ActualTeamID: actualID,
+		}
+		if found {
+			issue.Issue = fmt.Sprintf("stored team id %d does not match Grafana team id %d", mapping.GrafanaTeamID, actualID)
+		} else {
+			issue.Issue = fmt.Sprintf("team %q (id %d) not found in Grafana", mapping.GrafanaTeamName, mapping.GrafanaTeamID)
+		}
+		if err := s.store.UpdateMappingTeamID(mapping.ID, actualID); err != nil {
+			log.Printf("sync: correct team id for mapping %d failed: %v", mapping.ID, err)
+		} else {
+			issue.Corrected = true
+			log.Printf("sync: mapping %d team %q id corrected %d -> %d", mapping.ID, mapping.GrafanaTeamName, mapping.GrafanaTeamID, actualID)
+		}
+		issues = append(issues, issue)
+	}
+
+	s.mu.Lock()
+	s.lastIssues = issues
+	s.mu.Unlock()
+	return issues, nil
+}
+
+// LastValidationIssues returns the issues found by the most recent
+// ValidateMappings call.
+func (s *Syncer) LastValidationIssues() []MappingValidationIssue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]MappingValidationIssue(nil), s.lastIssues...)
+}
+
+// ListTeamMembers returns the members of a Grafana team, served from the
+// GRAFANA_CACHE_TTL cache when it is enabled.
+func (s *Syncer) ListTeamMembers(grafanaOrgID, teamID int64) ([]grafana.TeamMember, error) {
+	fetch := func() ([]grafana.TeamMember, error) {
+		return s.grafana.WithOrgContext(grafanaOrgID).ListTeamMembers(teamID)
+	}
+	c := s.cache
+	if c == nil || c.ttl <= 0 {
+		return fetch()
+	}
+	c.mu.Lock()
+	entry, ok := c.teamMembers[teamID]
+	generation := c.generation
+	c.mu.Unlock()
+	if ok {
+		if time.Now().After(entry.expiresAt) {
+			c.refreshAsync(fmt.Sprintf("team:%d", teamID), func() error {
+				members, err := fetch()
+				if err == nil {
+					c.storeTeamMembers(teamID, members, generation)
+				}
+				return err
+			})
+		}
+		return append([]grafana.TeamMember(nil), entry.members...), nil
+	}
+	members, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	c.storeTeamMembers(teamID, members, generation)
+	return members, nil
+}
+
+// ListOrgUsers returns the users of a Grafana org, served from the
+// GRAFANA_CACHE_TTL cache when it is enabled.
+func (s *Syncer) ListOrgUsers(grafanaOrgID int64) ([]grafana.OrgUser, error) {
+	fetch := func() ([]grafana.OrgUser, error) {
+		return s.grafana.WithOrgContext(grafanaOrgID).ListOrgUsers()
+	}
+	c := s.cache
+	if c == nil || c.ttl <= 0 {
+		return fetch()
+	}
+	c.mu.Lock()
+	entry, ok := c.orgUsers[grafanaOrgID]
+	generation := c.generation
+	c.mu.Unlock()
+	if ok {
+		if time.Now().After(entry.expiresAt) {
+			c.refreshAsync(fmt.Sprintf("org:%d", grafanaOrgID), func() error {
+				users, err := fetch()
+				if err == nil {
+					c.storeOrgUsers(grafanaOrgID, users, generation)
+				}
+				return err
+			})
+		}
+		return append([]grafana.OrgUser(nil), entry.users...), nil
+	}
+	users, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	c.storeOrgUsers(grafanaOrgID, users, generation)
+	return users, nil
+}
+
+// invalidateCache drops cached team members and org users touched by an
+// applied batch of actions so the next plan sees the new Grafana state.
+func (s *Syncer) invalidateCache(actions []store.PlanAction, createdTeamIDs map[string]int64) {
+	c := s.cache
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for _, action := range actions {
+		if action.GrafanaOrgID != 0 {
+			delete(c.orgUsers, action.GrafanaOrgID)
+		}
+		if action.TeamID != 0 {
+			delete(c.teamMembers, action.TeamID)
+		}
+	}
+	for _, teamID := range createdTeamIDs {
+		delete(c.teamMembers, teamID)
+	}
+}
+
+// storeTeamMembers caches a copy of members read while the cache was at
+// generation; it is dropped if the cache was invalidated since.
+func (c *grafanaCache) storeTeamMembers(teamID int64, members []grafana.TeamMember, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	c.teamMembers[teamID] = cachedTeamMembers{members: append([]grafana.TeamMember(nil), members...), expiresAt: time.Now().Add(c.ttl)}
+}
+
+// storeOrgUsers is storeTeamMembers for org users.
+func (c *grafanaCache) storeOrgUsers(orgID int64, users []grafana.OrgUser, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	c.orgUsers[orgID] = cachedOrgUsers{users: append([]grafana.OrgUser(nil), users...), expiresAt: time.Now().Add(c.ttl)}
+}
+
+// refreshAsync runs refresh in the background unless a refresh for the same
+// key is already in flight.
+func (c *grafanaCache) refreshAsync(key string, refresh func() error) {
+	c.mu.Lock()
+	if _, busy := c.refreshing[key]; busy {
+		c.mu.Unlock()
+		return
+	}
+	c.refreshing[key] = struct{}{}
+	c.mu.Unlock()
+	go func() {
+		if err := refresh(); err != nil {
+			log.Printf("sync: cache refresh %s failed: %v", key, err)
+		}
+		c.mu.Lock()
+		delete(c.refreshing, key)
+		c.mu.Unlock()
+	}()
+}
+
+// finish logs the outcome of a Run and records it in the sync_runs table.
+// planID is the plan a read-only run stored; runs that apply their plan
+// don't store it and pass 0.
+func (s *Syncer) finish(start time.Time, planID int64, applied int, err error) error {
+	finished := time.Now()
+	elapsed := finished.Sub(start)
+	msg := "ok"
+	status := "ok"
+	if err != nil {
+		msg = err.Error()
+		status = "failed"
+		log.Printf("sync: failed after %s: %v", elapsed.Round(time.Millisecond), err)
+	} else {
+		log.Printf("sync: completed in %s", elapsed.Round(time.Millisecond))
+	}
+	run := store.SyncRun{
+		StartedAt:      start,
+		FinishedAt:     finished,
+		Status:         status,
+		PlanID:         planID,
+		ActionsApplied: applied,
+		DurationMS:     elapsed.Milliseconds(),
+	}
+	if _, recErr := s.store.RecordSyncRun(run); recErr != nil {
+		log.Printf("sync: record sync run failed: %v", recErr)
+	}
+	s.mu.Lock()
+	s.lastRun = finished
+	s.lastMessage = msg
+	s.mu.Unlock()
+	return err
+}
+
+// removalGracePeriod returns how long a user must be missing from the mapped
+// Entra group before being removed from the team. A valid per-mapping value
+// overrides REMOVAL_GRACE_PERIOD.
+func (s *Syncer) removalGracePeriod(mapping store.Mapping) time.Duration {
+	raw := strings.TrimSpace(mapping.RemovalGracePeriod)
+	if raw == "" {
+		return s.removalGrace
+	}
+	grace, err := time.ParseDuration(raw)
+	if err != nil {
+		log.Printf("sync: mapping %d has invalid removal grace period %q: %v", mapping.ID, raw, err)
+		return s.removalGrace
+	}
+	return grace
+}
+
+// profileAction plans update_user_profile when user's name or email differs
+// from the Entra member resolved to email. Protected users are left alone.
+func (s *Syncer) profileAction(user *grafana.User, member entra.Member, email string) (store.PlanAction, bool) {
+	if s.isProtected(email, user, nil) {
+		return store.PlanAction{}, false
+	}
+	name := s.displayName(member)
+	if name == "" {
+		name = user.Name
+	}
+	var changes []string
+	if name != user.Name {
+		changes = append(changes, fmt.Sprintf("name %q -> %q", user.Name, name))
+	}
+	if !strings.EqualFold(user.Email, email) {
+		changes = append(changes, fmt.Sprintf("email %s -> %s", user.Email, email))
+	}
+	if len(changes) == 0 {
+		return store.PlanAction{}, false
+	}
+	return store.PlanAction{
+		ActionType:  "update_user_profile",
+		UserID:      user.ID,
+		Email:       email,
+		DisplayName: name,
+		Login:       user.Login,
+		Note:        strings.Join(changes, "; "),
+	}, true
+}
+
+// displayName renders the configured display name template for an Entra
+// member. Rendering errors fall back to the plain Entra display name.
+func (s *Syncer) displayName(member entra.Member) string {
+	if s.displayNameTmpl == nil {
+		return member.DisplayName
+	}
+	var buf strings.Builder
+	err := s.displayNameTmpl.Execute(&buf, displayNameData{
+		DisplayName: member.DisplayName,
+		GivenName:   member.GivenName,
+		Surname:     member.Surname,
+		Department:  member.Department,
+		UPN:         member.UPN,
+	})
+	if err != nil {
+		log.Printf("sync: render display name for %s failed: %v", member.ID, err)
+		return member.DisplayName
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+// groupMembers returns the members of an Entra group, from the persisted
+// member cache while it is fresh and from Graph otherwise.
+func (s *Syncer) groupMembers(client *entra.Client, groupID string) ([]entra.Member, error) {
+	members, cached, err := s.readGroupMembers(client, groupID)
+	if err != nil || cached || s.memberCacheTTL <= 0 {
+		return members, err
+	}
+	if err := s.store.SetGroupMemberCache(groupID, members); err != nil {
+		log.Printf("sync: member cache write %s failed: %v", groupID, err)
+	}
+	return members, nil
+}
+
+// readGroupMembers is groupMembers without refreshing the member cache.
+// cached reports that the members came from the cache.
+func (s *Syncer) readGroupMembers(client *entra.Client, groupID string) (members []entra.Member, cached bool, err error) {
+	if s.memberCacheTTL > 0 {
+		members, cachedAt, err := s.store.GetGroupMemberCache(groupID)
+		if err != nil {
+			log.Printf("sync: member cache read %s failed: %v", groupID, err)
+		} else if !cachedAt.IsZero() && time.Since(cachedAt) < s.memberCacheTTL {
+			return members, true, nil
+		}
+	}
+	members, err = client.ListGroupMembers(groupID)
+	return members, false, err
+}
+
+// mappingMembers returns the members of the mapping's Entra group with an
+// email, keyed by lowercased email. It raises each member's entry in
+// teamRoles to the mapping's team role, or to admin for
+// TEAM_ADMIN_EMAIL_DOMAINS; with GROUP_OWNERS_AS_ADMINS group owners are
+// set to admin as well. teamRoles collects every mapping of one team, so a
+// member gets the highest role any of them grants. With cacheMembers false
+// the member cache is read but not refreshed.
+func (s *Syncer) mappingMembers(client *entra.Client, mapping store.Mapping, teamRoles map[string]string, cacheMembers bool) (map[string]entra.Member, error) {
+	var members []entra.Member
+	var err error
+	if cacheMembers {
+		members, err = s.groupMembers(client, mapping.ExternalGroupID)
+	} else {
+		members, _, err = s.readGroupMembers(client, mapping.ExternalGroupID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	teamRole := normalizeTeamRole(mapping.TeamRole)
+	want := make(map[string]entra.Member)
+	for _, member := range members {
+		email := strings.TrimSpace(strings.ToLower(pickEmail(member)))
+		if email == "" {
+			continue
+		}
+		want[email] = member
+		teamRoles[email] = maxTeamRole(teamRoles[email], teamRole)
+		if s.adminDomains[emailDomain(email)] {
+			teamRoles[email] = "admin"
+		}
+	}
+	if s.ownersAsAdmins && teamRole == "member" {
+		owners, err := client.ListGroupOwners(mapping.ExternalGroupID)
+		if err != nil {
+			log.Printf("sync: list group owners %s failed: %v", mapping.ExternalGroupID, err)
+		}
+		for _, owner := range owners {
+			if email := strings.TrimSpace(strings.ToLower(pickEmail(owner))); email != "" {
+				teamRoles[email] = "admin"
+			}
+		}
+	}
+	return want, nil
+}
+
+// userLogin returns the Grafana login for a member according to the
+// configured login format, falling back to the email address.
+func (s *Syncer) userLogin(member entra.Member, email string) string {
+	switch s.loginFormat {
+	case "upn":
+		if upn := strings.TrimSpace(strings.ToLower(member.UPN)); upn != "" {
+			return upn
+		}
+	case "displayname_slug":
+		if slug := loginSlug(member.DisplayName); slug != "" {
+			return slug
+		}
 	}
-	return plan, nil
+	return email
 }
 
-func (s *Syncer) finish(start time.Time, err error) error {
-	elapsed := time.Since(start)
-	msg := "ok"
-	if err != nil {
-		msg = err.Error()
-		log.Printf("sync: failed after %s: %v", elapsed.Round(time.Millisecond), err)
-	} else {
-		log.Printf("sync: completed in %s", elapsed.Round(time.Millisecond))
+// loginSlug lowercases name, turns spaces into dots and drops everything
+// else that is not a letter or digit: "Jane O'Neil" becomes "jane.oneil".
+func loginSlug(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(strings.Join(strings.Fields(name), " ")) {
+		switch {
+		case r == ' ':
+			b.WriteRune('.')
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		}
 	}
-	s.mu.Lock()
-	s.lastRun = time.Now()
-	s.lastMessage = msg
-	s.mu.Unlock()
-	return err
+	return strings.Trim(b.String(), ".")
 }
 
 func pickEmail(member entra.Member) string {
@@ -583,9 +3044,22 @@ func userID(user *grafana.User) int64 {
 	return user.ID
 }
 
+// roleRank orders Grafana org roles; unknown roles such as None rank lowest.
+func roleRank(role string) int {
+	switch strings.ToLower(strings.TrimSpace(role)) {
+	case "viewer":
+		return 1
+	case "editor":
+		return 2
+	case "admin":
+		return 3
+	default:
+		return 0
+	}
+}
+
 func maxRole(current, candidate string) string {
-	order := map[string]int{"Viewer": 1, "Editor": 2, "Admin": 3}
-	if order[candidate] > order[current] {
+	if roleRank(candidate) > roleRank(current) {
 		return candidate
 	}
 	if current == "" {
@@ -603,6 +3077,724 @@ func normalizeTeamRole(role string) string {
 	}
 }
 
+func protectedLoginSet(logins []string) map[string]bool {
+	set := map[string]bool{}
+	for _, login := range logins {
+		if login = strings.ToLower(strings.TrimSpace(login)); login != "" {
+			set[login] = true
+		}
+	}
+	return set
+}
+
+// emailDomainSet lowercases TEAM_ADMIN_EMAIL_DOMAINS entries; a leading
+// "@" is optional.
+func emailDomainSet(domains []string) map[string]bool {
+	set := map[string]bool{}
+	for _, domain := range domains {
+		domain = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), "@")
+		if domain != "" {
+			set[domain] = true
+		}
+	}
+	return set
+}
+
+// emailDomain returns the lowercased part of email after the last "@", or
+// "" when there is none.
+func emailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(email[at+1:])
+}
+
+// protectedEmails resolves the protected logins to the email addresses of
+// the matching Grafana users.
+func (s *Syncer) protectedEmails() map[string]bool {
+	emails := map[string]bool{}
+	for login := range s.protectedLogins {
+		user, found, err := s.grafana.LookupUserByLogin(login)
+		if err != nil {
+			log.Printf("sync: lookup protected login %s failed: %v", login, err)
+			continue
+		}
+		if found && user.Email != "" {
+			emails[strings.ToLower(strings.TrimSpace(user.Email))] = true
+		}
+	}
+	return emails
+}
+
+func (s *Syncer) isProtected(email string, user *grafana.User, protectedEmails map[string]bool) bool {
+	if protectedEmails[email] || s.protectedLogins[email] {
+		return true
+	}
+	return user != nil && s.protectedLogins[strings.ToLower(user.Login)]
+}
+
+// skippedGroupType reports whether a group's type, looked up in types, is
+// left out by ENTRA_ALLOWED_GROUP_TYPES. Groups missing from types are kept.
+func (s *Syncer) skippedGroupType(types map[string]string, groupID string) (string, bool) {
+	groupType, ok := types[groupID]
+	return groupType, ok && s.groupTypes != nil && !s.groupTypes[groupType]
+}
+
+// groupInfo holds what a plan needs from a tenant's Entra groups, keyed by
+// group ID.
+type groupInfo struct {
+	descriptions map[string]string
+	// mails leaves out groups without a mail address.
+	mails map[string]string
+	// types holds entra.Group.Type.
+	types map[string]string
+}
+
+// listGroupInfo lists the tenant's groups once for a plan. A failed lookup
+// returns empty maps, so descriptions and mails are simply not synced and
+// no mapping is filtered by group type.
+func (s *Syncer) listGroupInfo(client *entra.Client) *groupInfo {
+	info := &groupInfo{descriptions: map[string]string{}, mails: map[string]string{}, types: map[string]string{}}
+	groups, err := client.ListGroups()
+	if err != nil {
+		log.Printf("sync: list groups failed: %v", err)
+		return info
+	}
+	for _, group := range groups {
+		info.descriptions[group.ID] = strings.TrimSpace(group.Description)
+		if mail := strings.TrimSpace(group.Mail); mail != "" {
+			info.mails[group.ID] = mail
+		}
+		info.types[group.ID] = group.Type()
+	}
+	return info
+}
+
+// teamDescriptionAction plans update_team_description when the Entra
+// group's description differs from the one last synced to the team. Grafana
+// does not return team descriptions, so the synced one is kept in the store.
+func (s *Syncer) teamDescriptionAction(org store.Org, teamID int64, mapping store.Mapping, description string) (store.PlanAction, bool) {
+	if description == "" {
+		return store.PlanAction{}, false
+	}
+	synced, err := s.store.GetTeamDescription(org.GrafanaOrgID, teamID)
+	if err != nil {
+		log.Printf("sync: get description of team %d failed: %v", teamID, err)
+		return store.PlanAction{}, false
+	}
+	if synced == description {
+		return store.PlanAction{}, false
+	}
+	return store.PlanAction{
+		ActionType:      "update_team_description",
+		OrgID:           org.ID,
+		GrafanaOrgID:    org.GrafanaOrgID,
+		TeamID:          teamID,
+		TeamName:        mapping.GrafanaTeamName,
+		ExternalGroupID: mapping.ExternalGroupID,
+		Description:     description,
+	}, true
+}
+
+// teamEmailAction plans update_team_email when the email last synced to
+// the team differs from the Entra group's mail address. Teams the plan is
+// about to create always get one; groups without a mail address are left
+// alone.
+func (s *Syncer) teamEmailAction(org store.Org, teamID int64, mapping store.Mapping, mail string) (store.PlanAction, bool) {
+	if mail == "" {
+		return store.PlanAction{}, false
+	}
+	if teamID != 0 {
+		synced, err := s.store.GetTeamEmail(org.GrafanaOrgID, teamID)
+		if err != nil {
+			log.Printf("sync: get email of team %d failed: %v", teamID, err)
+			return store.PlanAction{}, false
+		}
+		if strings.EqualFold(synced, mail) {
+			return store.PlanAction{}, false
+		}
+	}
+	return store.PlanAction{
+		ActionType:      "update_team_email",
+		OrgID:           org.ID,
+		GrafanaOrgID:    org.GrafanaOrgID,
+		TeamID:          teamID,
+		TeamName:        mapping.GrafanaTeamName,
+		ExternalGroupID: mapping.ExternalGroupID,
+		TeamEmail:       mail,
+		Note:            fmt.Sprintf("email: %s", mail),
+	}, true
+}
+
+// DueServiceAccountTokens returns the tracked service account tokens that
+// expire within SA_TOKEN_ROTATION_WINDOW.
+func (s *Syncer) DueServiceAccountTokens() ([]store.ServiceAccountToken, error) {
+	if s.saTokenWindow <= 0 {
+		return nil, nil
+	}
+	tokens, err := s.store.ListServiceAccountTokens()
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(s.saTokenWindow)
+	var due []store.ServiceAccountToken
+	for _, token := range tokens {
+		if !token.ExpiresAt.IsZero() && token.ExpiresAt.Before(deadline) {
+			due = append(due, token)
+		}
+	}
+	return due, nil
+}
+
+// serviceAccountTokenActions plans rotate_service_account_token for every
+// due token whose mapping still exists.
+func (s *Syncer) serviceAccountTokenActions(orgByID map[int64]store.Org, mappings []store.Mapping) []store.PlanAction {
+	due, err := s.DueServiceAccountTokens()
+	if err != nil {
+		log.Printf("sync: list service account tokens failed: %v", err)
+		return nil
+	}
+	mappingByID := make(map[int64]store.Mapping, len(mappings))
+	for _, mapping := range mappings {
+		mappingByID[mapping.ID] = mapping
+	}
+	var actions []store.PlanAction
+	for _, token := range due {
+		mapping, ok := mappingByID[token.MappingID]
+		if !ok {
+			log.Printf("sync: service account %d: mapping %d no longer exists, not rotating", token.SAID, token.MappingID)
+			continue
+		}
+		org, ok := orgByID[mapping.OrgID]
+		if !ok {
+			continue
+		}
+		actions = append(actions, store.PlanAction{
+			ActionType:      "rotate_service_account_token",
+			OrgID:           org.ID,
+			GrafanaOrgID:    org.GrafanaOrgID,
+			TeamName:        mapping.GrafanaTeamName,
+			ExternalGroupID: mapping.ExternalGroupID,
+			MappingID:       mapping.ID,
+			UserID:          token.SAID,
+			Note:            fmt.Sprintf("service account %d token %d expires %s", token.SAID, token.TokenID, token.ExpiresAt.UTC().Format(time.RFC3339)),
+		})
+	}
+	return actions
+}
+
+// teamPreferencesAction sets the team preferences of a mapping with
+// team_prefs_json when Grafana differs. Teams that do not exist yet get the
+// action too; it runs after create_team.
+func (s *Syncer) teamPreferencesAction(org store.Org, teamID int64, mapping store.Mapping) (store.PlanAction, bool) {
+	if strings.TrimSpace(mapping.TeamPrefsJSON) == "" {
+		return store.PlanAction{}, false
+	}
+	want, err := grafana.ParseTeamPreferences(mapping.TeamPrefsJSON)
+	if err != nil {
+		log.Printf("sync: mapping %d: invalid team preferences: %v", mapping.ID, err)
+		return store.PlanAction{}, false
+	}
+	if teamID != 0 {
+		current, err := s.grafana.WithOrgContext(org.GrafanaOrgID).GetTeamPreferences(teamID)
+		if err != nil {
+			log.Printf("sync: get team %d preferences failed: %v", teamID, err)
+			return store.PlanAction{}, false
+		}
+		if mergeTeamPreferences(*current, want) == *current {
+			return store.PlanAction{}, false
+		}
+	}
+	encoded, _ := json.Marshal(want)
+	return store.PlanAction{
+		ActionType:      "set_team_preferences",
+		OrgID:           org.ID,
+		GrafanaOrgID:    org.GrafanaOrgID,
+		TeamID:          teamID,
+		TeamName:        mapping.GrafanaTeamName,
+		ExternalGroupID: mapping.ExternalGroupID,
+		TeamPrefsJSON:   string(encoded),
+		Note:            fmt.Sprintf("preferences: %s", encoded),
+	}, true
+}
+
+// teamAvatarAction plans set_team_avatar when the rendered avatar URL
+// differs from the one last set on the team. Teams the plan is about to
+// create always get one.
+func (s *Syncer) teamAvatarAction(org store.Org, teamID int64, mapping store.Mapping) (store.PlanAction, bool) {
+	var buf bytes.Buffer
+	if err := s.avatarTmpl.Execute(&buf, teamAvatarData{TeamName: mapping.GrafanaTeamName, OrgID: org.GrafanaOrgID}); err != nil {
+		log.Printf("sync: render avatar URL for team %q failed: %v", mapping.GrafanaTeamName, err)
+		return store.PlanAction{}, false
+	}
+	avatarURL := strings.TrimSpace(buf.String())
+	if avatarURL == "" {
+		return store.PlanAction{}, false
+	}
+	if teamID != 0 {
+		current, err := s.store.GetTeamAvatarURL(org.GrafanaOrgID, teamID)
+		if err != nil {
+			log.Printf("sync: get avatar of team %d failed: %v", teamID, err)
+			return store.PlanAction{}, false
+		}
+		if current == avatarURL {
+			return store.PlanAction{}, false
+		}
+	}
+	return store.PlanAction{
+		ActionType:      "set_team_avatar",
+		OrgID:           org.ID,
+		GrafanaOrgID:    org.GrafanaOrgID,
+		TeamID:          teamID,
+		TeamName:        mapping.GrafanaTeamName,
+		ExternalGroupID: mapping.ExternalGroupID,
+		AvatarURL:       avatarURL,
+		Note:            fmt.Sprintf("avatar: %s", avatarURL),
+	}, true
+}
+
+// mergeTeamPreferences overlays the fields set in want on current.
+func mergeTeamPreferences(current, want grafana.TeamPreferences) grafana.TeamPreferences {
+	if want.Theme != "" {
+		current.Theme = want.Theme
+	}
+	if want.HomeDashboardUID != "" {
+		current.HomeDashboardUID = want.HomeDashboardUID
+	}
+	if want.Timezone != "" {
+		current.Timezone = want.Timezone
+	}
+	return current
+}
+
+// renameTeamAction renames the team a mapping used before its team name was
+// changed, so the team keeps its members, folders and permissions instead of
+// being replaced by a new one. Teams still used by other mappings are left
+// alone. With persist, a previous name whose team is gone is forgotten.
+func (s *Syncer) renameTeamAction(org store.Org, mapping store.Mapping, mappedTeams map[string]int, persist bool) (store.PlanAction, bool) {
+	previous := mapping.PreviousGrafanaTeamName
+	if mappedTeams[teamKey(org.ID, previous)] > 0 {
+		log.Printf("sync: mapping %d: team %q is still mapped elsewhere, creating %q instead of renaming", mapping.ID, previous, mapping.GrafanaTeamName)
+		return store.PlanAction{}, false
+	}
+	oldID, found, err := s.grafana.WithOrgContext(org.GrafanaOrgID).SearchTeam(previous)
+	if err != nil {
+		log.Printf("sync: search team %q failed: %v", previous, err)
+		return store.PlanAction{}, false
+	}
+	if !found {
+		if persist {
+			s.forgetPreviousTeamName(mapping, "old team not found")
+		}
+		return store.PlanAction{}, false
+	}
+	return store.PlanAction{
+		ActionType:      "rename_team",
+		OrgID:           org.ID,
+		GrafanaOrgID:    org.GrafanaOrgID,
+		TeamID:          oldID,
+		TeamName:        mapping.GrafanaTeamName,
+		ExternalGroupID: mapping.ExternalGroupID,
+		MappingID:       mapping.ID,
+		Note:            fmt.Sprintf("renamed from %q", previous),
+	}, true
+}
+
+// forgetPreviousTeamName clears a mapping's previous team name once there is
+// nothing left to rename, so later plans neither search for the old team nor
+// rename a team that reappears under that name.
+func (s *Syncer) forgetPreviousTeamName(mapping store.Mapping, reason string) {
+	log.Printf("sync: mapping %d: forgetting previous team name %q: %s", mapping.ID, mapping.PreviousGrafanaTeamName, reason)
+	if err := s.store.ClearPreviousTeamName(mapping.ID); err != nil {
+		log.Printf("sync: clear previous team name of mapping %d failed: %v", mapping.ID, err)
+	}
+}
+
+// defaultTeamFolderPermission is the folder permission granted to a team
+// on its auto-created folder unless TeamFolderPermission is set: edit, so
+// members can manage the team's dashboards.
+const defaultTeamFolderPermission = 2
+
+func (s *Syncer) teamFolderPermission() int {
+	if s.teamFolderPerm == 0 {
+		return defaultTeamFolderPermission
+	}
+	return s.teamFolderPerm
+}
+
+// teamFolderTitle renders TEAM_FOLDER_TITLE_TEMPLATE for a team, or returns
+// the team name when no template is set.
+func (s *Syncer) teamFolderTitle(teamName string, grafanaOrgID int64) (string, error) {
+	if s.folderTmpl == nil {
+		return teamName, nil
+	}
+	var buf bytes.Buffer
+	if err := s.folderTmpl.Execute(&buf, teamFolderData{TeamName: teamName, OrgID: grafanaOrgID}); err != nil {
+		return "", fmt.Errorf("render team folder title: %w", err)
+	}
+	title := strings.TrimSpace(buf.String())
+	if title == "" {
+		return "", fmt.Errorf("team folder title for %s is empty", teamName)
+	}
+	return title, nil
+}
+
+// teamFolderAction plans the folder for a team the plan is about to create,
+// unless one was already created for the mapping.
+func (s *Syncer) teamFolderAction(org store.Org, mapping store.Mapping) (store.PlanAction, bool) {
+	uid, err := s.store.GetTeamFolder(mapping.ID)
+	if err != nil {
+		log.Printf("sync: get team folder for mapping %d failed: %v", mapping.ID, err)
+		return store.PlanAction{}, false
+	}
+	if uid != "" {
+		return store.PlanAction{}, false
+	}
+	note := mappingNote(org.Name, mapping)
+	if title, err := s.teamFolderTitle(mapping.GrafanaTeamName, org.GrafanaOrgID); err == nil && title != mapping.GrafanaTeamName {
+		note = appendNote(note, fmt.Sprintf("folder: %s", title))
+	}
+	if s.teamFolderParent != "" {
+		note = appendNote(note, fmt.Sprintf("parent folder: %s", s.teamFolderParent))
+	}
+	return store.PlanAction{
+		ActionType:      "create_team_folder",
+		OrgID:           org.ID,
+		GrafanaOrgID:    org.GrafanaOrgID,
+		TeamName:        mapping.GrafanaTeamName,
+		ExternalGroupID: mapping.ExternalGroupID,
+		MappingID:       mapping.ID,
+		Note:            note,
+	}, true
+}
+
+// dataSourceTemplateData is the data a mapping's data source template is
+// rendered with.
+type dataSourceTemplateData struct {
+	TeamName string
+	// OrgID is the Grafana org ID.
+	OrgID   int64
+	OrgName string
+}
+
+// RenderDataSourceTemplate renders a mapping's data source template and
+// returns the resulting definition as compact JSON.
+func RenderDataSourceTemplate(text, teamName string, grafanaOrgID int64, orgName string) (string, error) {
+	tmpl, err := template.New("datasource").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("parse data source template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, dataSourceTemplateData{TeamName: teamName, OrgID: grafanaOrgID, OrgName: orgName}); err != nil {
+		return "", fmt.Errorf("execute data source template: %w", err)
+	}
+	spec, err := grafana.ParseDataSourceSpec(buf.String())
+	if err != nil {
+		return "", err
+	}
+	encoded, err := json.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// provisionedDataSourceAction plans the data source defined by the mapping's
+// template: provision_datasource when none has been created for the mapping
+// in its current org yet, update_datasource when the rendered definition has
+// changed since. A data source left in the mapping's old org is removed by
+// orphanedDataSourceActions.
+func (s *Syncer) provisionedDataSourceAction(org store.Org, mapping store.Mapping) (store.PlanAction, bool) {
+	if strings.TrimSpace(mapping.DataSourceTemplateJSON) == "" {
+		return store.PlanAction{}, false
+	}
+	spec, err := RenderDataSourceTemplate(mapping.DataSourceTemplateJSON, mapping.GrafanaTeamName, org.GrafanaOrgID, org.Name)
+	if err != nil {
+		log.Printf("sync: mapping %d: invalid data source template: %v", mapping.ID, err)
+		return store.PlanAction{}, false
+	}
+	current, err := s.store.GetMappingDataSource(mapping.ID)
+	if err != nil {
+		log.Printf("sync: get data source for mapping %d failed: %v", mapping.ID, err)
+		return store.PlanAction{}, false
+	}
+	action := store.PlanAction{
+		ActionType:         "provision_datasource",
+		OrgID:              org.ID,
+		GrafanaOrgID:       org.GrafanaOrgID,
+		TeamName:           mapping.GrafanaTeamName,
+		ExternalGroupID:    mapping.ExternalGroupID,
+		MappingID:          mapping.ID,
+		DataSourceSpecJSON: spec,
+		Note:               fmt.Sprintf("data source: %s", dataSourceName(spec)),
+	}
+	if current != nil && current.GrafanaOrgID == org.GrafanaOrgID {
+		if current.SpecJSON == spec {
+			return store.PlanAction{}, false
+		}
+		action.ActionType = "update_datasource"
+		action.DataSourceUID = current.DataSourceUID
+	}
+	return action, true
+}
+
+// orphanedDataSourceActions plans a delete_datasource action for each
+// provisioned data source whose mapping no longer exists, no longer has a
+// data source template, or has moved to another Grafana org. Data sources of
+// mappings whose org is not in orgByID are left alone.
+func (s *Syncer) orphanedDataSourceActions(mappings []store.Mapping, orgByID map[int64]store.Org) []store.PlanAction {
+	sources, err := s.store.ListMappingDataSources()
+	if err != nil {
+		log.Printf("sync: list provisioned data sources failed: %v", err)
+		return nil
+	}
+	mappingByID := make(map[int64]store.Mapping, len(mappings))
+	for _, mapping := range mappings {
+		mappingByID[mapping.ID] = mapping
+	}
+	var actions []store.PlanAction
+	for _, ds := range sources {
+		var reason string
+		mapping, ok := mappingByID[ds.MappingID]
+		switch {
+		case !ok:
+			reason = fmt.Sprintf("deleted mapping %d", ds.MappingID)
+		case strings.TrimSpace(mapping.DataSourceTemplateJSON) == "":
+			reason = fmt.Sprintf("mapping %d without a data source template", ds.MappingID)
+		default:
+			org, ok := orgByID[mapping.OrgID]
+			if !ok || org.GrafanaOrgID == ds.GrafanaOrgID {
+				continue
+			}
+			reason = fmt.Sprintf("mapping %d, moved to grafana org %d", ds.MappingID, org.GrafanaOrgID)
+		}
+		actions = append(actions, store.PlanAction{
+			ActionType:    "delete_datasource",
+			GrafanaOrgID:  ds.GrafanaOrgID,
+			MappingID:     ds.MappingID,
+			DataSourceUID: ds.DataSourceUID,
+			Note:          fmt.Sprintf("data source %s of %s", dataSourceName(ds.SpecJSON), reason),
+		})
+	}
+	return actions
+}
+
+// dataSourceName returns the name in a rendered data source definition.
+func dataSourceName(spec string) string {
+	var fields struct {
+		Name string `json:"name"`
+	}
+	json.Unmarshal([]byte(spec), &fields)
+	return fields.Name
+}
+
+// dataSourceState caches data source lookups for one BuildPlan call.
+type dataSourceState struct {
+	uids map[int64]map[string]bool
+	// unsupported is set once Grafana reports that data source permissions
+	// need Enterprise; later mappings are then skipped.
+	unsupported bool
+}
+
+// dataSourcePermissionActions plans a set_datasource_permission action for
+// each configured data source where the mapping's team lacks the configured
+// level. Teams the plan is about to create get every permission.
+func (s *Syncer) dataSourcePermissionActions(org store.Org, teamID int64, mapping store.Mapping, perms []store.DataSourcePermission, state *dataSourceState) []store.PlanAction {
+	if len(perms) == 0 || state.unsupported {
+		return nil
+	}
+	if state.uids[org.GrafanaOrgID] == nil {
+		sources, err := s.grafana.ListDataSources(org.GrafanaOrgID)
+		if err != nil {
+			log.Printf("sync: list data sources for org %d failed: %v", org.GrafanaOrgID, err)
+			return nil
+		}
+		uids := map[string]bool{}
+		for _, source := range sources {
+			uids[source.UID] = true
+		}
+		state.uids[org.GrafanaOrgID] = uids
+	}
+	var actions []store.PlanAction
+	for _, perm := range perms {
+		if !state.uids[org.GrafanaOrgID][perm.DataSourceUID] {
+			log.Printf("sync: mapping %d references missing data source %s", mapping.ID, perm.DataSourceUID)
+			continue
+		}
+		if teamID != 0 {
+			current, err := s.grafana.DataSourceTeamPermissions(org.GrafanaOrgID, perm.DataSourceUID)
+			if errors.Is(err, grafana.ErrEnterpriseRequired) {
+				log.Printf("sync: data source permissions need Grafana Enterprise, skipping them")
+				state.unsupported = true
+				return nil
+			}
+			if err != nil {
+				log.Printf("sync: read permissions of data source %s failed: %v", perm.DataSourceUID, err)
+				continue
+			}
+			if strings.EqualFold(current[teamID], perm.Permission) {
+				continue
+			}
+		}
+		actions = append(actions, store.PlanAction{
+			ActionType:      "set_datasource_permission",
+			OrgID:           org.ID,
+			GrafanaOrgID:    org.GrafanaOrgID,
+			TeamID:          teamID,
+			TeamName:        mapping.GrafanaTeamName,
+			ExternalGroupID: mapping.ExternalGroupID,
+			MappingID:       mapping.ID,
+			DataSourceUID:   perm.DataSourceUID,
+			Permission:      perm.Permission,
+			Note:            fmt.Sprintf("data source %s: %s", perm.DataSourceUID, perm.Permission),
+		})
+	}
+	return actions
+}
+
+// contactPointAction links a mapping's contact point to its team through a
+// notification policy route matching the team label. Routes depend only on
+// the team name, so teams about to be created are linked in the same plan.
+func (s *Syncer) contactPointAction(org store.Org, teamID int64, mapping store.Mapping) (store.PlanAction, bool) {
+	if mapping.ContactPointUID == "" {
+		return store.PlanAction{}, false
+	}
+	point, err := s.grafana.GetContactPoint(org.GrafanaOrgID, mapping.ContactPointUID)
+	if err != nil {
+		log.Printf("sync: get contact point %s failed: %v", mapping.ContactPointUID, err)
+		return store.PlanAction{}, false
+	}
+	if point == nil {
+		log.Printf("sync: mapping %d references missing contact point %s", mapping.ID, mapping.ContactPointUID)
+		return store.PlanAction{}, false
+	}
+	receiver, found, err := s.grafana.TeamContactPoint(org.GrafanaOrgID, mapping.GrafanaTeamName)
+	if err != nil {
+		log.Printf("sync: read notification policies for org %d failed: %v", org.GrafanaOrgID, err)
+		return store.PlanAction{}, false
+	}
+	if found && receiver == point.Name {
+		return store.PlanAction{}, false
+	}
+	return store.PlanAction{
+		ActionType:      "assign_contact_point",
+		OrgID:           org.ID,
+		GrafanaOrgID:    org.GrafanaOrgID,
+		TeamID:          teamID,
+		TeamName:        mapping.GrafanaTeamName,
+		ExternalGroupID: mapping.ExternalGroupID,
+		ContactPointUID: point.UID,
+		Note:            fmt.Sprintf("contact point: %s", point.Name),
+	}, true
+}
+
+// dropTeamAddsForOrgMembers removes add_user_to_team actions for users who
+// are already members of the action's org and returns how many it removed.
+func dropTeamAddsForOrgMembers(actions []store.PlanAction, orgUsersByOrgEmail map[int64]map[string]grafana.OrgUser) ([]store.PlanAction, int) {
+	kept := actions[:0]
+	dropped := 0
+	for _, action := range actions {
+		if action.ActionType == "add_user_to_team" {
+			if _, member := orgUsersByOrgEmail[action.OrgID][action.Email]; member {
+				dropped++
+				continue
+			}
+		}
+		kept = append(kept, action)
+	}
+	return kept, dropped
+}
+
+// userStateActions re-enables disabled users who are wanted by a mapping
+// again and, with disable, disables users whose last mapped team membership
+// is being removed. Only users in disabledBySync, which the syncer disabled
+// itself, are re-enabled unless enableAny is set.
+func userStateActions(actions []store.PlanAction, roleByOrgEmail map[int64]map[string]string, orgByID map[int64]store.Org, userCache map[string]*grafana.User, disable, enableAny bool, disabledBySync map[int64]bool) []store.PlanAction {
+	wanted := map[string]bool{}
+	for _, roleMap := range roleByOrgEmail {
+		for email := range roleMap {
+			wanted[email] = true
+		}
+	}
+	var out []store.PlanAction
+	seen := map[string]bool{}
+	for _, action := range actions {
+		if !disable || action.ActionType != "remove_user_from_team" || wanted[action.Email] || seen[action.Email] {
+			continue
+		}
+		seen[action.Email] = true
+		out = append(out, store.PlanAction{
+			ActionType:   "disable_user",
+			OrgID:        action.OrgID,
+			GrafanaOrgID: action.GrafanaOrgID,
+			UserID:       action.UserID,
+			Email:        action.Email,
+			Note:         "no longer in any mapped group",
+		})
+	}
+	for orgID, roleMap := range roleByOrgEmail {
+		for email := range roleMap {
+			user := userCache[email]
+			if user == nil || !user.IsDisabled || seen[email] || !(enableAny || disabledBySync[user.ID]) {
+				continue
+			}
+			seen[email] = true
+			out = append(out, store.PlanAction{
+				ActionType:   "enable_user",
+				OrgID:        orgID,
+				GrafanaOrgID: orgByID[orgID].GrafanaOrgID,
+				UserID:       user.ID,
+				Email:        email,
+				Note:         "disabled user is back in a mapped group",
+			})
+		}
+	}
+	return out
+}
+
+// blockDisabledUsers turns add_user_to_team and update_user_role actions of
+// disabled Grafana users into blocked_disabled_user, unless the plan also
+// re-enables the user. Users missing from userCache are checked by ID.
+func (s *Syncer) blockDisabledUsers(actions []store.PlanAction, userCache map[string]*grafana.User) []store.PlanAction {
+	enabled := map[string]bool{}
+	for _, action := range actions {
+		if action.ActionType == "enable_user" {
+			enabled[action.Email] = true
+		}
+	}
+	disabledByID := map[int64]bool{}
+	disabled := func(action store.PlanAction) bool {
+		if user := userCache[action.Email]; user != nil {
+			return user.IsDisabled
+		}
+		if action.UserID == 0 {
+			return false
+		}
+		if value, ok := disabledByID[action.UserID]; ok {
+			return value
+		}
+		active, err := s.grafana.IsUserActive(action.UserID)
+		if err != nil {
+			log.Printf("sync: check user %d active failed: %v", action.UserID, err)
+			return false
+		}
+		disabledByID[action.UserID] = !active
+		return !active
+	}
+	for i, action := range actions {
+		if action.ActionType != "add_user_to_team" && action.ActionType != "update_user_role" {
+			continue
+		}
+		if enabled[action.Email] || !disabled(action) {
+			continue
+		}
+		actions[i].Note = appendNote(fmt.Sprintf("Grafana user is disabled; %s skipped", action.ActionType), action.Note)
+		actions[i].ActionType = "blocked_disabled_user"
+	}
+	return actions
+}
+
 func maxTeamRole(current, candidate string) string {
 	if strings.ToLower(candidate) == "admin" {
 		return "admin"
@@ -613,16 +3805,7 @@ func maxTeamRole(current, candidate string) string {
 	return current
 }
 
-func sortActions(actions []store.PlanAction) {
-	order := map[string]int{
-		"create_team":          1,
-		"create_user":          2,
-		"add_user_to_org":      3,
-		"update_user_role":     4,
-		"add_user_to_team":     5,
-		"update_team_role":     6,
-		"remove_user_from_team": 7,
-	}
+func sortActions(actions []store.PlanAction, order map[string]int) {
 	sort.SliceStable(actions, func(i, j int) bool {
 		return order[actions[i].ActionType] < order[actions[j].ActionType]
 	})
@@ -0,0 +1,2210 @@
+package syncer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"grafana-ad-syncher/internal/config"
+	"grafana-ad-syncher/internal/entra"
+	"grafana-ad-syncher/internal/grafana"
+	"grafana-ad-syncher/internal/store"
+)
+
+// fakeGrafana is an in-memory Grafana HTTP API covering the endpoints the
+// syncer uses. Like Grafana, PUT /api/teams/{id} only keeps name and email,
+// and the team member and org user lists ignore pagination.
+type fakeGrafana struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	calls    map[string]int
+	nextID   int64
+	users    []grafana.User
+	teams    map[int64]*grafana.Team
+	teamOrg  map[int64]int64
+	members  map[int64][]grafana.TeamMember
+	orgUsers map[int64][]grafana.OrgUser
+	orgs     []grafana.Org
+	folders  map[int64][]grafana.Folder
+	// folderPerms holds the permission items last posted per folder UID.
+	folderPerms map[string][]map[string]any
+	settings    map[string]map[string]string
+	// handle, when set, runs first; returning true skips the default routes.
+	handle func(w http.ResponseWriter, r *http.Request) bool
+}
+
+func newFakeGrafana(t *testing.T) *fakeGrafana {
+	t.Helper()
+	f := &fakeGrafana{
+		t:           t,
+		calls:       map[string]int{},
+		nextID:      100,
+		teams:       map[int64]*grafana.Team{},
+		teamOrg:     map[int64]int64{},
+		members:     map[int64][]grafana.TeamMember{},
+		orgUsers:    map[int64][]grafana.OrgUser{},
+		folders:     map[int64][]grafana.Folder{},
+		folderPerms: map[string][]map[string]any{},
+		settings:    map[string]map[string]string{},
+	}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeGrafana) client() *grafana.Client {
+	return grafana.New(f.srv.URL, "/api", "admin", "admin", "", nil, false, false, grafana.TransportOptions{})
+}
+
+// count returns how often method and path (without query) were requested.
+func (f *fakeGrafana) count(method, path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method+" "+path]
+}
+
+func (f *fakeGrafana) addUser(id int64, login, email string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.users = append(f.users, grafana.User{ID: id, Login: login, Email: email, Name: login})
+}
+
+func (f *fakeGrafana) addTeam(orgID, id int64, name string) *grafana.Team {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	team := &grafana.Team{ID: id, Name: name}
+	f.teams[id] = team
+	f.teamOrg[id] = orgID
+	return team
+}
+
+func (f *fakeGrafana) addTeamMember(teamID int64, member grafana.TeamMember) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.members[teamID] = append(f.members[teamID], member)
+}
+
+func (f *fakeGrafana) addOrgUser(orgID int64, user grafana.OrgUser) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.orgUsers[orgID] = append(f.orgUsers[orgID], user)
+}
+
+// setDisabled marks a user's account as disabled or enabled.
+func (f *fakeGrafana) setDisabled(id int64, disabled bool) {
+	for i := range f.users {
+		if f.users[i].ID == id {
+			f.users[i].IsDisabled = disabled
+		}
+	}
+	for _, users := range f.orgUsers {
+		for i := range users {
+			if users[i].ID == id {
+				users[i].IsDisabled = disabled
+			}
+		}
+	}
+}
+
+func (f *fakeGrafana) team(id int64) grafana.Team {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return *f.teams[id]
+}
+
+func (f *fakeGrafana) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.calls[r.Method+" "+r.URL.Path]++
+	f.mu.Unlock()
+	if f.handle != nil && f.handle(w, r) {
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api"), "/"), "/")
+	orgID, _ := strconv.ParseInt(r.Header.Get("X-Grafana-Org-Id"), 10, 64)
+	if orgID == 0 {
+		orgID = 1
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/users/lookup":
+		value := r.URL.Query().Get("loginOrEmail")
+		for _, user := range f.users {
+			if strings.EqualFold(user.Email, value) || strings.EqualFold(user.Login, value) {
+				writeFakeJSON(w, user)
+				return
+			}
+		}
+		http.Error(w, `{"message":"user not found"}`, http.StatusNotFound)
+	case r.Method == http.MethodPost && len(parts) == 4 && parts[0] == "admin" && parts[1] == "users":
+		id, _ := strconv.ParseInt(parts[2], 10, 64)
+		f.setDisabled(id, parts[3] == "disable")
+		writeFakeJSON(w, map[string]string{"message": "ok"})
+	case r.Method == http.MethodGet && r.URL.Path == "/api/admin/settings":
+		writeFakeJSON(w, f.settings)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/orgs":
+		writeFakeJSON(w, f.orgs)
+	case r.Method == http.MethodPost && r.URL.Path == "/api/orgs":
+		var body struct {
+			Name string `json:"name"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		f.nextID++
+		f.orgs = append(f.orgs, grafana.Org{ID: f.nextID, Name: body.Name})
+		writeFakeJSON(w, map[string]any{"orgId": f.nextID})
+	case r.Method == http.MethodGet && r.URL.Path == "/api/teams/search":
+		if page, _ := strconv.Atoi(r.URL.Query().Get("page")); page > 1 {
+			writeFakeJSON(w, map[string]any{"teams": []grafana.Team{}})
+			return
+		}
+		name := r.URL.Query().Get("name")
+		teams := []grafana.Team{}
+		for id, team := range f.teams {
+			if f.teamOrg[id] == orgID && (name == "" || strings.EqualFold(team.Name, name)) {
+				teams = append(teams, *team)
+			}
+		}
+		writeFakeJSON(w, map[string]any{"teams": teams, "totalCount": len(teams)})
+	case r.Method == http.MethodPost && r.URL.Path == "/api/teams":
+		var body struct {
+			Name string `json:"name"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		f.nextID++
+		f.teams[f.nextID] = &grafana.Team{ID: f.nextID, Name: body.Name}
+		f.teamOrg[f.nextID] = orgID
+		writeFakeJSON(w, map[string]any{"teamId": f.nextID})
+	case len(parts) >= 2 && parts[0] == "teams":
+		f.serveTeam(w, r, parts)
+	case len(parts) >= 3 && parts[0] == "orgs" && parts[2] == "users":
+		id, _ := strconv.ParseInt(parts[1], 10, 64)
+		switch {
+		case r.Method == http.MethodGet && len(parts) == 3:
+			writeFakeJSON(w, f.orgUsers[id])
+		case r.Method == http.MethodGet && len(parts) == 4 && parts[3] == "search":
+			f.serveOrgUserSearch(w, r, id)
+		default:
+			writeFakeJSON(w, map[string]any{})
+		}
+	case r.URL.Path == "/api/folders":
+		if r.Method == http.MethodPost {
+			var body map[string]string
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			f.nextID++
+			folder := grafana.Folder{UID: fmt.Sprintf("folder-%d", f.nextID), Title: body["title"]}
+			f.folders[orgID] = append(f.folders[orgID], folder)
+			writeFakeJSON(w, folder)
+			return
+		}
+		writeFakeJSON(w, f.folders[orgID])
+	case len(parts) == 3 && parts[0] == "folders" && parts[2] == "permissions":
+		if r.Method == http.MethodPost {
+			var body struct {
+				Items []map[string]any `json:"items"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			f.folderPerms[parts[1]] = body.Items
+			writeFakeJSON(w, map[string]any{})
+			return
+		}
+		writeFakeJSON(w, f.folderPerms[parts[1]])
+	case r.Method != http.MethodGet:
+		writeFakeJSON(w, map[string]any{})
+	default:
+		http.Error(w, `{"message":"not found"}`, http.StatusNotFound)
+	}
+}
+
+// serveTeam handles /api/teams/{id} and its members. f.mu is held.
+func (f *fakeGrafana) serveTeam(w http.ResponseWriter, r *http.Request, parts []string) {
+	id, _ := strconv.ParseInt(parts[1], 10, 64)
+	team, ok := f.teams[id]
+	if !ok {
+		http.Error(w, `{"message":"team not found"}`, http.StatusNotFound)
+		return
+	}
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		writeFakeJSON(w, team)
+	case len(parts) == 2 && r.Method == http.MethodPut:
+		// Grafana's UpdateTeamCommand only has name and email.
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		team.Name = body["name"]
+		team.Email = body["email"]
+		writeFakeJSON(w, map[string]any{})
+	case len(parts) == 3 && parts[2] == "members" && r.Method == http.MethodGet:
+		members := f.members[id]
+		if members == nil {
+			members = []grafana.TeamMember{}
+		}
+		writeFakeJSON(w, members)
+	case len(parts) == 3 && parts[2] == "members" && r.Method == http.MethodPost:
+		var body struct {
+			UserID int64 `json:"userId"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		for _, user := range f.users {
+			if user.ID == body.UserID {
+				f.members[id] = append(f.members[id], grafana.TeamMember{ID: user.ID, Login: user.Login, Email: user.Email})
+			}
+		}
+		writeFakeJSON(w, map[string]any{})
+	default:
+		writeFakeJSON(w, map[string]any{})
+	}
+}
+
+// serveOrgUserSearch serves the paginated /api/orgs/{id}/users/search.
+func (f *fakeGrafana) serveOrgUserSearch(w http.ResponseWriter, r *http.Request, orgID int64) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("perpage"))
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = 1000
+	}
+	users := f.orgUsers[orgID]
+	start := (page - 1) * perPage
+	if start > len(users) {
+		start = len(users)
+	}
+	end := start + perPage
+	if end > len(users) {
+		end = len(users)
+	}
+	writeFakeJSON(w, map[string]any{
+		"totalCount": len(users),
+		"orgUsers":   append([]grafana.OrgUser{}, users[start:end]...),
+		"page":       page,
+		"perPage":    perPage,
+	})
+}
+
+func writeFakeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// fakeGraph is an in-memory Microsoft Graph API with a token endpoint.
+type fakeGraph struct {
+	srv *httptest.Server
+
+	mu      sync.Mutex
+	calls   map[string]int
+	groups  []entra.Group
+	members map[string][]entra.Member
+	owners  map[string][]entra.Member
+	// failGroupList makes GET /groups fail.
+	failGroupList bool
+}
+
+func newFakeGraph(t *testing.T) *fakeGraph {
+	t.Helper()
+	g := &fakeGraph{
+		calls:   map[string]int{},
+		members: map[string][]entra.Member{},
+		owners:  map[string][]entra.Member{},
+	}
+	g.srv = httptest.NewServer(http.HandlerFunc(g.serve))
+	t.Cleanup(g.srv.Close)
+	return g
+}
+
+func (g *fakeGraph) client() *entra.Client {
+	return entra.New("tenant", "client", "secret", g.srv.URL, g.srv.URL+"/v1.0", "", nil)
+}
+
+func (g *fakeGraph) count(path string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.calls[path]
+}
+
+func (g *fakeGraph) addGroup(group entra.Group, members ...entra.Member) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.groups = append(g.groups, group)
+	g.members[group.ID] = members
+}
+
+func (g *fakeGraph) serve(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.calls[r.URL.Path]++
+	if strings.HasSuffix(r.URL.Path, "/oauth2/v2.0/token") {
+		writeFakeJSON(w, map[string]any{"access_token": "token", "expires_in": 3600})
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1.0"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "groups":
+		if g.failGroupList {
+			http.Error(w, `{"error":{"code":"ServiceUnavailable"}}`, http.StatusServiceUnavailable)
+			return
+		}
+		writeFakeJSON(w, map[string]any{"value": g.groups})
+	case len(parts) == 2 && parts[0] == "groups":
+		for _, group := range g.groups {
+			if group.ID == parts[1] {
+				writeFakeJSON(w, group)
+				return
+			}
+		}
+		http.Error(w, `{"error":{"code":"Request_ResourceNotFound"}}`, http.StatusNotFound)
+	case len(parts) == 3 && parts[0] == "groups" && parts[2] == "members":
+		writeFakeJSON(w, map[string]any{"value": g.members[parts[1]]})
+	case len(parts) == 3 && parts[0] == "groups" && parts[2] == "owners":
+		writeFakeJSON(w, map[string]any{"value": g.owners[parts[1]]})
+	default:
+		http.Error(w, `{"error":{"code":"NotFound"}}`, http.StatusNotFound)
+	}
+}
+
+// testEnv is a Syncer wired to a fresh store and fake Grafana and Graph
+// servers, with one org (Grafana org 1) and no mappings.
+type testEnv struct {
+	store   *store.Store
+	grafana *fakeGrafana
+	graph   *fakeGraph
+	orgID   int64
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	st, err := store.Open(t.TempDir(), 4096, 2000)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { _ = st.Close() })
+	orgID, err := st.CreateOrg(store.Org{GrafanaOrgID: 1, Name: "Main", DefaultRole: "Viewer"})
+	if err != nil {
+		t.Fatalf("create org: %v", err)
+	}
+	return &testEnv{store: st, grafana: newFakeGrafana(t), graph: newFakeGraph(t), orgID: orgID}
+}
+
+func (e *testEnv) syncer(opts Options) *Syncer {
+	if opts.DefaultUserRole == "" {
+		opts.DefaultUserRole = "Viewer"
+	}
+	return New(e.store, e.grafana.client(), e.graph.client(), opts)
+}
+
+func (e *testEnv) addMapping(t *testing.T, m store.Mapping) int64 {
+	t.Helper()
+	if m.OrgID == 0 {
+		m.OrgID = e.orgID
+	}
+	if m.TeamRole == "" {
+		m.TeamRole = "member"
+	}
+	id, err := e.store.CreateMapping(m)
+	if err != nil {
+		t.Fatalf("create mapping: %v", err)
+	}
+	return id
+}
+
+// actionsOfType returns the plan's actions of the given type.
+func actionsOfType(plan *store.Plan, actionType string) []store.PlanAction {
+	var matched []store.PlanAction
+	for _, action := range plan.Actions {
+		if action.ActionType == actionType {
+			matched = append(matched, action)
+		}
+	}
+	return matched
+}
+
+func TestGrafanaCacheReducesAPICalls(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		ttl       time.Duration
+		wantCalls int
+	}{
+		{name: "disabled", ttl: 0, wantCalls: 3},
+		{name: "enabled", ttl: time.Hour, wantCalls: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.grafana.addTeam(1, 10, "Team")
+			env.grafana.addTeamMember(10, grafana.TeamMember{ID: 1, Email: "a@example.com"})
+			env.grafana.addOrgUser(1, grafana.OrgUser{ID: 1, Email: "a@example.com", Role: "Viewer"})
+			s := env.syncer(Options{CacheTTL: tc.ttl})
+			for i := 0; i < 3; i++ {
+				if _, err := s.ListTeamMembers(1, 10); err != nil {
+					t.Fatalf("ListTeamMembers: %v", err)
+				}
+				if _, err := s.ListOrgUsers(1); err != nil {
+					t.Fatalf("ListOrgUsers: %v", err)
+				}
+			}
+			if got := env.grafana.count("GET", "/api/teams/10/members"); got != tc.wantCalls {
+				t.Errorf("team member requests = %d, want %d", got, tc.wantCalls)
+			}
+			if got := env.grafana.count("GET", "/api/orgs/1/users"); got != tc.wantCalls {
+				t.Errorf("org user requests = %d, want %d", got, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestGrafanaCacheInvalidatedByApply(t *testing.T) {
+	env := newTestEnv(t)
+	env.grafana.addTeam(1, 10, "Team")
+	s := env.syncer(Options{CacheTTL: time.Hour})
+	if _, err := s.ListTeamMembers(1, 10); err != nil {
+		t.Fatalf("ListTeamMembers: %v", err)
+	}
+	s.invalidateCache([]store.PlanAction{{ActionType: "add_user_to_team", GrafanaOrgID: 1, TeamID: 10}}, nil)
+	if _, err := s.ListTeamMembers(1, 10); err != nil {
+		t.Fatalf("ListTeamMembers: %v", err)
+	}
+	if got := env.grafana.count("GET", "/api/teams/10/members"); got != 2 {
+		t.Errorf("team member requests = %d, want 2 after invalidation", got)
+	}
+}
+
+// TestGrafanaCacheDropsFetchRacingInvalidation checks that members read
+// before an apply invalidated the cache are not stored over it.
+func TestGrafanaCacheDropsFetchRacingInvalidation(t *testing.T) {
+	env := newTestEnv(t)
+	env.grafana.addTeam(1, 10, "Team")
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	env.grafana.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path == "/api/teams/10/members" {
+			once.Do(func() {
+				close(started)
+				<-release
+			})
+		}
+		return false
+	}
+	s := env.syncer(Options{CacheTTL: time.Hour})
+	done := make(chan error)
+	go func() {
+		_, err := s.ListTeamMembers(1, 10)
+		done <- err
+	}()
+	<-started
+	s.invalidateCache([]store.PlanAction{{GrafanaOrgID: 1, TeamID: 10}}, nil)
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("ListTeamMembers: %v", err)
+	}
+	if _, err := s.ListTeamMembers(1, 10); err != nil {
+		t.Fatalf("ListTeamMembers: %v", err)
+	}
+	if got := env.grafana.count("GET", "/api/teams/10/members"); got != 2 {
+		t.Errorf("team member requests = %d, want 2: the racing fetch must not be cached", got)
+	}
+}
+
+func TestGrafanaCacheConcurrentReadAndInvalidate(t *testing.T) {
+	env := newTestEnv(t)
+	env.grafana.addTeam(1, 10, "Team")
+	env.grafana.addTeamMember(10, grafana.TeamMember{ID: 1, Email: "a@example.com"})
+	s := env.syncer(Options{CacheTTL: time.Nanosecond})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				members, err := s.ListTeamMembers(1, 10)
+				if err != nil {
+					t.Errorf("ListTeamMembers: %v", err)
+					return
+				}
+				for k := range members {
+					members[k].Email = "changed"
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				s.invalidateCache([]store.PlanAction{{GrafanaOrgID: 1, TeamID: 10}}, nil)
+			}
+		}()
+	}
+	wg.Wait()
+	members, err := s.ListTeamMembers(1, 10)
+	if err != nil {
+		t.Fatalf("ListTeamMembers: %v", err)
+	}
+	if len(members) != 1 || members[0].Email != "a@example.com" {
+		t.Errorf("cached members were changed by a caller: %+v", members)
+	}
+}
+
+func TestGroupOwnersBecomeTeamAdmins(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			env := newTestEnv(t)
+			env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Team", SecurityEnabled: true},
+				entra.Member{ID: "u1", Mail: "alice@example.com"},
+				entra.Member{ID: "u2", Mail: "bob@example.com"},
+			)
+			env.graph.owners["g1"] = []entra.Member{{ID: "u2", Mail: "Bob@example.com"}}
+			env.grafana.addUser(1, "alice", "alice@example.com")
+			env.grafana.addUser(2, "bob", "bob@example.com")
+			env.grafana.addOrgUser(1, grafana.OrgUser{ID: 1, Email: "alice@example.com", Login: "alice", Role: "Viewer"})
+			env.grafana.addOrgUser(1, grafana.OrgUser{ID: 2, Email: "bob@example.com", Login: "bob", Role: "Viewer"})
+			env.grafana.addTeam(1, 10, "Team")
+			env.addMapping(t, store.Mapping{GrafanaTeamName: "Team", ExternalGroupID: "g1", TeamRole: "member"})
+
+			plan, err := env.syncer(Options{GroupOwnersAsTeamAdmins: enabled}).BuildPlan()
+			if err != nil {
+				t.Fatalf("BuildPlan: %v", err)
+			}
+			roles := map[string]string{}
+			for _, action := range actionsOfType(plan, "add_user_to_team") {
+				roles[action.Email] = action.TeamRole
+			}
+			wantBob := "member"
+			if enabled {
+				wantBob = "admin"
+			}
+			if roles["alice@example.com"] != "member" || roles["bob@example.com"] != wantBob {
+				t.Errorf("team roles = %v, want alice member and bob %s", roles, wantBob)
+			}
+			if got := env.graph.count("/v1.0/groups/g1/owners"); enabled != (got > 0) {
+				t.Errorf("owner requests = %d with owners-as-admins %v", got, enabled)
+			}
+		})
+	}
+}
+
+func TestGroupMemberCacheRefetchesWhenStale(t *testing.T) {
+	env := newTestEnv(t)
+	env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Team"}, entra.Member{ID: "u1", Mail: "alice@example.com"})
+	client := env.graph.client()
+
+	fresh := env.syncer(Options{MemberCacheTTL: time.Hour})
+	for i := 0; i < 2; i++ {
+		if _, err := fresh.groupMembers(client, "g1"); err != nil {
+			t.Fatalf("groupMembers: %v", err)
+		}
+	}
+	if got := env.graph.count("/v1.0/groups/g1/members"); got != 1 {
+		t.Fatalf("member requests with a fresh cache = %d, want 1", got)
+	}
+
+	env.graph.mu.Lock()
+	env.graph.members["g1"] = append(env.graph.members["g1"], entra.Member{ID: "u2", Mail: "bob@example.com"})
+	env.graph.mu.Unlock()
+	// The entry written above is older than a nanosecond TTL.
+	stale := env.syncer(Options{MemberCacheTTL: time.Nanosecond})
+	members, err := stale.groupMembers(client, "g1")
+	if err != nil {
+		t.Fatalf("groupMembers: %v", err)
+	}
+	if got := env.graph.count("/v1.0/groups/g1/members"); got != 2 || len(members) != 2 {
+		t.Fatalf("stale cache: %d member requests and %d members, want 2 and 2", got, len(members))
+	}
+	// The refetch refreshed the cache for the long TTL too.
+	members, err = fresh.groupMembers(client, "g1")
+	if err != nil || len(members) != 2 {
+		t.Fatalf("cached members after refresh = %v, %v", members, err)
+	}
+	if got := env.graph.count("/v1.0/groups/g1/members"); got != 2 {
+		t.Errorf("member requests = %d, want 2", got)
+	}
+}
+
+func TestMappingAllowRemoveMembersOverridesGlobal(t *testing.T) {
+	no, yes := false, true
+	for _, tc := range []struct {
+		name        string
+		global      bool
+		mapping     *bool
+		wantRemoved bool
+	}{
+		{name: "global on, mapping off", global: true, mapping: &no, wantRemoved: false},
+		{name: "global on, mapping unset", global: true, wantRemoved: true},
+		{name: "global off, mapping on", global: false, mapping: &yes, wantRemoved: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Team", SecurityEnabled: true})
+			env.grafana.addUser(1, "alice", "alice@example.com")
+			env.grafana.addOrgUser(1, grafana.OrgUser{ID: 1, Email: "alice@example.com", Login: "alice", Role: "Viewer"})
+			env.grafana.addTeam(1, 10, "Team")
+			env.grafana.addTeamMember(10, grafana.TeamMember{ID: 1, Email: "alice@example.com", Login: "alice"})
+			env.addMapping(t, store.Mapping{GrafanaTeamName: "Team", GrafanaTeamID: 10, ExternalGroupID: "g1", AllowRemoveMembers: tc.mapping})
+
+			plan, err := env.syncer(Options{AllowRemoveUsers: tc.global}).BuildPlan()
+			if err != nil {
+				t.Fatalf("BuildPlan: %v", err)
+			}
+			removed := len(actionsOfType(plan, "remove_user_from_team")) > 0
+			if removed != tc.wantRemoved {
+				t.Errorf("remove_user_from_team planned = %v, want %v; plan %+v", removed, tc.wantRemoved, plan.Actions)
+			}
+		})
+	}
+}
+
+func TestParseRoleRules(t *testing.T) {
+	rules, err := ParseRoleRules(`[{"regex":"_admin$","role":"admin"},{"regex":"^ops","role":"Editor"}]`)
+	if err != nil || len(rules) != 2 || rules[0].Role != "Admin" || rules[1].Role != "Editor" {
+		t.Fatalf("ParseRoleRules = %+v, %v", rules, err)
+	}
+	if rules, err := ParseRoleRules("  "); err != nil || rules != nil {
+		t.Errorf("blank rules = %+v, %v; want none", rules, err)
+	}
+	for _, bad := range []string{`{`, `[{"regex":"(","role":"Admin"}]`, `[{"regex":"x","role":"Owner"}]`} {
+		if _, err := ParseRoleRules(bad); err == nil {
+			t.Errorf("ParseRoleRules(%s) succeeded", bad)
+		}
+	}
+}
+
+func TestRoleRulesFirstOverlappingMatchWins(t *testing.T) {
+	rules, err := ParseRoleRules(`[{"regex":"_admin$","role":"Admin"},{"regex":"^ops","role":"Editor"},{"regex":".","role":"Viewer"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for group, want := range map[string]string{
+		"ops_admin": "Admin",
+		"ops_team":  "Editor",
+		"dev_admin": "Admin",
+		"dev_team":  "Viewer",
+		"":          "",
+	} {
+		env := newTestEnv(t)
+		env.graph.addGroup(entra.Group{ID: "g1", DisplayName: group}, entra.Member{ID: "u1", Mail: "alice@example.com"})
+		env.grafana.addUser(1, "alice", "alice@example.com")
+		env.grafana.addTeam(1, 10, "Team")
+		env.addMapping(t, store.Mapping{GrafanaTeamName: "Team", GrafanaTeamID: 10, ExternalGroupID: "g1", ExternalGroupName: group})
+		s := env.syncer(Options{RoleRules: rules})
+		rule, ok := s.matchRoleRule(group)
+		if rule.Role != want || ok != (want != "") {
+			t.Errorf("matchRoleRule(%q) = %s, %v; want %s", group, rule.Role, ok, want)
+		}
+		if want == "" {
+			continue
+		}
+		plan, err := s.BuildPlan()
+		if err != nil {
+			t.Fatalf("BuildPlan: %v", err)
+		}
+		adds := actionsOfType(plan, "add_user_to_org")
+		if len(adds) != 1 || adds[0].Role != want || !strings.Contains(adds[0].Note, "group name rule") {
+			t.Errorf("group %q: add_user_to_org = %+v, want role %s noted as a group name rule", group, adds, want)
+		}
+	}
+}
+
+// webhookRecorder collects the events posted to WEBHOOK_URL.
+func webhookRecorder(t *testing.T) (string, func(n int) []webhookEvent) {
+	t.Helper()
+	events := make(chan webhookEvent, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("decode webhook: %v", err)
+		}
+		events <- event
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, func(n int) []webhookEvent {
+		var got []webhookEvent
+		for len(got) < n {
+			select {
+			case event := <-events:
+				got = append(got, event)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("got %d webhook events, want %d", len(got), n)
+			}
+		}
+		select {
+		case event := <-events:
+			t.Fatalf("unexpected webhook event %+v", event)
+		case <-time.After(50 * time.Millisecond):
+		}
+		return got
+	}
+}
+
+func TestWebhookEvents(t *testing.T) {
+	env := newTestEnv(t)
+	env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Team"}, entra.Member{ID: "u1", Mail: "alice@example.com"})
+	env.grafana.addUser(1, "alice", "alice@example.com")
+	env.grafana.addOrgUser(1, grafana.OrgUser{ID: 1, Email: "alice@example.com", Login: "alice", Role: "Viewer"})
+	env.grafana.addTeam(1, 10, "Team")
+	env.addMapping(t, store.Mapping{GrafanaTeamName: "Team", GrafanaTeamID: 10, ExternalGroupID: "g1"})
+	url, wait := webhookRecorder(t)
+
+	quiet := env.syncer(Options{WebhookURL: url, PreviewAlertMinActions: 5})
+	if _, err := quiet.Preview(); err != nil {
+		t.Fatalf("Preview: %v", err)
+	}
+	wait(0)
+
+	s := env.syncer(Options{WebhookURL: url})
+	plan, err := s.Preview()
+	if err != nil {
+		t.Fatalf("Preview: %v", err)
+	}
+	if got := wait(1); got[0].Event != "preview_ready" || got[0].ActionCount != len(plan.Actions) {
+		t.Fatalf("preview event = %+v, want preview_ready with %d actions", got[0], len(plan.Actions))
+	}
+	if err := s.ApplyPlan(plan.Actions, nil); err != nil {
+		t.Fatalf("ApplyPlan: %v", err)
+	}
+	got := wait(1)
+	if got[0].Event != "plan_applied" || got[0].ActionCount != 1 || got[0].ActionCounts["add_user_to_team"] != 1 {
+		t.Fatalf("apply event = %+v, want plan_applied with one add_user_to_team", got[0])
+	}
+	if err := s.ApplyPlan(nil, nil); err != nil {
+		t.Fatalf("ApplyPlan(nil): %v", err)
+	}
+	wait(0)
+}
+
+func TestAllowedActionsFilterPlan(t *testing.T) {
+	env := newTestEnv(t)
+	env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Team", SecurityEnabled: true},
+		entra.Member{ID: "u1", Mail: "alice@example.com"},
+		entra.Member{ID: "u2", Mail: "bob@example.com"},
+	)
+	env.graph.addGroup(entra.Group{ID: "g2", DisplayName: "New", SecurityEnabled: true}, entra.Member{ID: "u1", Mail: "alice@example.com"})
+	env.grafana.addUser(1, "alice", "alice@example.com")
+	env.grafana.addOrgUser(1, grafana.OrgUser{ID: 1, Email: "alice@example.com", Login: "alice", Role: "Viewer"})
+	env.grafana.addTeam(1, 10, "Team")
+	env.addMapping(t, store.Mapping{GrafanaTeamName: "Team", GrafanaTeamID: 10, ExternalGroupID: "g1"})
+	env.addMapping(t, store.Mapping{GrafanaTeamName: "New", ExternalGroupID: "g2"})
+
+	all, err := env.syncer(Options{AllowCreateUsers: true}).BuildPlan()
+	if err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	for _, actionType := range []string{"create_user", "create_team", "add_user_to_team"} {
+		if len(actionsOfType(all, actionType)) == 0 {
+			t.Fatalf("unfiltered plan has no %s action: %+v", actionType, all.Actions)
+		}
+	}
+
+	allowed, err := ParseActionAllowlist(" add_user_to_team , ADD_USER_TO_ORG")
+	if err != nil {
+		t.Fatalf("ParseActionAllowlist: %v", err)
+	}
+	plan, err := env.syncer(Options{AllowCreateUsers: true, AllowedActions: allowed}).BuildPlan()
+	if err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	if len(plan.Actions) == 0 {
+		t.Fatal("filtered plan is empty, want the add_user_to_team actions")
+	}
+	for _, action := range plan.Actions {
+		if !allowed[action.ActionType] {
+			t.Errorf("filtered plan contains %s action %+v", action.ActionType, action)
+		}
+		if strings.HasPrefix(action.ActionType, "blocked_") {
+			t.Errorf("filtered plan contains %s instead of omitting the action", action.ActionType)
+		}
+	}
+}
+
+func TestParseActionAllowlist(t *testing.T) {
+	if allowed, err := ParseActionAllowlist(" , "); err != nil || len(allowed) != 0 {
+		t.Errorf("empty allowlist = %v, %v; want no entries", allowed, err)
+	}
+	if _, err := ParseActionAllowlist("add_user_to_team,grant_everything"); err == nil || !strings.Contains(err.Error(), "grant_everything") {
+		t.Errorf("unknown action type error = %v, want it to name grant_everything", err)
+	}
+}
+
+func TestReenableOnlyUsersDisabledBySync(t *testing.T) {
+	env := newTestEnv(t)
+	env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Team", SecurityEnabled: true},
+		entra.Member{ID: "u1", Mail: "alice@example.com"},
+		entra.Member{ID: "u2", Mail: "bob@example.com"},
+	)
+	env.grafana.addTeam(1, 10, "Team")
+	for _, user := range []grafana.OrgUser{
+		{ID: 1, Login: "alice", Email: "alice@example.com"},
+		{ID: 2, Login: "bob", Email: "bob@example.com"},
+		{ID: 3, Login: "carol", Email: "carol@example.com"},
+	} {
+		env.grafana.addUser(user.ID, user.Login, user.Email)
+		user.Role = "Viewer"
+		env.grafana.addOrgUser(1, user)
+		env.grafana.addTeamMember(10, grafana.TeamMember{ID: user.ID, Login: user.Login, Email: user.Email})
+	}
+	// An administrator disabled alice; the syncer disabled bob.
+	env.grafana.setDisabled(1, true)
+	env.grafana.setDisabled(2, true)
+	if err := env.store.RecordDisabledUser(2, "bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	env.addMapping(t, store.Mapping{GrafanaTeamName: "Team", GrafanaTeamID: 10, ExternalGroupID: "g1"})
+	s := env.syncer(Options{DeactivateRemovedUsers: true, AllowRemoveUsers: true})
+
+	plan, err := s.BuildPlan()
+	if err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	emails := func(actionType string) []string {
+		var out []string
+		for _, action := range actionsOfType(plan, actionType) {
+			out = append(out, action.Email)
+		}
+		return out
+	}
+	if got := emails("enable_user"); len(got) != 1 || got[0] != "bob@example.com" {
+		t.Fatalf("enable_user for %v, want only bob", got)
+	}
+	if got := emails("disable_user"); len(got) != 1 || got[0] != "carol@example.com" {
+		t.Fatalf("disable_user for %v, want only carol", got)
+	}
+	if err := s.ApplyPlan(plan.Actions, nil); err != nil {
+		t.Fatalf("ApplyPlan: %v", err)
+	}
+	disabled, err := env.store.ListDisabledUserIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(disabled) != 1 || !disabled[3] {
+		t.Fatalf("users disabled by sync = %v, want only carol (3)", disabled)
+	}
+
+	// Carol comes back and is re-enabled; alice still is not.
+	env.graph.mu.Lock()
+	env.graph.members["g1"] = append(env.graph.members["g1"], entra.Member{ID: "u3", Mail: "carol@example.com"})
+	env.graph.mu.Unlock()
+	if plan, err = s.BuildPlan(); err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	if got := emails("enable_user"); len(got) != 1 || got[0] != "carol@example.com" {
+		t.Fatalf("enable_user for %v, want only carol", got)
+	}
+}
+
+func TestTeamDescriptionSyncKeepsEmail(t *testing.T) {
+	env := newTestEnv(t)
+	env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Ops", Description: "Operations", SecurityEnabled: true})
+	env.grafana.addTeam(1, 10, "Ops").Email = "ops@example.com"
+	env.addMapping(t, store.Mapping{GrafanaTeamName: "Ops", GrafanaTeamID: 10, ExternalGroupID: "g1"})
+	s := env.syncer(Options{})
+
+	plan, err := s.BuildPlan()
+	if err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	if got := actionsOfType(plan, "update_team_description"); len(got) != 1 || got[0].Description != "Operations" {
+		t.Fatalf("update_team_description actions = %+v, want one with Operations", got)
+	}
+	if err := s.ApplyPlan(plan.Actions, nil); err != nil {
+		t.Fatalf("ApplyPlan: %v", err)
+	}
+	if team := env.grafana.team(10); team.Name != "Ops" || team.Email != "ops@example.com" {
+		t.Fatalf("team after description update = %+v, want name and email kept", team)
+	}
+
+	// Grafana does not return descriptions; the synced one is compared.
+	if plan, err = s.BuildPlan(); err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	if got := actionsOfType(plan, "update_team_description"); len(got) != 0 {
+		t.Fatalf("update_team_description planned again after sync: %+v", got)
+	}
+	env.graph.mu.Lock()
+	env.graph.groups[0].Description = "Operations and on-call"
+	env.graph.mu.Unlock()
+	if plan, err = s.BuildPlan(); err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	if got := actionsOfType(plan, "update_team_description"); len(got) != 1 || got[0].Description != "Operations and on-call" {
+		t.Fatalf("update_team_description after change = %+v", got)
+	}
+}
+
+func TestProtectedUserBlockedOnlyWhenChangeSuppressed(t *testing.T) {
+	env := newTestEnv(t)
+	env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Viewers", SecurityEnabled: true}, entra.Member{ID: "u1", Mail: "admin@example.com"})
+	env.graph.addGroup(entra.Group{ID: "g2", DisplayName: "Editors", SecurityEnabled: true}, entra.Member{ID: "u1", Mail: "admin@example.com"})
+	env.grafana.addUser(1, "admin", "admin@example.com")
+	env.grafana.addTeam(1, 10, "Viewers")
+	env.grafana.addTeam(1, 11, "Editors")
+	env.addMapping(t, store.Mapping{GrafanaTeamName: "Viewers", GrafanaTeamID: 10, ExternalGroupID: "g1"})
+	// The default protected logins come from the config.
+	s := env.syncer(Options{ProtectedLogins: config.Load().GrafanaProtectedLogins})
+
+	blocked := func() []store.PlanAction {
+		t.Helper()
+		plan, err := s.BuildPlan()
+		if err != nil {
+			t.Fatalf("BuildPlan: %v", err)
+		}
+		if got := actionsOfType(plan, "add_user_to_org"); len(got) != 0 {
+			t.Fatalf("add_user_to_org planned for protected admin: %+v", got)
+		}
+		if got := actionsOfType(plan, "update_user_role"); len(got) != 0 {
+			t.Fatalf("update_user_role planned for protected admin: %+v", got)
+		}
+		return actionsOfType(plan, "blocked_protected_user")
+	}
+
+	if got := blocked(); len(got) != 1 || !strings.Contains(got[0].Note, "add_user_to_org") {
+		t.Fatalf("blocked_protected_user for a missing org member = %+v, want one for add_user_to_org", got)
+	}
+
+	env.grafana.addOrgUser(1, grafana.OrgUser{ID: 1, Login: "admin", Email: "admin@example.com", Role: "Viewer"})
+	if got := blocked(); len(got) != 0 {
+		t.Fatalf("blocked_protected_user without a suppressed change: %+v", got)
+	}
+
+	env.addMapping(t, store.Mapping{GrafanaTeamName: "Editors", GrafanaTeamID: 11, ExternalGroupID: "g2", RoleOverride: "Editor"})
+	if got := blocked(); len(got) != 1 || !strings.Contains(got[0].Note, "update_user_role") {
+		t.Fatalf("blocked_protected_user for a role change = %+v, want one for update_user_role", got)
+	}
+}
+
+func TestTeamFolderRecordedOnlyAfterRestrict(t *testing.T) {
+	for _, failPermissions := range []bool{true, false} {
+		t.Run(fmt.Sprintf("fail=%v", failPermissions), func(t *testing.T) {
+			env := newTestEnv(t)
+			env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Ops", SecurityEnabled: true})
+			mappingID := env.addMapping(t, store.Mapping{GrafanaTeamName: "Ops", ExternalGroupID: "g1"})
+			env.grafana.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				if failPermissions && r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/permissions") {
+					http.Error(w, `{"message":"forbidden"}`, http.StatusForbidden)
+					return true
+				}
+				return false
+			}
+			s := env.syncer(Options{TeamFolderAutoCreate: true})
+
+			plan, err := s.BuildPlan()
+			if err != nil {
+				t.Fatalf("BuildPlan: %v", err)
+			}
+			if got := actionsOfType(plan, "create_team_folder"); len(got) != 1 {
+				t.Fatalf("create_team_folder actions = %+v, want one", plan.Actions)
+			}
+			if err := s.ApplyPlan(plan.Actions, nil); (err != nil) != failPermissions {
+				t.Fatalf("ApplyPlan error = %v, want error %v", err, failPermissions)
+			}
+			uid, err := env.store.GetTeamFolder(mappingID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if recorded := uid != ""; recorded == failPermissions {
+				t.Fatalf("team folder recorded = %v (%q) with failing permissions %v", recorded, uid, failPermissions)
+			}
+		})
+	}
+}
+
+func TestReusedTeamFolderKeepsForeignPermissions(t *testing.T) {
+	for _, recorded := range []bool{false, true} {
+		t.Run(fmt.Sprintf("recorded=%v", recorded), func(t *testing.T) {
+			env := newTestEnv(t)
+			env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Ops", SecurityEnabled: true})
+			mappingID := env.addMapping(t, store.Mapping{GrafanaTeamName: "Ops", ExternalGroupID: "g1"})
+			env.grafana.folders[1] = []grafana.Folder{{UID: "ops-folder", Title: "Ops"}}
+			env.grafana.folderPerms["ops-folder"] = []map[string]any{{"role": "Editor", "permission": 2}}
+			if recorded {
+				if err := env.store.SetTeamFolder(mappingID+100, "ops-folder"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s := env.syncer(Options{TeamFolderAutoCreate: true})
+
+			plan, err := s.BuildPlan()
+			if err != nil {
+				t.Fatalf("BuildPlan: %v", err)
+			}
+			if err := s.ApplyPlan(plan.Actions, nil); err != nil {
+				t.Fatalf("ApplyPlan: %v", err)
+			}
+			items := env.grafana.folderPerms["ops-folder"]
+			keptRole := false
+			for _, item := range items {
+				if item["role"] == "Editor" {
+					keptRole = true
+				}
+			}
+			if keptRole == recorded {
+				t.Fatalf("folder permissions = %+v, Editor role kept %v with recorded folder %v", items, keptRole, recorded)
+			}
+			if last := items[len(items)-1]; last["teamId"] == nil {
+				t.Fatalf("folder permissions = %+v, want the team granted", items)
+			}
+			if uid, err := env.store.GetTeamFolder(mappingID); err != nil || uid != "ops-folder" {
+				t.Fatalf("team folder = %q, %v, want ops-folder", uid, err)
+			}
+			if got := len(env.grafana.folders[1]); got != 1 {
+				t.Fatalf("folders = %d, want the existing one reused", got)
+			}
+		})
+	}
+}
+
+func TestParseActionOrder(t *testing.T) {
+	if len(DefaultActionOrder) != len(ActionTypes) {
+		t.Fatalf("DefaultActionOrder has %d types, ActionTypes %d", len(DefaultActionOrder), len(ActionTypes))
+	}
+	// actionOrderJSON returns DefaultActionOrder with overrides applied and
+	// the types in drop left out, as ACTION_ORDER JSON.
+	actionOrderJSON := func(overrides map[string]int, drop ...string) string {
+		order := map[string]int{}
+		for actionType, priority := range DefaultActionOrder {
+			order[actionType] = priority
+		}
+		for actionType, priority := range overrides {
+			order[actionType] = priority
+		}
+		for _, actionType := range drop {
+			delete(order, actionType)
+		}
+		data, err := json.Marshal(order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	for _, tc := range []struct {
+		name    string
+		text    string
+		wantErr string
+	}{
+		{name: "missing type", text: actionOrderJSON(nil, "disable_user"), wantErr: "missing action types: disable_user"},
+		{name: "only overrides", text: `{"remove_user_from_team":0}`, wantErr: "missing action types"},
+		{name: "unknown type", text: actionOrderJSON(map[string]int{"grant_everything": 1}), wantErr: `unknown action type "grant_everything"`},
+		{name: "not an object", text: `[1,2]`, wantErr: "invalid JSON"},
+		{name: "not a number", text: `{"create_team":"first"}`, wantErr: "invalid JSON"},
+	} {
+		if _, err := ParseActionOrder(tc.text); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: ParseActionOrder error = %v, want %q", tc.name, err, tc.wantErr)
+		}
+	}
+
+	order, err := ParseActionOrder(actionOrderJSON(map[string]int{"remove_user_from_team": 0, "add_user_to_org": 1}))
+	if err != nil {
+		t.Fatalf("ParseActionOrder: %v", err)
+	}
+	if len(order) != len(ActionTypes) || order["remove_user_from_team"] != 0 || order["add_user_to_org"] != 1 {
+		t.Errorf("order = %v, want the defaults with the two overrides", order)
+	}
+
+	actions := []store.PlanAction{
+		{ActionType: "add_user_to_team", Email: "a"},
+		{ActionType: "create_team", TeamName: "t"},
+		{ActionType: "remove_user_from_team", Email: "b"},
+		{ActionType: "add_user_to_org", Email: "c"},
+	}
+	sortActions(actions, order)
+	var got []string
+	for _, action := range actions {
+		got = append(got, action.ActionType)
+	}
+	if want := "remove_user_from_team,create_team,add_user_to_org,add_user_to_team"; strings.Join(got, ",") != want {
+		t.Errorf("sorted actions = %s, want %s", strings.Join(got, ","), want)
+	}
+}
+
+func TestBuildPlanLoadsOnlyMappedOrgs(t *testing.T) {
+	env := newTestEnv(t)
+	if _, err := env.store.CreateOrg(store.Org{GrafanaOrgID: 2, Name: "Unmapped", DefaultRole: "Viewer"}); err != nil {
+		t.Fatal(err)
+	}
+	env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Ops"})
+	env.addMapping(t, store.Mapping{GrafanaTeamName: "Ops", ExternalGroupID: "g1"})
+	missing := env.addMapping(t, store.Mapping{OrgID: env.orgID + 100, GrafanaTeamName: "Ghost", ExternalGroupID: "g1"})
+
+	plan, err := env.syncer(Options{}).BuildPlan()
+	if err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	for _, action := range plan.Actions {
+		if action.MappingID == missing || action.TeamName == "Ghost" {
+			t.Errorf("planned %+v for a mapping whose org does not exist", action)
+		}
+	}
+	if got := actionsOfType(plan, "create_team"); len(got) != 1 || got[0].TeamName != "Ops" {
+		t.Errorf("create_team actions = %+v, want one for Ops", got)
+	}
+	if got := env.grafana.count("GET", "/api/orgs/2/users"); got != 0 {
+		t.Errorf("users of the unmapped org listed %d times, want 0", got)
+	}
+}
+
+func TestRotateServiceAccountToken(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		encryptionKey string
+		wantErr       bool
+	}{
+		{name: "rotates", encryptionKey: "test-key"},
+		{name: "no encryption key", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.store.SetEncryptionKey(tc.encryptionKey)
+			var order []string
+			env.grafana.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				if !strings.HasPrefix(r.URL.Path, "/api/serviceaccounts/7/tokens") {
+					return false
+				}
+				order = append(order, r.Method+" "+r.URL.Path)
+				if r.Method == http.MethodPost {
+					writeFakeJSON(w, grafana.SAToken{ID: 71, Name: "rotated", Key: "glsa_rotated"})
+					return true
+				}
+				writeFakeJSON(w, map[string]string{"message": "deleted"})
+				return true
+			}
+			env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Team"})
+			env.grafana.addTeam(1, 10, "Team")
+			mappingID := env.addMapping(t, store.Mapping{GrafanaTeamName: "Team", GrafanaTeamID: 10, ExternalGroupID: "g1"})
+			if err := env.store.SetServiceAccountToken(store.ServiceAccountToken{MappingID: mappingID, SAID: 7, TokenID: 70, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+			// A token far from expiry is not rotated.
+			if err := env.store.SetServiceAccountToken(store.ServiceAccountToken{MappingID: mappingID, SAID: 8, TokenID: 80, ExpiresAt: time.Now().Add(30 * 24 * time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+
+			s := env.syncer(Options{SATokenRotationWindow: 48 * time.Hour, SATokenTTL: 720 * time.Hour})
+			plan, err := s.BuildPlan()
+			if err != nil {
+				t.Fatalf("BuildPlan: %v", err)
+			}
+			rotations := actionsOfType(plan, "rotate_service_account_token")
+			if len(rotations) != 1 || rotations[0].UserID != 7 || rotations[0].MappingID != mappingID {
+				t.Fatalf("rotations = %+v, want one for service account 7", rotations)
+			}
+			err = s.ApplyPlan(rotations, nil)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ApplyPlan error = %v, want error %v", err, tc.wantErr)
+			}
+			token, err := env.store.GetServiceAccountToken(mappingID, 7)
+			if err != nil || token == nil {
+				t.Fatalf("tracked token = %v, %v", token, err)
+			}
+			if tc.wantErr {
+				if len(order) != 0 || token.TokenID != 70 {
+					t.Fatalf("Grafana calls = %v, token = %+v; want no calls and the old token", order, token)
+				}
+				return
+			}
+			want := []string{"POST /api/serviceaccounts/7/tokens", "DELETE /api/serviceaccounts/7/tokens/70"}
+			if strings.Join(order, ",") != strings.Join(want, ",") {
+				t.Fatalf("Grafana calls = %v, want %v", order, want)
+			}
+			if token.TokenID != 71 || token.Key != "glsa_rotated" || time.Until(token.ExpiresAt) < 700*time.Hour {
+				t.Fatalf("tracked token = %+v, want token 71 with its key, expiring in 720h", token)
+			}
+		})
+	}
+}
+
+func TestRoleDowngradeOnlyWhenAllowed(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		allow         bool
+		wantDowngrade bool
+	}{
+		{name: "allowed", allow: true, wantDowngrade: true},
+		{name: "not allowed", allow: false, wantDowngrade: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			// Alice left the Editor group and is only in the Viewer group; Bob
+			// is in the Editor group but still a Viewer in Grafana.
+			env.graph.addGroup(entra.Group{ID: "editors", DisplayName: "Editors"}, entra.Member{ID: "u2", Mail: "bob@example.com"})
+			env.graph.addGroup(entra.Group{ID: "viewers", DisplayName: "Viewers"}, entra.Member{ID: "u1", Mail: "alice@example.com"})
+			env.grafana.addUser(1, "alice", "alice@example.com")
+			env.grafana.addUser(2, "bob", "bob@example.com")
+			env.grafana.addOrgUser(1, grafana.OrgUser{ID: 1, Email: "alice@example.com", Login: "alice", Role: "Editor"})
+			env.grafana.addOrgUser(1, grafana.OrgUser{ID: 2, Email: "bob@example.com", Login: "bob", Role: "Viewer"})
+			env.addMapping(t, store.Mapping{GrafanaTeamName: "Editors", ExternalGroupID: "editors", RoleOverride: "Editor"})
+			env.addMapping(t, store.Mapping{GrafanaTeamName: "Viewers", ExternalGroupID: "viewers", RoleOverride: "Viewer"})
+
+			plan, err := env.syncer(Options{AllowRoleDowngrade: tc.allow}).BuildPlan()
+			if err != nil {
+				t.Fatalf("BuildPlan: %v", err)
+			}
+			roles := map[string]string{}
+			for _, action := range actionsOfType(plan, "update_user_role") {
+				roles[action.Email] = action.Role
+			}
+			if roles["bob@example.com"] != "Editor" {
+				t.Errorf("bob's role change = %q, want the raise to Editor", roles["bob@example.com"])
+			}
+			role, downgraded := roles["alice@example.com"]
+			if downgraded != tc.wantDowngrade || (downgraded && role != "Viewer") {
+				t.Errorf("alice's role change = %q (planned %v), want downgrade to Viewer planned %v", role, downgraded, tc.wantDowngrade)
+			}
+		})
+	}
+}
+
+func TestBuildPlanDoesNotImportGrafanaOrgs(t *testing.T) {
+	env := newTestEnv(t)
+	env.grafana.orgs = []grafana.Org{{ID: 1, Name: "Main"}, {ID: 2, Name: "Ops"}}
+	missing, err := env.store.CreateOrg(store.Org{GrafanaOrgID: 7, Name: "Gone", DefaultRole: "Viewer"})
+	if err != nil {
+		t.Fatalf("create org: %v", err)
+	}
+	env.addMapping(t, store.Mapping{OrgID: missing, GrafanaTeamName: "Team", ExternalGroupID: "g1"})
+	s := env.syncer(Options{AutoCreateOrgs: true})
+
+	plan, err := s.BuildPlan()
+	if err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	if org, err := env.store.GetOrgByGrafanaID(2); err != nil || org != nil {
+		t.Fatalf("BuildPlan imported grafana org 2: %+v, %v", org, err)
+	}
+	creates := actionsOfType(plan, "create_grafana_org")
+	if len(creates) != 1 || creates[0].GrafanaOrgID != 7 {
+		t.Errorf("create_grafana_org actions = %+v, want one for grafana org 7", creates)
+	}
+
+	if err := s.ImportGrafanaOrgs(); err != nil {
+		t.Fatalf("ImportGrafanaOrgs: %v", err)
+	}
+	org, err := env.store.GetOrgByGrafanaID(2)
+	if err != nil || org == nil {
+		t.Fatalf("grafana org 2 not imported: %+v, %v", org, err)
+	}
+	if org.Name != "Ops" || org.DefaultRole != "Viewer" {
+		t.Errorf("imported org = %+v, want Ops with role Viewer", org)
+	}
+	if err := s.ImportGrafanaOrgs(); err != nil {
+		t.Fatalf("second ImportGrafanaOrgs: %v", err)
+	}
+	orgs, err := env.store.ListOrgs()
+	if err != nil {
+		t.Fatalf("list orgs: %v", err)
+	}
+	if len(orgs) != 3 {
+		t.Errorf("stored orgs = %d, want 3 after importing twice", len(orgs))
+	}
+}
+
+func TestPreviewImportsGrafanaOrgs(t *testing.T) {
+	env := newTestEnv(t)
+	env.grafana.orgs = []grafana.Org{{ID: 1, Name: "Main"}, {ID: 2, Name: "Ops"}}
+	if _, err := env.syncer(Options{AutoCreateOrgs: true}).Preview(); err != nil {
+		t.Fatalf("Preview: %v", err)
+	}
+	if org, err := env.store.GetOrgByGrafanaID(2); err != nil || org == nil || org.Name != "Ops" {
+		t.Fatalf("grafana org 2 after Preview = %+v, %v; want it imported", org, err)
+	}
+}
+
+func TestImportGrafanaOrgsNeedsAutoCreate(t *testing.T) {
+	env := newTestEnv(t)
+	env.grafana.orgs = []grafana.Org{{ID: 2, Name: "Ops"}}
+	if err := env.syncer(Options{}).ImportGrafanaOrgs(); err != nil {
+		t.Fatalf("ImportGrafanaOrgs: %v", err)
+	}
+	if got := env.grafana.count("GET", "/api/orgs"); got != 0 {
+		t.Errorf("grafana orgs listed %d times without AutoCreateOrgs, want 0", got)
+	}
+}
+
+func TestDryRunPlanLeavesStore(t *testing.T) {
+	env := newTestEnv(t)
+	env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Team"}, entra.Member{ID: "u1", Mail: "alice@example.com"})
+	env.grafana.addUser(1, "alice", "alice@example.com")
+	env.grafana.addUser(2, "bob", "bob@example.com")
+	env.grafana.addTeam(1, 10, "Team")
+	env.grafana.addTeamMember(10, grafana.TeamMember{ID: 1, Login: "alice", Email: "alice@example.com"})
+	env.grafana.addTeamMember(10, grafana.TeamMember{ID: 2, Login: "bob", Email: "bob@example.com"})
+	allow := true
+	id := env.addMapping(t, store.Mapping{GrafanaTeamName: "Old", ExternalGroupID: "g1", AllowRemoveMembers: &allow})
+	mapping, err := env.store.GetMapping(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Renamed to an existing team: BuildPlan would forget "Old".
+	mapping.GrafanaTeamName = "Team"
+	if err := env.store.UpdateMapping(*mapping); err != nil {
+		t.Fatal(err)
+	}
+	s := env.syncer(Options{RemovalGracePeriod: time.Hour, MemberCacheTTL: time.Hour})
+
+	plan, err := s.DryRunPlan(context.Background())
+	if err != nil {
+		t.Fatalf("DryRunPlan: %v", err)
+	}
+	if removals := actionsOfType(plan, "remove_user_from_team"); len(removals) != 0 {
+		t.Errorf("remove_user_from_team within the grace period: %+v", removals)
+	}
+	if pending, err := env.store.ListPendingRemovals(); err != nil || len(pending) != 0 {
+		t.Errorf("pending removals after dry run = %+v, %v; want none", pending, err)
+	}
+	if _, cachedAt, err := env.store.GetGroupMemberCache("g1"); err != nil || !cachedAt.IsZero() {
+		t.Errorf("member cache after dry run written at %v, %v; want no entry", cachedAt, err)
+	}
+	if mapping, err = env.store.GetMapping(id); err != nil || mapping.PreviousGrafanaTeamName != "Old" {
+		t.Errorf("previous team name after dry run = %+v, %v; want Old", mapping, err)
+	}
+
+	if _, err := s.BuildPlan(); err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	if pending, err := env.store.ListPendingRemovals(); err != nil || len(pending) != 1 {
+		t.Errorf("pending removals after BuildPlan = %+v, %v; want bob", pending, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.buildPlan(ctx, false); !errors.Is(err, context.Canceled) {
+		t.Errorf("buildPlan with a cancelled context error = %v, want context.Canceled", err)
+	}
+}
+
+func TestRenameTeamForgetsStalePreviousName(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		teams        []string
+		wantRename   bool
+		wantPrevious string
+	}{
+		{name: "old team exists", teams: []string{"Old"}, wantRename: true, wantPrevious: "Old"},
+		{name: "old team not found", wantPrevious: ""},
+		{name: "new name exists", teams: []string{"Old", "New"}, wantPrevious: ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Group"})
+			for i, name := range tc.teams {
+				env.grafana.addTeam(1, int64(10+i), name)
+			}
+			id := env.addMapping(t, store.Mapping{GrafanaTeamName: "Old", ExternalGroupID: "g1"})
+			mapping, err := env.store.GetMapping(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mapping.GrafanaTeamName = "New"
+			if err := env.store.UpdateMapping(*mapping); err != nil {
+				t.Fatal(err)
+			}
+
+			plan, err := env.syncer(Options{}).BuildPlan()
+			if err != nil {
+				t.Fatalf("BuildPlan: %v", err)
+			}
+			if renames := actionsOfType(plan, "rename_team"); (len(renames) == 1) != tc.wantRename {
+				t.Errorf("rename_team actions = %+v, want rename %v", renames, tc.wantRename)
+			}
+			if mapping, err = env.store.GetMapping(id); err != nil {
+				t.Fatal(err)
+			}
+			if mapping.PreviousGrafanaTeamName != tc.wantPrevious {
+				t.Errorf("previous team name = %q, want %q", mapping.PreviousGrafanaTeamName, tc.wantPrevious)
+			}
+		})
+	}
+}
+
+func TestProfileAction(t *testing.T) {
+	tmpl, err := ParseDisplayNameTemplate("{{.GivenName}} {{.Surname}} ({{.Department}})")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &grafana.User{ID: 7, Login: "alice", Email: "alice@example.com", Name: "Alice Smith"}
+	for _, tc := range []struct {
+		name     string
+		tmpl     *template.Template
+		member   entra.Member
+		email    string
+		wantName string
+		wantOK   bool
+	}{
+		{name: "unchanged", member: entra.Member{DisplayName: "Alice Smith"}, email: "alice@example.com"},
+		{name: "email differs only in case", member: entra.Member{DisplayName: "Alice Smith"}, email: "Alice@Example.com"},
+		{name: "no entra name", member: entra.Member{}, email: "alice@example.com"},
+		{name: "name changed", member: entra.Member{DisplayName: "Alice Jones"}, email: "alice@example.com", wantName: "Alice Jones", wantOK: true},
+		{name: "email changed", member: entra.Member{DisplayName: "Alice Smith"}, email: "alice.smith@example.com", wantName: "Alice Smith", wantOK: true},
+		{name: "template", tmpl: tmpl, member: entra.Member{DisplayName: "Alice Smith", GivenName: "Alice", Surname: "Smith", Department: "Ops"}, email: "alice@example.com", wantName: "Alice Smith (Ops)", wantOK: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			action, ok := env.syncer(Options{DisplayNameTemplate: tc.tmpl}).profileAction(user, tc.member, tc.email)
+			if ok != tc.wantOK {
+				t.Fatalf("profileAction planned %v (%+v), want %v", ok, action, tc.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if action.ActionType != "update_user_profile" || action.UserID != user.ID || action.Login != user.Login {
+				t.Errorf("action = %+v, want update_user_profile of user 7", action)
+			}
+			if action.DisplayName != tc.wantName || action.Email != tc.email {
+				t.Errorf("profile = %q <%s>, want %q <%s>", action.DisplayName, action.Email, tc.wantName, tc.email)
+			}
+		})
+	}
+}
+
+func TestParseTeamLabel(t *testing.T) {
+	for _, tc := range []struct {
+		raw       string
+		wantKey   string
+		wantValue string
+		wantErr   bool
+	}{
+		{raw: ""},
+		{raw: "  "},
+		{raw: "managed-by=grafana-ad-syncher", wantKey: "managed-by", wantValue: "grafana-ad-syncher"},
+		{raw: " owner = platform ", wantKey: "owner", wantValue: "platform"},
+		{raw: "managed=", wantKey: "managed"},
+		{raw: "a=b=c", wantKey: "a", wantValue: "b=c"},
+		{raw: "managed", wantErr: true},
+		{raw: "=value", wantErr: true},
+		{raw: EntraGroupLabel + "=g1", wantErr: true},
+	} {
+		key, value, err := ParseTeamLabel(tc.raw)
+		if (err != nil) != tc.wantErr || key != tc.wantKey || value != tc.wantValue {
+			t.Errorf("ParseTeamLabel(%q) = %q, %q, %v; want %q, %q, error %v", tc.raw, key, value, err, tc.wantKey, tc.wantValue, tc.wantErr)
+		}
+	}
+}
+
+func TestDeletedTeamLabelsForgotten(t *testing.T) {
+	env := newTestEnv(t)
+	env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Group"})
+	env.addMapping(t, store.Mapping{GrafanaTeamName: "Ops", GrafanaTeamID: 42, ExternalGroupID: "g1"})
+	if err := env.store.SetTeamLabels(1, 42, map[string]string{EntraGroupLabel: "g1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := env.syncer(Options{VerifyTeamIDs: true}).BuildPlan(); err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	labels, err := env.store.TeamLabels(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labels) != 0 {
+		t.Errorf("labels of deleted team 42 = %v, want none", labels)
+	}
+}
+
+func TestTeamSyncCompatSkipsOrgMembers(t *testing.T) {
+	for _, compat := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compat=%v", compat), func(t *testing.T) {
+			env := newTestEnv(t)
+			env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Team"},
+				entra.Member{ID: "u1", Mail: "alice@example.com"},
+				entra.Member{ID: "u2", Mail: "bob@example.com"},
+			)
+			env.grafana.addUser(1, "alice", "alice@example.com")
+			env.grafana.addUser(2, "bob", "bob@example.com")
+			env.grafana.addOrgUser(1, grafana.OrgUser{ID: 1, Email: "alice@example.com", Login: "alice", Role: "Viewer"})
+			env.grafana.addTeam(1, 10, "Team")
+			env.addMapping(t, store.Mapping{GrafanaTeamName: "Team", ExternalGroupID: "g1"})
+
+			plan, err := env.syncer(Options{TeamSyncCompat: compat}).BuildPlan()
+			if err != nil {
+				t.Fatalf("BuildPlan: %v", err)
+			}
+			added := map[string]bool{}
+			for _, action := range actionsOfType(plan, "add_user_to_team") {
+				added[action.Email] = true
+			}
+			if added["alice@example.com"] == compat {
+				t.Errorf("add_user_to_team for org member alice planned %v, want %v", added["alice@example.com"], !compat)
+			}
+			if !added["bob@example.com"] {
+				t.Error("add_user_to_team for bob, not yet in the org, missing")
+			}
+			if orgAdds := actionsOfType(plan, "add_user_to_org"); len(orgAdds) != 1 || orgAdds[0].Email != "bob@example.com" {
+				t.Errorf("add_user_to_org = %+v, want bob only", orgAdds)
+			}
+		})
+	}
+}
+
+func TestRuntimeSettingsOverrideOptions(t *testing.T) {
+	env := newTestEnv(t)
+	if err := env.store.UpdateOrgDefaultRole(env.orgID, ""); err != nil {
+		t.Fatal(err)
+	}
+	env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Team"}, entra.Member{ID: "u1", Mail: "new@example.com"})
+	env.grafana.addTeam(1, 10, "Team")
+	env.addMapping(t, store.Mapping{GrafanaTeamName: "Team", ExternalGroupID: "g1"})
+	s := env.syncer(Options{AllowCreateUsers: false, AllowRemoveUsers: true, DefaultUserRole: "Viewer"})
+
+	if got := s.RuntimeSettings(); got != (RuntimeSettings{AllowCreateUsers: false, AllowRemoveMembers: true, DefaultUserRole: "Viewer"}) {
+		t.Fatalf("RuntimeSettings before saving = %+v, want the options", got)
+	}
+	plan, err := s.BuildPlan()
+	if err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	if len(actionsOfType(plan, "create_user")) != 0 || len(actionsOfType(plan, "blocked_create_user")) != 1 {
+		t.Fatalf("actions = %+v, want the user creation blocked", plan.Actions)
+	}
+
+	want := RuntimeSettings{AllowCreateUsers: true, AllowRemoveMembers: false, DefaultUserRole: "Editor"}
+	if err := s.SetRuntimeSettings(want); err != nil {
+		t.Fatalf("SetRuntimeSettings: %v", err)
+	}
+	if got := s.RuntimeSettings(); got != want {
+		t.Fatalf("RuntimeSettings = %+v, want %+v", got, want)
+	}
+	if plan, err = s.BuildPlan(); err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	creates := actionsOfType(plan, "create_user")
+	if len(creates) != 1 || creates[0].Email != "new@example.com" {
+		t.Errorf("create_user actions = %+v, want new@example.com", creates)
+	}
+	if orgAdds := actionsOfType(plan, "add_user_to_org"); len(orgAdds) != 1 || orgAdds[0].Role != "Editor" {
+		t.Errorf("add_user_to_org actions = %+v, want the stored default role Editor", orgAdds)
+	}
+
+	if err := s.SetRuntimeSettings(RuntimeSettings{DefaultUserRole: "editor"}); err == nil {
+		t.Error("SetRuntimeSettings accepted a non-canonical role")
+	}
+	if err := env.store.SetSetting(allowCreateUsersSettingKey, "maybe"); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.RuntimeSettings(); got.AllowCreateUsers {
+		t.Error("an unparsable stored value did not fall back to the option")
+	}
+}
+
+func TestSAMLTeamSyncAnnotatesRemovals(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		saml     map[string]string
+		conflict bool
+	}{
+		{name: "saml off", saml: map[string]string{"enabled": "false", "group_sync": "true"}},
+		{name: "saml without group sync", saml: map[string]string{"enabled": "true"}},
+		{name: "saml group sync", saml: map[string]string{"enabled": "true", "group_sync": "true"}, conflict: true},
+		{name: "saml group attribute", saml: map[string]string{"enabled": "true", "assertion_attribute_groups": "groups"}, conflict: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.grafana.settings["auth.saml"] = tc.saml
+			env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Team"})
+			env.grafana.addUser(1, "alice", "alice@example.com")
+			env.grafana.addTeam(1, 10, "Team")
+			env.grafana.addTeamMember(10, grafana.TeamMember{ID: 1, Login: "alice", Email: "alice@example.com"})
+			env.addMapping(t, store.Mapping{GrafanaTeamName: "Team", ExternalGroupID: "g1"})
+
+			plan, err := env.syncer(Options{AllowRemoveUsers: true}).BuildPlan()
+			if err != nil {
+				t.Fatalf("BuildPlan: %v", err)
+			}
+			removals := actionsOfType(plan, "remove_user_from_team")
+			if len(removals) != 1 {
+				t.Fatalf("remove_user_from_team actions = %+v, want one", removals)
+			}
+			if plan.SAMLConflict != tc.conflict || (len(plan.Warnings) > 0) != tc.conflict {
+				t.Errorf("SAMLConflict = %v with warnings %q, want %v", plan.SAMLConflict, plan.Warnings, tc.conflict)
+			}
+			if strings.Contains(removals[0].Note, samlRemovalNote) != tc.conflict {
+				t.Errorf("removal note = %q, want SAML note %v", removals[0].Note, tc.conflict)
+			}
+		})
+	}
+}
+
+func TestSkipDisabledUsers(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skip=%v", skip), func(t *testing.T) {
+			env := newTestEnv(t)
+			env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Team"},
+				entra.Member{ID: "u1", Mail: "alice@example.com"},
+				entra.Member{ID: "u2", Mail: "bob@example.com"},
+			)
+			env.grafana.addUser(1, "alice", "alice@example.com")
+			env.grafana.addUser(2, "bob", "bob@example.com")
+			env.grafana.addOrgUser(1, grafana.OrgUser{ID: 1, Email: "alice@example.com", Login: "alice", Role: "Viewer"})
+			env.grafana.addOrgUser(1, grafana.OrgUser{ID: 2, Email: "bob@example.com", Login: "bob", Role: "Viewer"})
+			env.grafana.setDisabled(1, true)
+			env.grafana.addTeam(1, 10, "Team")
+			env.addMapping(t, store.Mapping{GrafanaTeamName: "Team", ExternalGroupID: "g1"})
+
+			plan, err := env.syncer(Options{SkipDisabledUsers: skip}).BuildPlan()
+			if err != nil {
+				t.Fatalf("BuildPlan: %v", err)
+			}
+			added := map[string]bool{}
+			for _, action := range actionsOfType(plan, "add_user_to_team") {
+				added[action.Email] = true
+			}
+			blocked := actionsOfType(plan, "blocked_disabled_user")
+			if skip {
+				if added["alice@example.com"] || len(blocked) != 1 || blocked[0].Email != "alice@example.com" {
+					t.Errorf("added %v, blocked %+v; want alice blocked instead of added", added, blocked)
+				}
+			} else if !added["alice@example.com"] || len(blocked) != 0 {
+				t.Errorf("added %v, blocked %+v; want alice added", added, blocked)
+			}
+			if !added["bob@example.com"] {
+				t.Error("active user bob not added")
+			}
+		})
+	}
+}
+
+func TestNoteTemplate(t *testing.T) {
+	tmpl, err := ParseNoteTemplate("{{.ActionType}} {{.OrgName}}/{{.TeamName}} group={{.GroupName}}({{.GroupID}}) {{.Email}} role={{.Role}} team_role={{.TeamRole}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseNoteTemplate("{{.Missing}}"); err == nil {
+		t.Error("ParseNoteTemplate accepted an unknown field")
+	}
+	if tmpl, err := ParseNoteTemplate(""); err != nil || tmpl != nil {
+		t.Errorf("ParseNoteTemplate(\"\") = %v, %v; want nil", tmpl, err)
+	}
+
+	env := newTestEnv(t)
+	env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Team"},
+		entra.Member{ID: "u1", Mail: "alice@example.com"},
+		entra.Member{ID: "u2", Mail: "bob@example.com"},
+	)
+	env.grafana.addUser(1, "alice", "alice@example.com")
+	env.grafana.addUser(2, "bob", "bob@example.com")
+	env.grafana.addUser(3, "carol", "carol@example.com")
+	env.grafana.addOrgUser(1, grafana.OrgUser{ID: 1, Email: "alice@example.com", Login: "alice", Role: "Viewer"})
+	env.grafana.addOrgUser(1, grafana.OrgUser{ID: 2, Email: "bob@example.com", Login: "bob", Role: "Viewer"})
+	env.grafana.addTeam(1, 10, "Team")
+	env.grafana.addTeamMember(10, grafana.TeamMember{ID: 1, Login: "alice", Email: "alice@example.com"})
+	env.grafana.addTeamMember(10, grafana.TeamMember{ID: 3, Login: "carol", Email: "carol@example.com"})
+	env.addMapping(t, store.Mapping{GrafanaTeamName: "Team", ExternalGroupID: "g1", ExternalGroupName: "Entra Team", TeamRole: "admin", RoleOverride: "Editor"})
+	env.addMapping(t, store.Mapping{GrafanaTeamName: "New", ExternalGroupID: "g1", ExternalGroupName: "Entra Team"})
+
+	plan, err := env.syncer(Options{NoteTemplate: tmpl, AllowRemoveUsers: true}).BuildPlan()
+	if err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	want := map[string]string{
+		"create_team":           "create_team Main/New group=Entra Team(g1)  role= team_role=member",
+		"update_user_role":      "update_user_role Main/ group=() alice@example.com role=Editor team_role=",
+		"update_team_role":      "update_team_role Main/Team group=Entra Team(g1) alice@example.com role= team_role=admin",
+		"remove_user_from_team": "remove_user_from_team Main/Team group=Entra Team(g1) carol@example.com role= team_role=",
+	}
+	seen := map[string]bool{}
+	for _, action := range plan.Actions {
+		note, ok := want[action.ActionType]
+		if !ok || seen[action.ActionType] {
+			continue
+		}
+		if action.ActionType == "update_user_role" && action.Email != "alice@example.com" {
+			continue
+		}
+		seen[action.ActionType] = true
+		if action.Note != note {
+			t.Errorf("%s note = %q, want %q", action.ActionType, action.Note, note)
+		}
+	}
+	for actionType := range want {
+		if !seen[actionType] {
+			t.Errorf("no %s action in plan %+v", actionType, plan.Actions)
+		}
+	}
+}
+
+func TestRenderDataSourceTemplate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		text    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "fields",
+			text: `{"name": "{{.TeamName}} Loki", "type": "loki", "jsonData": {"org": {{.OrgID}}, "tenant": "{{.OrgName}}"}}`,
+			want: `{"jsonData":{"org":3,"tenant":"Main"},"name":"Ops Loki","type":"loki"}`,
+		},
+		{name: "unknown field", text: `{"name": "{{.Team}}", "type": "loki"}`, wantErr: true},
+		{name: "not an object", text: `["{{.TeamName}}"]`, wantErr: true},
+		{name: "missing type", text: `{"name": "{{.TeamName}}"}`, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := RenderDataSourceTemplate(tc.text, "Ops", 3, "Main")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("RenderDataSourceTemplate error = %v, want error %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("RenderDataSourceTemplate = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestProvisionDataSource(t *testing.T) {
+	env := newTestEnv(t)
+	var created []map[string]any
+	env.grafana.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/datasources" {
+			return false
+		}
+		var body map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		created = append(created, body)
+		writeFakeJSON(w, map[string]any{"datasource": map[string]any{"id": 5, "uid": "ds-ops", "name": body["name"]}})
+		return true
+	}
+	env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Ops"})
+	env.grafana.addTeam(1, 10, "Ops")
+	mappingID := env.addMapping(t, store.Mapping{GrafanaTeamName: "Ops", GrafanaTeamID: 10, ExternalGroupID: "g1",
+		DataSourceTemplateJSON: `{"name": "{{.TeamName}} Loki", "type": "loki"}`})
+	s := env.syncer(Options{})
+
+	plan, err := s.BuildPlan()
+	if err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	provisions := actionsOfType(plan, "provision_datasource")
+	if len(provisions) != 1 || provisions[0].DataSourceSpecJSON != `{"name":"Ops Loki","type":"loki"}` || provisions[0].MappingID != mappingID {
+		t.Fatalf("provision_datasource actions = %+v, want one for mapping %d", provisions, mappingID)
+	}
+	if err := s.ApplyPlan(plan.Actions, nil); err != nil {
+		t.Fatalf("ApplyPlan: %v", err)
+	}
+	if len(created) != 1 || created[0]["name"] != "Ops Loki" {
+		t.Fatalf("created data sources = %v, want Ops Loki", created)
+	}
+	ds, err := env.store.GetMappingDataSource(mappingID)
+	if err != nil || ds == nil || ds.DataSourceUID != "ds-ops" {
+		t.Fatalf("stored data source = %+v, %v; want ds-ops", ds, err)
+	}
+
+	if plan, err = s.BuildPlan(); err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	if got := append(actionsOfType(plan, "provision_datasource"), actionsOfType(plan, "update_datasource")...); len(got) != 0 {
+		t.Fatalf("data source planned again after provisioning: %+v", got)
+	}
+
+	mapping, err := env.store.GetMapping(mappingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapping.DataSourceTemplateJSON = `{"name": "{{.TeamName}} Logs", "type": "loki"}`
+	if err := env.store.UpdateMapping(*mapping); err != nil {
+		t.Fatal(err)
+	}
+	if plan, err = s.BuildPlan(); err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	if updates := actionsOfType(plan, "update_datasource"); len(updates) != 1 || updates[0].DataSourceUID != "ds-ops" {
+		t.Fatalf("update_datasource actions = %+v, want one for ds-ops", updates)
+	}
+}
+
+func TestProvisionedDataSourceCleanup(t *testing.T) {
+	const tmpl = `{"name": "{{.TeamName}} Loki", "type": "loki"}`
+	for _, tc := range []struct {
+		name      string
+		template  string
+		movedOrg  bool
+		wantNewDS bool
+	}{
+		{name: "template cleared", template: ""},
+		{name: "moved org", template: tmpl, movedOrg: true, wantNewDS: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.grafana.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				if r.Method != http.MethodPost || r.URL.Path != "/api/datasources" {
+					return false
+				}
+				writeFakeJSON(w, map[string]any{"datasource": map[string]any{"id": 6, "uid": "ds-new", "name": "Ops Loki"}})
+				return true
+			}
+			env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Ops"})
+			orgID := env.orgID
+			grafanaOrgID := int64(1)
+			if tc.movedOrg {
+				var err error
+				if orgID, err = env.store.CreateOrg(store.Org{GrafanaOrgID: 2, Name: "Second", DefaultRole: "Viewer"}); err != nil {
+					t.Fatal(err)
+				}
+				grafanaOrgID = 2
+			}
+			env.grafana.addTeam(grafanaOrgID, 10, "Ops")
+			mappingID := env.addMapping(t, store.Mapping{OrgID: orgID, GrafanaTeamName: "Ops", GrafanaTeamID: 10, ExternalGroupID: "g1",
+				DataSourceTemplateJSON: tc.template})
+			if err := env.store.SetMappingDataSource(store.MappingDataSource{MappingID: mappingID, GrafanaOrgID: 1, DataSourceID: 5,
+				DataSourceUID: "ds-old", SpecJSON: `{"name":"Ops Loki","type":"loki"}`}); err != nil {
+				t.Fatal(err)
+			}
+			s := env.syncer(Options{})
+
+			plan, err := s.BuildPlan()
+			if err != nil {
+				t.Fatalf("BuildPlan: %v", err)
+			}
+			if deletes := actionsOfType(plan, "delete_datasource"); len(deletes) != 1 || deletes[0].DataSourceUID != "ds-old" || deletes[0].GrafanaOrgID != 1 {
+				t.Fatalf("delete_datasource actions = %+v, want one for ds-old in org 1", deletes)
+			}
+			if updates := actionsOfType(plan, "update_datasource"); len(updates) != 0 {
+				t.Fatalf("update_datasource planned: %+v", updates)
+			}
+			if provisions := actionsOfType(plan, "provision_datasource"); (len(provisions) == 1) != tc.wantNewDS {
+				t.Fatalf("provision_datasource actions = %+v, want new data source %v", provisions, tc.wantNewDS)
+			}
+			if err := s.ApplyPlan(plan.Actions, nil); err != nil {
+				t.Fatalf("ApplyPlan: %v", err)
+			}
+			if got := env.grafana.count(http.MethodDelete, "/api/datasources/uid/ds-old"); got != 1 {
+				t.Fatalf("DELETE ds-old called %d times, want 1", got)
+			}
+			ds, err := env.store.GetMappingDataSource(mappingID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantNewDS {
+				if ds == nil || ds.DataSourceUID != "ds-new" || ds.GrafanaOrgID != 2 {
+					t.Fatalf("stored data source = %+v, want ds-new in org 2", ds)
+				}
+			} else if ds != nil {
+				t.Fatalf("stored data source = %+v, want none", ds)
+			}
+		})
+	}
+}
+
+func TestTeamAvatar(t *testing.T) {
+	env := newTestEnv(t)
+	env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Ops"})
+	env.grafana.addTeam(1, 10, "Ops")
+	env.addMapping(t, store.Mapping{GrafanaTeamName: "Ops", GrafanaTeamID: 10, ExternalGroupID: "g1"})
+	tmpl := template.Must(template.New("avatar").Parse("https://avatars.example.com/{{.OrgID}}/{{.TeamName}}.png"))
+	s := env.syncer(Options{TeamAvatarURLTemplate: tmpl})
+
+	plan, err := s.BuildPlan()
+	if err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	avatars := actionsOfType(plan, "set_team_avatar")
+	if len(avatars) != 1 || avatars[0].AvatarURL != "https://avatars.example.com/1/Ops.png" {
+		t.Fatalf("set_team_avatar actions = %+v, want the rendered URL", avatars)
+	}
+	if err := s.ApplyPlan(plan.Actions, nil); err != nil {
+		t.Fatalf("ApplyPlan: %v", err)
+	}
+	if got := env.grafana.count(http.MethodPut, "/api/teams/10"); got != 1 {
+		t.Fatalf("PUT /api/teams/10 called %d times, want 1", got)
+	}
+
+	if plan, err = s.BuildPlan(); err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	if avatars := actionsOfType(plan, "set_team_avatar"); len(avatars) != 0 {
+		t.Fatalf("set_team_avatar planned again after it was set: %+v", avatars)
+	}
+}
+
+func TestRunRecordsSyncRuns(t *testing.T) {
+	env := newTestEnv(t)
+	env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Team"}, entra.Member{ID: "u1", Mail: "alice@example.com"})
+	env.grafana.addUser(1, "alice", "alice@example.com")
+	env.grafana.addOrgUser(1, grafana.OrgUser{ID: 1, Email: "alice@example.com", Login: "alice", Role: "Viewer"})
+	env.grafana.addTeam(1, 10, "Team")
+	env.addMapping(t, store.Mapping{GrafanaTeamName: "Team", GrafanaTeamID: 10, ExternalGroupID: "g1"})
+
+	before := time.Now()
+	if err := env.syncer(Options{}).Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := env.syncer(Options{ReadOnly: true}).Run(); err != nil {
+		t.Fatalf("read-only Run: %v", err)
+	}
+	runs, err := env.store.ListSyncRuns(10)
+	if err != nil {
+		t.Fatalf("ListSyncRuns: %v", err)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("ListSyncRuns = %+v, want two runs", runs)
+	}
+	// Newest first: the read-only run stored a plan instead of applying it.
+	if runs[0].PlanID == 0 || runs[0].ActionsApplied != 0 {
+		t.Errorf("read-only run = %+v, want a plan ID and nothing applied", runs[0])
+	}
+	if runs[1].PlanID != 0 || runs[1].ActionsApplied != 1 {
+		t.Errorf("applying run = %+v, want one action applied", runs[1])
+	}
+	for _, run := range runs {
+		if run.Status != "ok" || run.StartedAt.Before(before.Truncate(time.Second)) || run.FinishedAt.Before(run.StartedAt) || run.DurationMS < 0 {
+			t.Errorf("run = %+v, want an ok run with its duration", run)
+		}
+	}
+}
+
+func TestSyncTeamEmail(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		syncedEmail string
+		mail        string
+		want        bool
+	}{
+		{name: "differs", syncedEmail: "old@example.com", mail: "ops@example.com", want: true},
+		{name: "unset", mail: "ops@example.com", want: true},
+		{name: "same ignoring case", syncedEmail: "Ops@Example.com", mail: "ops@example.com"},
+		{name: "group without mail", syncedEmail: "old@example.com"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Ops", Mail: tc.mail})
+			env.grafana.addTeam(1, 10, "Ops").Email = tc.syncedEmail
+			if tc.syncedEmail != "" {
+				if err := env.store.SetTeamEmail(1, 10, tc.syncedEmail); err != nil {
+					t.Fatal(err)
+				}
+			}
+			env.addMapping(t, store.Mapping{GrafanaTeamName: "Ops", GrafanaTeamID: 10, ExternalGroupID: "g1"})
+			s := env.syncer(Options{SyncTeamEmail: true})
+
+			plan, err := s.BuildPlan()
+			if err != nil {
+				t.Fatalf("BuildPlan: %v", err)
+			}
+			emails := actionsOfType(plan, "update_team_email")
+			if (len(emails) == 1) != tc.want || len(emails) > 1 {
+				t.Fatalf("update_team_email actions = %+v, want %v", emails, tc.want)
+			}
+			if !tc.want {
+				return
+			}
+			if emails[0].TeamEmail != tc.mail {
+				t.Errorf("TeamEmail = %q, want %q", emails[0].TeamEmail, tc.mail)
+			}
+			if err := s.ApplyPlan(plan.Actions, nil); err != nil {
+				t.Fatalf("ApplyPlan: %v", err)
+			}
+			if team := env.grafana.team(10); team.Name != "Ops" || team.Email != tc.mail {
+				t.Errorf("team after update = %+v, want email %s", team, tc.mail)
+			}
+		})
+	}
+}
+
+func TestSyncTeamEmailSharedTeam(t *testing.T) {
+	env := newTestEnv(t)
+	env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Ops", SecurityEnabled: true})
+	env.graph.addGroup(entra.Group{ID: "g2", DisplayName: "Ops EU", Mail: "ops-eu@example.com", SecurityEnabled: true})
+	env.graph.addGroup(entra.Group{ID: "g3", DisplayName: "Ops US", Mail: "ops-us@example.com", SecurityEnabled: true})
+	env.grafana.addTeam(1, 10, "Ops")
+	for _, group := range []string{"g1", "g2", "g3"} {
+		env.addMapping(t, store.Mapping{GrafanaTeamName: "Ops", GrafanaTeamID: 10, ExternalGroupID: group})
+	}
+	// Types, descriptions and mails all come from one group listing.
+	s := env.syncer(Options{SyncTeamEmail: true, AllowedGroupTypes: map[string]bool{"security": true}})
+
+	plan, err := s.BuildPlan()
+	if err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	if got := env.graph.count("/v1.0/groups"); got != 1 {
+		t.Fatalf("groups listed %d times for one plan, want 1", got)
+	}
+	if emails := actionsOfType(plan, "update_team_email"); len(emails) != 1 || emails[0].TeamEmail != "ops-eu@example.com" {
+		t.Fatalf("update_team_email actions = %+v, want one for ops-eu@example.com", emails)
+	}
+	if err := s.ApplyPlan(plan.Actions, nil); err != nil {
+		t.Fatalf("ApplyPlan: %v", err)
+	}
+	if plan, err = s.BuildPlan(); err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	if emails := actionsOfType(plan, "update_team_email"); len(emails) != 0 {
+		t.Fatalf("update_team_email planned again after it was set: %+v", emails)
+	}
+}
+
+func TestTeamAdminEmailDomains(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		domains []string
+		want    map[string]string
+	}{
+		{name: "none", want: map[string]string{"alice@corp.example.com": "member", "bob@Partner.example.com": "member"}},
+		{name: "lowercase", domains: []string{"corp.example.com"}, want: map[string]string{"alice@corp.example.com": "admin", "bob@Partner.example.com": "member"}},
+		{name: "mixed case with at", domains: []string{" @PARTNER.example.com "}, want: map[string]string{"alice@corp.example.com": "member", "bob@Partner.example.com": "admin"}},
+		{name: "subdomain does not match", domains: []string{"example.com"}, want: map[string]string{"alice@corp.example.com": "member", "bob@Partner.example.com": "member"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Team"},
+				entra.Member{ID: "u1", Mail: "alice@corp.example.com"},
+				entra.Member{ID: "u2", Mail: "bob@Partner.example.com"},
+			)
+			env.grafana.addUser(1, "alice", "alice@corp.example.com")
+			env.grafana.addUser(2, "bob", "bob@partner.example.com")
+			env.grafana.addOrgUser(1, grafana.OrgUser{ID: 1, Email: "alice@corp.example.com", Login: "alice", Role: "Viewer"})
+			env.grafana.addOrgUser(1, grafana.OrgUser{ID: 2, Email: "bob@partner.example.com", Login: "bob", Role: "Viewer"})
+			env.grafana.addTeam(1, 10, "Team")
+			env.addMapping(t, store.Mapping{GrafanaTeamName: "Team", ExternalGroupID: "g1"})
+
+			plan, err := env.syncer(Options{TeamAdminEmailDomains: tc.domains}).BuildPlan()
+			if err != nil {
+				t.Fatalf("BuildPlan: %v", err)
+			}
+			roles := map[string]string{}
+			for _, action := range actionsOfType(plan, "add_user_to_team") {
+				roles[action.Email] = action.TeamRole
+			}
+			for email, role := range tc.want {
+				if got := roles[strings.ToLower(email)]; got != role {
+					t.Errorf("team role of %s = %q, want %q", email, got, role)
+				}
+			}
+		})
+	}
+}
+
+func TestPreviewMapping(t *testing.T) {
+	env := newTestEnv(t)
+	env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Team"},
+		entra.Member{ID: "u1", Mail: "alice@example.com"},
+		entra.Member{ID: "u2", Mail: "bob@example.com"},
+	)
+	env.grafana.addUser(1, "alice", "alice@example.com")
+	env.grafana.addUser(3, "carol", "carol@example.com")
+	env.grafana.addTeam(1, 10, "Team")
+	env.grafana.addTeamMember(10, grafana.TeamMember{ID: 1, Login: "alice", Email: "alice@example.com"})
+	env.grafana.addTeamMember(10, grafana.TeamMember{ID: 3, Login: "carol", Email: "carol@example.com"})
+	existingID := env.addMapping(t, store.Mapping{GrafanaTeamName: "Team", ExternalGroupID: "g1", TeamRole: "admin"})
+	missingID := env.addMapping(t, store.Mapping{GrafanaTeamName: "New", ExternalGroupID: "g1"})
+
+	for _, tc := range []struct {
+		name        string
+		mappingID   int64
+		teamID      int64
+		added       []MemberChange
+		removed     []MemberChange
+		roleUpdates []MemberChange
+	}{
+		{
+			name:        "existing team",
+			mappingID:   existingID,
+			teamID:      10,
+			added:       []MemberChange{{Email: "bob@example.com", TeamRole: "admin"}},
+			removed:     []MemberChange{{Email: "carol@example.com", TeamRole: "member"}},
+			roleUpdates: []MemberChange{{Email: "alice@example.com", TeamRole: "admin"}},
+		},
+		{
+			name:      "team to be created",
+			mappingID: missingID,
+			added:     []MemberChange{{Email: "alice@example.com", TeamRole: "member"}, {Email: "bob@example.com", TeamRole: "member"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			diff, err := env.syncer(Options{}).PreviewMapping(context.Background(), tc.mappingID)
+			if err != nil {
+				t.Fatalf("PreviewMapping: %v", err)
+			}
+			if diff.MappingID != tc.mappingID || diff.TeamID != tc.teamID {
+				t.Errorf("diff = %+v, want mapping %d and team %d", diff, tc.mappingID, tc.teamID)
+			}
+			for _, check := range []struct {
+				field     string
+				got, want []MemberChange
+			}{
+				{"Added", diff.Added, tc.added},
+				{"Removed", diff.Removed, tc.removed},
+				{"RoleUpdates", diff.RoleUpdates, tc.roleUpdates},
+			} {
+				if fmt.Sprint(check.got) != fmt.Sprint(check.want) {
+					t.Errorf("%s = %+v, want %+v", check.field, check.got, check.want)
+				}
+			}
+		})
+	}
+
+	if _, err := env.syncer(Options{}).PreviewMapping(context.Background(), 999); !errors.Is(err, ErrMappingNotFound) {
+		t.Errorf("PreviewMapping(999) error = %v, want ErrMappingNotFound", err)
+	}
+}
+
+func TestPreviewMappingFollowsPlanRules(t *testing.T) {
+	env := newTestEnv(t)
+	env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Ops", SecurityEnabled: true},
+		entra.Member{ID: "u1", Mail: "alice@example.com"},
+		entra.Member{ID: "u2", Mail: "bob@example.com"},
+		entra.Member{ID: "u3", Mail: "carol@example.com"},
+	)
+	env.graph.addGroup(entra.Group{ID: "g2", DisplayName: "Ops Leads", SecurityEnabled: true}, entra.Member{ID: "u2", Mail: "bob@example.com"})
+	env.graph.addGroup(entra.Group{ID: "g3", DisplayName: "Ops Mail", MailEnabled: true}, entra.Member{ID: "u1", Mail: "alice@example.com"})
+	env.grafana.addUser(1, "alice", "alice@example.com")
+	env.grafana.addUser(2, "bob", "bob@example.com")
+	env.grafana.addUser(3, "carol", "carol@example.com")
+	env.grafana.addOrgUser(1, grafana.OrgUser{ID: 3, Login: "carol", Email: "carol@example.com", Role: "Viewer"})
+	env.grafana.addTeam(1, 10, "Ops")
+	env.grafana.addTeamMember(10, grafana.TeamMember{ID: 1, Login: "alice", Email: "alice@example.com"})
+	opsID := env.addMapping(t, store.Mapping{GrafanaTeamName: "Ops", ExternalGroupID: "g1"})
+	env.addMapping(t, store.Mapping{GrafanaTeamName: "ops", ExternalGroupID: "g2", TeamRole: "admin"})
+	// The m365 group's admin role is left out with the mapping.
+	mailID := env.addMapping(t, store.Mapping{GrafanaTeamName: "Ops", ExternalGroupID: "g3", TeamRole: "admin"})
+	s := env.syncer(Options{
+		TeamSyncCompat:    true,
+		AllowedGroupTypes: map[string]bool{"security": true},
+		MemberCacheTTL:    time.Hour,
+	})
+
+	diff, err := s.PreviewMapping(context.Background(), opsID)
+	if err != nil {
+		t.Fatalf("PreviewMapping: %v", err)
+	}
+	// Bob is an admin through the other mapping; carol, an org member,
+	// is left to Grafana team sync.
+	if got, want := fmt.Sprint(diff.Added), fmt.Sprint([]MemberChange{{Email: "bob@example.com", TeamRole: "admin"}}); got != want {
+		t.Errorf("Added = %s, want %s", got, want)
+	}
+	if len(diff.RoleUpdates) != 0 || len(diff.Removed) != 0 || diff.Skipped != "" {
+		t.Errorf("diff = %+v, want only bob added", diff)
+	}
+	plan, err := s.BuildPlan()
+	if err != nil {
+		t.Fatalf("BuildPlan: %v", err)
+	}
+	if adds := actionsOfType(plan, "add_user_to_team"); len(adds) != 1 || adds[0].Email != "bob@example.com" || adds[0].TeamRole != "admin" {
+		t.Errorf("add_user_to_team actions = %+v, want the preview's", adds)
+	}
+
+	diff, err = s.PreviewMapping(context.Background(), mailID)
+	if err != nil {
+		t.Fatalf("PreviewMapping: %v", err)
+	}
+	if diff.Skipped == "" || len(diff.Added)+len(diff.Removed)+len(diff.RoleUpdates) != 0 {
+		t.Errorf("diff of skipped mapping = %+v, want a reason and no changes", diff)
+	}
+}
+
+func TestPreviewMappingLeavesMemberCache(t *testing.T) {
+	env := newTestEnv(t)
+	env.graph.addGroup(entra.Group{ID: "g1", DisplayName: "Team"}, entra.Member{ID: "u1", Mail: "alice@example.com"})
+	mappingID := env.addMapping(t, store.Mapping{GrafanaTeamName: "Team", ExternalGroupID: "g1"})
+	s := env.syncer(Options{MemberCacheTTL: time.Hour})
+
+	if _, err := s.PreviewMapping(context.Background(), mappingID); err != nil {
+		t.Fatalf("PreviewMapping: %v", err)
+	}
+	if _, cachedAt, err := env.store.GetGroupMemberCache("g1"); err != nil || !cachedAt.IsZero() {
+		t.Fatalf("member cache after preview written at %v, %v; want no entry", cachedAt, err)
+	}
+}
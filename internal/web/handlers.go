@@ -1,22 +1,32 @@
 package web
 
 import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"grafana-ad-syncher/internal/entra"
 	"grafana-ad-syncher/internal/grafana"
+	"grafana-ad-syncher/internal/metrics"
 	"grafana-ad-syncher/internal/store"
 	syncer "grafana-ad-syncher/internal/sync"
+	"grafana-ad-syncher/internal/webhooks"
 )
 
 type Server struct {
@@ -25,9 +35,103 @@ type Server struct {
 	grafana *grafana.Client
 	entra   *entra.Client
 	tmpl    *template.Template
+	// report renders the standalone plan report of GET
+	// /api/plans/{id}/report.
+	report  *template.Template
 	cacheMu sync.RWMutex
 	cache   externalCache
 	refresh bool
+
+	adminToken string
+
+	webhookSecret  string
+	webhookRunning atomic.Bool
+
+	startupHealth *StartupHealth
+
+	latencyWarn time.Duration
+
+	allowedGroupTypes map[string]bool
+
+	managedLabelKey   string
+	managedLabelValue string
+
+	syncInterval        time.Duration
+	syncIntervalChanged chan<- struct{}
+
+	// applyProgress holds the events of the apply started by POST
+	// /sync/apply/progress for GET /sync/apply/progress to stream.
+	applyProgress applyProgress
+}
+
+// applyProgress records the events of the most recent progress-tracked
+// apply. changed is closed and replaced whenever an event is added, waking
+// the streams waiting for more.
+type applyProgress struct {
+	mu      sync.Mutex
+	started bool
+	running bool
+	events  []any
+	changed chan struct{}
+}
+
+// start resets the recorded events for a new apply. It returns false when an
+// apply is already running.
+func (p *applyProgress) start() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.running {
+		return false
+	}
+	p.started, p.running, p.events = true, true, nil
+	p.notifyLocked()
+	return true
+}
+
+// add records event; done marks it as the last event of the apply.
+func (p *applyProgress) add(event any, done bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, event)
+	if done {
+		p.running = false
+	}
+	p.notifyLocked()
+}
+
+func (p *applyProgress) notifyLocked() {
+	if p.changed != nil {
+		close(p.changed)
+	}
+	p.changed = make(chan struct{})
+}
+
+// since returns the events after the first from, whether the apply has
+// finished and a channel closed on the next change.
+func (p *applyProgress) since(from int) (events []any, started, done bool, changed <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.changed == nil {
+		p.changed = make(chan struct{})
+	}
+	if from < len(p.events) {
+		events = append(events, p.events[from:]...)
+	}
+	return events, p.started, p.started && !p.running, p.changed
+}
+
+// StartupHealth is the result of the credential check run at startup. An
+// empty error string means the service was reachable and accepted the
+// credentials.
+type StartupHealth struct {
+	CheckedAt  time.Time
+	GrafanaErr string
+	EntraErr   string
+}
+
+// OK reports whether both checks passed.
+func (h StartupHealth) OK() bool {
+	return h.GrafanaErr == "" && h.EntraErr == ""
 }
 
 type externalCache struct {
@@ -45,62 +149,95 @@ type externalCache struct {
 }
 
 type grafanaTeamView struct {
-	OrgID        int64
-	OrgName      string
-	TeamID       int64
-	TeamName     string
-	MemberCount  int
-	GroupIDsCSV  string
-	MappingInfo  string
-	MappingState string
+	OrgID        int64  `json:"org_id"`
+	OrgName      string `json:"org_name"`
+	TeamID       int64  `json:"team_id"`
+	TeamName     string `json:"team_name"`
+	Email        string `json:"email"`
+	MemberCount  *int   `json:"member_count"`
+	GroupIDsCSV  string `json:"group_ids"`
+	MappingInfo  string `json:"mapping_info"`
+	MappingState string `json:"mapping_state"`
+	// Managed is set for teams carrying the TEAM_MANAGED_LABEL label.
+	Managed bool `json:"managed"`
 }
 
 type grafanaUserView struct {
-	ID    int64
-	Login string
-	Email string
-	Name  string
-	Teams string
+	ID    int64  `json:"id"`
+	Login string `json:"login"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+	Teams string `json:"teams"`
 }
 
 type entraGroupView struct {
-	ID           string
-	DisplayName  string
-	Mail         string
-	SecurityType string
-	MappingInfo  string
-	MappingState string
+	ID           string `json:"id"`
+	DisplayName  string `json:"display_name"`
+	Mail         string `json:"mail"`
+	SecurityType string `json:"security_type"`
+	MappingInfo  string `json:"mapping_info"`
+	MappingState string `json:"mapping_state"`
 }
 
 type entraUserView struct {
-	ID          string
-	DisplayName string
-	Mail        string
-	UPN         string
-	Department  string
-	Groups      string
+	ID          string `json:"id"`
+	DisplayName string `json:"display_name"`
+	Mail        string `json:"mail"`
+	UPN         string `json:"upn"`
+	Department  string `json:"department"`
+	Groups      string `json:"groups"`
 }
 
 type pageData struct {
-	Orgs             []store.Org
-	Mappings         []store.Mapping
-	GrafanaTeams     []grafanaTeamView
-	GrafanaTeamsErr  string
-	GrafanaUsers     []grafanaUserView
-	GrafanaUsersErr  string
-	EntraGroups      []entraGroupView
-	EntraGroupsErr   string
-	EntraUsers       []entraUserView
-	EntraUsersErr    string
-	FolderPerms      []folderPermGroup
-	FolderPermsErr   string
-	PlanGroups       []planTeamGroup
-	LastRun          string
-	LastStatus       string
-	Plan             *store.Plan
-	AutoSyncEnabled  bool
-	CurrentPage      string
-	ContentTemplate  string
+	Orgs              []store.Org
+	Tenants           []store.Tenant
+	Mappings          []store.Mapping
+	GrafanaTeams      []grafanaTeamView
+	GrafanaTeamsErr   string
+	GrafanaUsers      []grafanaUserView
+	GrafanaUsersErr   string
+	EntraGroups       []entraGroupView
+	EntraGroupsErr    string
+	EntraUsers        []entraUserView
+	EntraUsersErr     string
+	FolderPerms       []folderPermGroup
+	FolderPermsErr    string
+	PlanGroups        []planTeamGroup
+	PlanFilter        planFilter
+	PlanShown         int
+	MappingIssues     []syncer.MappingValidationIssue
+	UnmappedTeams     int
+	FormError         *APIError
+	UnmappedGroups    int
+	DuplicateMappings int
+	DataSourcePerms   map[int64][]store.DataSourcePermission
+	LastRun           string
+	LastStatus        string
+	DurationSparkline *durationSparkline
+	DataRefreshedAt   string
+	Plan              *store.Plan
+	PlanSummary       *store.PlanSummary
+	PlanExpiry        *planExpiry
+	StartupHealth     *StartupHealth
+	LatencyWarnings   []string
+	NoProvenance      bool
+	AutoSyncEnabled   bool
+	Settings          syncer.RuntimeSettings
+	SettingsEditable  bool
+	SettingsSaved     bool
+	SyncInterval      int
+	ReadOnly          bool
+	CurrentPage       string
+	ContentTemplate   string
+}
+
+// APIError is the structured error returned by the org and mapping
+// endpoints. Field names the offending form field, if any.
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+	Details any    `json:"details,omitempty"`
 }
 
 type planActionView struct {
@@ -121,6 +258,27 @@ type planTeamGroup struct {
 	Actions []planActionView
 }
 
+// planFilter narrows the plan actions shown by GET / and returned by
+// GET /api/plans/latest. Zero values match every action.
+type planFilter struct {
+	OrgID       int64
+	ActionTypes map[string]bool
+}
+
+// planActionJSON is a plan action as returned by GET /api/plans/latest.
+type planActionJSON struct {
+	ID           int64  `json:"id"`
+	ActionType   string `json:"action_type"`
+	OrgID        int64  `json:"org_id"`
+	GrafanaOrgID int64  `json:"grafana_org_id"`
+	TeamName     string `json:"team_name"`
+	TeamRole     string `json:"team_role,omitempty"`
+	Email        string `json:"email,omitempty"`
+	Role         string `json:"role,omitempty"`
+	Note         string `json:"note,omitempty"`
+	Selectable   bool   `json:"selectable"`
+}
+
 type folderPermEntry struct {
 	Subject     string
 	SubjectType string
@@ -135,53 +293,314 @@ type folderPermGroup struct {
 	Entries     []folderPermEntry
 }
 
-func New(store *store.Store, syncer *syncer.Syncer, grafanaClient *grafana.Client, entraClient *entra.Client, templateDir string) (*Server, error) {
+func New(store *store.Store, syncer *syncer.Syncer, grafanaClient *grafana.Client, entraClient *entra.Client, templateDir string, adminToken string) (*Server, error) {
 	tmpl, err := template.New("layout.html").Funcs(template.FuncMap{
 		"actionClass":  actionClass,
 		"actionLabel":  actionLabel,
 		"isSelectable": isSelectableAction,
+		"lower":        strings.ToLower,
+		"optBool":      optBool,
 	}).ParseFiles(
 		filepath.Join(templateDir, "layout.html"),
 		filepath.Join(templateDir, "index.html"),
 		filepath.Join(templateDir, "grafana.html"),
 		filepath.Join(templateDir, "entra.html"),
 		filepath.Join(templateDir, "folders.html"),
+		filepath.Join(templateDir, "settings.html"),
 	)
 	if err != nil {
 		return nil, err
 	}
+	report, err := template.New("report.html").Funcs(template.FuncMap{
+		"actionLabel": actionLabel,
+		"teamRole":    formatTeamRole,
+	}).ParseFiles(filepath.Join(templateDir, "report.html"))
+	if err != nil {
+		return nil, err
+	}
 	server := &Server{
 		store:   store,
 		syncer:  syncer,
 		grafana: grafanaClient,
 		entra:   entraClient,
 		tmpl:    tmpl,
+		report:  report,
+
+		adminToken: adminToken,
 	}
 	go server.refreshLoop(30 * time.Second)
 	return server, nil
 }
 
+// minSyncInterval is the shortest auto-sync interval the settings page
+// accepts; zero (off) is always allowed.
+const minSyncInterval = time.Minute
+
+// SetSyncInterval sets the auto-sync interval used while none is saved on the
+// settings page (SYNC_INTERVAL) and the channel signalled when it is changed
+// there, so the scheduler can pick up the new interval right away.
+func (s *Server) SetSyncInterval(fallback time.Duration, changed chan<- struct{}) {
+	s.syncInterval = fallback
+	s.syncIntervalChanged = changed
+}
+
+func (s *Server) currentSyncInterval() time.Duration {
+	interval, ok, err := s.store.SyncInterval()
+	if err != nil {
+		log.Printf("ui: sync interval lookup failed: %v", err)
+	}
+	if !ok {
+		return s.syncInterval
+	}
+	return interval
+}
+
+// parseSyncInterval validates an interval in seconds from the settings form
+// or API.
+func parseSyncInterval(seconds int) (time.Duration, error) {
+	interval := time.Duration(seconds) * time.Second
+	if seconds < 0 || (interval > 0 && interval < minSyncInterval) {
+		return 0, fmt.Errorf("sync interval must be 0 (off) or at least %d seconds", int(minSyncInterval/time.Second))
+	}
+	return interval, nil
+}
+
+func (s *Server) saveSyncInterval(interval time.Duration) error {
+	if err := s.store.SetSyncInterval(interval); err != nil {
+		return err
+	}
+	if s.syncIntervalChanged != nil {
+		select {
+		case s.syncIntervalChanged <- struct{}{}:
+		default:
+		}
+	}
+	log.Printf("ui: sync interval set to %s", interval)
+	return nil
+}
+
+// SetLatencyWarnThreshold shows a warning in the page header while the p99
+// latency of Grafana or Entra requests exceeds threshold; zero disables it.
+func (s *Server) SetLatencyWarnThreshold(threshold time.Duration) {
+	s.latencyWarn = threshold
+}
+
+// SetAllowedGroupTypes limits the Entra groups and users shown in the UI to
+// groups of the given types (see entra.ParseGroupTypes); nil allows all.
+func (s *Server) SetAllowedGroupTypes(types map[string]bool) {
+	s.allowedGroupTypes = types
+}
+
+// SetManagedTeamLabel sets the label (see syncer.ParseTeamLabel) that marks
+// a Grafana team as created by the syncer on the Grafana page. An empty key
+// marks no team.
+func (s *Server) SetManagedTeamLabel(key, value string) {
+	s.managedLabelKey = key
+	s.managedLabelValue = value
+}
+
+func (s *Server) groupTypeAllowed(group entra.Group) bool {
+	return s.allowedGroupTypes == nil || s.allowedGroupTypes[group.Type()]
+}
+
+// latencyCategory is one request category of a service's latency trackers.
+type latencyCategory struct {
+	service  string
+	label    string
+	category string
+	tracker  *metrics.LatencyTracker
+}
+
+// latencyCategories lists the latency trackers of the configured clients.
+func (s *Server) latencyCategories() []latencyCategory {
+	var categories []latencyCategory
+	if s.grafana != nil {
+		latency := s.grafana.Latency()
+		categories = append(categories,
+			latencyCategory{"grafana", "Grafana", "read", latency.Read},
+			latencyCategory{"grafana", "Grafana", "write", latency.Write})
+	}
+	if s.entra != nil {
+		latency := s.entra.Latency()
+		categories = append(categories,
+			latencyCategory{"entra", "Entra", "read", latency.Read},
+			latencyCategory{"entra", "Entra", "write", latency.Write})
+	}
+	return categories
+}
+
+// latencyP99 returns the live p99 of a category, or the one saved before
+// the last restart while no requests have been made yet.
+func (s *Server) latencyP99(c latencyCategory) time.Duration {
+	if c.tracker.Count() > 0 {
+		_, _, p99 := c.tracker.Percentiles()
+		return p99
+	}
+	p99, _, err := s.store.GetLatencyP99(c.service, c.category)
+	if err != nil {
+		log.Printf("ui: load %s %s latency failed: %v", c.service, c.category, err)
+	}
+	return p99
+}
+
+func (s *Server) latencyWarnings() []string {
+	if s.latencyWarn <= 0 {
+		return nil
+	}
+	var warnings []string
+	for _, c := range s.latencyCategories() {
+		if p99 := s.latencyP99(c); p99 > s.latencyWarn {
+			warnings = append(warnings, fmt.Sprintf("%s %s p99 %s", c.label, c.category, p99.Round(time.Millisecond)))
+		}
+	}
+	return warnings
+}
+
+// SaveLatency persists the current p99 latencies so they survive a
+// restart. Categories without requests keep their saved value.
+func (s *Server) SaveLatency() {
+	for _, c := range s.latencyCategories() {
+		if c.tracker.Count() == 0 {
+			continue
+		}
+		_, _, p99 := c.tracker.Percentiles()
+		if err := s.store.SetLatencyP99(c.service, c.category, p99); err != nil {
+			log.Printf("api: save %s %s latency failed: %v", c.service, c.category, err)
+		}
+	}
+}
+
+// handleLatencyMetrics serves GET /api/metrics/grafana-latency and
+// /api/metrics/entra-latency: percentiles of the last requests per category,
+// with the p99 saved before the last restart.
+func (s *Server) handleLatencyMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	service := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/metrics/"), "-latency")
+	type percentiles struct {
+		Count       int     `json:"count"`
+		P50Ms       float64 `json:"p50_ms"`
+		P95Ms       float64 `json:"p95_ms"`
+		P99Ms       float64 `json:"p99_ms"`
+		StoredP99Ms *int64  `json:"stored_p99_ms"`
+	}
+	resp := map[string]any{}
+	for _, c := range s.latencyCategories() {
+		if c.service != service {
+			continue
+		}
+		p50, p95, p99 := c.tracker.Percentiles()
+		entry := percentiles{
+			Count: c.tracker.Count(),
+			P50Ms: durationMs(p50),
+			P95Ms: durationMs(p95),
+			P99Ms: durationMs(p99),
+		}
+		stored, ok, err := s.store.GetLatencyP99(c.service, c.category)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load saved latency: %v", err), "")
+			return
+		}
+		if ok {
+			ms := stored.Milliseconds()
+			entry.StoredP99Ms = &ms
+		}
+		resp[c.category] = entry
+	}
+	if len(resp) == 0 {
+		writeAPIError(w, http.StatusNotFound, "not_configured", fmt.Sprintf("%s client is not configured", service), "")
+		return
+	}
+	resp["warn_threshold_ms"] = s.latencyWarn.Milliseconds()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("api: latency metrics encode failed: %v", err)
+	}
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// SetStartupHealth shows the startup credential check in the page header.
+func (s *Server) SetStartupHealth(health StartupHealth) {
+	s.startupHealth = &health
+}
+
+// SetWebhookSecret enables POST /webhooks/sync. Requests must be signed with
+// secret; the endpoint answers 403 while it is empty.
+func (s *Server) SetWebhookSecret(secret string) {
+	s.webhookSecret = secret
+}
+
 func (s *Server) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/", s.handleIndex)
 	mux.HandleFunc("/grafana", s.handleGrafanaSettings)
 	mux.HandleFunc("/entra", s.handleEntraSettings)
 	mux.HandleFunc("/folders", s.handleFolderPermissions)
 	mux.HandleFunc("/api/status", s.handleAPIStatus)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/metrics", s.handleMetrics)
 	mux.HandleFunc("/sync/fetch", s.handleFetch)
 	mux.HandleFunc("/orgs", s.handleCreateOrg)
 	mux.HandleFunc("/orgs/delete", s.handleDeleteOrg)
+	mux.HandleFunc("/orgs/tenant", s.handleSetOrgTenant)
 	mux.HandleFunc("/mappings", s.handleCreateMapping)
 	mux.HandleFunc("/mappings/delete", s.handleDeleteMapping)
 	mux.HandleFunc("/mappings/update", s.handleUpdateMapping)
 	mux.HandleFunc("/mappings/purge", s.handlePurgeMappings)
 	mux.HandleFunc("/entra/group/members", s.handleEntraGroupMembers)
+	mux.HandleFunc("/settings", s.handleSettings)
 	mux.HandleFunc("/settings/auto-sync", s.handleAutoSync)
+	mux.HandleFunc("/settings/sync-interval", s.handleSyncInterval)
 	mux.HandleFunc("/api/sync/pending", s.handleSyncPending)
 	mux.HandleFunc("/sync/preview", s.handlePreview)
 	mux.HandleFunc("/sync/run", s.handleRun)
 	mux.HandleFunc("/sync/apply", s.handleApply)
+	mux.HandleFunc("/sync/apply/progress", s.handleApplyProgress)
 	mux.HandleFunc("/sync/apply-selected", s.handleApplySelected)
 	mux.HandleFunc("/sync/clear", s.handleClearPlan)
+	mux.HandleFunc("/webhooks/sync", s.handleWebhookSync)
+	mux.HandleFunc("/api/admin/backup", s.handleBackup)
+	mux.HandleFunc("/api/admin/service-account-tokens", s.handleServiceAccountTokens)
+	mux.HandleFunc("/api/mappings/validate", s.handleValidateMappings)
+	mux.HandleFunc("/api/grafana/teams/unmapped", s.handleUnmappedGrafanaTeams)
+	mux.HandleFunc("/api/mappings", s.handleAPIMappings)
+	mux.HandleFunc("/api/mappings/import-csv", s.handleImportMappingsCSV)
+	mux.HandleFunc("/api/mappings/duplicates", s.handleDuplicateMappings)
+	mux.HandleFunc("/api/mappings/", s.handleMappingDataSources)
+	mux.HandleFunc("/api/sync/history/archive", s.handleSyncHistoryArchive)
+	mux.HandleFunc("/api/sync/runs", s.handleSyncRuns)
+	mux.HandleFunc("/api/entra/groups/unmapped", s.handleUnmappedEntraGroups)
+	mux.HandleFunc("/api/metrics/grafana-latency", s.handleLatencyMetrics)
+	mux.HandleFunc("/api/metrics/entra-latency", s.handleLatencyMetrics)
+	mux.HandleFunc("/api/grafana-tokens", s.handleGrafanaTokens)
+	mux.HandleFunc("/api/grafana-tokens/", s.handleGrafanaTokens)
+	mux.HandleFunc("/api/cache/refresh", s.handleCacheRefresh)
+	mux.HandleFunc("/api/cache/status", s.handleCacheStatus)
+	mux.HandleFunc("/api/cache/grafana-teams", s.handleCacheDump)
+	mux.HandleFunc("/api/cache/grafana-users", s.handleCacheDump)
+	mux.HandleFunc("/api/cache/entra-groups", s.handleCacheDump)
+	mux.HandleFunc("/api/cache/entra-users", s.handleCacheDump)
+	mux.HandleFunc("/api/grafana/users", s.handleAPIGrafanaUsers)
+	mux.HandleFunc("/api/entra/users", s.handleAPIEntraUsers)
+	mux.HandleFunc("/api/tenants", s.handleAPITenants)
+	mux.HandleFunc("/api/users/", s.handleUserHistory)
+	mux.HandleFunc("/api/plans/", s.handlePlans)
+	mux.HandleFunc("/api/orgs/", s.handleAPIOrg)
+}
+
+// handleHealthz is the liveness probe: it answers 200 while the process
+// serves HTTP, without calling Grafana or Entra.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
 }
 
 func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
@@ -191,6 +610,11 @@ func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
 	}
 	start := time.Now()
 
+	filter, apiErr := parsePlanFilter(r.URL.Query())
+	if apiErr != nil {
+		http.Error(w, apiErr.Message, http.StatusBadRequest)
+		return
+	}
 	data, err := s.buildPageData()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -198,6 +622,13 @@ func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
 	}
 	data.CurrentPage = "home"
 	data.ContentTemplate = "content-index"
+	data.FormError = formErrorFromQuery(r)
+	if data.Plan != nil && filter.Active() {
+		actions := filterPlanActions(data.Plan.Actions, filter)
+		data.PlanGroups = buildPlanGroups(actions)
+		data.PlanShown = len(actions)
+	}
+	data.PlanFilter = filter
 	if err := s.tmpl.ExecuteTemplate(w, "layout.html", data); err != nil {
 		log.Printf("render error: %v", err)
 	}
@@ -217,12 +648,42 @@ func (s *Server) buildPageData() (pageData, error) {
 	if err != nil {
 		return pageData{}, fmt.Errorf("failed to load plan: %w", err)
 	}
+	tenants, err := s.store.ListTenants()
+	if err != nil {
+		return pageData{}, fmt.Errorf("failed to load tenants: %w", err)
+	}
+	duplicates, err := s.store.FindDuplicateMappings()
+	if err != nil {
+		return pageData{}, fmt.Errorf("failed to check duplicate mappings: %w", err)
+	}
+	dsPerms, err := s.store.ListDataSourcePermissions(0)
+	if err != nil {
+		return pageData{}, fmt.Errorf("failed to load data source permissions: %w", err)
+	}
+	dsPermsByMapping := map[int64][]store.DataSourcePermission{}
+	for _, perm := range dsPerms {
+		dsPermsByMapping[perm.MappingID] = append(dsPermsByMapping[perm.MappingID], perm)
+	}
 	grafanaTeams, grafanaTeamsErr, grafanaUsers, grafanaUsersErr, entraGroups, entraGroupsErr, entraUsers, entraUsersErr, folderPerms, folderPermsErr := s.getExternalData(orgs, mappings)
 	var planGroups []planTeamGroup
+	var planSummary *store.PlanSummary
 	if plan != nil {
 		planGroups = buildPlanGroups(plan.Actions)
+		planSummary, err = s.store.GetPlanSummary(plan.ID)
+		if err != nil {
+			return pageData{}, fmt.Errorf("failed to load plan summary: %w", err)
+		}
 	}
 	lastRun, lastStatus := s.syncer.LastRun()
+	s.cacheMu.RLock()
+	refreshedAt := s.cache.refreshedAt
+	s.cacheMu.RUnlock()
+	var sparkline *durationSparkline
+	if runs, err := s.store.ListSyncRuns(syncRunsLimit); err != nil {
+		log.Printf("ui: sync runs load failed: %v", err)
+	} else {
+		sparkline = newDurationSparkline(runs)
+	}
 	autoSyncEnabled := true
 	if enabled, err := s.store.AutoSyncEnabled(); err != nil {
 		log.Printf("ui: auto sync state load failed: %v", err)
@@ -230,23 +691,37 @@ func (s *Server) buildPageData() (pageData, error) {
 		autoSyncEnabled = enabled
 	}
 	return pageData{
-		Orgs:            orgs,
-		Mappings:        mappings,
-		GrafanaTeams:    grafanaTeams,
-		GrafanaTeamsErr: grafanaTeamsErr,
-		GrafanaUsers:    grafanaUsers,
-		GrafanaUsersErr: grafanaUsersErr,
-		EntraGroups:     entraGroups,
-		EntraGroupsErr:  entraGroupsErr,
-		EntraUsers:      entraUsers,
-		EntraUsersErr:   entraUsersErr,
-		FolderPerms:     folderPerms,
-		FolderPermsErr:  folderPermsErr,
-		PlanGroups:      planGroups,
-		LastRun:         formatTime(lastRun),
-		LastStatus:      lastStatus,
-		Plan:            plan,
-		AutoSyncEnabled: autoSyncEnabled,
+		Orgs:              orgs,
+		Tenants:           tenants,
+		Mappings:          mappings,
+		GrafanaTeams:      grafanaTeams,
+		GrafanaTeamsErr:   grafanaTeamsErr,
+		GrafanaUsers:      grafanaUsers,
+		GrafanaUsersErr:   grafanaUsersErr,
+		EntraGroups:       entraGroups,
+		EntraGroupsErr:    entraGroupsErr,
+		EntraUsers:        entraUsers,
+		EntraUsersErr:     entraUsersErr,
+		FolderPerms:       folderPerms,
+		FolderPermsErr:    folderPermsErr,
+		PlanGroups:        planGroups,
+		PlanExpiry:        newPlanExpiry(plan, s.syncer.PlanMaxAge()),
+		StartupHealth:     s.startupHealth,
+		LatencyWarnings:   s.latencyWarnings(),
+		NoProvenance:      s.grafana != nil && s.grafana.DisableProvenance(),
+		MappingIssues:     s.syncer.LastValidationIssues(),
+		UnmappedTeams:     countUnmapped(len(grafanaTeams), func(i int) string { return grafanaTeams[i].MappingState }),
+		UnmappedGroups:    countUnmapped(len(entraGroups), func(i int) string { return entraGroups[i].MappingState }),
+		DuplicateMappings: len(duplicates),
+		DataSourcePerms:   dsPermsByMapping,
+		LastRun:           formatTime(lastRun),
+		LastStatus:        lastStatus,
+		DurationSparkline: sparkline,
+		DataRefreshedAt:   formatTime(refreshedAt),
+		Plan:              plan,
+		PlanSummary:       planSummary,
+		AutoSyncEnabled:   autoSyncEnabled,
+		ReadOnly:          s.syncer.ReadOnly(),
 	}, nil
 }
 
@@ -296,6 +771,37 @@ func (s *Server) refreshExternalData() {
 	s.cache = cache
 	s.refresh = false
 	s.cacheMu.Unlock()
+
+	s.saveConnectivity()
+}
+
+// saveConnectivity persists the clients' LastOK and LastError so the status
+// survives a restart.
+func (s *Server) saveConnectivity() {
+	if s.grafana != nil {
+		status := connStatus(s.grafana.LastOK(), s.grafana.LastError(), s.grafana.LastErrorAt())
+		if err := s.store.SetConnectivity("grafana", status); err != nil {
+			log.Printf("ui: save grafana connectivity failed: %v", err)
+		}
+	}
+	if s.entra != nil {
+		status := connStatus(s.entra.LastOK(), s.entra.LastError(), s.entra.LastErrorAt())
+		if err := s.store.SetConnectivity("entra", status); err != nil {
+			log.Printf("ui: save entra connectivity failed: %v", err)
+		}
+	}
+}
+
+func connStatus(lastOK time.Time, lastErr error, lastErrAt time.Time) store.ConnStatus {
+	var status store.ConnStatus
+	if !lastOK.IsZero() {
+		status.LastOK = lastOK.UTC().Format(time.RFC3339)
+	}
+	if lastErr != nil {
+		status.LastError = lastErr.Error()
+		status.LastErrorAt = lastErrAt.UTC().Format(time.RFC3339)
+	}
+	return status
 }
 
 func (s *Server) getExternalData(orgs []store.Org, mappings []store.Mapping) ([]grafanaTeamView, string, []grafanaUserView, string, []entraGroupView, string, []entraUserView, string, []folderPermGroup, string) {
@@ -329,6 +835,7 @@ func (s *Server) handleGrafanaSettings(w http.ResponseWriter, r *http.Request) {
 	}
 	data.CurrentPage = "grafana"
 	data.ContentTemplate = "content-grafana"
+	data.FormError = formErrorFromQuery(r)
 	if err := s.tmpl.ExecuteTemplate(w, "layout.html", data); err != nil {
 		log.Printf("render error: %v", err)
 	}
@@ -375,16 +882,60 @@ func (s *Server) handleFolderPermissions(w http.ResponseWriter, r *http.Request)
 	log.Printf("ui: folder permissions rendered in %s", time.Since(start).Round(time.Millisecond))
 }
 
-func (s *Server) handleAPIStatus(w http.ResponseWriter, r *http.Request) {
+// handleMetrics serves Prometheus metrics. The sync alert rule provisioned by
+// PROVISION_SYNC_ALERTS queries the last sync action timestamp.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	orgs, err := s.store.ListOrgs()
+	last, err := s.store.LastSyncActionTime()
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to load orgs: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("failed to load last sync action: %v", err), http.StatusInternalServerError)
+		return
+	}
+	var timestamp int64
+	if !last.IsZero() {
+		timestamp = last.Unix()
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP %s Unix time of the newest recorded sync action, 0 when there is none.\n", syncer.LastSyncActionMetric)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", syncer.LastSyncActionMetric)
+	fmt.Fprintf(w, "%s %d\n", syncer.LastSyncActionMetric, timestamp)
+	fmt.Fprintf(w, "# HELP %s Scheduled syncs skipped because they fell outside the sync window.\n", syncer.SyncWindowSkippedMetric)
+	fmt.Fprintf(w, "# TYPE %s counter\n", syncer.SyncWindowSkippedMetric)
+	fmt.Fprintf(w, "%s %d\n", syncer.SyncWindowSkippedMetric, s.syncer.WindowSkips())
+}
+
+func (s *Server) handleAPIStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	var orgs []store.Org
+	if raw := r.URL.Query().Get("grafana_org_id"); raw != "" {
+		grafanaOrgID, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || grafanaOrgID <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "grafana_org_id must be a positive integer")
+			return
+		}
+		org, err := s.store.GetOrgByGrafanaID(grafanaOrgID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to load org: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if org == nil {
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("no org configured for Grafana org %d", grafanaOrgID))
+			return
+		}
+		orgs = []store.Org{*org}
+	} else {
+		var err error
+		if orgs, err = s.store.ListOrgs(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to load orgs: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
 
 	type windowCounts struct {
 		Users int `json:"users"`
@@ -404,12 +955,19 @@ func (s *Server) handleAPIStatus(w http.ResponseWriter, r *http.Request) {
 		Changes7Days     windowCounts `json:"changes_last_7_days"`
 	}
 	type apiStatus struct {
-		GeneratedAt    string      `json:"generated_at"`
-		GrafanaOK      bool        `json:"grafana_ok"`
-		EntraOK        bool        `json:"entra_ok"`
-		GrafanaLastOK  string      `json:"grafana_last_ok"`
-		EntraLastOK    string      `json:"entra_last_ok"`
-		Orgs           []orgStatus `json:"orgs"`
+		GeneratedAt   string            `json:"generated_at"`
+		GrafanaOK     bool              `json:"grafana_ok"`
+		EntraOK       bool              `json:"entra_ok"`
+		EntraError    string            `json:"entra_error,omitempty"`
+		GrafanaLastOK string            `json:"grafana_last_ok"`
+		EntraLastOK   string            `json:"entra_last_ok"`
+		Connectivity  store.ConnHistory `json:"connectivity"`
+		ReadOnly      bool              `json:"read_only"`
+		WindowSkipped int64             `json:"sync_window_skipped_total"`
+		SyncDuration  *durationStats    `json:"sync_duration_ms,omitempty"`
+		AutoLogin     bool              `json:"oauth_auto_login"`
+		Warnings      []string          `json:"warnings,omitempty"`
+		Orgs          []orgStatus       `json:"orgs"`
 	}
 
 	now := time.Now().UTC()
@@ -418,9 +976,12 @@ func (s *Server) handleAPIStatus(w http.ResponseWriter, r *http.Request) {
 	since7d := now.AddDate(0, 0, -7)
 
 	entraOK := false
+	entraError := ""
 	if s.entra != nil {
 		if _, err := s.entra.ListGroups(); err == nil {
 			entraOK = true
+		} else {
+			entraError = err.Error()
 		}
 	}
 
@@ -428,9 +989,9 @@ func (s *Server) handleAPIStatus(w http.ResponseWriter, r *http.Request) {
 	grafanaOK := s.grafana != nil
 	for _, org := range orgs {
 		status := orgStatus{
-			OrgID:        org.ID,
-			GrafanaOrgID: org.GrafanaOrgID,
-			Name:         org.Name,
+			OrgID:         org.ID,
+			GrafanaOrgID:  org.GrafanaOrgID,
+			Name:          org.Name,
 			EntraAccessOK: entraOK,
 		}
 		if s.grafana != nil {
@@ -478,6 +1039,10 @@ func (s *Server) handleAPIStatus(w http.ResponseWriter, r *http.Request) {
 		orgStatuses = append(orgStatuses, status)
 	}
 
+	connectivity, err := s.store.GetConnectivityHistory()
+	if err != nil {
+		log.Printf("api: status connectivity load failed: %v", err)
+	}
 	grafanaLastOK := "never"
 	if s.grafana != nil {
 		grafanaLastOK = formatTime(s.grafana.LastOK())
@@ -491,16 +1056,235 @@ func (s *Server) handleAPIStatus(w http.ResponseWriter, r *http.Request) {
 		GeneratedAt:   now.Format(time.RFC3339),
 		GrafanaOK:     grafanaOK,
 		EntraOK:       entraOK,
+		EntraError:    entraError,
 		GrafanaLastOK: grafanaLastOK,
 		EntraLastOK:   entraLastOK,
+		Connectivity:  connectivity,
+		ReadOnly:      s.syncer.ReadOnly(),
+		WindowSkipped: s.syncer.WindowSkips(),
+		AutoLogin:     s.syncer.OAuthAutoLogin(),
 		Orgs:          orgStatuses,
 	}
+	if runs, err := s.store.ListSyncRuns(syncRunsLimit); err != nil {
+		log.Printf("api: status sync runs load failed: %v", err)
+	} else {
+		resp.SyncDuration = newDurationStats(runs)
+	}
+	if resp.AutoLogin {
+		resp.Warnings = append(resp.Warnings, "Grafana OAuth auto-login is enabled: users can't sign in with a local password, so missing users are invited instead of created")
+	}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		log.Printf("api: status encode failed: %v", err)
 	}
 }
 
+// handleAPIOrg routes /api/orgs/{id}, /api/orgs/{id}/grafana-org-id and
+// /api/orgs/{id}/stats.
+func (s *Server) handleAPIOrg(w http.ResponseWriter, r *http.Request) {
+	rawID, op, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/orgs/"), "/")
+	switch op {
+	case "stats":
+		s.handleOrgStats(w, r)
+		return
+	case "", "grafana-org-id":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if rawID == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPatch {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_id", "org id must be a number", "id")
+		return
+	}
+	org, err := s.store.GetOrg(id)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load org: %v", err), "")
+		return
+	}
+	if org == nil {
+		writeAPIError(w, http.StatusNotFound, "org_not_found", fmt.Sprintf("org %d does not exist", id), "id")
+		return
+	}
+	if op == "grafana-org-id" {
+		s.patchOrgGrafanaID(w, r, org)
+	} else {
+		s.patchOrg(w, r, org)
+	}
+}
+
+// patchOrg serves PATCH /api/orgs/{id}: fields left out of the JSON body
+// keep their value. Only default_role can be changed.
+func (s *Server) patchOrg(w http.ResponseWriter, r *http.Request, org *store.Org) {
+	var in struct {
+		DefaultRole *string `json:"default_role"`
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_json", fmt.Sprintf("invalid JSON body: %v", err), "")
+		return
+	}
+	if in.DefaultRole != nil {
+		role, ok := canonicalOrgRole(*in.DefaultRole)
+		if !ok || role == "" {
+			writeAPIError(w, http.StatusUnprocessableEntity, "invalid_default_role", "default role must be Viewer, Editor or Admin", "default_role")
+			return
+		}
+		if err := s.store.UpdateOrgDefaultRole(org.ID, role); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to update org: %v", err), "")
+			return
+		}
+		org.DefaultRole = role
+	}
+	writeOrgJSON(w, org)
+}
+
+// patchOrgGrafanaID serves PATCH /api/orgs/{id}/grafana-org-id, which points
+// an org at a different Grafana org, e.g. after the Grafana org was
+// recreated with a new ID.
+func (s *Server) patchOrgGrafanaID(w http.ResponseWriter, r *http.Request, org *store.Org) {
+	var in struct {
+		GrafanaOrgID *int64 `json:"grafana_org_id"`
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_json", fmt.Sprintf("invalid JSON body: %v", err), "")
+		return
+	}
+	if in.GrafanaOrgID == nil || *in.GrafanaOrgID <= 0 {
+		writeAPIError(w, http.StatusUnprocessableEntity, "invalid_grafana_org_id", "Grafana org ID must be a positive number", "grafana_org_id")
+		return
+	}
+	err := s.store.SetOrgGrafanaID(org.ID, *in.GrafanaOrgID)
+	if errors.Is(err, store.ErrDuplicate) {
+		writeAPIError(w, http.StatusConflict, "duplicate_org", fmt.Sprintf("Grafana org %d is already configured", *in.GrafanaOrgID), "grafana_org_id")
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to update org: %v", err), "")
+		return
+	}
+	log.Printf("api: org %d moved from Grafana org %d to %d", org.ID, org.GrafanaOrgID, *in.GrafanaOrgID)
+	org.GrafanaOrgID = *in.GrafanaOrgID
+	writeOrgJSON(w, org)
+}
+
+func writeOrgJSON(w http.ResponseWriter, org *store.Org) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"id":             org.ID,
+		"grafana_org_id": org.GrafanaOrgID,
+		"name":           org.Name,
+		"default_role":   org.DefaultRole,
+		"tenant_id":      org.TenantID,
+	}); err != nil {
+		log.Printf("api: org encode failed: %v", err)
+	}
+}
+
+// handleOrgStats serves GET /api/orgs/{id}/stats: membership counts from the
+// cached Grafana data and sync activity from the store for one org.
+func (s *Server) handleOrgStats(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/orgs/")
+	rawID, ok := strings.CutSuffix(rest, "/stats")
+	if !ok || rawID == "" || strings.Contains(rawID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_id", "org id must be a number", "id")
+		return
+	}
+	org, err := s.store.GetOrg(id)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load org: %v", err), "")
+		return
+	}
+	if org == nil {
+		writeAPIError(w, http.StatusNotFound, "org_not_found", fmt.Sprintf("org %d does not exist", id), "id")
+		return
+	}
+
+	type orgStats struct {
+		OrgID        int64  `json:"org_id"`
+		GrafanaOrgID int64  `json:"grafana_org_id"`
+		Name         string `json:"name"`
+		UserCount    int    `json:"user_count"`
+		TeamCount    int    `json:"team_count"`
+		MappingCount int    `json:"mapping_count"`
+		LastSyncAt   string `json:"last_sync_at"`
+		ActionsToday int    `json:"actions_today"`
+		Actions7d    int    `json:"actions_7d"`
+	}
+	stats := orgStats{OrgID: org.ID, GrafanaOrgID: org.GrafanaOrgID, Name: org.Name}
+
+	if s.grafana != nil {
+		if users, err := s.syncer.ListOrgUsers(org.GrafanaOrgID); err != nil {
+			log.Printf("api: org stats users fetch failed org=%d: %v", org.GrafanaOrgID, err)
+		} else {
+			stats.UserCount = len(users)
+		}
+		s.cacheMu.RLock()
+		cached := !s.cache.refreshedAt.IsZero()
+		teams := s.cache.grafanaTeams
+		s.cacheMu.RUnlock()
+		if cached {
+			for _, team := range teams {
+				if team.OrgID == org.GrafanaOrgID {
+					stats.TeamCount++
+				}
+			}
+		} else if live, err := s.grafana.ListTeams(org.GrafanaOrgID); err != nil {
+			log.Printf("api: org stats teams fetch failed org=%d: %v", org.GrafanaOrgID, err)
+		} else {
+			stats.TeamCount = len(live)
+		}
+	}
+
+	if stats.MappingCount, err = s.store.CountMappingsByOrg(org.ID); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to count mappings: %v", err), "")
+		return
+	}
+	last, err := s.store.LatestSyncActionTime(org.ID)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load last sync: %v", err), "")
+		return
+	}
+	if !last.IsZero() {
+		stats.LastSyncAt = last.UTC().Format(time.RFC3339)
+	}
+	now := time.Now().UTC()
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if stats.ActionsToday, err = s.store.CountSyncActionsSince(org.ID, startOfDay); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to count sync actions: %v", err), "")
+		return
+	}
+	if stats.Actions7d, err = s.store.CountSyncActionsSince(org.ID, now.AddDate(0, 0, -7)); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to count sync actions: %v", err), "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		log.Printf("api: org stats encode failed: %v", err)
+	}
+}
+
 func (s *Server) handleSyncPending(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -556,22 +1340,229 @@ func (s *Server) handleCreateOrg(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("invalid form: %v", err), http.StatusBadRequest)
 		return
 	}
+	const formPage = "/grafana#add-org"
 	orgID, err := strconv.ParseInt(r.FormValue("grafana_org_id"), 10, 64)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("invalid grafana_org_id: %v", err), http.StatusBadRequest)
+	if err != nil || orgID <= 0 {
+		s.formError(w, r, formPage, http.StatusBadRequest, "invalid_grafana_org_id", "Grafana org ID must be a positive number", "grafana_org_id")
 		return
 	}
 	name := r.FormValue("name")
-	defaultRole := r.FormValue("default_role")
+	defaultRole, ok := canonicalOrgRole(r.FormValue("default_role"))
+	if !ok {
+		s.formError(w, r, formPage, http.StatusBadRequest, "invalid_default_role", "default role must be Viewer, Editor or Admin", "default_role")
+		return
+	}
 	if defaultRole == "" {
 		defaultRole = "Viewer"
 	}
-	_, err = s.store.CreateOrg(store.Org{GrafanaOrgID: orgID, Name: name, DefaultRole: defaultRole})
+	tenantID, apiErr := s.parseTenantRef(r.FormValue("tenant_id"))
+	if apiErr != nil {
+		s.formError(w, r, formPage, http.StatusBadRequest, apiErr.Code, apiErr.Message, apiErr.Field)
+		return
+	}
+	_, err = s.store.CreateOrg(store.Org{GrafanaOrgID: orgID, Name: name, DefaultRole: defaultRole, TenantID: tenantID})
+	if errors.Is(err, store.ErrDuplicate) {
+		s.formError(w, r, formPage, http.StatusConflict, "duplicate_org", fmt.Sprintf("Grafana org %d is already configured", orgID), "grafana_org_id")
+		return
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to create org: %v", err), http.StatusBadRequest)
+		s.formError(w, r, formPage, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to create org: %v", err), "")
 		return
 	}
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	if wantsJSON(r) {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// parseTenantRef parses a tenant_id form value; empty or 0 selects the
+// default tenant.
+func (s *Server) parseTenantRef(raw string) (int64, *APIError) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" || raw == "0" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || id < 0 {
+		return 0, &APIError{Code: "invalid_tenant", Message: "tenant must be a tenant id", Field: "tenant_id"}
+	}
+	tenant, err := s.store.GetTenant(id)
+	if err != nil {
+		return 0, &APIError{Code: "internal_error", Message: fmt.Sprintf("failed to load tenant: %v", err)}
+	}
+	if tenant == nil {
+		return 0, &APIError{Code: "unknown_tenant", Message: fmt.Sprintf("tenant %d does not exist", id), Field: "tenant_id"}
+	}
+	return id, nil
+}
+
+func (s *Server) handleSetOrgTenant(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, fmt.Sprintf("invalid form: %v", err), http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid org id: %v", err), http.StatusBadRequest)
+		return
+	}
+	tenantID, apiErr := s.parseTenantRef(r.FormValue("tenant_id"))
+	if apiErr != nil {
+		http.Error(w, apiErr.Message, http.StatusBadRequest)
+		return
+	}
+	if err := s.store.SetOrgTenant(id, tenantID); err != nil {
+		http.Error(w, fmt.Sprintf("failed to update org tenant: %v", err), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/grafana", http.StatusSeeOther)
+}
+
+// handleAPITenants manages the Entra tenants orgs can be assigned to.
+// GET lists them without secrets, POST creates one, and PUT and DELETE
+// address one by the id query parameter. A PUT without client_secret keeps
+// the stored secret.
+func (s *Server) handleAPITenants(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		tenants, err := s.store.ListTenants()
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load tenants: %v", err), "")
+			return
+		}
+		result := []store.Tenant{}
+		for _, tenant := range tenants {
+			tenant.ClientSecret = ""
+			result = append(result, tenant)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			log.Printf("api: tenants encode failed: %v", err)
+		}
+		return
+	case http.MethodPost, http.MethodPut:
+	case http.MethodDelete:
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_id", "id query parameter is required", "id")
+			return
+		}
+		if err := s.store.DeleteTenant(id); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to delete tenant: %v", err), "")
+			return
+		}
+		s.reloadTenants()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var in store.Tenant
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_json", fmt.Sprintf("invalid JSON body: %v", err), "")
+		return
+	}
+	in.Name = strings.TrimSpace(in.Name)
+	in.TenantID = strings.TrimSpace(in.TenantID)
+	in.ClientID = strings.TrimSpace(in.ClientID)
+	in.AuthorityBaseURL = strings.TrimRight(strings.TrimSpace(in.AuthorityBaseURL), "/")
+	in.GraphBaseURL = strings.TrimRight(strings.TrimSpace(in.GraphBaseURL), "/")
+	for _, required := range []struct{ field, value string }{
+		{"name", in.Name},
+		{"tenant_id", in.TenantID},
+		{"client_id", in.ClientID},
+	} {
+		if required.value == "" {
+			writeAPIError(w, http.StatusBadRequest, "missing_field", required.field+" is required", required.field)
+			return
+		}
+	}
+
+	status := http.StatusCreated
+	if r.Method == http.MethodPut {
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_id", "id query parameter is required", "id")
+			return
+		}
+		existing, err := s.store.GetTenant(id)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load tenant: %v", err), "")
+			return
+		}
+		if existing == nil {
+			writeAPIError(w, http.StatusNotFound, "not_found", fmt.Sprintf("tenant %d does not exist", id), "id")
+			return
+		}
+		in.ID = id
+		if in.ClientSecret == "" {
+			in.ClientSecret = existing.ClientSecret
+		}
+		err = s.store.UpdateTenant(in)
+		if errors.Is(err, store.ErrNoEncryptionKey) {
+			writeAPIError(w, http.StatusForbidden, "encryption_disabled", "tenants cannot be saved: DATA_ENCRYPTION_KEY not set", "")
+			return
+		}
+		if errors.Is(err, store.ErrDuplicate) {
+			writeAPIError(w, http.StatusConflict, "duplicate_tenant", fmt.Sprintf("a tenant named %q already exists", in.Name), "name")
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to update tenant: %v", err), "")
+			return
+		}
+		status = http.StatusOK
+	} else {
+		if in.ClientSecret == "" {
+			writeAPIError(w, http.StatusBadRequest, "missing_field", "client_secret is required", "client_secret")
+			return
+		}
+		id, err := s.store.CreateTenant(in)
+		if errors.Is(err, store.ErrNoEncryptionKey) {
+			writeAPIError(w, http.StatusForbidden, "encryption_disabled", "tenants cannot be saved: DATA_ENCRYPTION_KEY not set", "")
+			return
+		}
+		if errors.Is(err, store.ErrDuplicate) {
+			writeAPIError(w, http.StatusConflict, "duplicate_tenant", fmt.Sprintf("a tenant named %q already exists", in.Name), "name")
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to create tenant: %v", err), "")
+			return
+		}
+		in.ID = id
+	}
+	s.reloadTenants()
+	log.Printf("api: tenant %d (%s) saved", in.ID, in.Name)
+
+	in.ClientSecret = ""
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(in); err != nil {
+		log.Printf("api: tenant encode failed: %v", err)
+	}
+}
+
+// entraForOrg returns the Entra client of the org's tenant, falling back to
+// the default client.
+func (s *Server) entraForOrg(org *store.Org) *entra.Client {
+	if org == nil || s.syncer == nil {
+		return s.entra
+	}
+	return s.syncer.EntraForOrg(*org)
+}
+
+func (s *Server) reloadTenants() {
+	if err := s.syncer.ReloadTenants(); err != nil {
+		log.Printf("api: reload tenants failed: %v", err)
+	}
 }
 
 func (s *Server) handleDeleteOrg(w http.ResponseWriter, r *http.Request) {
@@ -595,6 +1586,24 @@ func (s *Server) handleDeleteOrg(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// mappingInput is a mapping creation request from the HTML form or the
+// JSON API.
+type mappingInput struct {
+	OrgID              int64  `json:"org_id"`
+	GrafanaTeamName    string `json:"grafana_team_name"`
+	ExternalGroupID    string `json:"external_group_id"`
+	ExternalGroupName  string `json:"external_group_name"`
+	TeamRole           string `json:"team_role"`
+	RoleOverride       string `json:"role_override"`
+	RemovalGracePeriod string `json:"removal_grace_period"`
+	AllowRemoveMembers *bool  `json:"allow_remove_members"`
+	ContactPointUID    string `json:"contact_point_uid"`
+	TeamPrefsJSON      string `json:"team_prefs_json"`
+	// DataSourceTemplateJSON is a template for a data source provisioned
+	// for the team.
+	DataSourceTemplateJSON string `json:"datasource_template_json"`
+}
+
 func (s *Server) handleCreateMapping(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -604,47 +1613,155 @@ func (s *Server) handleCreateMapping(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("invalid form: %v", err), http.StatusBadRequest)
 		return
 	}
+	const formPage = "/#add-mapping"
 	orgID, err := strconv.ParseInt(r.FormValue("org_id"), 10, 64)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("invalid org id: %v", err), http.StatusBadRequest)
+		s.formError(w, r, formPage, http.StatusBadRequest, "invalid_org_id", "org must be selected", "org_id")
 		return
 	}
-	teamName := r.FormValue("grafana_team_name")
-	externalGroupID := r.FormValue("external_group_id")
-	externalGroupName := r.FormValue("external_group_name")
-	if externalGroupID == "" && externalGroupName != "" && s.entra != nil {
-		groups, err := s.entra.ListGroups()
-		if err == nil {
-			for _, group := range groups {
-				if strings.EqualFold(group.DisplayName, externalGroupName) {
-					externalGroupID = group.ID
-					break
-				}
+	allowRemove, err := parseOptionalBool(r.FormValue("allow_remove_members"))
+	if err != nil {
+		s.formError(w, r, formPage, http.StatusBadRequest, "invalid_allow_remove_members", err.Error(), "allow_remove_members")
+		return
+	}
+	_, status, apiErr := s.createMapping(mappingInput{
+		OrgID:                  orgID,
+		GrafanaTeamName:        r.FormValue("grafana_team_name"),
+		ExternalGroupID:        r.FormValue("external_group_id"),
+		ExternalGroupName:      r.FormValue("external_group_name"),
+		TeamRole:               r.FormValue("team_role"),
+		RoleOverride:           r.FormValue("role_override"),
+		RemovalGracePeriod:     r.FormValue("removal_grace_period"),
+		AllowRemoveMembers:     allowRemove,
+		ContactPointUID:        r.FormValue("contact_point_uid"),
+		TeamPrefsJSON:          r.FormValue("team_prefs_json"),
+		DataSourceTemplateJSON: r.FormValue("datasource_template_json"),
+	})
+	if apiErr != nil {
+		if wantsJSON(r) {
+			writeAPIErrorValue(w, status, *apiErr)
+			return
+		}
+		s.formError(w, r, formPage, status, apiErr.Code, apiErr.Message, apiErr.Field)
+		return
+	}
+	if wantsJSON(r) {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// createMapping validates in and stores the mapping. On failure it returns
+// the HTTP status and a structured error.
+func (s *Server) createMapping(in mappingInput) (int64, int, *APIError) {
+	fail := func(status int, code, message, field string) (int64, int, *APIError) {
+		return 0, status, &APIError{Code: code, Message: message, Field: field}
+	}
+	org, err := s.store.GetOrg(in.OrgID)
+	if err != nil {
+		return fail(http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load org: %v", err), "")
+	}
+	if org == nil {
+		return fail(http.StatusNotFound, "org_not_found", fmt.Sprintf("org %d does not exist", in.OrgID), "org_id")
+	}
+	teamName := strings.TrimSpace(in.GrafanaTeamName)
+	if teamName == "" {
+		return fail(http.StatusBadRequest, "missing_team_name", "Grafana team name is required", "grafana_team_name")
+	}
+	externalGroupID := strings.TrimSpace(in.ExternalGroupID)
+	externalGroupName := strings.TrimSpace(in.ExternalGroupName)
+	if entraClient := s.entraForOrg(org); externalGroupID == "" && externalGroupName != "" && entraClient != nil {
+		group, err := entraClient.FindGroupByDisplayName(externalGroupName)
+		var ambiguous *entra.ErrGroupAmbiguous
+		switch {
+		case errors.As(err, &ambiguous):
+			ids := make([]string, 0, len(ambiguous.Matches))
+			matches := make([]map[string]string, 0, len(ambiguous.Matches))
+			for _, match := range ambiguous.Matches {
+				ids = append(ids, match.ID)
+				matches = append(matches, map[string]string{"id": match.ID, "display_name": match.DisplayName, "mail": match.Mail})
 			}
+			return 0, http.StatusUnprocessableEntity, &APIError{
+				Code:    "ambiguous_group",
+				Message: fmt.Sprintf("%d Entra groups are named %q (%s); specify the group ID", len(ids), externalGroupName, strings.Join(ids, ", ")),
+				Field:   "external_group_id",
+				Details: matches,
+			}
+		case errors.Is(err, entra.ErrGroupNotFound):
+		case err != nil:
+			return fail(http.StatusBadGateway, "entra_error", fmt.Sprintf("failed to look up Entra group: %v", err), "external_group_name")
+		default:
+			externalGroupID = group.ID
 		}
 	}
 	if externalGroupID == "" {
-		http.Error(w, "missing Entra group id", http.StatusBadRequest)
-		return
+		return fail(http.StatusBadRequest, "missing_group", "Entra group not found", "external_group_name")
 	}
-	teamRole := strings.ToLower(strings.TrimSpace(r.FormValue("team_role")))
-	if teamRole != "admin" {
+	teamRole := strings.ToLower(strings.TrimSpace(in.TeamRole))
+	if teamRole == "" {
 		teamRole = "member"
 	}
-	roleOverride := r.FormValue("role_override")
-	_, err = s.store.CreateMapping(store.Mapping{
-		OrgID:             orgID,
-		GrafanaTeamName:   teamName,
-		ExternalGroupID:   externalGroupID,
-		ExternalGroupName: externalGroupName,
-		TeamRole:          teamRole,
-		RoleOverride:      roleOverride,
+	if teamRole != "member" && teamRole != "admin" {
+		return fail(http.StatusBadRequest, "invalid_team_role", "team role must be member or admin", "team_role")
+	}
+	roleOverride, ok := canonicalOrgRole(in.RoleOverride)
+	if !ok {
+		return fail(http.StatusBadRequest, "invalid_role_override", "org role must be Viewer, Editor, Admin or empty", "role_override")
+	}
+	removalGrace, err := parseGracePeriod(in.RemovalGracePeriod)
+	if err != nil {
+		return fail(http.StatusBadRequest, "invalid_removal_grace_period", err.Error(), "removal_grace_period")
+	}
+	teamPrefs, err := parseTeamPrefs(in.TeamPrefsJSON)
+	if err != nil {
+		return fail(http.StatusBadRequest, "invalid_team_prefs_json", err.Error(), "team_prefs_json")
+	}
+	dsTemplate, err := parseDataSourceTemplate(in.DataSourceTemplateJSON)
+	if err != nil {
+		return fail(http.StatusBadRequest, "invalid_datasource_template_json", err.Error(), "datasource_template_json")
+	}
+	// Checked here for a clear message; older databases with duplicates may
+	// still lack the case-insensitive unique index.
+	groupMappings, err := s.store.GetMappingByGroupID(in.OrgID, externalGroupID)
+	if err != nil {
+		return fail(http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load mappings: %v", err), "")
+	}
+	for _, existing := range groupMappings {
+		if strings.EqualFold(existing.GrafanaTeamName, teamName) {
+			return fail(http.StatusConflict, "duplicate_mapping", fmt.Sprintf("group %s is already mapped to team %s in this org", externalGroupID, existing.GrafanaTeamName), "grafana_team_name")
+		}
+	}
+	// Another mapping of the same team already knows its Grafana team ID.
+	var teamID int64
+	teamMapping, err := s.store.GetMappingByTeamName(in.OrgID, teamName)
+	if err != nil {
+		return fail(http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load mappings: %v", err), "")
+	}
+	if teamMapping != nil {
+		teamID = teamMapping.GrafanaTeamID
+	}
+	id, err := s.store.CreateMapping(store.Mapping{
+		OrgID:                  in.OrgID,
+		GrafanaTeamName:        teamName,
+		GrafanaTeamID:          teamID,
+		ExternalGroupID:        externalGroupID,
+		ExternalGroupName:      externalGroupName,
+		TeamRole:               teamRole,
+		RoleOverride:           roleOverride,
+		RemovalGracePeriod:     removalGrace,
+		AllowRemoveMembers:     in.AllowRemoveMembers,
+		ContactPointUID:        strings.TrimSpace(in.ContactPointUID),
+		TeamPrefsJSON:          teamPrefs,
+		DataSourceTemplateJSON: dsTemplate,
 	})
+	if errors.Is(err, store.ErrDuplicate) {
+		return fail(http.StatusConflict, "duplicate_mapping", fmt.Sprintf("group %s is already mapped to team %s in this org", externalGroupID, teamName), "grafana_team_name")
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to create mapping: %v", err), http.StatusBadRequest)
-		return
+		return fail(http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to create mapping: %v", err), "")
 	}
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return id, http.StatusCreated, nil
 }
 
 func (s *Server) handleDeleteMapping(w http.ResponseWriter, r *http.Request) {
@@ -703,10 +1820,18 @@ func (s *Server) handleUpdateMapping(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	if externalGroupID == "" && externalGroupName != "" {
-		orgs, orgErr := s.store.ListOrgs()
-		mappings, mapErr := s.store.ListMappings()
-		if orgErr == nil && mapErr == nil {
-			_, _, _, _, entraGroups, _, _, _, _, _ := s.getExternalData(orgs, mappings)
+		org, err := s.store.GetOrg(orgID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to load org: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if org == nil {
+			http.Error(w, fmt.Sprintf("org %d does not exist", orgID), http.StatusNotFound)
+			return
+		}
+		// The cached group list only covers the default tenant.
+		if org.TenantID == 0 {
+			_, _, _, _, entraGroups, _, _, _, _, _ := s.getExternalData(nil, nil)
 			for _, group := range entraGroups {
 				if strings.EqualFold(group.DisplayName, externalGroupName) {
 					externalGroupID = group.ID
@@ -714,15 +1839,15 @@ func (s *Server) handleUpdateMapping(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 		}
-	}
-	if externalGroupID == "" && externalGroupName != "" && s.entra != nil {
-		groups, err := s.entra.ListGroups()
-		if err == nil {
-			for _, group := range groups {
-				if strings.EqualFold(group.DisplayName, externalGroupName) {
-					externalGroupID = group.ID
-					break
-				}
+		if entraClient := s.entraForOrg(org); externalGroupID == "" && entraClient != nil {
+			group, err := entraClient.FindGroupByDisplayName(externalGroupName)
+			var ambiguous *entra.ErrGroupAmbiguous
+			if errors.As(err, &ambiguous) {
+				http.Error(w, ambiguous.Error()+"; specify the group ID", http.StatusUnprocessableEntity)
+				return
+			}
+			if err == nil {
+				externalGroupID = group.ID
 			}
 		}
 	}
@@ -735,20 +1860,59 @@ func (s *Server) handleUpdateMapping(w http.ResponseWriter, r *http.Request) {
 		teamRole = "member"
 	}
 	roleOverride := r.FormValue("role_override")
+	removalGrace, err := parseGracePeriod(r.FormValue("removal_grace_period"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	allowRemove, err := parseOptionalBool(r.FormValue("allow_remove_members"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	teamPrefs, err := parseTeamPrefs(r.FormValue("team_prefs_json"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dsTemplate, err := parseDataSourceTemplate(r.FormValue("datasource_template_json"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	groupMappings, err := s.store.GetMappingByGroupID(orgID, externalGroupID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to load mappings: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for _, other := range groupMappings {
+		if other.ID != id && strings.EqualFold(other.GrafanaTeamName, teamName) {
+			http.Error(w, fmt.Sprintf("group %s is already mapped to team %s in this org", externalGroupID, other.GrafanaTeamName), http.StatusConflict)
+			return
+		}
+	}
 	teamID := int64(0)
 	if existingMapping != nil && existingMapping.OrgID == orgID && strings.EqualFold(existingMapping.GrafanaTeamName, teamName) {
 		teamID = existingMapping.GrafanaTeamID
 	}
 	if err := s.store.UpdateMapping(store.Mapping{
-		ID:                id,
-		OrgID:             orgID,
-		GrafanaTeamName:   teamName,
-		GrafanaTeamID:     teamID,
-		ExternalGroupID:   externalGroupID,
-		ExternalGroupName: externalGroupName,
-		TeamRole:          teamRole,
-		RoleOverride:      roleOverride,
-	}); err != nil {
+		ID:                     id,
+		OrgID:                  orgID,
+		GrafanaTeamName:        teamName,
+		GrafanaTeamID:          teamID,
+		ExternalGroupID:        externalGroupID,
+		ExternalGroupName:      externalGroupName,
+		TeamRole:               teamRole,
+		RoleOverride:           roleOverride,
+		RemovalGracePeriod:     removalGrace,
+		AllowRemoveMembers:     allowRemove,
+		ContactPointUID:        strings.TrimSpace(r.FormValue("contact_point_uid")),
+		TeamPrefsJSON:          teamPrefs,
+		DataSourceTemplateJSON: dsTemplate,
+	}); errors.Is(err, store.ErrDuplicate) {
+		http.Error(w, fmt.Sprintf("group %s is already mapped to team %s in this org", externalGroupID, teamName), http.StatusConflict)
+		return
+	} else if err != nil {
 		http.Error(w, fmt.Sprintf("failed to update mapping: %v", err), http.StatusBadRequest)
 		return
 	}
@@ -788,6 +1952,86 @@ func (s *Server) handlePurgeMappings(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// handleSettings shows (GET) and saves (POST) the sync settings that can be
+// changed at runtime. Saving requires ADMIN_API_TOKEN, sent as the
+// admin_token form field or a bearer token.
+func (s *Server) handleSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		start := time.Now()
+		data, err := s.buildPageData()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.CurrentPage = "settings"
+		data.ContentTemplate = "content-settings"
+		data.FormError = formErrorFromQuery(r)
+		data.Settings = s.syncer.RuntimeSettings()
+		data.SettingsEditable = s.adminToken != ""
+		data.SettingsSaved = r.URL.Query().Get("saved") == "1"
+		data.SyncInterval = int(s.currentSyncInterval() / time.Second)
+		if err := s.tmpl.ExecuteTemplate(w, "layout.html", data); err != nil {
+			log.Printf("render error: %v", err)
+		}
+		log.Printf("ui: settings rendered in %s", time.Since(start).Round(time.Millisecond))
+	case http.MethodPost:
+		const formPage = "/settings"
+		if err := r.ParseForm(); err != nil {
+			s.formError(w, r, formPage, http.StatusBadRequest, "invalid_form", fmt.Sprintf("invalid form: %v", err), "")
+			return
+		}
+		if s.adminToken == "" {
+			s.formError(w, r, formPage, http.StatusForbidden, "settings_disabled", "settings cannot be changed: ADMIN_API_TOKEN not set", "")
+			return
+		}
+		token := strings.TrimSpace(r.FormValue("admin_token"))
+		if token == "" {
+			token = strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			s.formError(w, r, formPage, http.StatusUnauthorized, "invalid_admin_token", "invalid admin token", "admin_token")
+			return
+		}
+		role, ok := canonicalOrgRole(r.FormValue("default_user_role"))
+		if !ok || role == "" {
+			s.formError(w, r, formPage, http.StatusBadRequest, "invalid_role", "default user role must be Viewer, Editor or Admin", "default_user_role")
+			return
+		}
+		rawInterval := strings.TrimSpace(r.FormValue("sync_interval_seconds"))
+		var interval time.Duration
+		if rawInterval != "" {
+			seconds, err := strconv.Atoi(rawInterval)
+			if err != nil {
+				seconds = -1
+			}
+			if interval, err = parseSyncInterval(seconds); err != nil {
+				s.formError(w, r, formPage, http.StatusBadRequest, "invalid_sync_interval", err.Error(), "sync_interval_seconds")
+				return
+			}
+		}
+		settings := syncer.RuntimeSettings{
+			AllowCreateUsers:   r.FormValue("allow_create_users") == "true",
+			AllowRemoveMembers: r.FormValue("allow_remove_members") == "true",
+			DefaultUserRole:    role,
+		}
+		if err := s.syncer.SetRuntimeSettings(settings); err != nil {
+			s.formError(w, r, formPage, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to save settings: %v", err), "")
+			return
+		}
+		if rawInterval != "" && interval != s.currentSyncInterval() {
+			if err := s.saveSyncInterval(interval); err != nil {
+				s.formError(w, r, formPage, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to save sync interval: %v", err), "")
+				return
+			}
+		}
+		log.Printf("ui: settings updated allow_create_users=%t allow_remove_members=%t default_user_role=%s", settings.AllowCreateUsers, settings.AllowRemoveMembers, settings.DefaultUserRole)
+		http.Redirect(w, r, formPage+"?saved=1", http.StatusSeeOther)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 func (s *Server) handleAutoSync(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -805,104 +2049,1507 @@ func (s *Server) handleAutoSync(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-func (s *Server) handleFetch(w http.ResponseWriter, r *http.Request) {
+// handleSyncInterval changes the auto-sync interval: POST
+// {"interval_seconds":N}, where 0 turns automatic sync off.
+func (s *Server) handleSyncInterval(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	s.resolveTeamIDs()
-	s.refreshExternalData()
-	http.Redirect(w, r, "/", http.StatusSeeOther)
-}
-
-func (s *Server) resolveTeamIDs() {
-	if s.grafana == nil {
+	if !s.requireAdminToken(w, r) {
 		return
 	}
-	orgs, err := s.store.ListOrgs()
-	if err != nil {
-		log.Printf("ui: resolve team ids failed to load orgs: %v", err)
+	var in struct {
+		IntervalSeconds *int `json:"interval_seconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_json", fmt.Sprintf("invalid JSON body: %v", err), "")
 		return
 	}
-	mappings, err := s.store.ListMappings()
+	if in.IntervalSeconds == nil {
+		writeAPIError(w, http.StatusBadRequest, "missing_interval", "interval_seconds is required", "interval_seconds")
+		return
+	}
+	interval, err := parseSyncInterval(*in.IntervalSeconds)
 	if err != nil {
-		log.Printf("ui: resolve team ids failed to load mappings: %v", err)
+		writeAPIError(w, http.StatusBadRequest, "invalid_sync_interval", err.Error(), "interval_seconds")
 		return
 	}
-	orgByID := map[int64]store.Org{}
-	for _, org := range orgs {
-		orgByID[org.ID] = org
+	if err := s.saveSyncInterval(interval); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to save sync interval: %v", err), "")
+		return
 	}
-	for _, mapping := range mappings {
-		org, ok := orgByID[mapping.OrgID]
-		if !ok || strings.TrimSpace(mapping.GrafanaTeamName) == "" {
-			continue
-		}
-		teamID, found, err := s.grafana.SearchTeam(org.GrafanaOrgID, mapping.GrafanaTeamName)
-		if err != nil {
-			log.Printf("ui: resolve team id failed org=%d team=%s: %v", org.GrafanaOrgID, mapping.GrafanaTeamName, err)
-			continue
-		}
-		if !found || teamID == 0 {
-			continue
-		}
-		if mapping.GrafanaTeamID != teamID {
-			if err := s.store.UpdateMappingTeamID(mapping.ID, teamID); err != nil {
-				log.Printf("ui: resolve team id update failed mapping=%d team=%d: %v", mapping.ID, teamID, err)
-			}
-		}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]int{"interval_seconds": *in.IntervalSeconds}); err != nil {
+		log.Printf("api: sync interval encode failed: %v", err)
 	}
 }
 
-func (s *Server) handlePreview(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleFetch(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	plan, err := s.syncer.BuildPlan()
-	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to build plan: %v", err), http.StatusInternalServerError)
-		return
-	}
-	if _, err := s.store.ReplacePlan(*plan); err != nil {
-		http.Error(w, fmt.Sprintf("failed to store plan: %v", err), http.StatusInternalServerError)
-		return
+	if _, err := s.syncer.ValidateMappings(r.Context()); err != nil {
+		log.Printf("ui: validate mappings failed: %v", err)
 	}
+	s.resolveTeamIDs()
+	s.refreshExternalData()
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-func (s *Server) handleRun(w http.ResponseWriter, r *http.Request) {
+type cacheStatus struct {
+	RefreshedAt    string `json:"refreshed_at"`
+	GrafanaTeamsOK bool   `json:"grafana_teams_ok"`
+	GrafanaUsersOK bool   `json:"grafana_users_ok"`
+	EntraGroupsOK  bool   `json:"entra_groups_ok"`
+	EntraUsersOK   bool   `json:"entra_users_ok"`
+}
+
+func (s *Server) cacheStatus() cacheStatus {
+	s.cacheMu.RLock()
+	defer s.cacheMu.RUnlock()
+	status := cacheStatus{
+		GrafanaTeamsOK: s.cache.grafanaTeamsErr == "",
+		GrafanaUsersOK: s.cache.grafanaUsersErr == "",
+		EntraGroupsOK:  s.cache.entraGroupsErr == "",
+		EntraUsersOK:   s.cache.entraUsersErr == "",
+	}
+	if !s.cache.refreshedAt.IsZero() {
+		status.RefreshedAt = s.cache.refreshedAt.Format(time.RFC3339Nano)
+	}
+	return status
+}
+
+// handleCacheRefresh reloads the external Grafana and Entra data cache
+// synchronously and reports its freshness.
+func (s *Server) handleCacheRefresh(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	plan, err := s.syncer.BuildPlan()
-	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to build plan: %v", err), http.StatusInternalServerError)
-		return
+	s.refreshExternalData()
+	log.Printf("api: external data cache refreshed")
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.cacheStatus()); err != nil {
+		log.Printf("api: cache status encode failed: %v", err)
 	}
-	planID, err := s.store.ReplacePlan(*plan)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to store plan: %v", err), http.StatusInternalServerError)
+}
+
+func (s *Server) handleCacheStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	if err := s.store.UpdatePlanStatus(planID, "applying"); err != nil {
-		log.Printf("plan status update failed: %v", err)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.cacheStatus()); err != nil {
+		log.Printf("api: cache status encode failed: %v", err)
 	}
-	err = s.syncer.ApplyPlan(plan.Actions)
-	s.syncer.RecordRun(err)
-	if err != nil {
-		_ = s.store.UpdatePlanStatus(planID, "failed")
-		http.Error(w, fmt.Sprintf("apply failed: %v", err), http.StatusInternalServerError)
+}
+
+// handleGrafanaTokens saves (POST /api/grafana-tokens) and deletes
+// (DELETE /api/grafana-tokens/{grafana_org_id}) org-scoped Grafana API
+// tokens. Saved tokens are encrypted with DATA_ENCRYPTION_KEY and used for
+// that org's requests instead of the admin credentials.
+func (s *Server) handleGrafanaTokens(w http.ResponseWriter, r *http.Request) {
+	rawID := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/grafana-tokens"), "/")
+	if (rawID == "" && r.Method != http.MethodPost) || (rawID != "" && r.Method != http.MethodDelete) {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	_ = s.store.UpdatePlanStatus(planID, "applied")
+	if !s.requireAdminToken(w, r) {
+		return
+	}
+	if rawID != "" {
+		orgID, err := strconv.ParseInt(rawID, 10, 64)
+		if err != nil || orgID <= 0 {
+			writeAPIError(w, http.StatusBadRequest, "invalid_org_id", "grafana org id must be a positive number", "grafana_org_id")
+			return
+		}
+		deleted, err := s.store.DeleteGrafanaToken(orgID)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to delete token: %v", err), "")
+			return
+		}
+		if !deleted {
+			writeAPIError(w, http.StatusNotFound, "token_not_found", fmt.Sprintf("no token saved for grafana org %d", orgID), "grafana_org_id")
+			return
+		}
+		log.Printf("api: grafana token deleted org=%d", orgID)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var in struct {
+		GrafanaOrgID int64     `json:"grafana_org_id"`
+		Token        string    `json:"token"`
+		ExpiresAt    time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_json", fmt.Sprintf("invalid JSON body: %v", err), "")
+		return
+	}
+	if in.GrafanaOrgID <= 0 {
+		writeAPIError(w, http.StatusBadRequest, "invalid_org_id", "grafana_org_id must be a positive number", "grafana_org_id")
+		return
+	}
+	if strings.TrimSpace(in.Token) == "" {
+		writeAPIError(w, http.StatusBadRequest, "missing_token", "token is required", "token")
+		return
+	}
+	if !in.ExpiresAt.IsZero() && !in.ExpiresAt.After(time.Now()) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_expires_at", "expires_at must be in the future", "expires_at")
+		return
+	}
+	if err := s.store.SetGrafanaToken(in.GrafanaOrgID, strings.TrimSpace(in.Token), in.ExpiresAt); err != nil {
+		if errors.Is(err, store.ErrNoEncryptionKey) {
+			writeAPIError(w, http.StatusForbidden, "encryption_disabled", "tokens cannot be saved: DATA_ENCRYPTION_KEY not set", "")
+			return
+		}
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to store token: %v", err), "")
+		return
+	}
+	log.Printf("api: grafana token saved org=%d", in.GrafanaOrgID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCacheDump returns one slice of the external data cache as it is,
+// without refreshing it, so it can be compared with the live APIs.
+func (s *Server) handleCacheDump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireAdminToken(w, r) {
+		return
+	}
+	resp := struct {
+		RefreshedAt string `json:"cache_refreshed_at"`
+		Error       string `json:"error,omitempty"`
+		Items       any    `json:"items"`
+	}{}
+	s.cacheMu.RLock()
+	if !s.cache.refreshedAt.IsZero() {
+		resp.RefreshedAt = s.cache.refreshedAt.Format(time.RFC3339Nano)
+	}
+	switch strings.TrimPrefix(r.URL.Path, "/api/cache/") {
+	case "grafana-teams":
+		resp.Items, resp.Error = append([]grafanaTeamView{}, s.cache.grafanaTeams...), s.cache.grafanaTeamsErr
+	case "grafana-users":
+		resp.Items, resp.Error = append([]grafanaUserView{}, s.cache.grafanaUsers...), s.cache.grafanaUsersErr
+	case "entra-groups":
+		resp.Items, resp.Error = append([]entraGroupView{}, s.cache.entraGroups...), s.cache.entraGroupsErr
+	case "entra-users":
+		resp.Items, resp.Error = append([]entraUserView{}, s.cache.entraUsers...), s.cache.entraUsersErr
+	}
+	s.cacheMu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("api: cache dump encode failed: %v", err)
+	}
+}
+
+func (s *Server) handleValidateMappings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	issues, err := s.syncer.ValidateMappings(r.Context())
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("failed to validate mappings: %v", err))
+		return
+	}
+	if issues == nil {
+		issues = []syncer.MappingValidationIssue{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(issues); err != nil {
+		log.Printf("api: mapping validation encode failed: %v", err)
+	}
+}
+
+func (s *Server) handleAPIMappings(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var in mappingInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_json", fmt.Sprintf("invalid JSON body: %v", err), "")
+			return
+		}
+		id, status, apiErr := s.createMapping(in)
+		if apiErr != nil {
+			writeAPIErrorValue(w, status, *apiErr)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(map[string]int64{"id": id}); err != nil {
+			log.Printf("api: mapping create encode failed: %v", err)
+		}
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mappings, err := s.store.ListMappings()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("failed to load mappings: %v", err))
+		return
+	}
+	query := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+	teamRole := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("team_role")))
+	roleOverride := strings.TrimSpace(r.URL.Query().Get("role_override"))
+
+	type mappingView struct {
+		ID                     int64  `json:"id"`
+		OrgID                  int64  `json:"org_id"`
+		GrafanaTeamName        string `json:"grafana_team_name"`
+		GrafanaTeamID          int64  `json:"grafana_team_id"`
+		ExternalGroupID        string `json:"external_group_id"`
+		ExternalGroupName      string `json:"external_group_name"`
+		TeamRole               string `json:"team_role"`
+		RoleOverride           string `json:"role_override"`
+		RemovalGracePeriod     string `json:"removal_grace_period"`
+		AllowRemoveMembers     *bool  `json:"allow_remove_members"`
+		ContactPointUID        string `json:"contact_point_uid"`
+		TeamPrefsJSON          string `json:"team_prefs_json"`
+		DataSourceTemplateJSON string `json:"datasource_template_json"`
+	}
+	result := []mappingView{}
+	for _, m := range mappings {
+		if query != "" {
+			haystack := strings.ToLower(m.GrafanaTeamName + " " + m.ExternalGroupName + " " + m.ExternalGroupID)
+			if !strings.Contains(haystack, query) {
+				continue
+			}
+		}
+		if teamRole != "" && teamRole != normalizeMappingTeamRole(m.TeamRole) {
+			continue
+		}
+		if roleOverride != "" {
+			if roleOverride == "none" {
+				if m.RoleOverride != "" {
+					continue
+				}
+			} else if !strings.EqualFold(roleOverride, m.RoleOverride) {
+				continue
+			}
+		}
+		result = append(result, mappingView{
+			ID:                     m.ID,
+			OrgID:                  m.OrgID,
+			GrafanaTeamName:        m.GrafanaTeamName,
+			GrafanaTeamID:          m.GrafanaTeamID,
+			ExternalGroupID:        m.ExternalGroupID,
+			ExternalGroupName:      m.ExternalGroupName,
+			TeamRole:               normalizeMappingTeamRole(m.TeamRole),
+			RoleOverride:           m.RoleOverride,
+			RemovalGracePeriod:     m.RemovalGracePeriod,
+			AllowRemoveMembers:     m.AllowRemoveMembers,
+			ContactPointUID:        m.ContactPointUID,
+			TeamPrefsJSON:          m.TeamPrefsJSON,
+			DataSourceTemplateJSON: m.DataSourceTemplateJSON,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("api: mappings encode failed: %v", err)
+	}
+}
+
+// syncRunsLimit is how many recent sync runs GET /api/sync/runs returns and
+// the duration statistics and sparkline are computed from.
+const syncRunsLimit = 50
+
+func (s *Server) handleSyncRuns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	runs, err := s.store.ListSyncRuns(syncRunsLimit)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("failed to load sync runs: %v", err))
+		return
+	}
+	if runs == nil {
+		runs = []store.SyncRun{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(runs); err != nil {
+		log.Printf("api: sync runs encode failed: %v", err)
+	}
+}
+
+// durationStats summarises recent sync run durations for GET /api/status.
+type durationStats struct {
+	P50  int64 `json:"p50"`
+	P95  int64 `json:"p95"`
+	Runs int   `json:"runs"`
+}
+
+func newDurationStats(runs []store.SyncRun) *durationStats {
+	if len(runs) == 0 {
+		return nil
+	}
+	durations := make([]int64, len(runs))
+	for i, run := range runs {
+		durations[i] = run.DurationMS
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return &durationStats{
+		P50:  percentile(durations, 50),
+		P95:  percentile(durations, 95),
+		Runs: len(durations),
+	}
+}
+
+// percentile returns the nearest-rank percentile p of sorted, which must not
+// be empty.
+func percentile(sorted []int64, p int) int64 {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// durationSparkline is an inline SVG polyline of recent sync run durations,
+// oldest on the left.
+type durationSparkline struct {
+	Width  int
+	Height int
+	Points string
+	Title  string
+}
+
+func newDurationSparkline(runs []store.SyncRun) *durationSparkline {
+	if len(runs) < 2 {
+		return nil
+	}
+	const width, height = 120, 20
+	var max int64 = 1
+	for _, run := range runs {
+		if run.DurationMS > max {
+			max = run.DurationMS
+		}
+	}
+	points := make([]string, len(runs))
+	for i := range runs {
+		// runs are newest first.
+		run := runs[len(runs)-1-i]
+		x := float64(i) * width / float64(len(runs)-1)
+		y := height - 1 - float64(run.DurationMS)*(height-2)/float64(max)
+		points[i] = fmt.Sprintf("%.1f,%.1f", x, y)
+	}
+	stats := newDurationStats(runs)
+	return &durationSparkline{
+		Width:  width,
+		Height: height,
+		Points: strings.Join(points, " "),
+		Title: fmt.Sprintf("Last %d sync runs: p50 %s, p95 %s, max %s", len(runs),
+			time.Duration(stats.P50)*time.Millisecond, time.Duration(stats.P95)*time.Millisecond, time.Duration(max)*time.Millisecond),
+	}
+}
+
+func (s *Server) handleSyncHistoryArchive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	filter := store.SyncActionFilter{
+		Email:      q.Get("email"),
+		ActionType: q.Get("action_type"),
+	}
+	if raw := q.Get("org_id"); raw != "" {
+		orgID, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid org_id")
+			return
+		}
+		filter.OrgID = orgID
+	}
+	for _, param := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		raw := q.Get(param.name)
+		if raw == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s: use RFC 3339", param.name))
+			return
+		}
+		*param.dst = parsed
+	}
+	if raw := q.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > 1000 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		filter.Limit = limit
+	}
+
+	records, err := s.store.ListArchivedSyncActions(filter)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("failed to load archive: %v", err))
+		return
+	}
+	if records == nil {
+		records = []store.SyncActionRecord{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(records); err != nil {
+		log.Printf("api: archive encode failed: %v", err)
+	}
+}
+
+const maxMappingCSVSize = 1 << 20
+
+// validDataSourcePermissions are the levels Grafana's data source
+// permissions API accepts.
+var validDataSourcePermissions = map[string]string{
+	"query": "Query",
+	"edit":  "Edit",
+	"admin": "Admin",
+}
+
+// handlePlans routes /api/plans/latest and the /api/plans/{id}/summary,
+// apply-by-team, validate, export and report endpoints.
+func (s *Server) handlePlans(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/api/plans/latest" {
+		s.handleLatestPlan(w, r)
+		return
+	}
+	rawID, op, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/plans/"), "/")
+	if !ok || rawID == "" || (op != "summary" && op != "apply-by-team" && op != "validate" && op != "export" && op != "report") {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_id", "plan id must be a number", "id")
+		return
+	}
+	switch op {
+	case "apply-by-team":
+		s.handleApplyByTeam(w, r, id)
+	case "validate":
+		s.handleValidatePlan(w, r, id)
+	case "export":
+		s.handlePlanExport(w, r, id)
+	case "report":
+		s.handlePlanReport(w, r, id)
+	default:
+		s.handlePlanSummary(w, r, id)
+	}
+}
+
+// handleValidatePlan serves POST /api/plans/{id}/validate: read-only checks
+// of the current plan's actions against Grafana.
+func (s *Server) handleValidatePlan(w http.ResponseWriter, r *http.Request, id int64) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	plan, err := s.store.LatestPlan()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load plan: %v", err), "")
+		return
+	}
+	if plan == nil || plan.ID != id {
+		writeAPIError(w, http.StatusNotFound, "plan_not_found", fmt.Sprintf("plan %d is not the current plan", id), "id")
+		return
+	}
+	result := s.syncer.ValidatePlan(plan.Actions)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("api: plan validation encode failed: %v", err)
+	}
+}
+
+// handlePlanExport serves GET /api/plans/{id}/export?format=markdown: the
+// current plan as GitHub-flavoured Markdown for review in a pull request.
+func (s *Server) handlePlanExport(w http.ResponseWriter, r *http.Request, id int64) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if format := r.URL.Query().Get("format"); format != "" && format != "markdown" {
+		writeAPIError(w, http.StatusBadRequest, "invalid_format", fmt.Sprintf("unsupported export format %q; use markdown", format), "format")
+		return
+	}
+	plan, err := s.store.LatestPlan()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load plan: %v", err), "")
+		return
+	}
+	if plan == nil || plan.ID != id {
+		writeAPIError(w, http.StatusNotFound, "plan_not_found", fmt.Sprintf("plan %d is not the current plan", id), "id")
+		return
+	}
+	orgs, err := s.store.ListOrgs()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load orgs: %v", err), "")
+		return
+	}
+	orgNames := make(map[int64]string, len(orgs))
+	for _, org := range orgs {
+		orgNames[org.GrafanaOrgID] = org.Name
+	}
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	if _, err := io.WriteString(w, planMarkdown(plan, orgNames)); err != nil {
+		log.Printf("api: plan export write failed: %v", err)
+	}
+}
+
+// planReport is the data of the report.html template.
+type planReport struct {
+	ID          int64
+	CreatedAt   string
+	Status      string
+	GeneratedAt string
+	Total       int
+	Adds        int
+	Removes     int
+	Updates     int
+	Orgs        []planReportOrg
+}
+
+type planReportOrg struct {
+	Name   string
+	Groups []planTeamGroup
+}
+
+// handlePlanReport serves GET /api/plans/{id}/report: the current plan as a
+// self-contained HTML file for sharing with people without access to the UI.
+func (s *Server) handlePlanReport(w http.ResponseWriter, r *http.Request, id int64) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	plan, err := s.store.LatestPlan()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load plan: %v", err), "")
+		return
+	}
+	if plan == nil || plan.ID != id {
+		writeAPIError(w, http.StatusNotFound, "plan_not_found", fmt.Sprintf("plan %d is not the current plan", id), "id")
+		return
+	}
+	orgs, err := s.store.ListOrgs()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load orgs: %v", err), "")
+		return
+	}
+	orgNames := make(map[int64]string, len(orgs))
+	for _, org := range orgs {
+		orgNames[org.GrafanaOrgID] = org.Name
+	}
+	var buf bytes.Buffer
+	if err := s.report.Execute(&buf, newPlanReport(plan, orgNames, time.Now())); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to render report: %v", err), "")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="sync-plan-%d-report.html"`, plan.ID))
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Printf("api: plan report write failed: %v", err)
+	}
+}
+
+// newPlanReport groups the plan's actions by Grafana org, in plan order, and
+// within each org by team like the planned actions card. orgNames is keyed
+// by Grafana org ID.
+func newPlanReport(plan *store.Plan, orgNames map[int64]string, now time.Time) planReport {
+	report := planReport{
+		ID:          plan.ID,
+		CreatedAt:   plan.CreatedAt,
+		Status:      plan.Status,
+		GeneratedAt: now.UTC().Format(time.RFC3339),
+		Total:       len(plan.Actions),
+	}
+	byOrg := map[int64][]store.PlanAction{}
+	var order []int64
+	for _, action := range plan.Actions {
+		if _, ok := byOrg[action.GrafanaOrgID]; !ok {
+			order = append(order, action.GrafanaOrgID)
+		}
+		byOrg[action.GrafanaOrgID] = append(byOrg[action.GrafanaOrgID], action)
+		switch actionChangeKind(action.ActionType) {
+		case "add":
+			report.Adds++
+		case "remove":
+			report.Removes++
+		case "update":
+			report.Updates++
+		}
+	}
+	for _, orgID := range order {
+		name := orgNames[orgID]
+		switch {
+		case name != "":
+			name = fmt.Sprintf("%s (org %d)", name, orgID)
+		case orgID != 0:
+			name = fmt.Sprintf("Org %d", orgID)
+		default:
+			name = "Other actions"
+		}
+		report.Orgs = append(report.Orgs, planReportOrg{Name: name, Groups: buildPlanGroups(byOrg[orgID])})
+	}
+	return report
+}
+
+// planMarkdown renders a plan as a summary line, one table per team (grouped
+// like the planned actions card) and a legend of the action types used.
+// orgNames is keyed by Grafana org ID.
+func planMarkdown(plan *store.Plan, orgNames map[int64]string) string {
+	counts := map[string]int{}
+	for _, action := range plan.Actions {
+		counts[actionChangeKind(action.ActionType)]++
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "## Sync Plan - %d actions (%d adds, %d removes, %d updates)\n\n", len(plan.Actions), counts["add"], counts["remove"], counts["update"])
+	fmt.Fprintf(&b, "Plan #%d, %s, created %s.\n", plan.ID, plan.Status, plan.CreatedAt)
+	used := map[string]bool{}
+	var types []string
+	for _, group := range buildPlanGroups(plan.Actions) {
+		fmt.Fprintf(&b, "\n### %s\n\n", markdownCell(group.Title))
+		b.WriteString("| Action | Org | Team | Email | Role | Note |\n")
+		b.WriteString("| --- | --- | --- | --- | --- | --- |\n")
+		for _, action := range group.Actions {
+			if !used[action.Type] {
+				used[action.Type] = true
+				types = append(types, action.Type)
+			}
+			org := orgNames[action.OrgID]
+			if org == "" && action.OrgID != 0 {
+				org = fmt.Sprintf("Org %d", action.OrgID)
+			}
+			role := action.Role
+			if role == "" && action.TeamRole != "" {
+				role = formatTeamRole(action.TeamRole)
+			}
+			fmt.Fprintf(&b, "| %s | %s | %s | %s | %s | %s |\n",
+				markdownCell(actionLabel(action.Type)), markdownCell(org), markdownCell(action.Team),
+				markdownCell(action.Email), markdownCell(role), markdownCell(action.Note))
+		}
+	}
+	if len(types) > 0 {
+		b.WriteString("\n### Legend\n\n")
+		b.WriteString("| Action | Meaning |\n")
+		b.WriteString("| --- | --- |\n")
+		for _, actionType := range types {
+			fmt.Fprintf(&b, "| %s | %s |\n", markdownCell(actionLabel(actionType)), markdownCell(actionDescription(actionType)))
+		}
+	}
+	return b.String()
+}
+
+// markdownCell escapes text for a Markdown table cell.
+func markdownCell(text string) string {
+	text = strings.ReplaceAll(text, "\\", "\\\\")
+	text = strings.ReplaceAll(text, "|", "\\|")
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// actionChangeKind sorts action types into "add", "remove" and "update" for
+// the export summary; blocked actions change nothing and return "".
+func actionChangeKind(actionType string) string {
+	switch {
+	case strings.HasPrefix(actionType, "blocked_"):
+		return ""
+	case strings.HasPrefix(actionType, "create_"), strings.HasPrefix(actionType, "add_"),
+		actionType == "invite_user", actionType == "provision_datasource":
+		return "add"
+	case strings.HasPrefix(actionType, "remove_"), strings.HasPrefix(actionType, "delete_"),
+		actionType == "disable_user":
+		return "remove"
+	default:
+		return "update"
+	}
+}
+
+// handleLatestPlan serves GET /api/plans/latest: the current plan with its
+// actions, optionally narrowed by org_id and action_type.
+func (s *Server) handleLatestPlan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	filter, apiErr := parsePlanFilter(r.URL.Query())
+	if apiErr != nil {
+		writeAPIError(w, http.StatusBadRequest, apiErr.Code, apiErr.Message, apiErr.Field)
+		return
+	}
+	plan, err := s.store.LatestPlan()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load plan: %v", err), "")
+		return
+	}
+	if plan == nil {
+		writeAPIError(w, http.StatusNotFound, "plan_not_found", "no plan available", "")
+		return
+	}
+	actions := filterPlanActions(plan.Actions, filter)
+	resp := struct {
+		PlanID       int64            `json:"plan_id"`
+		Status       string           `json:"status"`
+		CreatedAt    string           `json:"created_at"`
+		Total        int              `json:"total"`
+		Actions      []planActionJSON `json:"actions"`
+		SAMLConflict bool             `json:"saml_conflict_detected"`
+	}{
+		PlanID:       plan.ID,
+		Status:       plan.Status,
+		CreatedAt:    plan.CreatedAt,
+		Total:        len(plan.Actions),
+		Actions:      make([]planActionJSON, 0, len(actions)),
+		SAMLConflict: plan.SAMLConflict,
+	}
+	for _, action := range actions {
+		resp.Actions = append(resp.Actions, planActionJSON{
+			ID:           action.ID,
+			ActionType:   action.ActionType,
+			OrgID:        action.OrgID,
+			GrafanaOrgID: action.GrafanaOrgID,
+			TeamName:     action.TeamName,
+			TeamRole:     action.TeamRole,
+			Email:        action.Email,
+			Role:         action.Role,
+			Note:         action.Note,
+			Selectable:   isSelectableAction(action.ActionType),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("api: latest plan encode failed: %v", err)
+	}
+}
+
+// handlePlanSummary serves GET /api/plans/{id}/summary: the plan's status
+// and action counts by type, without the actions themselves.
+func (s *Server) handlePlanSummary(w http.ResponseWriter, r *http.Request, id int64) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	summary, err := s.store.GetPlanSummary(id)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load plan summary: %v", err), "")
+		return
+	}
+	if summary == nil {
+		writeAPIError(w, http.StatusNotFound, "plan_not_found", fmt.Sprintf("plan %d does not exist", id), "id")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		log.Printf("api: plan summary encode failed: %v", err)
+	}
+}
+
+// handleMappingPreview serves POST /api/mappings/{id}/preview: the team
+// membership changes of one mapping, without rebuilding or storing the plan.
+func (s *Server) handleMappingPreview(w http.ResponseWriter, r *http.Request, rawID string) {
+	if rawID == "" || strings.Contains(rawID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_id", "mapping id must be a number", "id")
+		return
+	}
+	diff, err := s.syncer.PreviewMapping(r.Context(), id)
+	if errors.Is(err, syncer.ErrMappingNotFound) {
+		writeAPIError(w, http.StatusNotFound, "mapping_not_found", fmt.Sprintf("mapping %d does not exist", id), "id")
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, "preview_failed", fmt.Sprintf("failed to preview mapping: %v", err), "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(diff); err != nil {
+		log.Printf("api: mapping preview encode failed: %v", err)
+	}
+}
+
+// handleMappingDataSources manages /api/mappings/{id}/datasources: GET lists
+// the mapping's data source permissions, PUT adds or replaces one from
+// {"datasource_uid","permission"} and DELETE ?datasource_uid= removes one.
+// POST /api/mappings/{id}/preview is passed on to handleMappingPreview.
+func (s *Server) handleMappingDataSources(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/mappings/")
+	if rawID, ok := strings.CutSuffix(rest, "/preview"); ok {
+		s.handleMappingPreview(w, r, rawID)
+		return
+	}
+	rawID, ok := strings.CutSuffix(rest, "/datasources")
+	if !ok || rawID == "" || strings.Contains(rawID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_id", "mapping id must be a number", "id")
+		return
+	}
+	mapping, err := s.store.GetMapping(id)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load mapping: %v", err), "")
+		return
+	}
+	if mapping == nil {
+		writeAPIError(w, http.StatusNotFound, "mapping_not_found", fmt.Sprintf("mapping %d does not exist", id), "id")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		perms, err := s.store.ListDataSourcePermissions(id)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load data source permissions: %v", err), "")
+			return
+		}
+		if perms == nil {
+			perms = []store.DataSourcePermission{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(perms); err != nil {
+			log.Printf("api: mapping data sources encode failed: %v", err)
+		}
+	case http.MethodPut, http.MethodPost:
+		var in store.DataSourcePermission
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_json", fmt.Sprintf("invalid JSON body: %v", err), "")
+			return
+		}
+		in.MappingID = id
+		in.DataSourceUID = strings.TrimSpace(in.DataSourceUID)
+		if in.DataSourceUID == "" {
+			writeAPIError(w, http.StatusBadRequest, "missing_field", "datasource_uid is required", "datasource_uid")
+			return
+		}
+		permission, ok := validDataSourcePermissions[strings.ToLower(strings.TrimSpace(in.Permission))]
+		if !ok {
+			writeAPIError(w, http.StatusBadRequest, "invalid_permission", "permission must be Query, Edit or Admin", "permission")
+			return
+		}
+		in.Permission = permission
+		if err := s.store.SetDataSourcePermission(in); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to save data source permission: %v", err), "")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(in); err != nil {
+			log.Printf("api: mapping data source encode failed: %v", err)
+		}
+	case http.MethodDelete:
+		uid := strings.TrimSpace(r.URL.Query().Get("datasource_uid"))
+		if uid == "" {
+			writeAPIError(w, http.StatusBadRequest, "missing_field", "datasource_uid query parameter is required", "datasource_uid")
+			return
+		}
+		if err := s.store.DeleteDataSourcePermission(id, uid); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to delete data source permission: %v", err), "")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type csvImportError struct {
+	Row     int    `json:"row"`
+	Message string `json:"message"`
+}
+
+// handleDuplicateMappings lists groups of mappings that share org, team and
+// Entra group, each as an array of mapping IDs with the shared values.
+func (s *Server) handleDuplicateMappings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	groups, err := s.store.FindDuplicateMappings()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("failed to find duplicate mappings: %v", err))
+		return
+	}
+	type duplicateGroup struct {
+		OrgID           int64   `json:"org_id"`
+		GrafanaTeamName string  `json:"grafana_team_name"`
+		ExternalGroupID string  `json:"external_group_id"`
+		MappingIDs      []int64 `json:"mapping_ids"`
+	}
+	result := []duplicateGroup{}
+	for _, group := range groups {
+		dup := duplicateGroup{
+			OrgID:           group[0].OrgID,
+			GrafanaTeamName: group[0].GrafanaTeamName,
+			ExternalGroupID: group[0].ExternalGroupID,
+		}
+		for _, m := range group {
+			dup.MappingIDs = append(dup.MappingIDs, m.ID)
+		}
+		result = append(result, dup)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("api: duplicate mappings encode failed: %v", err)
+	}
+}
+
+// handleImportMappingsCSV bulk-creates mappings from an uploaded CSV with a
+// header row naming the columns grafana_org_id, grafana_team_name,
+// external_group_id, external_group_name, team_role and role_override.
+// Rows for mappings that already exist are skipped.
+func (s *Server) handleImportMappingsCSV(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxMappingCSVSize+64<<10)
+	if err := r.ParseMultipartForm(maxMappingCSVSize); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_upload", fmt.Sprintf("upload must be multipart/form-data of at most 1MB: %v", err), "file")
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "missing_file", "file field is required", "file")
+		return
+	}
+	defer file.Close()
+	if header.Size > maxMappingCSVSize {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "file_too_large", "CSV file must be at most 1MB", "file")
+		return
+	}
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	columns, err := reader.Read()
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_csv", fmt.Sprintf("failed to read header row: %v", err), "file")
+		return
+	}
+	index := map[string]int{}
+	for i, name := range columns {
+		index[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	for _, required := range []string{"grafana_org_id", "grafana_team_name"} {
+		if _, ok := index[required]; !ok {
+			writeAPIError(w, http.StatusBadRequest, "invalid_csv", fmt.Sprintf("header row is missing column %s", required), "file")
+			return
+		}
+	}
+
+	result := struct {
+		Created int              `json:"created"`
+		Skipped int              `json:"skipped"`
+		Errors  []csvImportError `json:"errors"`
+	}{Errors: []csvImportError{}}
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, csvImportError{Row: row, Message: err.Error()})
+			continue
+		}
+		field := func(name string) string {
+			if i, ok := index[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		grafanaOrgID, err := strconv.ParseInt(field("grafana_org_id"), 10, 64)
+		if err != nil {
+			result.Errors = append(result.Errors, csvImportError{Row: row, Message: "invalid grafana_org_id"})
+			continue
+		}
+		org, err := s.store.GetOrgByGrafanaID(grafanaOrgID)
+		if err != nil {
+			result.Errors = append(result.Errors, csvImportError{Row: row, Message: fmt.Sprintf("failed to load grafana org %d: %v", grafanaOrgID, err)})
+			continue
+		}
+		if org == nil {
+			result.Errors = append(result.Errors, csvImportError{Row: row, Message: fmt.Sprintf("grafana org %d is not configured", grafanaOrgID)})
+			continue
+		}
+		_, _, apiErr := s.createMapping(mappingInput{
+			OrgID:             org.ID,
+			GrafanaTeamName:   field("grafana_team_name"),
+			ExternalGroupID:   field("external_group_id"),
+			ExternalGroupName: field("external_group_name"),
+			TeamRole:          field("team_role"),
+			RoleOverride:      field("role_override"),
+		})
+		switch {
+		case apiErr == nil:
+			result.Created++
+		case apiErr.Code == "duplicate_mapping":
+			result.Skipped++
+		default:
+			result.Errors = append(result.Errors, csvImportError{Row: row, Message: apiErr.Message})
+		}
+	}
+	log.Printf("api: csv mapping import created=%d skipped=%d errors=%d", result.Created, result.Skipped, len(result.Errors))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("api: csv import encode failed: %v", err)
+	}
+}
+
+func normalizeMappingTeamRole(role string) string {
+	if strings.EqualFold(role, "admin") {
+		return "admin"
+	}
+	return "member"
+}
+
+const (
+	defaultUsersPerPage = 50
+	maxUsersPerPage     = 500
+)
+
+type userPage struct {
+	Page    int `json:"page"`
+	PerPage int `json:"per_page"`
+	Total   int `json:"total"`
+	Pages   int `json:"pages"`
+	Items   any `json:"items"`
+}
+
+// pageBounds clamps the page and per_page query parameters and returns the
+// slice bounds of that page within total items.
+func pageBounds(r *http.Request, total int) (page, perPage, start, end int) {
+	page, _ = strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ = strconv.Atoi(r.URL.Query().Get("per_page"))
+	if perPage < 1 {
+		perPage = defaultUsersPerPage
+	}
+	if perPage > maxUsersPerPage {
+		perPage = maxUsersPerPage
+	}
+	// Pages past the end are empty; clamping first keeps the offset from
+	// overflowing for huge page numbers.
+	if last := total/perPage + 1; page > last {
+		page = last
+	}
+	start = (page - 1) * perPage
+	if start > total {
+		start = total
+	}
+	end = start + perPage
+	if end > total {
+		end = total
+	}
+	return page, perPage, start, end
+}
+
+func matchesQuery(q string, fields ...string) bool {
+	if q == "" {
+		return true
+	}
+	for _, field := range fields {
+		if strings.Contains(strings.ToLower(field), q) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeUserPage(w http.ResponseWriter, r *http.Request, total int, items func(start, end int) any) {
+	page, perPage, start, end := pageBounds(r, total)
+	resp := userPage{
+		Page:    page,
+		PerPage: perPage,
+		Total:   total,
+		Pages:   (total + perPage - 1) / perPage,
+		Items:   items(start, end),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("api: user page encode failed: %v", err)
+	}
+}
+
+// handleAPIGrafanaUsers pages through the cached Grafana users. q filters
+// by login, email or name.
+func (s *Server) handleAPIGrafanaUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, _, users, usersErr, _, _, _, _, _, _ := s.getExternalData(nil, nil)
+	if len(users) == 0 && usersErr != "" {
+		writeJSONError(w, http.StatusBadGateway, usersErr)
+		return
+	}
+	q := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+	filtered := []grafanaUserView{}
+	for _, user := range users {
+		if matchesQuery(q, user.Login, user.Email, user.Name) {
+			filtered = append(filtered, user)
+		}
+	}
+	writeUserPage(w, r, len(filtered), func(start, end int) any { return filtered[start:end] })
+}
+
+// handleAPIEntraUsers pages through the cached Entra users. q filters by
+// UPN, mail or display name.
+func (s *Server) handleAPIEntraUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_, _, _, _, _, _, users, usersErr, _, _ := s.getExternalData(nil, nil)
+	if len(users) == 0 && usersErr != "" {
+		writeJSONError(w, http.StatusBadGateway, usersErr)
+		return
+	}
+	q := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+	filtered := []entraUserView{}
+	for _, user := range users {
+		if matchesQuery(q, user.UPN, user.Mail, user.DisplayName) {
+			filtered = append(filtered, user)
+		}
+	}
+	writeUserPage(w, r, len(filtered), func(start, end int) any { return filtered[start:end] })
+}
+
+// handleUserHistory serves GET /api/users/{email}/history, the applied sync
+// actions for one email address, newest first.
+func (s *Server) handleUserHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rest := strings.TrimPrefix(r.URL.EscapedPath(), "/api/users/")
+	escaped, ok := strings.CutSuffix(rest, "/history")
+	if !ok || escaped == "" || strings.Contains(escaped, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	email, err := url.PathUnescape(escaped)
+	if err != nil || strings.TrimSpace(email) == "" {
+		writeAPIError(w, http.StatusBadRequest, "invalid_email", "email must be a URL-escaped address", "email")
+		return
+	}
+	limit := 50
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 || parsed > 1000 {
+			writeAPIError(w, http.StatusBadRequest, "invalid_limit", "limit must be between 1 and 1000", "limit")
+			return
+		}
+		limit = parsed
+	}
+	actions, err := s.store.ListSyncActionsForUser(email, limit)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load user history: %v", err), "")
+		return
+	}
+	if actions == nil {
+		actions = []store.SyncAction{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(actions); err != nil {
+		log.Printf("api: user history encode failed: %v", err)
+	}
+}
+
+func (s *Server) handleUnmappedGrafanaTeams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	orgs, err := s.store.ListOrgs()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("failed to load orgs: %v", err))
+		return
+	}
+	mappings, err := s.store.ListMappings()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("failed to load mappings: %v", err))
+		return
+	}
+	teams, teamsErr, _, _, _, _, _, _, _, _ := s.getExternalData(orgs, mappings)
+	if len(teams) == 0 && teamsErr != "" {
+		writeJSONError(w, http.StatusBadGateway, teamsErr)
+		return
+	}
+
+	type unmappedTeam struct {
+		OrgID        int64  `json:"org_id"`
+		GrafanaOrgID int64  `json:"grafana_org_id"`
+		OrgName      string `json:"org_name"`
+		TeamID       int64  `json:"team_id"`
+		TeamName     string `json:"team_name"`
+		MemberCount  *int   `json:"member_count"`
+	}
+	orgIDs := map[int64]int64{}
+	for _, org := range orgs {
+		orgIDs[org.GrafanaOrgID] = org.ID
+	}
+	result := []unmappedTeam{}
+	for _, team := range teams {
+		if team.MappingState != "unmapped" {
+			continue
+		}
+		result = append(result, unmappedTeam{
+			OrgID:        orgIDs[team.OrgID],
+			GrafanaOrgID: team.OrgID,
+			OrgName:      team.OrgName,
+			TeamID:       team.TeamID,
+			TeamName:     team.TeamName,
+			MemberCount:  team.MemberCount,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("api: unmapped teams encode failed: %v", err)
+	}
+}
+
+func (s *Server) handleUnmappedEntraGroups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	orgs, err := s.store.ListOrgs()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("failed to load orgs: %v", err))
+		return
+	}
+	mappings, err := s.store.ListMappings()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("failed to load mappings: %v", err))
+		return
+	}
+	_, _, _, _, groups, groupsErr, _, _, _, _ := s.getExternalData(orgs, mappings)
+	if len(groups) == 0 && groupsErr != "" {
+		writeJSONError(w, http.StatusBadGateway, groupsErr)
+		return
+	}
+
+	type unmappedGroup struct {
+		ID           string `json:"id"`
+		DisplayName  string `json:"display_name"`
+		Mail         string `json:"mail"`
+		SecurityType string `json:"security_type"`
+	}
+	result := []unmappedGroup{}
+	for _, group := range groups {
+		if group.MappingState != "unmapped" {
+			continue
+		}
+		result = append(result, unmappedGroup{
+			ID:           group.ID,
+			DisplayName:  group.DisplayName,
+			Mail:         group.Mail,
+			SecurityType: group.SecurityType,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("api: unmapped groups encode failed: %v", err)
+	}
+}
+
+func (s *Server) resolveTeamIDs() {
+	if s.grafana == nil {
+		return
+	}
+	orgs, err := s.store.ListOrgs()
+	if err != nil {
+		log.Printf("ui: resolve team ids failed to load orgs: %v", err)
+		return
+	}
+	mappings, err := s.store.ListMappings()
+	if err != nil {
+		log.Printf("ui: resolve team ids failed to load mappings: %v", err)
+		return
+	}
+	orgByID := map[int64]store.Org{}
+	for _, org := range orgs {
+		orgByID[org.ID] = org
+	}
+	for _, mapping := range mappings {
+		org, ok := orgByID[mapping.OrgID]
+		if !ok || strings.TrimSpace(mapping.GrafanaTeamName) == "" {
+			continue
+		}
+		teamID, found, err := s.grafana.SearchTeam(org.GrafanaOrgID, mapping.GrafanaTeamName)
+		if err != nil {
+			log.Printf("ui: resolve team id failed org=%d team=%s: %v", org.GrafanaOrgID, mapping.GrafanaTeamName, err)
+			continue
+		}
+		if !found || teamID == 0 {
+			continue
+		}
+		if mapping.GrafanaTeamID != teamID {
+			if err := s.store.UpdateMappingTeamID(mapping.ID, teamID); err != nil {
+				log.Printf("ui: resolve team id update failed mapping=%d team=%d: %v", mapping.ID, teamID, err)
+			}
+		}
+	}
+}
+
+func (s *Server) handlePreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.syncer.ImportGrafanaOrgs(); err != nil {
+		log.Printf("ui: import grafana orgs failed: %v", err)
+	}
+	plan, err := s.syncer.DryRunPlan(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to build plan: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := s.store.ReplacePlan(*plan); err != nil {
+		http.Error(w, fmt.Sprintf("failed to store plan: %v", err), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (s *Server) handleWebhookSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.webhookSecret == "" {
+		writeJSONError(w, http.StatusForbidden, "inbound webhooks are disabled; set WEBHOOK_INBOUND_SECRET")
+		return
+	}
+	if _, err := webhooks.Verify(r, s.webhookSecret, time.Now()); err != nil {
+		log.Printf("ui: rejected webhook from %s: %v", r.RemoteAddr, err)
+		writeJSONError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	status := "already_running"
+	if s.webhookRunning.CompareAndSwap(false, true) {
+		status = "started"
+		go func() {
+			defer s.webhookRunning.Store(false)
+			if err := s.syncer.Run(); err != nil {
+				log.Printf("ui: webhook-triggered sync failed: %v", err)
+			}
+		}()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(map[string]string{"status": status}); err != nil {
+		log.Printf("api: webhook response encode failed: %v", err)
+	}
+}
+
+func (s *Server) handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.syncer.ReadOnly() {
+		writeJSONError(w, http.StatusForbidden, syncer.ErrReadOnly.Error())
+		return
+	}
+	plan, err := s.syncer.BuildPlan()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to build plan: %v", err), http.StatusInternalServerError)
+		return
+	}
+	planID, err := s.store.ReplacePlan(*plan)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to store plan: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := s.store.UpdatePlanStatus(planID, "applying"); err != nil {
+		log.Printf("plan status update failed: %v", err)
+	}
+	err = s.syncer.ApplyPlan(plan.Actions, nil)
+	s.syncer.RecordRun(err)
+	if err != nil {
+		_ = s.store.UpdatePlanStatus(planID, "failed")
+		http.Error(w, fmt.Sprintf("apply failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	_ = s.store.UpdatePlanStatus(planID, "applied")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (s *Server) handleApply(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.syncer.ReadOnly() {
+		writeJSONError(w, http.StatusForbidden, syncer.ErrReadOnly.Error())
+		return
+	}
+	plan, err := s.store.LatestPlan()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to load plan: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if plan == nil {
+		http.Error(w, "no plan available", http.StatusBadRequest)
+		return
+	}
+	if s.rejectExpiredPlan(w, plan) {
+		return
+	}
+	if err := s.store.UpdatePlanStatus(plan.ID, "applying"); err != nil {
+		log.Printf("plan status update failed: %v", err)
+	}
+	err = s.syncer.ApplyPlan(plan.Actions, nil)
+	s.syncer.RecordRun(err)
+	if err != nil {
+		_ = s.store.UpdatePlanStatus(plan.ID, "failed")
+		http.Error(w, fmt.Sprintf("apply failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	_ = s.store.UpdatePlanStatus(plan.ID, "applied")
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-func (s *Server) handleApply(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+// handleApplyProgress starts applying the latest plan on POST and, on GET,
+// streams a Server-Sent Event per applied action of the running or most
+// recent apply, followed by a final {"done":true,"errors":N} event. GET
+// never changes anything.
+func (s *Server) handleApplyProgress(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		s.startApplyWithProgress(w, r)
+	case http.MethodGet:
+		s.streamApplyProgress(w, r)
+	default:
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// startApplyWithProgress applies the latest plan in the background,
+// recording its progress for streamApplyProgress. It answers 202 at once.
+func (s *Server) startApplyWithProgress(w http.ResponseWriter, r *http.Request) {
+	if s.syncer.ReadOnly() {
+		writeJSONError(w, http.StatusForbidden, syncer.ErrReadOnly.Error())
 		return
 	}
 	plan, err := s.store.LatestPlan()
@@ -914,18 +3561,95 @@ func (s *Server) handleApply(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "no plan available", http.StatusBadRequest)
 		return
 	}
+	if s.rejectExpiredPlan(w, plan) {
+		return
+	}
+	if !s.applyProgress.start() {
+		writeJSONError(w, http.StatusConflict, "an apply is already running")
+		return
+	}
 	if err := s.store.UpdatePlanStatus(plan.ID, "applying"); err != nil {
 		log.Printf("plan status update failed: %v", err)
 	}
-	err = s.syncer.ApplyPlan(plan.Actions)
-	s.syncer.RecordRun(err)
-	if err != nil {
-		_ = s.store.UpdatePlanStatus(plan.ID, "failed")
-		http.Error(w, fmt.Sprintf("apply failed: %v", err), http.StatusInternalServerError)
+	go func() {
+		events := make(chan syncer.ProgressEvent, 16)
+		var applyErr error
+		go func() {
+			applyErr = s.syncer.ApplyPlan(plan.Actions, events)
+			close(events)
+		}()
+		for event := range events {
+			s.applyProgress.add(event, false)
+		}
+		s.syncer.RecordRun(applyErr)
+
+		final := struct {
+			Done   bool   `json:"done"`
+			Errors int    `json:"errors"`
+			Error  string `json:"error,omitempty"`
+		}{Done: true}
+		if applyErr != nil {
+			final.Errors = 1
+			final.Error = applyErr.Error()
+			_ = s.store.UpdatePlanStatus(plan.ID, "failed")
+		} else {
+			_ = s.store.UpdatePlanStatus(plan.ID, "applied")
+		}
+		s.applyProgress.add(final, true)
+	}()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]int64{"plan_id": plan.ID})
+}
+
+// streamApplyProgress replays the events of the running or most recent
+// apply and follows it until the final event.
+func (s *Server) streamApplyProgress(w http.ResponseWriter, r *http.Request) {
+	if _, started, _, _ := s.applyProgress.since(0); !started {
+		http.Error(w, "no apply has been started", http.StatusNotFound)
 		return
 	}
-	_ = s.store.UpdatePlanStatus(plan.ID, "applied")
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	rc := http.NewResponseController(w)
+	// Large plans can outlive the server's write timeout.
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("api: apply progress write deadline: %v", err)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	_ = rc.Flush()
+
+	sent := 0
+	for {
+		events, _, done, changed := s.applyProgress.since(sent)
+		for _, event := range events {
+			if err := writeSSE(w, event); err != nil {
+				return
+			}
+		}
+		sent += len(events)
+		if len(events) > 0 && rc.Flush() != nil {
+			return
+		}
+		if done {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", payload)
+	return err
 }
 
 func (s *Server) handleApplySelected(w http.ResponseWriter, r *http.Request) {
@@ -933,6 +3657,10 @@ func (s *Server) handleApplySelected(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if s.syncer.ReadOnly() {
+		writeJSONError(w, http.StatusForbidden, syncer.ErrReadOnly.Error())
+		return
+	}
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, fmt.Sprintf("invalid form: %v", err), http.StatusBadRequest)
 		return
@@ -951,6 +3679,9 @@ func (s *Server) handleApplySelected(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "no plan available", http.StatusBadRequest)
 		return
 	}
+	if s.rejectExpiredPlan(w, plan) {
+		return
+	}
 	allowed := map[int64]struct{}{}
 	for _, raw := range ids {
 		if id, err := strconv.ParseInt(raw, 10, 64); err == nil {
@@ -973,7 +3704,7 @@ func (s *Server) handleApplySelected(w http.ResponseWriter, r *http.Request) {
 	if err := s.store.UpdatePlanStatus(plan.ID, "applying-selected"); err != nil {
 		log.Printf("plan status update failed: %v", err)
 	}
-	err = s.syncer.ApplyPlan(selected)
+	err = s.syncer.ApplyPlan(selected, nil)
 	s.syncer.RecordRun(err)
 	if err != nil {
 		_ = s.store.UpdatePlanStatus(plan.ID, "failed")
@@ -984,6 +3715,124 @@ func (s *Server) handleApplySelected(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// rejectExpiredPlan answers 409 plan_expired when plan is older than
+// PLAN_MAX_AGE and reports whether it did.
+func (s *Server) rejectExpiredPlan(w http.ResponseWriter, plan *store.Plan) bool {
+	if !plan.IsExpired(s.syncer.PlanMaxAge()) {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	body := map[string]string{
+		"error":   "plan_expired",
+		"message": fmt.Sprintf("plan is %d hours old; rebuild required", int(plan.Age().Hours())),
+	}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("api: error encode failed: %v", err)
+	}
+	return true
+}
+
+// planExpiry describes how close the current plan is to PLAN_MAX_AGE.
+type planExpiry struct {
+	Expired bool
+	// Near is set during the last quarter of the plan's lifetime.
+	Near      bool
+	Remaining string
+}
+
+func newPlanExpiry(plan *store.Plan, maxAge time.Duration) *planExpiry {
+	if plan == nil || maxAge <= 0 {
+		return nil
+	}
+	remaining := maxAge - plan.Age()
+	if remaining > maxAge/4 {
+		return nil
+	}
+	return &planExpiry{
+		Expired:   remaining <= 0,
+		Near:      remaining > 0,
+		Remaining: remaining.Round(time.Minute).String(),
+	}
+}
+
+// ApplyResult is the JSON answer of the apply API endpoints.
+type ApplyResult struct {
+	PlanID  int64  `json:"plan_id"`
+	Status  string `json:"status"`
+	Applied int    `json:"applied"`
+	Error   string `json:"error,omitempty"`
+}
+
+// handleApplyByTeam serves POST /api/plans/{id}/apply-by-team: it applies
+// every selectable action of the named teams from the current plan.
+func (s *Server) handleApplyByTeam(w http.ResponseWriter, r *http.Request, planID int64) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.syncer.ReadOnly() {
+		writeAPIError(w, http.StatusForbidden, "read_only", syncer.ErrReadOnly.Error(), "")
+		return
+	}
+	var in struct {
+		TeamNames []string `json:"team_names"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_json", fmt.Sprintf("invalid JSON body: %v", err), "")
+		return
+	}
+	if len(in.TeamNames) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "missing_team_names", "team_names must list at least one team", "team_names")
+		return
+	}
+	plan, err := s.store.LatestPlan()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load plan: %v", err), "")
+		return
+	}
+	if plan == nil || plan.ID != planID {
+		writeAPIError(w, http.StatusNotFound, "plan_not_found", fmt.Sprintf("plan %d is not the current plan", planID), "id")
+		return
+	}
+	if s.rejectExpiredPlan(w, plan) {
+		return
+	}
+	actions, err := s.store.GetPlanActionsByTeam(planID, in.TeamNames)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load plan actions: %v", err), "")
+		return
+	}
+	var selected []store.PlanAction
+	for _, action := range actions {
+		if isSelectableAction(action.ActionType) {
+			selected = append(selected, action)
+		}
+	}
+	if len(selected) == 0 {
+		writeAPIError(w, http.StatusBadRequest, "no_actions", "the plan has no applicable actions for these teams", "team_names")
+		return
+	}
+	if err := s.store.UpdatePlanStatus(planID, "applying-selected"); err != nil {
+		log.Printf("plan status update failed: %v", err)
+	}
+	err = s.syncer.ApplyPlan(selected, nil)
+	s.syncer.RecordRun(err)
+	result := ApplyResult{PlanID: planID, Status: "applied-selected", Applied: len(selected)}
+	status := http.StatusOK
+	if err != nil {
+		result.Status = "failed"
+		result.Error = err.Error()
+		status = http.StatusInternalServerError
+	}
+	_ = s.store.UpdatePlanStatus(planID, result.Status)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("api: apply by team encode failed: %v", err)
+	}
+}
+
 func (s *Server) handleClearPlan(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -996,6 +3845,260 @@ func (s *Server) handleClearPlan(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// optBool renders a tri-state flag as "", "true" or "false".
+func optBool(v *bool) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatBool(*v)
+}
+
+// parseOptionalBool parses a tri-state form value: empty means "use the
+// default" and yields nil.
+func parseOptionalBool(raw string) (*bool, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid boolean %q", raw)
+	}
+	return &v, nil
+}
+
+// parseTeamPrefs validates a mapping's team preferences JSON and returns it
+// re-encoded; blank input returns "".
+func parseTeamPrefs(raw string) (string, error) {
+	if strings.TrimSpace(raw) == "" {
+		return "", nil
+	}
+	prefs, err := grafana.ParseTeamPreferences(raw)
+	if err != nil {
+		return "", err
+	}
+	encoded, err := json.Marshal(prefs)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// parseDataSourceTemplate checks that a data source template renders to a
+// valid data source definition and returns it trimmed.
+func parseDataSourceTemplate(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", nil
+	}
+	if _, err := syncer.RenderDataSourceTemplate(raw, "team", 1, "org"); err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+// parseGracePeriod validates a per-mapping removal grace period form value.
+// An empty value means the REMOVAL_GRACE_PERIOD default applies.
+func parseGracePeriod(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", nil
+	}
+	grace, err := time.ParseDuration(raw)
+	if err != nil || grace < 0 {
+		return "", fmt.Errorf("invalid removal_grace_period %q: use a duration like 24h", raw)
+	}
+	return grace.String(), nil
+}
+
+// requireAdminToken checks the ADMIN_API_TOKEN bearer token and writes an
+// error response when the request is not authorised.
+func (s *Server) requireAdminToken(w http.ResponseWriter, r *http.Request) bool {
+	if s.adminToken == "" {
+		writeJSONError(w, http.StatusForbidden, "admin API disabled: ADMIN_API_TOKEN not set")
+		return false
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+		writeJSONError(w, http.StatusUnauthorized, "invalid admin token")
+		return false
+	}
+	return true
+}
+
+// handleServiceAccountTokens lists the tracked service account tokens,
+// including the keys of rotated ones, or registers a token for rotation.
+func (s *Server) handleServiceAccountTokens(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdminToken(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := s.store.ListServiceAccountTokens()
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load tokens: %v", err), "")
+			return
+		}
+		if tokens == nil {
+			tokens = []store.ServiceAccountToken{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(tokens); err != nil {
+			log.Printf("api: service account tokens encode failed: %v", err)
+		}
+	case http.MethodPost:
+		var in store.ServiceAccountToken
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_json", fmt.Sprintf("invalid JSON body: %v", err), "")
+			return
+		}
+		if in.SAID <= 0 {
+			writeAPIError(w, http.StatusBadRequest, "invalid_sa_id", "sa_id must be a service account ID", "sa_id")
+			return
+		}
+		if in.TokenID <= 0 {
+			writeAPIError(w, http.StatusBadRequest, "invalid_token_id", "token_id must be a token ID", "token_id")
+			return
+		}
+		if in.ExpiresAt.IsZero() {
+			writeAPIError(w, http.StatusBadRequest, "missing_expires_at", "expires_at is required", "expires_at")
+			return
+		}
+		mapping, err := s.store.GetMapping(in.MappingID)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to load mapping: %v", err), "")
+			return
+		}
+		if mapping == nil {
+			writeAPIError(w, http.StatusNotFound, "mapping_not_found", fmt.Sprintf("mapping %d does not exist", in.MappingID), "mapping_id")
+			return
+		}
+		in.Key = ""
+		if err := s.store.SetServiceAccountToken(in); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("failed to store token: %v", err), "")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleBackup streams an online copy of the SQLite database.
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireAdminToken(w, r) {
+		return
+	}
+	tmpDir, err := os.MkdirTemp("", "sync-backup-")
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("backup temp dir: %v", err))
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	now := time.Now()
+	path, err := s.store.WriteBackup(tmpDir, now)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("open backup: %v", err))
+		return
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", store.BackupFileName(now)))
+	if _, err := io.Copy(w, f); err != nil {
+		log.Printf("api: backup stream failed: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message, field string) {
+	writeAPIErrorValue(w, status, APIError{Code: code, Message: message, Field: field})
+}
+
+func writeAPIErrorValue(w http.ResponseWriter, status int, apiErr APIError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(apiErr); err != nil {
+		log.Printf("api: error encode failed: %v", err)
+	}
+}
+
+// formError answers a failed form submission: JSON clients get an APIError,
+// browsers are sent back to the form page with the error in the query.
+func (s *Server) formError(w http.ResponseWriter, r *http.Request, page string, status int, code, message, field string) {
+	if wantsJSON(r) {
+		writeAPIError(w, status, code, message, field)
+		return
+	}
+	path, fragment, _ := strings.Cut(page, "#")
+	q := url.Values{"error_code": {code}, "error_message": {message}}
+	if field != "" {
+		q.Set("error_field", field)
+	}
+	target := path + "?" + q.Encode()
+	if fragment != "" {
+		target += "#" + fragment
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+func formErrorFromQuery(r *http.Request) *APIError {
+	q := r.URL.Query()
+	if q.Get("error_code") == "" {
+		return nil
+	}
+	return &APIError{Code: q.Get("error_code"), Message: q.Get("error_message"), Field: q.Get("error_field")}
+}
+
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// canonicalOrgRole normalises a Grafana org role; empty is allowed and
+// means "not set".
+func canonicalOrgRole(raw string) (string, bool) {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "":
+		return "", true
+	case "viewer":
+		return "Viewer", true
+	case "editor":
+		return "Editor", true
+	case "admin":
+		return "Admin", true
+	}
+	return "", false
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]string{"error": message}); err != nil {
+		log.Printf("api: error encode failed: %v", err)
+	}
+}
+
+func countUnmapped(n int, state func(int) string) int {
+	count := 0
+	for i := 0; i < n; i++ {
+		if state(i) == "unmapped" {
+			count++
+		}
+	}
+	return count
+}
+
 func formatTime(t time.Time) string {
 	if t.IsZero() {
 		return "never"
@@ -1003,6 +4106,35 @@ func formatTime(t time.Time) string {
 	return t.Format(time.RFC3339)
 }
 
+// memberCount returns the count for teamID, or nil when Grafana's member
+// list for the team couldn't be read.
+func memberCount(counts map[int64]int, teamID int64) *int {
+	count, ok := counts[teamID]
+	if !ok {
+		return nil
+	}
+	return &count
+}
+
+// pruneTeamLabels drops the recorded labels of teams that no longer exist in
+// the Grafana org; teams is the org's complete team list.
+func (s *Server) pruneTeamLabels(grafanaOrgID int64, teams []grafana.Team, labels map[int64]map[string]string) {
+	exists := make(map[int64]bool, len(teams))
+	for _, team := range teams {
+		exists[team.ID] = true
+	}
+	for teamID := range labels {
+		if exists[teamID] {
+			continue
+		}
+		if err := s.store.DeleteTeamLabels(grafanaOrgID, teamID); err != nil {
+			log.Printf("ui: delete labels of team %d failed: %v", teamID, err)
+			continue
+		}
+		log.Printf("ui: dropped labels of team %d, deleted from grafana org %d", teamID, grafanaOrgID)
+	}
+}
+
 func (s *Server) loadGrafanaTeams(orgs []store.Org, mappings []store.Mapping) ([]grafanaTeamView, string) {
 	if s.grafana == nil {
 		return nil, "grafana client not configured"
@@ -1031,6 +4163,16 @@ func (s *Server) loadGrafanaTeams(orgs []store.Org, mappings []store.Mapping) ([
 			continue
 		}
 		log.Printf("ui: grafana teams fetched org=%d count=%d", org.GrafanaOrgID, len(teams))
+		memberCounts, err := s.grafana.TeamMemberCounts(org.GrafanaOrgID, teams)
+		if err != nil {
+			log.Printf("ui: grafana team member counts fetch failed for org %d: %v", org.GrafanaOrgID, err)
+			errs = append(errs, fmt.Sprintf("org %d member counts: %v", org.GrafanaOrgID, err))
+		}
+		teamLabels, err := s.store.TeamLabels(org.GrafanaOrgID)
+		if err != nil {
+			log.Printf("ui: team labels load failed for org %d: %v", org.GrafanaOrgID, err)
+		}
+		s.pruneTeamLabels(org.GrafanaOrgID, teams, teamLabels)
 		for _, team := range teams {
 			var mapped []store.Mapping
 			if team.ID > 0 {
@@ -1045,15 +4187,6 @@ func (s *Server) loadGrafanaTeams(orgs []store.Org, mappings []store.Mapping) ([
 					groupIDs = append(groupIDs, entry.ExternalGroupID)
 				}
 			}
-			memberCount := 0
-			if team.ID > 0 {
-				members, err := s.grafana.ListTeamMembers(team.ID)
-				if err != nil {
-					log.Printf("ui: grafana team members fetch failed team=%d: %v", team.ID, err)
-				} else {
-					memberCount = len(members)
-				}
-			}
 			info := mappingGroupsSummary(mapped)
 			state := "unmapped"
 			if info != "" {
@@ -1064,10 +4197,12 @@ func (s *Server) loadGrafanaTeams(orgs []store.Org, mappings []store.Mapping) ([
 				OrgName:      org.Name,
 				TeamID:       team.ID,
 				TeamName:     team.Name,
-				MemberCount:  memberCount,
+				Email:        team.Email,
+				MemberCount:  memberCount(memberCounts, team.ID),
 				GroupIDsCSV:  strings.Join(groupIDs, ","),
 				MappingInfo:  info,
 				MappingState: state,
+				Managed:      s.managedLabelKey != "" && teamLabels[team.ID][s.managedLabelKey] == s.managedLabelValue,
 			})
 		}
 	}
@@ -1094,7 +4229,7 @@ func (s *Server) loadGrafanaUsers(orgs []store.Org) ([]grafanaUserView, string)
 			continue
 		}
 		for _, team := range teams {
-			members, err := s.grafana.ListTeamMembers(team.ID)
+			members, err := s.syncer.ListTeamMembers(org.GrafanaOrgID, team.ID)
 			if err != nil {
 				log.Printf("ui: grafana team members fetch failed team=%d: %v", team.ID, err)
 				continue
@@ -1103,7 +4238,7 @@ func (s *Server) loadGrafanaUsers(orgs []store.Org) ([]grafanaUserView, string)
 				if member.ID == 0 {
 					continue
 				}
-				label := fmt.Sprintf("%s (%s)", team.Name, formatTeamRole(member.Role))
+				label := fmt.Sprintf("%s (%s)", team.Name, formatTeamRole(member.TeamRole()))
 				if teamLabelsByUser[member.ID] == nil {
 					teamLabelsByUser[member.ID] = map[string]struct{}{}
 				}
@@ -1187,7 +4322,7 @@ func (s *Server) loadEntraGroups(orgs []store.Org, mappings []store.Mapping) ([]
 	}
 	views := make([]entraGroupView, 0, len(groups))
 	for _, group := range groups {
-		if !matchEntraGroupName(group.DisplayName) {
+		if !matchEntraGroupName(group.DisplayName) || !s.groupTypeAllowed(group) {
 			continue
 		}
 		mapped := byGroup[group.ID]
@@ -1196,17 +4331,11 @@ func (s *Server) loadEntraGroups(orgs []store.Org, mappings []store.Mapping) ([]
 		if info != "" {
 			state = "mapped"
 		}
-		securityType := "security"
-		if group.MailEnabled {
-			securityType = "m365"
-		} else if !group.SecurityEnabled {
-			securityType = "distribution"
-		}
 		views = append(views, entraGroupView{
 			ID:           group.ID,
 			DisplayName:  group.DisplayName,
 			Mail:         group.Mail,
-			SecurityType: securityType,
+			SecurityType: group.Type(),
 			MappingInfo:  info,
 			MappingState: state,
 		})
@@ -1239,7 +4368,7 @@ func (s *Server) loadEntraUsers() ([]entraUserView, string) {
 	}
 	seen := map[string]*memberInfo{}
 	for _, group := range groups {
-		if !matchEntraGroupName(group.DisplayName) {
+		if !matchEntraGroupName(group.DisplayName) || !s.groupTypeAllowed(group) {
 			continue
 		}
 		members, err := s.entra.ListGroupMembers(group.ID)
@@ -1311,7 +4440,7 @@ func (s *Server) loadGrafanaFolderPermissions(orgs []store.Org) ([]folderPermGro
 				entry := folderPermEntry{
 					Subject:     subject,
 					SubjectType: subjectType,
-					Permission: perm.PermissionName,
+					Permission:  perm.PermissionName,
 				}
 				group.Entries = append(group.Entries, entry)
 			}
@@ -1357,16 +4486,30 @@ func (s *Server) handleEntraGroupMembers(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	if s.entra == nil {
-		http.Error(w, "entra client not configured", http.StatusInternalServerError)
-		return
-	}
 	groupID := strings.TrimSpace(r.URL.Query().Get("group_id"))
 	if groupID == "" {
 		http.Error(w, "missing group_id", http.StatusBadRequest)
 		return
 	}
-	members, err := s.entra.ListGroupMembers(groupID)
+	// grafana_org_id selects the Entra tenant of that org.
+	var org *store.Org
+	if raw := r.URL.Query().Get("grafana_org_id"); raw != "" {
+		grafanaOrgID, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid grafana_org_id: %v", err), http.StatusBadRequest)
+			return
+		}
+		if org, err = s.store.GetOrgByGrafanaID(grafanaOrgID); err != nil {
+			http.Error(w, fmt.Sprintf("failed to load org: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	entraClient := s.entraForOrg(org)
+	if entraClient == nil {
+		http.Error(w, "entra client not configured", http.StatusInternalServerError)
+		return
+	}
+	members, err := entraClient.ListGroupMembers(groupID)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("failed to list group members: %v", err), http.StatusInternalServerError)
 		return
@@ -1433,6 +4576,60 @@ func mappingTeamsSummary(mappings []store.Mapping, orgNames map[int64]string) st
 	return strings.Join(values, ", ")
 }
 
+// parsePlanFilter reads org_id and action_type from query. action_type may
+// be repeated or comma-separated.
+func parsePlanFilter(query url.Values) (planFilter, *APIError) {
+	var filter planFilter
+	if raw := strings.TrimSpace(query.Get("org_id")); raw != "" {
+		id, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || id <= 0 {
+			return planFilter{}, &APIError{Code: "invalid_org_id", Message: "org_id must be a positive number", Field: "org_id"}
+		}
+		filter.OrgID = id
+	}
+	known := map[string]bool{}
+	for _, actionType := range syncer.ActionTypes {
+		known[actionType] = true
+	}
+	for _, raw := range query["action_type"] {
+		for _, actionType := range strings.Split(raw, ",") {
+			actionType = strings.TrimSpace(actionType)
+			if actionType == "" {
+				continue
+			}
+			if !known[actionType] {
+				return planFilter{}, &APIError{Code: "invalid_action_type", Message: fmt.Sprintf("unknown action type %q", actionType), Field: "action_type"}
+			}
+			if filter.ActionTypes == nil {
+				filter.ActionTypes = map[string]bool{}
+			}
+			filter.ActionTypes[actionType] = true
+		}
+	}
+	return filter, nil
+}
+
+func (f planFilter) Active() bool {
+	return f.OrgID != 0 || len(f.ActionTypes) > 0
+}
+
+func filterPlanActions(actions []store.PlanAction, filter planFilter) []store.PlanAction {
+	if !filter.Active() {
+		return actions
+	}
+	var result []store.PlanAction
+	for _, action := range actions {
+		if filter.OrgID != 0 && action.OrgID != filter.OrgID {
+			continue
+		}
+		if len(filter.ActionTypes) > 0 && !filter.ActionTypes[action.ActionType] {
+			continue
+		}
+		result = append(result, action)
+	}
+	return result
+}
+
 func buildPlanGroups(actions []store.PlanAction) []planTeamGroup {
 	type group struct {
 		title   string
@@ -1507,10 +4704,12 @@ func joinGroupLabels(labels map[string]struct{}) string {
 
 func actionClass(actionType string) string {
 	switch actionType {
-	case "remove_user_from_team":
+	case "remove_user_from_team", "delete_datasource":
 		return "danger"
 	case "blocked_create_user":
 		return "muted"
+	case "disable_user", "blocked_protected_user", "blocked_disabled_user":
+		return "warning"
 	default:
 		return "success"
 	}
@@ -1518,14 +4717,24 @@ func actionClass(actionType string) string {
 
 func actionLabel(actionType string) string {
 	switch actionType {
+	case "create_grafana_org":
+		return "Create Grafana org"
 	case "create_team":
 		return "Create team"
+	case "rename_team":
+		return "Rename team"
+	case "create_team_folder":
+		return "Create team folder"
 	case "create_user":
 		return "Create user"
+	case "invite_user":
+		return "Invite user"
 	case "add_user_to_org":
 		return "Add to org"
 	case "update_user_role":
 		return "Update org role"
+	case "update_user_profile":
+		return "Update user profile"
 	case "add_user_to_team":
 		return "Add to team"
 	case "update_team_role":
@@ -1534,14 +4743,104 @@ func actionLabel(actionType string) string {
 		return "Remove from team"
 	case "blocked_create_user":
 		return "Blocked create user"
+	case "blocked_protected_user":
+		return "Protected user"
+	case "blocked_disabled_user":
+		return "Disabled user"
+	case "update_team_description":
+		return "Update team description"
+	case "update_team_email":
+		return "Update team email"
+	case "set_team_preferences":
+		return "Set team preferences"
+	case "set_team_avatar":
+		return "Set team avatar"
+	case "rotate_service_account_token":
+		return "Rotate service account token"
+	case "assign_contact_point":
+		return "Assign contact point"
+	case "set_datasource_permission":
+		return "Set data source permission"
+	case "provision_datasource":
+		return "Provision data source"
+	case "update_datasource":
+		return "Update data source"
+	case "delete_datasource":
+		return "Delete data source"
+	case "disable_user":
+		return "Disable user"
+	case "enable_user":
+		return "Enable user"
 	default:
 		return actionType
 	}
 }
 
-func isSelectableAction(actionType string) bool {
+// actionDescription explains an action type in the plan export legend.
+func actionDescription(actionType string) string {
 	switch actionType {
+	case "create_grafana_org":
+		return "Creates the Grafana org of a mapped org that does not exist yet."
+	case "create_team":
+		return "Creates the mapped Grafana team."
+	case "rename_team":
+		return "Renames an existing team to the mapping's new team name."
+	case "create_team_folder":
+		return "Creates a folder only the team can access."
+	case "create_user":
+		return "Creates a Grafana user for an Entra group member."
+	case "invite_user":
+		return "Invites the user to the org; Grafana OAuth auto-login creates the account."
+	case "add_user_to_org":
+		return "Adds the user to the org with the given role."
+	case "update_user_role":
+		return "Changes the user's org role to the given role."
+	case "update_user_profile":
+		return "Updates the user's name or email from Entra."
+	case "add_user_to_team":
+		return "Adds the user to the team with the given team role."
+	case "update_team_role":
+		return "Changes the user's team role."
+	case "remove_user_from_team":
+		return "Removes a team member who is no longer in the Entra group."
 	case "blocked_create_user":
+		return "The user is missing but creating users is turned off; nothing is applied."
+	case "blocked_protected_user":
+		return "The user's login is protected; nothing is applied."
+	case "blocked_disabled_user":
+		return "The Grafana account is disabled; nothing is applied."
+	case "update_team_description":
+		return "Copies the Entra group description to the team."
+	case "update_team_email":
+		return "Sets the team's email to the Entra group's mail address."
+	case "set_team_preferences":
+		return "Sets the team's home dashboard, theme or timezone."
+	case "set_team_avatar":
+		return "Sets the team's avatar URL."
+	case "rotate_service_account_token":
+		return "Replaces a service account token that is about to expire."
+	case "assign_contact_point":
+		return "Routes the team's alerts to its contact point."
+	case "set_datasource_permission":
+		return "Grants the team access to a data source."
+	case "provision_datasource":
+		return "Creates the team's data source from the mapping template."
+	case "update_datasource":
+		return "Updates the team's data source to match the template."
+	case "delete_datasource":
+		return "Deletes a data source whose mapping was removed."
+	case "disable_user":
+		return "Disables the account of a user removed from their last mapped team."
+	case "enable_user":
+		return "Re-enables the disabled account of a user who is mapped again."
+	default:
+		return ""
+	}
+}
+
+func isSelectableAction(actionType string) bool {
+	switch actionType {
+	case "blocked_create_user", "blocked_protected_user", "blocked_disabled_user":
 		return false
 	default:
 		return true
@@ -0,0 +1,1158 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"grafana-ad-syncher/internal/entra"
+	"grafana-ad-syncher/internal/grafana"
+	"grafana-ad-syncher/internal/store"
+	syncer "grafana-ad-syncher/internal/sync"
+	"grafana-ad-syncher/internal/webhooks"
+)
+
+// testServer is a Server over a fresh store whose Grafana and Graph clients
+// point at upstream, which answers 404 unless a test sets a handler with
+// setHandler. Graph is served under /v1.0 and its token endpoint under
+// /tenant/.
+type testServer struct {
+	server   *Server
+	store    *store.Store
+	mux      *http.ServeMux
+	upstream *httptest.Server
+
+	// handlerMu guards handler, which the server's background refresh
+	// reads through upstream while tests set it.
+	handlerMu sync.Mutex
+	handler   http.HandlerFunc
+}
+
+func newTestServer(t *testing.T, adminToken string) *testServer {
+	t.Helper()
+	return newTestServerWithOptions(t, adminToken, func(string) syncer.Options {
+		return syncer.Options{DefaultUserRole: "Viewer"}
+	})
+}
+
+// newTestServerWithOptions is newTestServer with the syncer built from the
+// options opts returns for upstream's URL. The server's background refresh
+// starts in New, so the syncer must be complete before then.
+func newTestServerWithOptions(t *testing.T, adminToken string, opts func(upstreamURL string) syncer.Options) *testServer {
+	t.Helper()
+	st, err := store.Open(t.TempDir(), 4096, 2000)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { _ = st.Close() })
+	ts := &testServer{store: st}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/oauth2/v2.0/token") {
+			w.Write([]byte(`{"access_token":"token","expires_in":3600}`))
+			return
+		}
+		ts.handlerMu.Lock()
+		handler := ts.handler
+		ts.handlerMu.Unlock()
+		if handler != nil {
+			handler(w, r)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(upstream.Close)
+	grafanaClient := grafana.New(upstream.URL, "/api", "admin", "admin", "", nil, false, false, grafana.TransportOptions{})
+	entraClient := entra.New("tenant", "client", "secret", upstream.URL, upstream.URL, "v1.0", nil)
+	sync := syncer.New(st, grafanaClient, entraClient, opts(upstream.URL))
+	server, err := New(st, sync, grafanaClient, entraClient, filepath.Join("..", "..", "web", "templates"), adminToken)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	ts.server, ts.mux, ts.upstream = server, http.NewServeMux(), upstream
+	server.Register(ts.mux)
+	return ts
+}
+
+// setHandler makes upstream answer with handler.
+func (ts *testServer) setHandler(handler http.HandlerFunc) {
+	ts.handlerMu.Lock()
+	defer ts.handlerMu.Unlock()
+	ts.handler = handler
+}
+
+func (ts *testServer) do(method, target, body string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	rec := httptest.NewRecorder()
+	ts.mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func (ts *testServer) planStatus(t *testing.T) string {
+	t.Helper()
+	plan, err := ts.store.LatestPlan()
+	if err != nil || plan == nil {
+		t.Fatalf("latest plan: %v %v", plan, err)
+	}
+	return plan.Status
+}
+
+func TestApplyProgressGetIsReadOnly(t *testing.T) {
+	ts := newTestServer(t, "")
+	if _, err := ts.store.ReplacePlan(store.Plan{Status: "pending"}); err != nil {
+		t.Fatalf("replace plan: %v", err)
+	}
+
+	if rec := ts.do(http.MethodGet, "/sync/apply/progress", "", nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("GET before any apply = %d, want 404", rec.Code)
+	}
+	if got := ts.planStatus(t); got != "pending" {
+		t.Fatalf("plan status after GET = %q, want pending", got)
+	}
+
+	if rec := ts.do(http.MethodPost, "/sync/apply/progress", "", nil); rec.Code != http.StatusAccepted {
+		t.Fatalf("POST = %d %s, want 202", rec.Code, rec.Body)
+	}
+
+	srv := httptest.NewServer(ts.mux)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/sync/apply/progress")
+	if err != nil {
+		t.Fatalf("GET progress: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+	}
+	var last string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "data: ") {
+			last = line
+		}
+	}
+	if !strings.Contains(last, `"done":true`) || !strings.Contains(last, `"errors":0`) {
+		t.Fatalf("last event = %q, want done without errors", last)
+	}
+	if got := ts.planStatus(t); got != "applied" {
+		t.Fatalf("plan status = %q, want applied", got)
+	}
+
+	// Replaying the finished apply changes nothing.
+	if _, err := ts.store.ReplacePlan(store.Plan{Status: "pending"}); err != nil {
+		t.Fatalf("replace plan: %v", err)
+	}
+	rec := ts.do(http.MethodGet, "/sync/apply/progress", "", nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"done":true`) {
+		t.Fatalf("GET replay = %d %q", rec.Code, rec.Body)
+	}
+	if got := ts.planStatus(t); got != "pending" {
+		t.Fatalf("plan status after replay = %q, want pending", got)
+	}
+}
+
+func TestApplyProgressRejectsConcurrentApply(t *testing.T) {
+	ts := newTestServer(t, "")
+	if !ts.server.applyProgress.start() {
+		t.Fatal("start on idle tracker returned false")
+	}
+	if _, err := ts.store.ReplacePlan(store.Plan{Status: "pending"}); err != nil {
+		t.Fatalf("replace plan: %v", err)
+	}
+	if rec := ts.do(http.MethodPost, "/sync/apply/progress", "", nil); rec.Code != http.StatusConflict {
+		t.Fatalf("POST while running = %d, want 409", rec.Code)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rec := ts.do(http.MethodGet, "/sync/apply/progress", "", nil)
+		if !strings.Contains(rec.Body.String(), `"late":true`) {
+			t.Errorf("stream missed event added while waiting: %q", rec.Body)
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+	ts.server.applyProgress.add(map[string]bool{"late": true}, true)
+	<-done
+}
+
+func TestBackupRequiresAdminToken(t *testing.T) {
+	ts := newTestServer(t, "secret-token")
+	if rec := ts.do(http.MethodPost, "/api/admin/backup", "", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("backup without token = %d, want 401", rec.Code)
+	}
+	rec := ts.do(http.MethodPost, "/api/admin/backup", "", http.Header{"Authorization": {"Bearer secret-token"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("backup = %d %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/octet-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if cd := rec.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, `attachment; filename="sync-backup-`) {
+		t.Errorf("Content-Disposition = %q", cd)
+	}
+	if !strings.HasPrefix(rec.Body.String(), "SQLite format 3\x00") {
+		t.Error("backup body is not an SQLite database")
+	}
+}
+
+func TestCreateMappingErrors(t *testing.T) {
+	ts := newTestServer(t, "")
+	orgID, err := ts.store.CreateOrg(store.Org{GrafanaOrgID: 1, Name: "Main", DefaultRole: "Viewer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.store.CreateMapping(store.Mapping{OrgID: orgID, GrafanaTeamName: "Ops", ExternalGroupID: "g1", TeamRole: "member"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name     string
+		body     string
+		wantCode int
+		wantErr  string
+	}{
+		{"org not found", `{"org_id":999,"grafana_team_name":"Dev","external_group_id":"g2"}`, http.StatusNotFound, "org_not_found"},
+		{"duplicate", fmt.Sprintf(`{"org_id":%d,"grafana_team_name":"OPS","external_group_id":"g1"}`, orgID), http.StatusConflict, "duplicate_mapping"},
+		{"team role", fmt.Sprintf(`{"org_id":%d,"grafana_team_name":"Dev","external_group_id":"g2","team_role":"owner"}`, orgID), http.StatusBadRequest, "invalid_team_role"},
+		{"role override", fmt.Sprintf(`{"org_id":%d,"grafana_team_name":"Dev","external_group_id":"g2","role_override":"Root"}`, orgID), http.StatusBadRequest, "invalid_role_override"},
+		{"missing team", fmt.Sprintf(`{"org_id":%d,"external_group_id":"g2"}`, orgID), http.StatusBadRequest, "missing_team_name"},
+		{"invalid json", `{`, http.StatusBadRequest, "invalid_json"},
+		{"created", fmt.Sprintf(`{"org_id":%d,"grafana_team_name":"Dev","external_group_id":"g2"}`, orgID), http.StatusCreated, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := ts.do(http.MethodPost, "/api/mappings", tc.body, http.Header{"Content-Type": {"application/json"}})
+			if rec.Code != tc.wantCode {
+				t.Fatalf("status = %d %s, want %d", rec.Code, rec.Body, tc.wantCode)
+			}
+			if tc.wantErr == "" {
+				return
+			}
+			var apiErr APIError
+			if err := json.Unmarshal(rec.Body.Bytes(), &apiErr); err != nil || apiErr.Code != tc.wantErr {
+				t.Fatalf("error = %+v (%v), want code %s", apiErr, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCreateMappingFormOrgNotFound(t *testing.T) {
+	ts := newTestServer(t, "")
+	form := url.Values{"org_id": {"999"}, "grafana_team_name": {"Dev"}, "external_group_id": {"g1"}}
+	rec := ts.do(http.MethodPost, "/mappings", form.Encode(), http.Header{
+		"Content-Type": {"application/x-www-form-urlencoded"},
+		"Accept":       {"application/json"},
+	})
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "org_not_found") {
+		t.Fatalf("status = %d %s, want 404 org_not_found", rec.Code, rec.Body)
+	}
+}
+
+func TestAPIStatusByGrafanaOrgID(t *testing.T) {
+	ts := newTestServer(t, "")
+	for _, org := range []store.Org{{GrafanaOrgID: 1, Name: "Main"}, {GrafanaOrgID: 2, Name: "Sub"}} {
+		org.DefaultRole = "Viewer"
+		if _, err := ts.store.CreateOrg(org); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		query     string
+		wantCode  int
+		wantNames []string
+	}{
+		{"", http.StatusOK, []string{"Main", "Sub"}},
+		{"?grafana_org_id=2", http.StatusOK, []string{"Sub"}},
+		{"?grafana_org_id=3", http.StatusNotFound, nil},
+		{"?grafana_org_id=abc", http.StatusBadRequest, nil},
+	} {
+		rec := ts.do(http.MethodGet, "/api/status"+tc.query, "", nil)
+		if rec.Code != tc.wantCode {
+			t.Errorf("%q: status = %d %s, want %d", tc.query, rec.Code, rec.Body, tc.wantCode)
+			continue
+		}
+		if tc.wantCode != http.StatusOK {
+			continue
+		}
+		var status struct {
+			Orgs []struct {
+				Name string `json:"name"`
+			} `json:"orgs"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, org := range status.Orgs {
+			names = append(names, org.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(tc.wantNames, ",") {
+			t.Errorf("%q: orgs = %v, want %v", tc.query, names, tc.wantNames)
+		}
+	}
+}
+
+func TestLoadGrafanaTeamsSearchesOnce(t *testing.T) {
+	ts := newTestServer(t, "")
+	var mu sync.Mutex
+	searches := 0
+	ts.setHandler(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/teams/search":
+			mu.Lock()
+			searches++
+			mu.Unlock()
+			if r.URL.Query().Get("page") != "1" {
+				w.Write([]byte(`{"teams":[]}`))
+				return
+			}
+			w.Write([]byte(`{"teams":[{"id":1,"name":"Ops","memberCount":4},{"id":2,"name":"Dev"}]}`))
+		case "/api/teams/2/members":
+			http.Error(w, `{"message":"boom"}`, http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	views, errText := ts.server.loadGrafanaTeams([]store.Org{{ID: 1, GrafanaOrgID: 1, Name: "Main"}}, nil)
+	mu.Lock()
+	if searches != 2 {
+		t.Errorf("team searches = %d, want 2 (one page of teams and the empty last page)", searches)
+	}
+	mu.Unlock()
+	if !strings.Contains(errText, "member counts") {
+		t.Errorf("error = %q, want the member count failure", errText)
+	}
+	counts := map[string]*int{}
+	for _, view := range views {
+		counts[view.TeamName] = view.MemberCount
+	}
+	if counts["Ops"] == nil || *counts["Ops"] != 4 {
+		t.Errorf("Ops member count = %v, want 4", counts["Ops"])
+	}
+	if _, ok := counts["Dev"]; !ok || counts["Dev"] != nil {
+		t.Errorf("Dev member count = %v, want unset", counts["Dev"])
+	}
+}
+
+func TestApplyByTeam(t *testing.T) {
+	ts := newTestServer(t, "")
+	var mu sync.Mutex
+	var created []string
+	ts.setHandler(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/teams":
+			var body struct {
+				Name string `json:"name"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			mu.Lock()
+			created = append(created, body.Name)
+			mu.Unlock()
+			fmt.Fprintf(w, `{"teamId":%d}`, 10+len(created))
+		case r.URL.Path == "/api/teams/search":
+			w.Write([]byte(`{"teams":[]}`))
+		case r.Method == http.MethodGet:
+			w.Write([]byte(`[]`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	})
+	planID, err := ts.store.ReplacePlan(store.Plan{Status: "pending", Actions: []store.PlanAction{
+		{ActionType: "create_team", OrgID: 1, GrafanaOrgID: 1, TeamName: "Alpha"},
+		{ActionType: "create_team", OrgID: 1, GrafanaOrgID: 1, TeamName: "Beta"},
+		{ActionType: "blocked_create_user", OrgID: 1, GrafanaOrgID: 1, TeamName: "Gamma", Email: "x@example.com"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name     string
+		planID   int64
+		body     string
+		wantCode int
+		wantErr  string
+	}{
+		{"invalid json", planID, `{`, http.StatusBadRequest, "invalid_json"},
+		{"no teams", planID, `{"team_names":[]}`, http.StatusBadRequest, "missing_team_names"},
+		{"not the current plan", planID + 1, `{"team_names":["Alpha"]}`, http.StatusNotFound, "plan_not_found"},
+		{"only blocked actions", planID, `{"team_names":["Gamma"]}`, http.StatusBadRequest, "no_actions"},
+		{"applies one team", planID, `{"team_names":["Alpha"]}`, http.StatusOK, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := ts.do(http.MethodPost, fmt.Sprintf("/api/plans/%d/apply-by-team", tc.planID), tc.body, nil)
+			if rec.Code != tc.wantCode {
+				t.Fatalf("status = %d %s, want %d", rec.Code, rec.Body, tc.wantCode)
+			}
+			if tc.wantErr != "" {
+				var apiErr APIError
+				if err := json.Unmarshal(rec.Body.Bytes(), &apiErr); err != nil || apiErr.Code != tc.wantErr {
+					t.Fatalf("error = %+v (%v), want code %s", apiErr, err, tc.wantErr)
+				}
+				return
+			}
+			var result ApplyResult
+			if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			if result.PlanID != planID || result.Status != "applied-selected" || result.Applied != 1 {
+				t.Fatalf("result = %+v, want one action applied", result)
+			}
+		})
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(created, ",") != "Alpha" {
+		t.Fatalf("created teams = %v, want only Alpha", created)
+	}
+	if got := ts.planStatus(t); got != "applied-selected" {
+		t.Fatalf("plan status = %q, want applied-selected", got)
+	}
+}
+
+func TestPlanSummaryMatchesActions(t *testing.T) {
+	ts := newTestServer(t, "")
+	actions := []store.PlanAction{
+		{ActionType: "create_team", OrgID: 1, GrafanaOrgID: 1, TeamName: "Alpha"},
+		{ActionType: "add_user_to_team", OrgID: 1, GrafanaOrgID: 1, TeamName: "Alpha", Email: "a@example.com"},
+		{ActionType: "add_user_to_team", OrgID: 1, GrafanaOrgID: 1, TeamName: "Alpha", Email: "b@example.com"},
+		{ActionType: "add_user_to_team", OrgID: 1, GrafanaOrgID: 1, TeamName: "Beta", Email: "a@example.com"},
+		{ActionType: "add_user_to_org", OrgID: 1, GrafanaOrgID: 1, Email: "b@example.com"},
+	}
+	planID, err := ts.store.ReplacePlan(store.Plan{Status: "pending", Actions: actions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := ts.store.LatestPlan()
+	if err != nil || plan == nil {
+		t.Fatalf("latest plan: %+v, %v", plan, err)
+	}
+	want := map[string]int{}
+	for _, action := range plan.Actions {
+		want[action.ActionType]++
+	}
+
+	rec := ts.do(http.MethodGet, fmt.Sprintf("/api/plans/%d/summary", planID), "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d %s, want 200", rec.Code, rec.Body)
+	}
+	var summary store.PlanSummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.PlanID != planID || summary.Status != "pending" || summary.Total != len(plan.Actions) {
+		t.Errorf("summary = %+v, want plan %d pending with %d actions", summary, planID, len(plan.Actions))
+	}
+	if !reflect.DeepEqual(summary.ActionCounts, want) {
+		t.Errorf("action counts = %v, want %v", summary.ActionCounts, want)
+	}
+	if summary.TeamCounts["Alpha"] != 3 || summary.TeamCounts["Beta"] != 1 || summary.TeamCounts[""] != 1 {
+		t.Errorf("team counts = %v, want Alpha 3, Beta 1 and 1 without a team", summary.TeamCounts)
+	}
+
+	rec = ts.do(http.MethodGet, fmt.Sprintf("/api/plans/%d/summary", planID+1), "", nil)
+	var apiErr APIError
+	if rec.Code != http.StatusNotFound || json.Unmarshal(rec.Body.Bytes(), &apiErr) != nil || apiErr.Code != "plan_not_found" {
+		t.Errorf("missing plan: status = %d %s, want 404 plan_not_found", rec.Code, rec.Body)
+	}
+}
+
+func TestParseGracePeriod(t *testing.T) {
+	for _, tc := range []struct {
+		raw, want string
+		wantErr   bool
+	}{
+		{raw: "", want: ""},
+		{raw: "  ", want: ""},
+		{raw: "24h", want: "24h0m0s"},
+		{raw: " 90m ", want: "1h30m0s"},
+		{raw: "0s", want: "0s"},
+		{raw: "-1h", wantErr: true},
+		{raw: "tomorrow", wantErr: true},
+	} {
+		got, err := parseGracePeriod(tc.raw)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("parseGracePeriod(%q) = %q, %v; want %q, error %v", tc.raw, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestParseOptionalBool(t *testing.T) {
+	for raw, want := range map[string]string{"": "", "true": "true", "0": "false", " FALSE ": "false"} {
+		got, err := parseOptionalBool(raw)
+		if err != nil || optBool(got) != want {
+			t.Errorf("parseOptionalBool(%q) = %q, %v; want %q", raw, optBool(got), err, want)
+		}
+	}
+	if _, err := parseOptionalBool("maybe"); err == nil {
+		t.Error(`parseOptionalBool("maybe") succeeded`)
+	}
+}
+
+func TestCreateMappingAmbiguousGroupName(t *testing.T) {
+	ts := newTestServer(t, "")
+	ts.setHandler(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1.0/groups" && strings.Contains(r.URL.Query().Get("$filter"), "'Ops'") {
+			w.Write([]byte(`{"value":[{"id":"g1","displayName":"Ops","mail":"ops@example.com"},{"id":"g2","displayName":"Ops"}]}`))
+			return
+		}
+		w.Write([]byte(`{"value":[]}`))
+	})
+	orgID, err := ts.store.CreateOrg(store.Org{GrafanaOrgID: 1, Name: "Main", DefaultRole: "Viewer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := ts.do(http.MethodPost, "/api/mappings", fmt.Sprintf(`{"org_id":%d,"grafana_team_name":"Ops","external_group_name":"Ops"}`, orgID), nil)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d %s, want 422", rec.Code, rec.Body)
+	}
+	var apiErr struct {
+		Code    string              `json:"code"`
+		Field   string              `json:"field"`
+		Details []map[string]string `json:"details"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &apiErr); err != nil {
+		t.Fatal(err)
+	}
+	if apiErr.Code != "ambiguous_group" || apiErr.Field != "external_group_id" || len(apiErr.Details) != 2 ||
+		apiErr.Details[0]["id"] != "g1" || apiErr.Details[1]["id"] != "g2" {
+		t.Fatalf("error = %+v, want ambiguous_group listing g1 and g2", apiErr)
+	}
+	if mappings, _ := ts.store.ListMappings(); len(mappings) != 0 {
+		t.Errorf("ambiguous name created %d mappings", len(mappings))
+	}
+
+	rec = ts.do(http.MethodPost, "/api/mappings", fmt.Sprintf(`{"org_id":%d,"grafana_team_name":"Ops","external_group_name":"Missing"}`, orgID), nil)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "missing_group") {
+		t.Errorf("unknown name = %d %s, want 400 missing_group", rec.Code, rec.Body)
+	}
+	rec = ts.do(http.MethodPost, "/api/mappings", fmt.Sprintf(`{"org_id":%d,"grafana_team_name":"Ops","external_group_name":"Ops","external_group_id":"g2"}`, orgID), nil)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("explicit ID = %d %s, want 201", rec.Code, rec.Body)
+	}
+}
+
+func TestImportMappingsCSV(t *testing.T) {
+	ts := newTestServer(t, "")
+	orgID, err := ts.store.CreateOrg(store.Org{GrafanaOrgID: 1, Name: "Main", DefaultRole: "Viewer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.store.CreateMapping(store.Mapping{OrgID: orgID, GrafanaTeamName: "Ops", ExternalGroupID: "g1", TeamRole: "member"}); err != nil {
+		t.Fatal(err)
+	}
+	fixture := "grafana_org_id,grafana_team_name,external_group_id,external_group_name,team_role,role_override\n" +
+		"1,Dev,g2,,admin,Editor\n" +
+		"7,Web,g3,,,\n" +
+		"1,Ops,g1,,,\n"
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "mappings.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(fixture))
+	form.Close()
+	rec := ts.do(http.MethodPost, "/api/mappings/import-csv", body.String(), http.Header{"Content-Type": {form.FormDataContentType()}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d %s, want 200", rec.Code, rec.Body)
+	}
+	var result struct {
+		Created int              `json:"created"`
+		Skipped int              `json:"skipped"`
+		Errors  []csvImportError `json:"errors"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Created != 1 || result.Skipped != 1 || len(result.Errors) != 1 || result.Errors[0].Row != 3 {
+		t.Fatalf("result = %+v, want 1 created, 1 skipped and an error for row 3", result)
+	}
+	mapping, err := ts.store.GetMappingByTeamName(orgID, "Dev")
+	if err != nil || mapping == nil || mapping.TeamRole != "admin" || mapping.RoleOverride != "Editor" {
+		t.Fatalf("imported mapping = %+v, %v", mapping, err)
+	}
+}
+
+func TestMetricsServesWindowSkips(t *testing.T) {
+	ts := newTestServer(t, "")
+	ts.server.syncer.RecordWindowSkip()
+	ts.server.syncer.RecordWindowSkip()
+	rec := ts.do(http.MethodGet, "/metrics", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d %s", rec.Code, rec.Body)
+	}
+	for _, want := range []string{
+		"# TYPE sync_window_skipped_total counter\n",
+		"\nsync_window_skipped_total 2\n",
+		"\ngrafana_ad_syncher_last_sync_action_timestamp_seconds 0\n",
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, rec.Body)
+		}
+	}
+}
+
+func TestWebhookSyncSignature(t *testing.T) {
+	const secret = "webhook-secret"
+	// A Microsoft Graph change notification as a relay forwards it.
+	body := `{"value":[{"subscriptionId":"7f105c7d-2dc5-4530-97cd-4e7ae6534c07",` +
+		`"clientState":"secretClientValue","changeType":"updated",` +
+		`"resource":"groups/0f6f3b8c-9d2a-4b7e-8c1d-2e3f4a5b6c7d",` +
+		`"subscriptionExpirationDateTime":"2026-10-18T11:00:00.0000000Z",` +
+		`"resourceData":{"@odata.type":"#Microsoft.Graph.Group","id":"0f6f3b8c-9d2a-4b7e-8c1d-2e3f4a5b6c7d"},` +
+		`"tenantId":"84bd8158-6d4d-4958-8b9f-9d6445542f95"}]}`
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-webhooks.MaxAge-time.Minute).Unix(), 10)
+
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		body      string
+		want      int
+	}{
+		{"valid", now, webhooks.Sign(secret, now, []byte(body)), body, http.StatusAccepted},
+		{"tampered body", now, webhooks.Sign(secret, now, []byte(body)), strings.Replace(body, "updated", "deleted", 1), http.StatusForbidden},
+		{"rewritten timestamp", now, webhooks.Sign(secret, stale, []byte(body)), body, http.StatusForbidden},
+		{"stale", stale, webhooks.Sign(secret, stale, []byte(body)), body, http.StatusForbidden},
+		{"missing timestamp", "", webhooks.Sign(secret, now, []byte(body)), body, http.StatusForbidden},
+		{"body-only signature", now, "sha256=" + hmacHex(secret, body), body, http.StatusForbidden},
+		{"missing signature", now, "", body, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, "")
+			ts.server.SetWebhookSecret(secret)
+			header := http.Header{}
+			if tt.timestamp != "" {
+				header.Set(webhooks.TimestampHeader, tt.timestamp)
+			}
+			if tt.signature != "" {
+				header.Set(webhooks.SignatureHeader, tt.signature)
+			}
+			rec := ts.do(http.MethodPost, "/webhooks/sync", tt.body, header)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d %s, want %d", rec.Code, rec.Body, tt.want)
+			}
+			// Let a started sync finish before the store is closed.
+			for deadline := time.Now().Add(5 * time.Second); ts.server.webhookRunning.Load(); {
+				if time.Now().After(deadline) {
+					t.Fatal("webhook-triggered sync did not finish")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func hmacHex(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestPageBounds(t *testing.T) {
+	for _, tc := range []struct {
+		query                     string
+		total                     int
+		page, perPage, start, end int
+	}{
+		{query: "", total: 120, page: 1, perPage: 50, start: 0, end: 50},
+		{query: "page=3", total: 120, page: 3, perPage: 50, start: 100, end: 120},
+		{query: "page=4", total: 120, page: 3, perPage: 50, start: 100, end: 120},
+		{query: "page=2&per_page=60", total: 120, page: 2, perPage: 60, start: 60, end: 120},
+		{query: "page=3&per_page=60", total: 120, page: 3, perPage: 60, start: 120, end: 120},
+		{query: "page=0&per_page=-5", total: 10, page: 1, perPage: 50, start: 0, end: 10},
+		{query: "per_page=100000", total: 10, page: 1, perPage: 500, start: 0, end: 10},
+		{query: "page=2", total: 0, page: 1, perPage: 50, start: 0, end: 0},
+		{query: "page=abc", total: 5, page: 1, perPage: 50, start: 0, end: 5},
+		{query: "page=9223372036854775807", total: 120, page: 3, perPage: 50, start: 100, end: 120},
+		{query: "page=9223372036854775807&per_page=500", total: 1000, page: 3, perPage: 500, start: 1000, end: 1000},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/grafana/users?"+tc.query, nil)
+		page, perPage, start, end := pageBounds(r, tc.total)
+		if page != tc.page || perPage != tc.perPage || start != tc.start || end != tc.end {
+			t.Errorf("pageBounds(%q, %d) = %d, %d, %d, %d; want %d, %d, %d, %d", tc.query, tc.total,
+				page, perPage, start, end, tc.page, tc.perPage, tc.start, tc.end)
+		}
+	}
+}
+
+func TestMappingGroupLookupUsesOrgTenant(t *testing.T) {
+	ts := newTestServerWithOptions(t, "", func(upstreamURL string) syncer.Options {
+		return syncer.Options{
+			DefaultUserRole: "Viewer",
+			NewTenantClient: func(tenant store.Tenant) *entra.Client {
+				return entra.New(tenant.TenantID, tenant.ClientID, tenant.ClientSecret, upstreamURL, upstreamURL+"/sub", "v1.0", nil)
+			},
+		}
+	})
+	ts.store.SetEncryptionKey("test-key")
+	tenantID, err := ts.store.CreateTenant(store.Tenant{Name: "Subsidiary", TenantID: "sub", ClientID: "client", ClientSecret: "sub-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.server.syncer.ReloadTenants(); err != nil {
+		t.Fatal(err)
+	}
+	orgID, err := ts.store.CreateOrg(store.Org{GrafanaOrgID: 2, Name: "Sub", DefaultRole: "Viewer", TenantID: tenantID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var paths []string
+	ts.setHandler(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.RequestURI())
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/sub/v1.0/groups":
+			w.Write([]byte(`{"value":[{"id":"sub-group","displayName":"Devs"}]}`))
+		case "/sub/v1.0/groups/sub-group/members":
+			w.Write([]byte(`{"value":[{"id":"u1","displayName":"Dana","mail":"dana@sub.example.com"}]}`))
+		default:
+			w.Write([]byte(`{"value":[{"id":"default-group","displayName":"Devs"}]}`))
+		}
+	})
+
+	body := fmt.Sprintf(`{"org_id":%d,"grafana_team_name":"Dev","external_group_name":"Devs"}`, orgID)
+	if rec := ts.do(http.MethodPost, "/api/mappings", body, http.Header{"Content-Type": {"application/json"}}); rec.Code != http.StatusCreated {
+		t.Fatalf("create mapping status = %d %s", rec.Code, rec.Body)
+	}
+	mapping, err := ts.store.GetMappingByTeamName(orgID, "Dev")
+	if err != nil || mapping == nil || mapping.ExternalGroupID != "sub-group" {
+		t.Fatalf("mapping = %+v, %v; want the subsidiary tenant's group", mapping, err)
+	}
+
+	form := url.Values{"id": {fmt.Sprint(mapping.ID)}, "org_id": {fmt.Sprint(orgID)}, "grafana_team_name": {"Dev"}, "external_group_name": {"Devs"}}
+	if rec := ts.do(http.MethodPost, "/mappings/update", form.Encode(), http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}); rec.Code != http.StatusSeeOther {
+		t.Fatalf("update mapping status = %d %s", rec.Code, rec.Body)
+	}
+	if mapping, err = ts.store.GetMapping(mapping.ID); err != nil || mapping.ExternalGroupID != "sub-group" {
+		t.Fatalf("updated mapping = %+v, %v; want the subsidiary tenant's group", mapping, err)
+	}
+
+	rec := ts.do(http.MethodGet, "/entra/group/members?group_id=sub-group&grafana_org_id=2", "", nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "dana@sub.example.com") {
+		t.Fatalf("group members = %d %s", rec.Code, rec.Body)
+	}
+	// The page data refresh lists the default tenant's groups in the
+	// background; lookups and member lists must not use it.
+	mu.Lock()
+	defer mu.Unlock()
+	for _, uri := range paths {
+		lookup := strings.Contains(uri, "filter=") || strings.Contains(uri, "/members")
+		if lookup && !strings.HasPrefix(uri, "/sub/") {
+			t.Errorf("request to %s went to the default tenant", uri)
+		}
+	}
+}
+
+func TestLoadGrafanaTeamsPrunesDeletedTeamLabels(t *testing.T) {
+	ts := newTestServer(t, "")
+	ts.setHandler(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/teams/search" && r.URL.Query().Get("page") == "1" {
+			w.Write([]byte(`{"teams":[{"id":1,"name":"Ops","memberCount":1}]}`))
+			return
+		}
+		w.Write([]byte(`{"teams":[]}`))
+	})
+	for _, teamID := range []int64{1, 2} {
+		if err := ts.store.SetTeamLabels(1, teamID, map[string]string{"managed-by": "grafana-ad-syncher"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ts.store.SetTeamLabels(2, 2, map[string]string{"managed-by": "grafana-ad-syncher"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, errText := ts.server.loadGrafanaTeams([]store.Org{{ID: 1, GrafanaOrgID: 1, Name: "Main"}}, nil); errText != "" {
+		t.Fatalf("loadGrafanaTeams error = %q", errText)
+	}
+	labels, err := ts.store.TeamLabels(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labels) != 1 || labels[1] == nil {
+		t.Errorf("org 1 team labels = %v, want only team 1's", labels)
+	}
+	if other, err := ts.store.TeamLabels(2); err != nil || len(other) != 1 {
+		t.Errorf("org 2 team labels = %v, %v; want them kept", other, err)
+	}
+}
+
+func TestCacheRefresh(t *testing.T) {
+	ts := newTestServer(t, "")
+
+	var status cacheStatus
+	rec := ts.do(http.MethodGet, "/api/cache/status", "", nil)
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &status) != nil || status.RefreshedAt != "" {
+		t.Fatalf("status before refresh = %d %s, want an empty refreshed_at", rec.Code, rec.Body)
+	}
+
+	var refreshed []time.Time
+	for i := 0; i < 2; i++ {
+		rec := ts.do(http.MethodPost, "/api/cache/refresh", "", nil)
+		if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &status) != nil {
+			t.Fatalf("refresh = %d %s", rec.Code, rec.Body)
+		}
+		at, err := time.Parse(time.RFC3339Nano, status.RefreshedAt)
+		if err != nil {
+			t.Fatalf("refreshed_at = %q: %v", status.RefreshedAt, err)
+		}
+		refreshed = append(refreshed, at)
+	}
+	if !refreshed[1].After(refreshed[0]) {
+		t.Errorf("refreshed_at went from %s to %s, want it to advance", refreshed[0], refreshed[1])
+	}
+	if rec := ts.do(http.MethodGet, "/api/cache/status", "", nil); json.Unmarshal(rec.Body.Bytes(), &status) != nil || status.RefreshedAt != refreshed[1].Format(time.RFC3339Nano) {
+		t.Errorf("status after refresh = %s, want refreshed_at %s", rec.Body, refreshed[1].Format(time.RFC3339Nano))
+	}
+	if rec := ts.do(http.MethodGet, "/api/cache/refresh", "", nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /api/cache/refresh = %d, want 405", rec.Code)
+	}
+}
+
+func TestCacheDump(t *testing.T) {
+	ts := newTestServer(t, "secret-token")
+	auth := http.Header{"Authorization": {"Bearer secret-token"}}
+	var status cacheStatus
+	if rec := ts.do(http.MethodPost, "/api/cache/refresh", "", nil); json.Unmarshal(rec.Body.Bytes(), &status) != nil || status.RefreshedAt == "" {
+		t.Fatalf("refresh = %d %s", rec.Code, rec.Body)
+	}
+
+	for _, path := range []string{"/api/cache/grafana-teams", "/api/cache/grafana-users", "/api/cache/entra-groups", "/api/cache/entra-users"} {
+		for _, tc := range []struct {
+			name   string
+			header http.Header
+			want   int
+		}{
+			{name: "no token", want: http.StatusUnauthorized},
+			{name: "wrong token", header: http.Header{"Authorization": {"Bearer nope"}}, want: http.StatusUnauthorized},
+			{name: "admin token", header: auth, want: http.StatusOK},
+		} {
+			t.Run(path+"/"+tc.name, func(t *testing.T) {
+				rec := ts.do(http.MethodGet, path, "", tc.header)
+				if rec.Code != tc.want {
+					t.Fatalf("status = %d %s, want %d", rec.Code, rec.Body, tc.want)
+				}
+				if tc.want != http.StatusOK {
+					return
+				}
+				var dump map[string]json.RawMessage
+				if err := json.Unmarshal(rec.Body.Bytes(), &dump); err != nil {
+					t.Fatal(err)
+				}
+				if string(dump["cache_refreshed_at"]) != strconv.Quote(status.RefreshedAt) {
+					t.Errorf("cache_refreshed_at = %s, want the last refresh", dump["cache_refreshed_at"])
+				}
+				if items := dump["items"]; len(items) == 0 || items[0] != '[' {
+					t.Errorf("items = %s, want a JSON array", items)
+				}
+			})
+		}
+	}
+	if rec := newTestServer(t, "").do(http.MethodGet, "/api/cache/grafana-teams", "", nil); rec.Code != http.StatusForbidden {
+		t.Errorf("dump without ADMIN_API_TOKEN = %d, want 403", rec.Code)
+	}
+}
+
+func TestPlanFilter(t *testing.T) {
+	ts := newTestServer(t, "")
+	for _, org := range []store.Org{{GrafanaOrgID: 1, Name: "Main"}, {GrafanaOrgID: 2, Name: "Other"}} {
+		if _, err := ts.store.CreateOrg(org); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ts.store.ReplacePlan(store.Plan{Status: "pending", Actions: []store.PlanAction{
+		{ActionType: "create_team", OrgID: 1, GrafanaOrgID: 1, TeamName: "Alpha-Team"},
+		{ActionType: "add_user_to_team", OrgID: 1, GrafanaOrgID: 1, TeamName: "Alpha-Team", Email: "a@example.com"},
+		{ActionType: "add_user_to_team", OrgID: 2, GrafanaOrgID: 2, TeamName: "Beta-Team", Email: "b@example.com"},
+		{ActionType: "remove_user_from_team", OrgID: 2, GrafanaOrgID: 2, TeamName: "Gamma-Team", Email: "c@example.com"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		query string
+		teams []string
+		code  int
+	}{
+		{query: "", teams: []string{"Alpha-Team", "Alpha-Team", "Beta-Team", "Gamma-Team"}},
+		{query: "?org_id=2", teams: []string{"Beta-Team", "Gamma-Team"}},
+		{query: "?action_type=add_user_to_team", teams: []string{"Alpha-Team", "Beta-Team"}},
+		{query: "?action_type=create_team,remove_user_from_team", teams: []string{"Alpha-Team", "Gamma-Team"}},
+		{query: "?org_id=1&action_type=remove_user_from_team"},
+		{query: "?org_id=x", code: http.StatusBadRequest},
+		{query: "?action_type=bogus", code: http.StatusBadRequest},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			want := tc.code
+			if want == 0 {
+				want = http.StatusOK
+			}
+			rec := ts.do(http.MethodGet, "/api/plans/latest"+tc.query, "", nil)
+			if rec.Code != want {
+				t.Fatalf("/api/plans/latest = %d %s, want %d", rec.Code, rec.Body, want)
+			}
+			page := ts.do(http.MethodGet, "/"+tc.query, "", nil)
+			if page.Code != want {
+				t.Fatalf("/ = %d, want %d", page.Code, want)
+			}
+			if want != http.StatusOK {
+				return
+			}
+			var resp struct {
+				Total   int              `json:"total"`
+				Actions []planActionJSON `json:"actions"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			var teams []string
+			for _, action := range resp.Actions {
+				teams = append(teams, action.TeamName)
+			}
+			if resp.Total != 4 || fmt.Sprint(teams) != fmt.Sprint(tc.teams) {
+				t.Errorf("total %d, teams %v; want 4 and %v", resp.Total, teams, tc.teams)
+			}
+			for _, team := range []string{"Alpha-Team", "Beta-Team", "Gamma-Team"} {
+				listed := strings.Contains(fmt.Sprint(tc.teams), team)
+				if strings.Contains(page.Body.String(), team) != listed {
+					t.Errorf("/ lists %s: %v, want %v", team, !listed, listed)
+				}
+			}
+		})
+	}
+}
+
+// seedReportPlan stores a plan for the export and report endpoints and
+// returns its ID.
+func seedReportPlan(t *testing.T, ts *testServer) int64 {
+	t.Helper()
+	if _, err := ts.store.CreateOrg(store.Org{GrafanaOrgID: 1, Name: "Main"}); err != nil {
+		t.Fatal(err)
+	}
+	planID, err := ts.store.ReplacePlan(store.Plan{Status: "pending", Actions: []store.PlanAction{
+		{ActionType: "create_team", OrgID: 1, GrafanaOrgID: 1, TeamName: "Ops"},
+		{ActionType: "add_user_to_team", OrgID: 1, GrafanaOrgID: 1, TeamName: "Ops", Email: "a@example.com", TeamRole: "admin", Note: "owner | lead"},
+		{ActionType: "remove_user_from_team", OrgID: 1, GrafanaOrgID: 1, TeamName: "Ops", Email: "b@example.com"},
+		{ActionType: "update_user_role", OrgID: 1, GrafanaOrgID: 7, Email: "c@example.com", Role: "Editor"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return planID
+}
+
+func TestPlanExportMarkdown(t *testing.T) {
+	ts := newTestServer(t, "")
+	planID := seedReportPlan(t, ts)
+
+	rec := ts.do(http.MethodGet, fmt.Sprintf("/api/plans/%d/export?format=markdown", planID), "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("export = %d %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/markdown; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"## Sync Plan - 4 actions (2 adds, 1 removes, 1 updates)\n",
+		fmt.Sprintf("Plan #%d, pending, created ", planID),
+		"### Ops\n",
+		"| Action | Org | Team | Email | Role | Note |\n",
+		fmt.Sprintf("| %s | Main | Ops | a@example.com | %s | owner \\| lead |\n", actionLabel("add_user_to_team"), formatTeamRole("admin")),
+		fmt.Sprintf("| %s | Org 7 |  | c@example.com | Editor |", actionLabel("update_user_role")),
+		"### Legend\n",
+		fmt.Sprintf("| %s | %s |\n", actionLabel("remove_user_from_team"), actionDescription("remove_user_from_team")),
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("export is missing %q:\n%s", want, body)
+		}
+	}
+
+	for _, tc := range []struct {
+		target string
+		want   int
+	}{
+		{target: fmt.Sprintf("/api/plans/%d/export", planID), want: http.StatusOK},
+		{target: fmt.Sprintf("/api/plans/%d/export?format=csv", planID), want: http.StatusBadRequest},
+		{target: fmt.Sprintf("/api/plans/%d/export", planID+1), want: http.StatusNotFound},
+	} {
+		if rec := ts.do(http.MethodGet, tc.target, "", nil); rec.Code != tc.want {
+			t.Errorf("GET %s = %d, want %d", tc.target, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestPlanReport(t *testing.T) {
+	ts := newTestServer(t, "")
+	planID := seedReportPlan(t, ts)
+
+	rec := ts.do(http.MethodGet, fmt.Sprintf("/api/plans/%d/report", planID), "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("report = %d %s", rec.Code, rec.Body)
+	}
+	if cd, want := rec.Header().Get("Content-Disposition"), fmt.Sprintf(`attachment; filename="sync-plan-%d-report.html"`, planID); cd != want {
+		t.Errorf("Content-Disposition = %q, want %q", cd, want)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"Main (org 1)",
+		"Org 7",
+		"<td>a@example.com</td>",
+		"<td>b@example.com</td>",
+		"<td>owner | lead</td>",
+		"<td>Editor</td>",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("report is missing %q", want)
+		}
+	}
+	if rows := strings.Count(body, "<td>"+actionLabel("add_user_to_team")+"</td>"); rows != 1 {
+		t.Errorf("report has %d add_user_to_team rows, want 1", rows)
+	}
+	if rec := ts.do(http.MethodGet, fmt.Sprintf("/api/plans/%d/report", planID+1), "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("report of a missing plan = %d, want 404", rec.Code)
+	}
+}
+
+func TestPatchOrg(t *testing.T) {
+	ts := newTestServer(t, "")
+	orgID, err := ts.store.CreateOrg(store.Org{GrafanaOrgID: 3, Name: "Ops", DefaultRole: "Viewer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := fmt.Sprintf("/api/orgs/%d", orgID)
+	for _, tc := range []struct {
+		name     string
+		target   string
+		body     string
+		code     int
+		errCode  string
+		wantRole string
+	}{
+		{name: "empty body keeps fields", body: `{}`, code: http.StatusOK, wantRole: "Viewer"},
+		{name: "role", body: `{"default_role":"editor"}`, code: http.StatusOK, wantRole: "Editor"},
+		{name: "invalid role", body: `{"default_role":"Owner"}`, code: http.StatusUnprocessableEntity, errCode: "invalid_default_role", wantRole: "Editor"},
+		{name: "empty role", body: `{"default_role":""}`, code: http.StatusUnprocessableEntity, errCode: "invalid_default_role", wantRole: "Editor"},
+		{name: "unknown field", body: `{"name":"Renamed"}`, code: http.StatusBadRequest, errCode: "invalid_json", wantRole: "Editor"},
+		{name: "missing org", target: fmt.Sprintf("/api/orgs/%d", orgID+1), body: `{}`, code: http.StatusNotFound, errCode: "org_not_found", wantRole: "Editor"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := target
+			if tc.target != "" {
+				path = tc.target
+			}
+			rec := ts.do(http.MethodPatch, path, tc.body, nil)
+			if rec.Code != tc.code {
+				t.Fatalf("PATCH = %d %s, want %d", rec.Code, rec.Body, tc.code)
+			}
+			if tc.errCode != "" {
+				var apiErr APIError
+				if json.Unmarshal(rec.Body.Bytes(), &apiErr) != nil || apiErr.Code != tc.errCode {
+					t.Errorf("error = %s, want %s", rec.Body, tc.errCode)
+				}
+			} else {
+				var got map[string]any
+				if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+					t.Fatal(err)
+				}
+				if got["default_role"] != tc.wantRole || got["name"] != "Ops" || got["grafana_org_id"] != float64(3) {
+					t.Errorf("response = %v, want Ops with default role %s", got, tc.wantRole)
+				}
+			}
+			org, err := ts.store.GetOrg(orgID)
+			if err != nil || org.DefaultRole != tc.wantRole || org.Name != "Ops" {
+				t.Errorf("stored org = %+v, %v; want default role %s", org, err, tc.wantRole)
+			}
+		})
+	}
+}
+
+func TestSyncRunStats(t *testing.T) {
+	ts := newTestServer(t, "")
+	rec := ts.do(http.MethodGet, "/api/sync/runs", "", nil)
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Fatalf("runs before any sync = %d %s, want []", rec.Code, rec.Body)
+	}
+	start := time.Date(2026, 5, 6, 7, 8, 9, 0, time.UTC)
+	for i, ms := range []int64{400, 100, 300, 200, 1000} {
+		run := store.SyncRun{StartedAt: start.Add(time.Duration(i) * time.Hour), FinishedAt: start.Add(time.Duration(i) * time.Hour), Status: "ok", DurationMS: ms}
+		if _, err := ts.store.RecordSyncRun(run); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec = ts.do(http.MethodGet, "/api/sync/runs", "", nil)
+	var runs []store.SyncRun
+	if err := json.Unmarshal(rec.Body.Bytes(), &runs); err != nil || len(runs) != 5 || runs[0].DurationMS != 1000 {
+		t.Fatalf("runs = %s, %v; want five, newest first", rec.Body, err)
+	}
+
+	for _, tc := range []struct {
+		durations []int64
+		p50, p95  int64
+	}{
+		{durations: []int64{100}, p50: 100, p95: 100},
+		{durations: []int64{100, 200}, p50: 100, p95: 200},
+		{durations: []int64{100, 200, 300, 400, 1000}, p50: 300, p95: 1000},
+	} {
+		var runs []store.SyncRun
+		for _, ms := range tc.durations {
+			runs = append(runs, store.SyncRun{DurationMS: ms})
+		}
+		stats := newDurationStats(runs)
+		if stats.P50 != tc.p50 || stats.P95 != tc.p95 || stats.Runs != len(tc.durations) {
+			t.Errorf("newDurationStats(%v) = %+v, want p50 %d and p95 %d", tc.durations, stats, tc.p50, tc.p95)
+		}
+	}
+	if stats := newDurationStats(nil); stats != nil {
+		t.Errorf("newDurationStats(nil) = %+v, want nil", stats)
+	}
+}
+
+func TestCacheRefreshDoesNotImportOrgs(t *testing.T) {
+	ts := newTestServerWithOptions(t, "", func(string) syncer.Options {
+		return syncer.Options{DefaultUserRole: "Viewer", AutoCreateOrgs: true}
+	})
+	ts.setHandler(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/orgs" {
+			w.Write([]byte(`[{"id":2,"name":"Ops"}]`))
+			return
+		}
+		http.NotFound(w, r)
+	})
+
+	if rec := ts.do(http.MethodPost, "/api/cache/refresh", "", nil); rec.Code != http.StatusOK {
+		t.Fatalf("refresh = %d %s", rec.Code, rec.Body)
+	}
+	if org, err := ts.store.GetOrgByGrafanaID(2); err != nil || org != nil {
+		t.Fatalf("cache refresh imported grafana org 2: %+v, %v", org, err)
+	}
+	if rec := ts.do(http.MethodPost, "/sync/preview", "", nil); rec.Code != http.StatusSeeOther {
+		t.Fatalf("preview = %d %s", rec.Code, rec.Body)
+	}
+	if org, err := ts.store.GetOrgByGrafanaID(2); err != nil || org == nil {
+		t.Fatalf("grafana org 2 after preview = %+v, %v; want it imported", org, err)
+	}
+}
@@ -0,0 +1,195 @@
+package yamlconv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FromJSON converts a JSON document to block-style YAML. Object keys keep
+// their JSON order and numbers keep their JSON text.
+func FromJSON(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	root, err := parse(dec)
+	if err != nil {
+		return nil, fmt.Errorf("yamlconv: %w", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("yamlconv: trailing data after JSON value")
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(root); err != nil {
+		return nil, fmt.Errorf("yamlconv: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("yamlconv: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// parse reads one JSON value from dec as a yaml.Node. Scalars carry an
+// explicit tag so the encoder quotes strings that would otherwise read back
+// as another type.
+func parse(dec *json.Decoder) (*yaml.Node, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch v := tok.(type) {
+	case json.Delim:
+		switch v {
+		case '{':
+			n := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			for dec.More() {
+				keyTok, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				key, _ := keyTok.(string)
+				value, err := parse(dec)
+				if err != nil {
+					return nil, err
+				}
+				n.Content = append(n.Content, scalar("!!str", key), value)
+			}
+			_, err := dec.Token()
+			return n, err
+		case '[':
+			n := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+			for dec.More() {
+				value, err := parse(dec)
+				if err != nil {
+					return nil, err
+				}
+				n.Content = append(n.Content, value)
+			}
+			_, err := dec.Token()
+			return n, err
+		}
+		return nil, fmt.Errorf("unexpected %v", v)
+	case string:
+		return scalar("!!str", v), nil
+	case json.Number:
+		if strings.ContainsAny(v.String(), ".eE") {
+			return scalar("!!float", v.String()), nil
+		}
+		return scalar("!!int", v.String()), nil
+	case bool:
+		return scalar("!!bool", strconv.FormatBool(v)), nil
+	default:
+		return scalar("!!null", "null"), nil
+	}
+}
+
+func scalar(tag, value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value}
+}
+
+// WantsYAML reports whether r asks for YAML through ?format=yaml or its
+// Accept header.
+func WantsYAML(r *http.Request) bool {
+	if strings.EqualFold(r.URL.Query().Get("format"), "yaml") {
+		return true
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(part, ";")
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "application/yaml", "application/x-yaml", "text/yaml":
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware re-encodes the JSON responses of paths under prefix as YAML
+// when the client asks for it (see WantsYAML). Other responses, and all
+// requests that don't ask for YAML, pass through unchanged.
+func Middleware(next http.Handler, prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, prefix) || !WantsYAML(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rw := &responseWriter{w: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+		rw.finish()
+	})
+}
+
+// responseWriter buffers JSON responses so they can be converted once the
+// handler is done. Responses of any other type are streamed through as
+// they are written.
+type responseWriter struct {
+	w           http.ResponseWriter
+	status      int
+	wroteHeader bool
+	convert     bool
+	body        bytes.Buffer
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.w.Header()
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.status = status
+	rw.wroteHeader = true
+	rw.w.Header().Add("Vary", "Accept")
+	mediaType, _, _ := strings.Cut(rw.w.Header().Get("Content-Type"), ";")
+	if strings.TrimSpace(mediaType) == "application/json" {
+		rw.convert = true
+		return
+	}
+	rw.w.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	rw.WriteHeader(http.StatusOK)
+	if rw.convert {
+		return rw.body.Write(p)
+	}
+	return rw.w.Write(p)
+}
+
+// Flush passes flushes through for streamed responses. Buffered JSON is
+// sent by finish.
+func (rw *responseWriter) Flush() {
+	rw.WriteHeader(http.StatusOK)
+	if rw.convert {
+		return
+	}
+	if flusher, ok := rw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.w
+}
+
+func (rw *responseWriter) finish() {
+	if !rw.wroteHeader || !rw.convert {
+		return
+	}
+	body := rw.body.Bytes()
+	if converted, err := FromJSON(body); err == nil {
+		body = converted
+		rw.w.Header().Set("Content-Type", "application/yaml")
+		rw.w.Header().Del("Content-Length")
+	}
+	rw.w.WriteHeader(rw.status)
+	_, _ = rw.w.Write(body)
+}
@@ -0,0 +1,185 @@
+package yamlconv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fixture holds strings that need quoting in YAML next to ordinary values.
+const fixture = `{
+  "name": "Platform",
+  "colon": "key: value",
+  "comment": "a # b",
+  "dash": "- item",
+  "bools": ["yes", "no", "on", "off", "true", "null", "~", "Y"],
+  "numbers": ["123", "0x1F", "1e3", "-1"],
+  "multiline": "line one\nline two\n",
+  "escaped": "tab\there \"quoted\" \\ back\/slash \u00e9 \u2603",
+  "blank": "",
+  "spaces": "  padded  ",
+  "flow": "[not, a list]",
+  "anchor": "&ref *alias !tag %dir @at ` + "`tick`" + `",
+  "count": 42,
+  "ratio": 0.25,
+  "big": 12345678901234567890,
+  "enabled": false,
+  "missing": null,
+  "empty_object": {},
+  "empty_list": [],
+  "nested": {"list": [{"id": 1, "tags": ["a", "b"]}, [1, [2]]]}
+}`
+
+// decodeJSON and decodeYAML return comparable generic values.
+func decodeJSON(t *testing.T, data []byte) any {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("decode JSON: %v\n%s", err, data)
+	}
+	return v
+}
+
+func decodeYAML(t *testing.T, data []byte) any {
+	t.Helper()
+	var v any
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		t.Fatalf("decode YAML: %v\n%s", err, data)
+	}
+	// yaml.v3 decodes numbers as int or float64; JSON as float64.
+	normalized, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("re-encode YAML value: %v", err)
+	}
+	return decodeJSON(t, normalized)
+}
+
+func TestFromJSONRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+	}{
+		{"fixture", fixture},
+		{"top-level list", `[{"a": 1}, "b", [], {}]`},
+		{"string", `"yes"`},
+		{"number", `7`},
+		{"null", `null`},
+		{"empty object", `{}`},
+		{"empty list", `[]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := FromJSON([]byte(tt.json))
+			if err != nil {
+				t.Fatalf("FromJSON: %v", err)
+			}
+			if got, want := decodeYAML(t, out), decodeJSON(t, []byte(tt.json)); !reflect.DeepEqual(got, want) {
+				t.Fatalf("round trip = %#v, want %#v\nYAML:\n%s", got, want, out)
+			}
+		})
+	}
+}
+
+func TestFromJSONKeepsKeyOrderAndBlockStyle(t *testing.T) {
+	out, err := FromJSON([]byte(`{"zeta": 1, "alpha": {"b": [1, 2], "a": "x"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "zeta: 1\nalpha:\n  b:\n    - 1\n    - 2\n  a: x\n"
+	if string(out) != want {
+		t.Fatalf("FromJSON =\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestFromJSONRejectsInvalidJSON(t *testing.T) {
+	for _, input := range []string{``, `{`, `{"a": 1} trailing`, `a: b`} {
+		if _, err := FromJSON([]byte(input)); err == nil {
+			t.Errorf("FromJSON(%q) succeeded, want error", input)
+		}
+	}
+}
+
+func TestMiddlewareFormats(t *testing.T) {
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", "1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(fixture))
+	}), "/api/")
+
+	tests := []struct {
+		name     string
+		target   string
+		accept   string
+		wantType string
+	}{
+		{"no preference", "/api/status", "", "application/json"},
+		{"accept json", "/api/status", "application/json", "application/json"},
+		{"accept yaml", "/api/status", "application/yaml", "application/yaml"},
+		{"accept yaml with params", "/api/status", "text/html;q=0.9, application/x-yaml;q=0.8", "application/yaml"},
+		{"format query", "/api/status?format=yaml", "application/json", "application/yaml"},
+		{"outside prefix", "/status?format=yaml", "", "application/json"},
+	}
+	want := decodeJSON(t, []byte(fixture))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("status = %d, want 201", rec.Code)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.wantType {
+				t.Fatalf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			var got any
+			if tt.wantType == "application/yaml" {
+				if rec.Header().Get("Content-Length") != "" {
+					t.Fatalf("stale Content-Length kept on converted body")
+				}
+				got = decodeYAML(t, rec.Body.Bytes())
+			} else {
+				got = decodeJSON(t, rec.Body.Bytes())
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("body = %#v, want %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareStreamsOtherContent(t *testing.T) {
+	flushed := make(chan struct{})
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+		<-flushed
+		w.Write([]byte("data: 2\n\n"))
+	}), "/api/")
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/events?format=yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+	}
+	// The first event arrives while the handler is still blocked.
+	buf := make([]byte, len("data: 1\n\n"))
+	if _, err := resp.Body.Read(buf); err != nil || !strings.HasPrefix(string(buf), "data: 1") {
+		t.Fatalf("first read = %q, %v", buf, err)
+	}
+	close(flushed)
+}
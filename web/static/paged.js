@@ -0,0 +1,112 @@
+// Server-side paginated tables. A table with data-paged-endpoint="<url>" and
+// data-columns="<comma separated JSON keys>" is filled from the endpoint,
+// which returns {page, per_page, total, pages, items}. The container with
+// data-paged-controls="<table id>" holds the search box and page size
+// select (data-paged-param), previous/next buttons and the page label. The
+// column named by data-history-column is rendered as a button carrying
+// data-user-history for pages that show a user's sync history.
+(function () {
+  document.querySelectorAll("table[data-paged-endpoint]").forEach((table) => {
+    const controls = document.querySelector(`[data-paged-controls="${table.id}"]`);
+    const columns = table.dataset.columns.split(",");
+    const historyColumn = table.dataset.historyColumn;
+    const tbody = table.querySelector("tbody");
+    const inputs = controls ? Array.from(controls.querySelectorAll("[data-paged-param]")) : [];
+    const prev = controls && controls.querySelector("[data-paged-prev]");
+    const next = controls && controls.querySelector("[data-paged-next]");
+    const label = controls && controls.querySelector("[data-paged-label]");
+    let page = 1;
+    let pages = 1;
+    let timer = null;
+
+    const message = (text) => {
+      tbody.innerHTML = "";
+      const row = tbody.insertRow();
+      const cell = row.insertCell();
+      cell.colSpan = columns.length;
+      cell.className = "muted";
+      cell.textContent = text;
+    };
+
+    const load = async () => {
+      const url = new URL(table.dataset.pagedEndpoint, window.location.origin);
+      url.searchParams.set("page", page);
+      inputs.forEach((input) => {
+        if (input.value.trim()) {
+          url.searchParams.set(input.dataset.pagedParam, input.value.trim());
+        }
+      });
+      try {
+        const resp = await fetch(url, { headers: { Accept: "application/json" } });
+        const data = await resp.json();
+        if (!resp.ok) {
+          message(data.error || "Failed to load users.");
+          return;
+        }
+        pages = Math.max(data.pages, 1);
+        page = data.page;
+        if (!data.items.length) {
+          message("No users found.");
+        } else {
+          tbody.innerHTML = "";
+          data.items.forEach((item) => {
+            const row = tbody.insertRow();
+            columns.forEach((column) => {
+              const value = item[column];
+              const cell = row.insertCell();
+              if (column === historyColumn && value) {
+                const button = document.createElement("button");
+                button.type = "button";
+                button.className = "link";
+                button.dataset.userHistory = value;
+                button.textContent = value;
+                cell.appendChild(button);
+                return;
+              }
+              cell.textContent = value === "" || value === undefined ? "-" : value;
+            });
+          });
+        }
+        if (label) {
+          label.textContent = `Page ${page} of ${pages} (${data.total} users)`;
+        }
+        if (prev) {
+          prev.disabled = page <= 1;
+        }
+        if (next) {
+          next.disabled = page >= pages;
+        }
+      } catch (err) {
+        message(`Failed to load users: ${err}`);
+      }
+    };
+
+    inputs.forEach((input) => {
+      const eventName = input.tagName === "SELECT" ? "change" : "input";
+      input.addEventListener(eventName, () => {
+        clearTimeout(timer);
+        timer = setTimeout(() => {
+          page = 1;
+          load();
+        }, 250);
+      });
+    });
+    if (prev) {
+      prev.addEventListener("click", () => {
+        if (page > 1) {
+          page--;
+          load();
+        }
+      });
+    }
+    if (next) {
+      next.addEventListener("click", () => {
+        if (page < pages) {
+          page++;
+          load();
+        }
+      });
+    }
+    load();
+  });
+})();
@@ -0,0 +1,68 @@
+// Client-side table filtering. A container with data-filter-table="<id>"
+// holds inputs/selects carrying data-param="<query param>"; rows of the
+// table with that id are matched against them. "q" matches the row's
+// data-search text, any other param must equal the row's data-<param>
+// attribute. Filter values are mirrored into the URL so views can be
+// bookmarked.
+(function () {
+  const params = new URLSearchParams(window.location.search);
+
+  document.querySelectorAll("[data-filter-table]").forEach((container) => {
+    const table = document.getElementById(container.dataset.filterTable);
+    if (!table) {
+      return;
+    }
+    const controls = Array.from(container.querySelectorAll("[data-param]"));
+    const counter = container.querySelector("[data-filter-count]");
+
+    const apply = () => {
+      const active = controls
+        .map((control) => [control.dataset.param, control.value.trim().toLowerCase()])
+        .filter(([, value]) => value !== "");
+      let shown = 0;
+      let total = 0;
+      table.querySelectorAll("tbody tr[data-search]").forEach((row) => {
+        total++;
+        const visible = active.every(([param, value]) => {
+          if (param === "q" || param === "org") {
+            return row.dataset.search.includes(value);
+          }
+          return (row.getAttribute("data-" + param) || "").toLowerCase() === value;
+        });
+        row.hidden = !visible;
+        if (visible) {
+          shown++;
+        }
+      });
+      if (counter) {
+        counter.textContent = active.length ? shown + " of " + total : "";
+      }
+    };
+
+    const syncURL = () => {
+      const url = new URL(window.location.href);
+      controls.forEach((control) => {
+        const value = control.value.trim();
+        if (value) {
+          url.searchParams.set(control.dataset.param, value);
+        } else {
+          url.searchParams.delete(control.dataset.param);
+        }
+      });
+      window.history.replaceState(null, "", url);
+    };
+
+    controls.forEach((control) => {
+      const initial = params.get(control.dataset.param);
+      if (initial !== null) {
+        control.value = initial;
+      }
+      const eventName = control.tagName === "SELECT" ? "change" : "input";
+      control.addEventListener(eventName, () => {
+        apply();
+        syncURL();
+      });
+    });
+    apply();
+  });
+})();